@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// javaImageHints are words of image names telling they likely ship jars.
+var javaImageHints = []string{
+	"activemq", "artemis", "cassandra", "confluent", "corretto", "elasticsearch",
+	"flink", "graalvm", "hadoop", "hive", "java", "jboss", "jdk", "jenkins",
+	"jetty", "jre", "kafka", "keycloak", "liberica", "logstash", "maven", "neo4j",
+	"nexus", "nifi", "opensearch", "presto", "solr", "sonarqube", "spark",
+	"spring", "temurin", "tomcat", "trino", "wildfly", "zookeeper", "zulu",
+}
+
+// isJavaImage guesses from its name whether image runs on the JVM.
+func isJavaImage(image string) bool {
+	name := strings.ToLower(parseImageRef(image).Name())
+	for _, hint := range javaImageHints {
+		if strings.Contains(name, hint) {
+			return true
+		}
+	}
+	return false
+}
+
+// analyzerArgs returns the trivy arguments turning off the analyzers image
+// doesn't need: the Java DB download, skipped by -java-db auto for images
+// whose name doesn't look like a JVM one and with -offline, and the library
+// analyzers with -skip-libraries.
+func analyzerArgs(image string, opts scanOptions) []string {
+	args := []string{}
+	if opts.offline || opts.javaDB == "off" || (opts.javaDB == "auto" && !isJavaImage(image)) {
+		args = append(args, "--skip-java-db-update")
+	}
+	if opts.skipLibraries {
+		args = append(args, "--pkg-types", "os")
+	}
+	return args
+}
+
+// validateJavaDB checks the value of -java-db.
+func validateJavaDB(javaDB string) error {
+	switch javaDB {
+	case "", "auto", "on", "off":
+		return nil
+	}
+	return fmt.Errorf("unknown -java-db mode %v, expected auto, on or off", javaDB)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Annotations -annotate-output adds to the workloads: the scan time, and the
+// vulnerability counts of the image of each container, the container name
+// following the prefix.
+const (
+	annotationScannedAt = annotationPrefix + "scanned-at"
+	annotationVulns     = annotationPrefix + "vulnerabilities."
+)
+
+// mappingValue returns the value of key in a YAML mapping node, nil if it
+// isn't there.
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// setMappingValue sets key in a YAML mapping node, and returns its value.
+func setMappingValue(node *yaml.Node, key string, value *yaml.Node) *yaml.Node {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			node.Content[i+1] = value
+			return value
+		}
+	}
+	node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, value)
+	return value
+}
+
+// containerLists are the keys of the lists of containers of pod specs, and
+// of the steps and sidecars of Tekton tasks and Argo templates.
+var containerLists = map[string]bool{"containers": true, "initContainers": true, "steps": true, "sidecars": true}
+
+// nodeContainers returns the name and image of the containers found in a
+// manifest. The container or script of an Argo template is named after the
+// template.
+func nodeContainers(node *yaml.Node) [][2]string {
+	containers := [][2]string{}
+	switch node.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i].Value, node.Content[i+1]
+			if key == "container" || key == "script" {
+				name, image := mappingValue(node, "name"), mappingValue(value, "image")
+				if value.Kind == yaml.MappingNode && name != nil && image != nil {
+					containers = append(containers, [2]string{name.Value, image.Value})
+					continue
+				}
+			}
+			if value.Kind != yaml.SequenceNode || !containerLists[key] {
+				containers = append(containers, nodeContainers(value)...)
+				continue
+			}
+			for _, c := range value.Content {
+				name, image := mappingValue(c, "name"), mappingValue(c, "image")
+				if c.Kind == yaml.MappingNode && name != nil && image != nil {
+					containers = append(containers, [2]string{name.Value, image.Value})
+				}
+			}
+		}
+	case yaml.SequenceNode, yaml.DocumentNode:
+		for _, child := range node.Content {
+			containers = append(containers, nodeContainers(child)...)
+		}
+	}
+	return containers
+}
+
+// annotateManifests adds to the manifests having containers the time of the
+// scan and the vulnerability counts of the images of their containers,
+// counts being keyed by image. Other manifests are left as they are.
+func annotateManifests(manifests string, counts map[string]map[string]int, scanned time.Time) (string, error) {
+	docs := []string{}
+	for _, doc := range strings.Split(strings.TrimPrefix(manifests, "---\n"), "\n---\n") {
+		var node yaml.Node
+		if err := yaml.Unmarshal([]byte(doc), &node); err != nil {
+			return "", err
+		}
+		if len(node.Content) == 0 || node.Content[0].Kind != yaml.MappingNode {
+			docs = append(docs, doc)
+			continue
+		}
+		annotations := map[string]string{}
+		for _, c := range nodeContainers(&node) {
+			imageCounts, ok := counts[c[1]]
+			if !ok {
+				continue
+			}
+			values := []string{}
+			for _, severity := range severities {
+				values = append(values, fmt.Sprintf("%s=%d", severity, imageCounts[severity]))
+			}
+			annotations[annotationVulns+c[0]] = strings.Join(values, ",")
+		}
+		if len(annotations) == 0 {
+			docs = append(docs, doc)
+			continue
+		}
+		annotations[annotationScannedAt] = scanned.UTC().Format(time.RFC3339)
+		metadata := mappingValue(node.Content[0], "metadata")
+		if metadata == nil || metadata.Kind != yaml.MappingNode {
+			metadata = setMappingValue(node.Content[0], "metadata", &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"})
+		}
+		values := mappingValue(metadata, "annotations")
+		if values == nil || values.Kind != yaml.MappingNode {
+			values = setMappingValue(metadata, "annotations", &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"})
+		}
+		keys := []string{}
+		for key := range annotations {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			setMappingValue(values, key, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: annotations[key]})
+		}
+		var out bytes.Buffer
+		enc := yaml.NewEncoder(&out)
+		enc.SetIndent(2)
+		if err := enc.Encode(&node); err != nil {
+			return "", err
+		}
+		docs = append(docs, strings.TrimSuffix(out.String(), "\n"))
+	}
+	return "---\n" + strings.Join(docs, "\n---\n") + "\n", nil
+}
+
+// writeAnnotatedManifests writes the manifests of chart to path, annotated
+// with the vulnerability counts of the scanned images.
+func writeAnnotatedManifests(path string, chart string, result chartResult, opts scanOptions) error {
+	manifests, err := renderChart(chart, opts)
+	if err != nil {
+		return fmt.Errorf("could not render chart %v: %v", chart, err)
+	}
+	counts := map[string]map[string]int{}
+	for _, image := range result.Images {
+		counts[image.Scan.Image] = countBySeverity(image.Report.vulnerabilities())
+	}
+	annotated, err := annotateManifests(manifests, counts, time.Now())
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, []byte(annotated), 0644)
+}
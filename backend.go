@@ -0,0 +1,407 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/docker/go-units"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+)
+
+// trivyContainer describes a trivy run, the vuln cache dir is mounted on
+// /.cache.
+type trivyContainer struct {
+	Image    string
+	Cmd      []string
+	Env      []string
+	User     string
+	CacheDir string
+	// Input is the image archive or OCI layout mounted at /input, if any.
+	Input   string
+	CPU     string
+	Memory  string
+	Network string
+}
+
+// validatePullPolicy checks the -pull-policy of the trivy image.
+func validatePullPolicy(policy string) error {
+	switch policy {
+	case "always", "ifnotpresent", "never":
+		return nil
+	}
+	return fmt.Errorf("unknown -pull-policy %v, expected always, ifnotpresent or never", policy)
+}
+
+// pullScanner pulls the image of the -scanner as -pull-policy says. A failed
+// pull, behind a proxy or offline, falls back to the image already present.
+func pullScanner(ctx context.Context, backend scanBackend, opts scanOptions) error {
+	if opts.pullPolicy == "never" {
+		return nil
+	}
+	scanner, err := newScanner(opts)
+	if err != nil {
+		return err
+	}
+	image := scanner.image(opts)
+	present, err := backend.present(ctx, image)
+	if err != nil {
+		log.Debugf("Could not look for %v: %v", image, err)
+	}
+	if present && opts.pullPolicy == "ifnotpresent" {
+		return nil
+	}
+	log.Infof("Pulling %v", image)
+	user, password := registryCredentials(image, opts)
+	if err := backend.pull(ctx, image, user, password); err != nil {
+		if !present {
+			return fmt.Errorf("could not pull %v, and it is not present: %v", image, err)
+		}
+		log.Warnf("Could not pull %v, using the present one: %v", image, err)
+		return nil
+	}
+	log.Infof("Pulled %v", image)
+	return nil
+}
+
+// scanBackend runs trivy containers on a container runtime.
+type scanBackend interface {
+	// pull pulls image, with the given registry credentials if not empty.
+	pull(ctx context.Context, image string, username string, password string) error
+	// present tells whether image is available without pulling it.
+	present(ctx context.Context, image string) (bool, error)
+	// run runs the container to completion and decodes the JSON of its
+	// standard output into out, see decodeOutput.
+	run(ctx context.Context, c trivyContainer, out interface{}) error
+}
+
+// imageArchiver is a backend that can save images to a tar file and load
+// them back, for helm trivy bundle.
+type imageArchiver interface {
+	save(ctx context.Context, image string, file string) error
+	load(ctx context.Context, file string) error
+}
+
+// errOutOfMemory is returned when trivy gets killed for going over its
+// memory limit, scanning large images can take a lot of memory.
+var errOutOfMemory = errors.New("trivy ran out of memory, raise -scan-memory")
+
+// parseCPU parses a CPU limit given as a number of CPUs ("1.5") or in
+// Kubernetes millicpus ("500m").
+func parseCPU(cpu string) (float64, error) {
+	if strings.HasSuffix(cpu, "m") {
+		millis, err := strconv.ParseFloat(strings.TrimSuffix(cpu, "m"), 64)
+		return millis / 1000, err
+	}
+	return strconv.ParseFloat(cpu, 64)
+}
+
+// validateLimits checks the scan resource limits before any scan starts.
+func validateLimits(opts scanOptions) error {
+	if opts.scanCPU != "" {
+		if cpus, err := parseCPU(opts.scanCPU); err != nil || cpus <= 0 {
+			return fmt.Errorf("invalid CPU limit %q", opts.scanCPU)
+		}
+	}
+	if opts.scanMemory != "" {
+		if _, err := units.RAMInBytes(opts.scanMemory); err != nil {
+			return fmt.Errorf("invalid memory limit %q", opts.scanMemory)
+		}
+	}
+	return nil
+}
+
+func newBackend(opts scanOptions) (scanBackend, error) {
+	if err := validateLimits(opts); err != nil {
+		return nil, err
+	}
+	switch opts.backend {
+	case "docker":
+		cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+		if err != nil {
+			return nil, fmt.Errorf("could not get docker client: %v", err)
+		}
+		return dockerBackend{cli}, nil
+	case "containerd":
+		return containerdBackend{address: opts.containerdAddress, namespace: opts.containerdNamespace}, nil
+	case "k8s-job":
+		return newK8sJobBackend(opts)
+	}
+	return nil, fmt.Errorf("unknown backend %q", opts.backend)
+}
+
+type dockerBackend struct {
+	cli *client.Client
+}
+
+func (b dockerBackend) pull(ctx context.Context, image string, username string, password string) error {
+	options := types.ImagePullOptions{}
+	if username != "" {
+		auth, err := json.Marshal(types.AuthConfig{Username: username, Password: password})
+		if err != nil {
+			return err
+		}
+		options.RegistryAuth = base64.URLEncoding.EncodeToString(auth)
+	}
+	out, err := b.cli.ImagePull(ctx, image, options)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	// The pull goes on as long as its progress is read, and its errors
+	// are reported in it.
+	decoder := json.NewDecoder(out)
+	for {
+		var message struct {
+			Error string `json:"error"`
+		}
+		if err := decoder.Decode(&message); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if message.Error != "" {
+			return errors.New(message.Error)
+		}
+	}
+}
+
+func (b dockerBackend) present(ctx context.Context, image string) (bool, error) {
+	_, _, err := b.cli.ImageInspectWithRaw(ctx, image)
+	if client.IsErrNotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (b dockerBackend) save(ctx context.Context, image string, file string) error {
+	body, err := b.cli.ImageSave(ctx, []string{image})
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, body)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (b dockerBackend) load(ctx context.Context, file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	resp, err := b.cli.ImageLoad(ctx, f, true)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var message struct {
+			Error string `json:"error"`
+		}
+		if err := decoder.Decode(&message); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if message.Error != "" {
+			return errors.New(message.Error)
+		}
+	}
+}
+
+func (b dockerBackend) run(ctx context.Context, c trivyContainer, output interface{}) error {
+	config := container.Config{
+		Image: c.Image,
+		Cmd:   c.Cmd,
+		User:  c.User,
+		Env:   c.Env,
+	}
+	hostConfig := container.HostConfig{
+		Binds:       []string{c.CacheDir + ":/.cache"},
+		NetworkMode: container.NetworkMode(c.Network),
+	}
+	if c.Input != "" {
+		hostConfig.Binds = append(hostConfig.Binds, c.Input+":/input:ro")
+	}
+	if c.CPU != "" {
+		cpus, _ := parseCPU(c.CPU)
+		hostConfig.NanoCPUs = int64(cpus * 1e9)
+	}
+	if c.Memory != "" {
+		hostConfig.Memory, _ = units.RAMInBytes(c.Memory)
+	}
+	resp, err := b.cli.ContainerCreate(ctx, &config, &hostConfig, nil, "")
+	if err != nil {
+		return fmt.Errorf("could not create trivy container: %v", err)
+	}
+	log.Debugf("Starting container with command: %v", config.Cmd)
+	if err := b.cli.ContainerStart(ctx, resp.ID, types.ContainerStartOptions{}); err != nil {
+		return fmt.Errorf("could not start trivy container: %v", err)
+	}
+	statusCh, errCh := b.cli.ContainerWait(ctx, resp.ID, container.WaitConditionNotRunning)
+	var status int64
+	select {
+	case err := <-errCh:
+		if err != nil {
+			return fmt.Errorf("error while waiting for container: %v", err)
+		}
+	case s := <-statusCh:
+		status = s.StatusCode
+	}
+	if info, err := b.cli.ContainerInspect(ctx, resp.ID); err == nil && info.State != nil && info.State.OOMKilled {
+		return errOutOfMemory
+	}
+	if status != 0 {
+		return withExitCode(exitBackend, "trivy container exited with status %d: %v", status, b.stderr(ctx, resp.ID))
+	}
+
+	out, err := b.cli.ContainerLogs(ctx, resp.ID, types.ContainerLogsOptions{ShowStdout: true, ShowStderr: false})
+	if err != nil {
+		return fmt.Errorf("cannot get container logs: %v", err)
+	}
+	defer out.Close()
+	// Without a TTY stdout and stderr are multiplexed, trivy logs must not
+	// end up in its JSON output, which is decoded as it is demultiplexed.
+	stdout, w := io.Pipe()
+	defer stdout.Close()
+	go func() {
+		_, err := stdcopy.StdCopy(w, ioutil.Discard, out)
+		if err != nil {
+			err = fmt.Errorf("cannot read container logs: %v", err)
+		}
+		w.CloseWithError(err)
+	}()
+	return decodeOutput(stdout, output)
+}
+
+// stderr returns the end of what the container wrote to stderr, which
+// explains why it failed.
+func (b dockerBackend) stderr(ctx context.Context, id string) string {
+	out, err := b.cli.ContainerLogs(ctx, id, types.ContainerLogsOptions{ShowStderr: true, Tail: "20"})
+	if err != nil {
+		return fmt.Sprintf("cannot get container logs: %v", err)
+	}
+	defer out.Close()
+	var stderr bytes.Buffer
+	stdcopy.StdCopy(ioutil.Discard, &stderr, out)
+	return strings.TrimSpace(stderr.String())
+}
+
+// containerdBackend runs trivy with nerdctl, for hosts having containerd but
+// no docker daemon.
+type containerdBackend struct {
+	address   string
+	namespace string
+}
+
+// command returns the nerdctl command running the given subcommand, with
+// its stderr going to the returned buffer.
+func (b containerdBackend) command(ctx context.Context, args ...string) (*exec.Cmd, *bytes.Buffer) {
+	global := []string{"--namespace", b.namespace}
+	if b.address != "" {
+		global = append(global, "--address", b.address)
+	}
+	args = append(global, args...)
+	log.Debugf("Running nerdctl cmd: nerdctl %v", redactArgs(args))
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "nerdctl", args...)
+	cmd.Stderr = &stderr
+	return cmd, &stderr
+}
+
+func (b containerdBackend) nerdctl(ctx context.Context, args ...string) (string, error) {
+	cmd, stderr := b.command(ctx, args...)
+	out, err := cmd.Output()
+	if err != nil {
+		return string(out), fmt.Errorf("nerdctl %v: %v: %v", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return string(out), nil
+}
+
+// pull pulls image with the credentials nerdctl login saved, nerdctl taking
+// none on its command line.
+func (b containerdBackend) pull(ctx context.Context, image string, username string, password string) error {
+	_, err := b.nerdctl(ctx, "pull", "--quiet", image)
+	return err
+}
+
+func (b containerdBackend) present(ctx context.Context, image string) (bool, error) {
+	out, err := b.nerdctl(ctx, "image", "ls", "--quiet", image)
+	return strings.TrimSpace(out) != "", err
+}
+
+func (b containerdBackend) save(ctx context.Context, image string, file string) error {
+	_, err := b.nerdctl(ctx, "save", "--output", file, image)
+	return err
+}
+
+func (b containerdBackend) load(ctx context.Context, file string) error {
+	_, err := b.nerdctl(ctx, "load", "--input", file)
+	return err
+}
+
+func (b containerdBackend) run(ctx context.Context, c trivyContainer, output interface{}) error {
+	args := []string{"run", "--rm", "--user", c.User, "--volume", c.CacheDir + ":/.cache"}
+	if c.Input != "" {
+		args = append(args, "--volume", c.Input+":/input:ro")
+	}
+	if c.CPU != "" {
+		cpus, _ := parseCPU(c.CPU)
+		args = append(args, "--cpus", strconv.FormatFloat(cpus, 'f', -1, 64))
+	}
+	if c.Memory != "" {
+		args = append(args, "--memory", c.Memory)
+	}
+	if c.Network != "" {
+		args = append(args, "--network", c.Network)
+	}
+	// Only the names of the variables are on the command line, which other
+	// users of the host can read, nerdctl takes their values from its own
+	// environment.
+	for _, env := range c.Env {
+		args = append(args, "--env", strings.SplitN(env, "=", 2)[0])
+	}
+	args = append(args, c.Image)
+	args = append(args, c.Cmd...)
+	cmd, stderr := b.command(ctx, args...)
+	cmd.Env = append(os.Environ(), c.Env...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("nerdctl run: %v", err)
+	}
+	readErr := decodeOutput(stdout, output)
+	io.Copy(ioutil.Discard, stdout)
+	err = cmd.Wait()
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 137 {
+		return errOutOfMemory
+	}
+	if err != nil {
+		return fmt.Errorf("nerdctl run: %v: %v", err, strings.TrimSpace(stderr.String()))
+	}
+	return readErr
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// prioritizeImages orders images for a scan under -time-budget: images
+// never scanned on this host first, then the ones scanned the longest ago,
+// likely to have changed.
+func prioritizeImages(images []chartImage, opts scanOptions) []chartImage {
+	scanned := map[string]time.Time{}
+	for _, image := range images {
+		cached, ok, err := loadCachedScan(image.Name, opts)
+		if err != nil {
+			log.Debugf("Could not read cached scan of %v: %v", image.Name, err)
+		}
+		if ok {
+			scanned[image.Name] = cached.Scanned
+		}
+	}
+	sorted := append([]chartImage{}, images...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return scanned[sorted[i].Name].Before(scanned[sorted[j].Name])
+	})
+	return sorted
+}
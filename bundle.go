@@ -0,0 +1,349 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+)
+
+// Contents of an air-gapped bundle.
+const (
+	bundleManifestFile  = "bundle.json"
+	bundleImageFile     = "trivy-image.tar"
+	bundleCacheDir      = "cache"
+	bundleFormattersDir = "formatters"
+)
+
+// bundleManifest describes what an air-gapped bundle holds.
+type bundleManifest struct {
+	TrivyImage  string    `json:"trivyImage"`
+	Trivy       string    `json:"trivy,omitempty"`
+	DBUpdatedAt string    `json:"dbUpdatedAt,omitempty"`
+	JavaDB      bool      `json:"javaDB"`
+	Formatters  []string  `json:"formatters,omitempty"`
+	Created     time.Time `json:"created"`
+}
+
+// copyTree copies the regular files of src into dst, with their mode.
+func copyTree(src string, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if info.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		in, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, info.Mode().Perm())
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(out, in)
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+		return err
+	})
+}
+
+// writeBundle writes the files of dir to a gzipped tar file.
+func writeBundle(file string, dir string) error {
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	zw := gzip.NewWriter(f)
+	tw := tar.NewWriter(zw)
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || path == dir || !(info.IsDir() || info.Mode().IsRegular()) {
+			return err
+		}
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(rel)
+		if err := tw.WriteHeader(header); err != nil || info.IsDir() {
+			return err
+		}
+		in, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		_, err = io.Copy(tw, in)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// readBundle extracts a bundle into dir, refusing the entries leading out of
+// it.
+func readBundle(file string, dir string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return fmt.Errorf("%v is not a bundle: %v", file, err)
+	}
+	tr := tar.NewReader(zr)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dir, filepath.FromSlash(header.Name))
+		if !strings.HasPrefix(target, filepath.Clean(dir)+string(filepath.Separator)) {
+			return fmt.Errorf("invalid bundle entry %v", header.Name)
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(header.Mode).Perm())
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(out, tr)
+			if closeErr := out.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// exportBundle writes a bundle of the trivy image, its DBs and the
+// formatters to file, for hosts without network access.
+func exportBundle(file string, ctx context.Context, backend scanBackend, opts scanOptions) error {
+	archiver, ok := backend.(imageArchiver)
+	if !ok {
+		return fmt.Errorf("the %v backend can't save images", opts.backend)
+	}
+	dir, err := ioutil.TempDir("", "helm-trivy-bundle")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	if err := pullScanner(ctx, backend, opts); err != nil {
+		return err
+	}
+	log.Infof("Saving %v", opts.trivyImage)
+	if err := archiver.save(ctx, opts.trivyImage, filepath.Join(dir, bundleImageFile)); err != nil {
+		return fmt.Errorf("could not save %v: %v", opts.trivyImage, err)
+	}
+	opts.cacheDir = filepath.Join(dir, bundleCacheDir)
+	if err := fetchTrivyDB(vulnerabilityDB(opts), opts.cacheDir, opts); err != nil {
+		return err
+	}
+	m := bundleManifest{TrivyImage: opts.trivyImage, JavaDB: opts.javaDB != "off", Created: time.Now().UTC()}
+	if m.JavaDB {
+		if err := fetchTrivyDB(javaDB, opts.cacheDir, opts); err != nil {
+			return err
+		}
+	}
+	if info, err := scannerInfo(ctx, backend, opts); err != nil {
+		log.Warnf("Could not get trivy version: %v", err)
+	} else {
+		m.Trivy, m.DBUpdatedAt = info.Trivy, info.DBUpdatedAt
+	}
+	if m.Formatters = listFormatters(opts.formattersDir); len(m.Formatters) > 0 {
+		if err := copyTree(opts.formattersDir, filepath.Join(dir, bundleFormattersDir)); err != nil {
+			return fmt.Errorf("could not copy formatters: %v", err)
+		}
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, bundleManifestFile), data, 0644); err != nil {
+		return err
+	}
+	return writeBundle(file, dir)
+}
+
+// importBundle loads the trivy image of a bundle, and copies its DBs into
+// the cache dir and its formatters into the formatters dir.
+func importBundle(file string, ctx context.Context, backend scanBackend, opts scanOptions) (bundleManifest, error) {
+	var m bundleManifest
+	archiver, ok := backend.(imageArchiver)
+	if !ok {
+		return m, fmt.Errorf("the %v backend can't load images", opts.backend)
+	}
+	dir, err := ioutil.TempDir("", "helm-trivy-bundle")
+	if err != nil {
+		return m, err
+	}
+	defer os.RemoveAll(dir)
+
+	if err := readBundle(file, dir); err != nil {
+		return m, err
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, bundleManifestFile))
+	if err != nil {
+		return m, fmt.Errorf("%v is not a bundle: %v", file, err)
+	}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return m, fmt.Errorf("invalid bundle manifest: %v", err)
+	}
+	log.Infof("Loading %v", m.TrivyImage)
+	if err := archiver.load(ctx, filepath.Join(dir, bundleImageFile)); err != nil {
+		return m, fmt.Errorf("could not load %v: %v", m.TrivyImage, err)
+	}
+	if err := copyTree(filepath.Join(dir, bundleCacheDir), opts.cacheDir); err != nil {
+		return m, fmt.Errorf("could not copy DBs to %v: %v", opts.cacheDir, err)
+	}
+	if len(m.Formatters) > 0 {
+		if err := copyTree(filepath.Join(dir, bundleFormattersDir), opts.formattersDir); err != nil {
+			return m, fmt.Errorf("could not copy formatters to %v: %v", opts.formattersDir, err)
+		}
+	}
+	return m, nil
+}
+
+func bundleMain(args []string) {
+	var opts scanOptions
+
+	usage := func(fs *flag.FlagSet) func() {
+		return func() {
+			fmt.Fprintf(os.Stderr, "Usage: helm trivy bundle export [options] <bundle file>\n")
+			fmt.Fprintf(os.Stderr, "       helm trivy bundle import [options] <bundle file>\n")
+			fmt.Fprintf(os.Stderr, "Example: helm trivy bundle export trivy-bundle.tar.gz\n\n")
+			if fs != nil {
+				fmt.Fprintf(os.Stderr, "Options:\n")
+				fs.PrintDefaults()
+			}
+		}
+	}
+	if len(args) == 0 || (args[0] != "export" && args[0] != "import") {
+		usage(nil)()
+		os.Exit(exitUsage)
+	}
+	command := args[0]
+
+	fs := flag.NewFlagSet("bundle "+command, flag.ExitOnError)
+	fs.Usage = usage(fs)
+	fs.BoolVar(&debug, "debug", false, "Enable debug logging")
+	fs.StringVar(&opts.backend, "backend", "docker", "Container runtime the trivy image is saved from or loaded into: docker or containerd")
+	fs.StringVar(&opts.containerdAddress, "containerd-address", "", "containerd socket used by the containerd backend, nerdctl's default if empty")
+	fs.StringVar(&opts.containerdNamespace, "containerd-namespace", "default", "containerd namespace used by the containerd backend")
+	fs.StringVar(&opts.formattersDir, "formatters-dir", defaultFormattersDir(), "Directory of the formatter executables, defaults to $HELM_TRIVY_FORMATTERS")
+	if command == "export" {
+		fs.StringVar(&opts.trivyImage, "trivy-image", "aquasec/trivy", "Trivy image put in the bundle, pulled with the registry credentials of the images")
+		fs.StringVar(&opts.pullPolicy, "pull-policy", "always", "When the trivy image is pulled: always, ifnotpresent or never, a present image is used when the pull fails")
+		fs.StringVar(&opts.trivyUser, "trivyuser", "1000", "Specify user to run Trivy as")
+		fs.StringVar(&opts.dockerUser, "dockeruser", "", "Specify Docker Auth username")
+		fs.StringVar(&opts.dockerPass, "dockerpass", "", "Specify Docker Auth password")
+		fs.StringVar(&opts.credStore, "cred-store", "", "Get registry credentials from this docker credential helper when -dockeruser is not set: osxkeychain, wincred, pass, secretservice, or auto for the one of the OS")
+		fs.StringVar(&opts.dbRepository, "db-repository", defaultDBRepository, "OCI repository the vulnerability DB is downloaded from")
+		fs.IntVar(&opts.dbRetries, "db-retries", 5, "Attempts at downloading each DB")
+		fs.DurationVar(&opts.dbTimeout, "db-timeout", 5*time.Minute, "Time an attempt at downloading a DB is given")
+		fs.StringVar(&opts.javaDB, "java-db", "on", "Put the Java DB in the bundle: on or off")
+	} else {
+		fs.StringVar(&opts.cacheDir, "cachedir", "", "Vuln cache dir the DBs are copied to, to scan with -offline -cachedir")
+	}
+	fs.Parse(args[1:])
+
+	if debug {
+		log.SetLevel(log.DebugLevel)
+	}
+	if fs.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "Error: A bundle file is needed.\n")
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	if command == "import" && opts.cacheDir == "" {
+		fmt.Fprintf(os.Stderr, "Error: -cachedir is needed.\n")
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	if command == "export" {
+		if err := validatePullPolicy(opts.pullPolicy); err != nil {
+			fatal(exitUsage, opts, "%v", err)
+		}
+		if opts.javaDB != "on" && opts.javaDB != "off" {
+			fatal(exitUsage, opts, "Unknown -java-db %v, expected on or off", opts.javaDB)
+		}
+		if opts.dbRetries < 1 {
+			fatal(exitUsage, opts, "-db-retries must be positive")
+		}
+		if err := validateCredStore(opts.credStore); err != nil {
+			fatal(exitUsage, opts, "%v", err)
+		}
+		if err := resolveSecretRefs(&opts); err != nil {
+			fatal(exitUsage, opts, "%v", err)
+		}
+		registerSecrets(opts)
+	}
+	ctx := context.Background()
+	backend, err := newBackend(opts)
+	if err != nil {
+		fatal(exitBackend, opts, "Could not set up %v backend: %v", opts.backend, err)
+	}
+
+	file := fs.Arg(0)
+	if command == "export" {
+		if err := exportBundle(file, ctx, backend, opts); err != nil {
+			fatal(exitCode(err), opts, "Could not export bundle: %v", err)
+		}
+		log.Infof("Bundle written to %v", file)
+		return
+	}
+	m, err := importBundle(file, ctx, backend, opts)
+	if err != nil {
+		fatal(exitCode(err), opts, "Could not import bundle: %v", err)
+	}
+	log.Infof("Imported %v (trivy %v, vulnerability DB of %v), scan with: helm trivy -offline -cachedir %v -trivy-image %v <chart>",
+		m.TrivyImage, m.Trivy, m.DBUpdatedAt, opts.cacheDir, m.TrivyImage)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// Chart authors can recommend scan settings with Chart.yaml annotations,
+// flags given on the command line take precedence:
+//
+//	annotations:
+//	  helm-trivy/severity: HIGH,CRITICAL
+//	  helm-trivy/ignore: |
+//	    CVE-2023-1234 image=bitnami/redis-exporter reason=not reachable
+const annotationPrefix = "helm-trivy/"
+
+type chartMetadata struct {
+	Version      string            `yaml:"version"`
+	Annotations  map[string]string `yaml:"annotations"`
+	Dependencies []struct {
+		Name      string   `yaml:"name"`
+		Condition string   `yaml:"condition"`
+		Tags      []string `yaml:"tags"`
+	} `yaml:"dependencies"`
+}
+
+// showChart reads the Chart.yaml of chart.
+func showChart(chart string, opts scanOptions) (chartMetadata, error) {
+	var metadata chartMetadata
+	cmd := []string{"show", "chart"}
+	if len(opts.chartVersion) > 0 {
+		cmd = append(cmd, "--version", opts.chartVersion)
+	}
+	cmd = append(cmd, chartArgs(chart, opts)...)
+	out, err := runHelm(cmd, opts)
+	if err != nil {
+		return metadata, err
+	}
+	err = yaml.Unmarshal(out, &metadata)
+	return metadata, err
+}
+
+// chartAnnotations reads the helm-trivy annotations of chart, without their
+// prefix.
+func chartAnnotations(chart string, opts scanOptions) (map[string]string, error) {
+	metadata, err := showChart(chart, opts)
+	if err != nil {
+		return nil, err
+	}
+	annotations := map[string]string{}
+	for key, value := range metadata.Annotations {
+		if strings.HasPrefix(key, annotationPrefix) {
+			annotations[strings.TrimPrefix(key, annotationPrefix)] = value
+		}
+	}
+	return annotations, nil
+}
+
+// applyChartConfig returns opts updated with the settings recommended by the
+// chart annotations, unless they were set with flags.
+func applyChartConfig(annotations map[string]string, opts scanOptions) (scanOptions, error) {
+	for key, value := range annotations {
+		if opts.setFlags[key] {
+			log.Debugf("Ignoring chart annotation %v%v, set by flag", annotationPrefix, key)
+			continue
+		}
+		switch key {
+		case "severity":
+			if err := validateSeverities(value); err != nil {
+				return opts, fmt.Errorf("annotation %v%v: %v", annotationPrefix, key, err)
+			}
+			opts.severity = value
+		case "allowed-registries":
+			opts.allowedRegistries = value
+		case "deny-latest-tag":
+			deny, err := strconv.ParseBool(value)
+			if err != nil {
+				return opts, fmt.Errorf("annotation %v%v: %v", annotationPrefix, key, err)
+			}
+			opts.denyLatestTag = deny
+		case "ignore":
+			// Ignore rules add up with the ones of the ignore file, which
+			// come first and so win for the same vulnerability.
+			rules := append([]ignoreRule{}, opts.ignores...)
+			for _, line := range strings.Split(value, "\n") {
+				line = strings.TrimSpace(line)
+				if line == "" || strings.HasPrefix(line, "#") {
+					continue
+				}
+				rule, err := parseIgnoreRule(line)
+				if err != nil {
+					return opts, fmt.Errorf("annotation %v%v: %v", annotationPrefix, key, err)
+				}
+				rules = append(rules, rule)
+			}
+			warnExpired(rules[len(opts.ignores):])
+			opts.ignores = rules
+		default:
+			log.Warnf("Unknown chart annotation %v%v", annotationPrefix, key)
+			continue
+		}
+		log.Infof("Using %v%v from the chart annotations", annotationPrefix, key)
+	}
+	return opts, nil
+}
+
+// setFlags returns the names of the flags given on the command line.
+func setFlags(fs *flag.FlagSet) map[string]bool {
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	return set
+}
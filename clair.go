@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// clairTimeout caps the time Clair takes to index an image.
+const clairTimeout = 10 * time.Minute
+
+// clairPollInterval is how often Clair is asked whether it indexed an image.
+const clairPollInterval = 2 * time.Second
+
+var clairClient = &http.Client{Timeout: 5 * time.Minute}
+
+// clairScanner submits images to a Clair v4 instance, like the one of a Quay
+// registry, which fetches their layers from the registries.
+type clairScanner struct{}
+
+func (clairScanner) image(opts scanOptions) string {
+	return ""
+}
+
+// validateClair checks the options of -scanner clair.
+func validateClair(opts scanOptions) error {
+	if opts.clairURL == "" {
+		return fmt.Errorf("-scanner clair needs -clair-url")
+	}
+	if len(opts.imageInputs) > 0 {
+		return fmt.Errorf("-image-input can't be used with -scanner clair, Clair fetches images from their registry")
+	}
+	return nil
+}
+
+// clairLayer is a layer of an image submitted to Clair, with the URL and
+// the headers Clair fetches it with.
+type clairLayer struct {
+	Hash    string              `json:"hash"`
+	URI     string              `json:"uri"`
+	Headers map[string][]string `json:"headers"`
+}
+
+// clairManifest is an image submitted to Clair.
+type clairManifest struct {
+	Hash   string       `json:"hash"`
+	Layers []clairLayer `json:"layers"`
+}
+
+// clairIndexReport is the state of the indexing of an image by Clair.
+type clairIndexReport struct {
+	State string `json:"state"`
+	Err   string `json:"err"`
+}
+
+// clairVulnerabilityReport is the vulnerability report of an image by
+// Clair, packages and vulnerabilities being keyed by their ID.
+type clairVulnerabilityReport struct {
+	Packages map[string]struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	} `json:"packages"`
+	Distributions map[string]struct {
+		DID       string `json:"did"`
+		VersionID string `json:"version_id"`
+	} `json:"distributions"`
+	Environments map[string][]struct {
+		DistributionID string `json:"distribution_id"`
+	} `json:"environments"`
+	Vulnerabilities map[string]struct {
+		Name               string `json:"name"`
+		Description        string `json:"description"`
+		Links              string `json:"links"`
+		NormalizedSeverity string `json:"normalized_severity"`
+		FixedInVersion     string `json:"fixed_in_version"`
+		Repository         *struct {
+			Name string `json:"name"`
+		} `json:"repository"`
+	} `json:"vulnerabilities"`
+	PackageVulnerabilities map[string][]string `json:"package_vulnerabilities"`
+}
+
+// blobAuthorization returns the Authorization header Clair needs to fetch
+// the blob at url, empty when the registry doesn't ask for one.
+func blobAuthorization(url string, ref imageRef, username string, password string) (string, error) {
+	resp, err := registryClient.Head(url)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		return "", nil
+	}
+	return registryAuthorization(resp.Header.Get("WWW-Authenticate"), ref, username, password)
+}
+
+// clairImageManifest reads the manifest of image from its registry, for
+// linux/amd64 when it is a multi-platform image.
+func clairImageManifest(image string, opts scanOptions) (clairManifest, error) {
+	ref := parseImageRef(image)
+	user, password := registryCredentials(image, opts)
+	reference := ref.Tag
+	if ref.Digest != "" {
+		reference = ref.Digest
+	}
+	// An index leads to the manifest of the platform.
+	for depth := 0; depth < 2; depth++ {
+		url := fmt.Sprintf("https://%s/v2/%s/manifests/%s", registryHost(ref), ref.Repository, reference)
+		resp, err := registryDo(http.MethodGet, url, ref, manifestTypes, user, password)
+		if err != nil {
+			return clairManifest{}, err
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return clairManifest{}, fmt.Errorf("could not get manifest of %v: %v", ref, resp.Status)
+		}
+		var manifest struct {
+			Layers []struct {
+				Digest string `json:"digest"`
+			} `json:"layers"`
+			Manifests []indexManifest `json:"manifests"`
+		}
+		if err == nil {
+			err = json.Unmarshal(body, &manifest)
+		}
+		if err != nil {
+			return clairManifest{}, fmt.Errorf("invalid manifest of %v: %v", ref, err)
+		}
+		if len(manifest.Manifests) > 0 {
+			reference = platformDigest(manifest.Manifests)
+			continue
+		}
+		m := clairManifest{Hash: resp.Header.Get("Docker-Content-Digest"), Layers: []clairLayer{}}
+		if m.Hash == "" {
+			sum := sha256.Sum256(body)
+			m.Hash = "sha256:" + hex.EncodeToString(sum[:])
+		}
+		auth := ""
+		for i, layer := range manifest.Layers {
+			uri := fmt.Sprintf("https://%s/v2/%s/blobs/%s", registryHost(ref), ref.Repository, layer.Digest)
+			if i == 0 {
+				if auth, err = blobAuthorization(uri, ref, user, password); err != nil {
+					return clairManifest{}, err
+				}
+			}
+			l := clairLayer{Hash: layer.Digest, URI: uri, Headers: map[string][]string{}}
+			if auth != "" {
+				l.Headers["Authorization"] = []string{auth}
+			}
+			m.Layers = append(m.Layers, l)
+		}
+		return m, nil
+	}
+	return clairManifest{}, fmt.Errorf("no image manifest in the index of %v", ref)
+}
+
+// clairDo sends a request to the Clair API and decodes its JSON response
+// into out.
+func clairDo(method string, path string, body io.Reader, out interface{}, opts scanOptions) error {
+	url := strings.TrimSuffix(opts.clairURL, "/") + path
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if opts.clairToken != "" {
+		req.Header.Set("Authorization", "Bearer "+opts.clairToken)
+	}
+	resp, err := clairClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("%v %v: %v", method, path, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// clairIndex submits an image to Clair, and waits for Clair to index it.
+func clairIndex(manifest clairManifest, opts scanOptions) error {
+	body, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	var report clairIndexReport
+	if err := clairDo(http.MethodPost, "/indexer/api/v1/index_report", bytes.NewReader(body), &report, opts); err != nil {
+		return err
+	}
+	deadline := time.Now().Add(clairTimeout)
+	for report.State != "IndexFinished" {
+		if report.State == "IndexError" || report.Err != "" {
+			return fmt.Errorf("Clair could not index %v: %v", manifest.Hash, report.Err)
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("Clair did not index %v within %v", manifest.Hash, clairTimeout)
+		}
+		time.Sleep(clairPollInterval)
+		if err := clairDo(http.MethodGet, "/indexer/api/v1/index_report/"+manifest.Hash, nil, &report, opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (clairScanner) scan(image string, ctx context.Context, backend scanBackend, opts scanOptions) (trivyReport, error) {
+	rewritten := rewriteImage(image, opts.imageRewrites)
+	if rewritten != image {
+		log.Infof("Scanning %v as %v", image, rewritten)
+	}
+	manifest, err := clairImageManifest(rewritten, opts)
+	if err != nil {
+		return trivyReport{}, err
+	}
+	log.Debugf("Submitting %v to Clair as %v", image, manifest.Hash)
+	if err := clairIndex(manifest, opts); err != nil {
+		return trivyReport{}, err
+	}
+	var report clairVulnerabilityReport
+	if err := clairDo(http.MethodGet, "/matcher/api/v1/vulnerability_report/"+manifest.Hash, nil, &report, opts); err != nil {
+		return trivyReport{}, err
+	}
+	return clairResults(image, report, opts), nil
+}
+
+// clairResults converts the vulnerability report of image by Clair to a
+// trivy report. Packages of a distribution are OS packages, the
+// others are libraries of the repository of their vulnerabilities.
+func clairResults(image string, report clairVulnerabilityReport, opts scanOptions) trivyReport {
+	wanted := wantedSeverities(opts)
+	var distro *trivyOS
+	ids := []string{}
+	for id := range report.Distributions {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	if len(ids) > 0 {
+		d := report.Distributions[ids[0]]
+		distro = &trivyOS{Family: d.DID, Name: d.VersionID}
+	}
+	packages := []string{}
+	for id := range report.PackageVulnerabilities {
+		packages = append(packages, id)
+	}
+	sort.Strings(packages)
+	results := map[string]*trivyResult{}
+	for _, pkgID := range packages {
+		pkg := report.Packages[pkgID]
+		distribution := ""
+		if envs := report.Environments[pkgID]; len(envs) > 0 {
+			distribution = envs[0].DistributionID
+		}
+		for _, vulnID := range report.PackageVulnerabilities[pkgID] {
+			v := report.Vulnerabilities[vulnID]
+			vuln := trivyVulnerability{
+				VulnerabilityID:  v.Name,
+				PkgName:          pkg.Name,
+				InstalledVersion: pkg.Version,
+				FixedVersion:     v.FixedInVersion,
+				// Clair normalizes severities the way Harbor does.
+				Severity:    harborSeverity(v.NormalizedSeverity),
+				Description: v.Description,
+			}
+			if links := strings.Fields(v.Links); len(links) > 0 {
+				vuln.PrimaryURL = links[0]
+			}
+			if len(wanted) > 0 && !wanted[vuln.Severity] {
+				continue
+			}
+			target, class, typ := "library", "lang-pkgs", ""
+			if d, ok := report.Distributions[distribution]; ok {
+				target = fmt.Sprintf("%s (%s %s)", image, d.DID, d.VersionID)
+				class, typ = "os-pkgs", d.DID
+			} else if opts.skipLibraries {
+				continue
+			} else if v.Repository != nil && v.Repository.Name != "" {
+				target, typ = v.Repository.Name, v.Repository.Name
+			}
+			if results[target] == nil {
+				results[target] = &trivyResult{Target: target, Class: class, Type: typ, Vulnerabilities: []trivyVulnerability{}}
+			}
+			results[target].Vulnerabilities = append(results[target].Vulnerabilities, vuln)
+		}
+	}
+	return convertedReport(image, distro, results)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+type composeFile struct {
+	Services map[string]struct {
+		Image string      `yaml:"image"`
+		Build interface{} `yaml:"build"`
+	} `yaml:"services"`
+}
+
+// composeVariable matches the ${VAR}, ${VAR:-default} and ${VAR-default}
+// interpolations of compose files.
+var composeVariable = regexp.MustCompile(`\$\{([a-zA-Z_][a-zA-Z0-9_]*)(:?-([^}]*))?\}`)
+
+// interpolateCompose replaces the variables of s with their value in the
+// environment, as docker compose does.
+func interpolateCompose(s string) string {
+	return composeVariable.ReplaceAllStringFunc(s, func(match string) string {
+		m := composeVariable.FindStringSubmatch(match)
+		value, ok := os.LookupEnv(m[1])
+		switch {
+		case strings.HasPrefix(m[2], ":-") && value == "":
+			return m[3]
+		case strings.HasPrefix(m[2], "-") && !ok:
+			return m[3]
+		}
+		return value
+	})
+}
+
+// composeImages returns the images of the services of docker compose files.
+// Services built locally without an image name are left out.
+func composeImages(files []string) ([]chartImage, error) {
+	images := []chartImage{}
+	seen := map[string]bool{}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		var compose composeFile
+		if err := yaml.Unmarshal(data, &compose); err != nil {
+			return nil, fmt.Errorf("invalid compose file %v: %v", file, err)
+		}
+		names := []string{}
+		for name := range compose.Services {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			service := compose.Services[name]
+			image := interpolateCompose(service.Image)
+			if image == "" {
+				if service.Build != nil {
+					log.Infof("Skipping service %v of %v, built without image name", name, file)
+				}
+				continue
+			}
+			log.Debugf("Found image %v of service %v", image, name)
+			if !seen[image] {
+				seen[image] = true
+				images = append(images, chartImage{Name: image})
+			}
+		}
+	}
+	return images, nil
+}
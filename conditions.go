@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// chartToggles returns the values enabling the optional dependencies of
+// chart: the first path of their condition, as helm uses the first one set,
+// and their tags.
+func chartToggles(chart string, opts scanOptions) ([]string, error) {
+	metadata, err := showChart(chart, opts)
+	if err != nil {
+		return nil, err
+	}
+	toggles := []string{}
+	seen := map[string]bool{}
+	add := func(toggle string) {
+		if toggle != "" && !seen[toggle] {
+			seen[toggle] = true
+			toggles = append(toggles, toggle)
+		}
+	}
+	for _, d := range metadata.Dependencies {
+		add(strings.TrimSpace(strings.Split(d.Condition, ",")[0]))
+		for _, tag := range d.Tags {
+			add("tags." + tag)
+		}
+	}
+	return toggles, nil
+}
+
+// toggleCombinations returns the --set options of the combinations of
+// toggles, at most limit of them, the ones enabling the most toggles first.
+func toggleCombinations(toggles []string, limit int) []string {
+	combinations := []string{}
+	var pick func(start int, left int, disabled map[int]bool)
+	pick = func(start int, left int, disabled map[int]bool) {
+		if len(combinations) >= limit {
+			return
+		}
+		if left == 0 {
+			set := []string{}
+			for i, toggle := range toggles {
+				set = append(set, fmt.Sprintf("%s=%t", toggle, !disabled[i]))
+			}
+			combinations = append(combinations, strings.Join(set, ","))
+			return
+		}
+		for i := start; i <= len(toggles)-left; i++ {
+			disabled[i] = true
+			pick(i+1, left-1, disabled)
+			delete(disabled, i)
+		}
+	}
+	for off := 0; off <= len(toggles) && len(combinations) < limit; off++ {
+		pick(0, off, map[int]bool{})
+	}
+	return combinations
+}
+
+// expandedImages renders chart with its default values, then once per
+// combination of its toggles, and returns the images of all the renders.
+// The images the defaults don't render are labelled optional.
+func expandedImages(chart string, opts scanOptions) ([]chartImage, error) {
+	out, err := renderChart(chart, opts)
+	if err != nil {
+		return nil, err
+	}
+	images := extractImages(out, opts)
+	toggles, err := chartToggles(chart, opts)
+	if err != nil {
+		return nil, fmt.Errorf("could not read dependencies: %v", err)
+	}
+	if len(toggles) == 0 {
+		log.Debugf("No condition nor tag in the dependencies of %v", chart)
+		return images, nil
+	}
+	combinations := toggleCombinations(toggles, opts.expandLimit)
+	if len(toggles) >= 31 || len(combinations) < 1<<uint(len(toggles)) {
+		log.Warnf("Rendering %d of the combinations of %v, raise -expand-limit to render more", len(combinations), strings.Join(toggles, ", "))
+	}
+	seen := map[string]bool{}
+	for _, image := range images {
+		seen[image.Name] = true
+	}
+	for _, set := range combinations {
+		combination := opts
+		combination.templateSet = set
+		if opts.templateSet != "" {
+			combination.templateSet = opts.templateSet + "," + set
+		}
+		log.Debugf("Rendering %v with %v", chart, set)
+		out, err := renderChart(chart, combination)
+		if err != nil {
+			// Some combinations are invalid, like a required external
+			// database with the bundled one disabled.
+			log.Debugf("Could not render %v with %v: %v", chart, set, err)
+			continue
+		}
+		for _, image := range extractImages(out, combination) {
+			if seen[image.Name] {
+				continue
+			}
+			seen[image.Name] = true
+			image.Labels = append(image.Labels, labelOptional)
+			images = append(images, image)
+		}
+	}
+	return images, nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// scalarString returns a scalar of a decoded payload as a string, tags like
+// 1.20 being decoded as numbers.
+func scalarString(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case int, float64:
+		return fmt.Sprint(v)
+	}
+	return ""
+}
+
+// istioProxyImages returns the sidecar images of the values of the istio
+// sidecar injector: the proxy and proxy_init images of global, pulled from
+// the global hub with the global tag unless they are full references.
+func istioProxyImages(values map[string]interface{}) []string {
+	global, _ := values["global"].(map[string]interface{})
+	hub, tag := scalarString(global["hub"]), scalarString(global["tag"])
+	if hub == "" || tag == "" {
+		return nil
+	}
+	if variant := scalarString(global["variant"]); variant != "" {
+		tag += "-" + variant
+	}
+	images := []string{}
+	for _, key := range []string{"proxy", "proxy_init"} {
+		proxy, _ := global[key].(map[string]interface{})
+		image := scalarString(proxy["image"])
+		switch {
+		case image == "":
+			continue
+		case !strings.Contains(image, "/"):
+			image = hub + "/" + image + ":" + tag
+		case !imagePattern.MatchString(image):
+			image += ":" + tag
+		}
+		if imagePattern.MatchString(image) {
+			images = append(images, image)
+		}
+	}
+	return images
+}
+
+// payloadImages looks for image references in a decoded payload: values of
+// keys mentioning an image, and image mappings giving a repository and a tag
+// the way charts write them in their values.
+func payloadImages(obj interface{}) []string {
+	images := []string{}
+	switch v := obj.(type) {
+	case map[string]interface{}:
+		keys := []string{}
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if !strings.Contains(strings.ToLower(key), "image") {
+				images = append(images, payloadImages(v[key])...)
+				continue
+			}
+			if value := scalarString(v[key]); looksLikeImage(key, value) {
+				images = append(images, value)
+				continue
+			}
+			image, ok := v[key].(map[string]interface{})
+			if !ok {
+				images = append(images, payloadImages(v[key])...)
+				continue
+			}
+			ref := scalarString(image["repository"])
+			if registry := scalarString(image["registry"]); registry != "" && ref != "" {
+				ref = registry + "/" + ref
+			}
+			if tag := scalarString(image["tag"]); tag != "" {
+				ref += ":" + tag
+			}
+			if digest := scalarString(image["digest"]); digest != "" {
+				ref += "@" + digest
+			}
+			if imagePattern.MatchString(ref) {
+				images = append(images, ref)
+			}
+		}
+	case []interface{}:
+		for _, value := range v {
+			images = append(images, payloadImages(value)...)
+		}
+	}
+	return images
+}
+
+// configMapImages looks for image references in the payloads of a
+// ConfigMap, where operators like istiod or cert-manager get the values of
+// the images they deploy. Payloads are decoded as YAML or JSON, those that
+// are neither are skipped.
+func configMapImages(obj map[string]interface{}) []string {
+	if obj["kind"] != "ConfigMap" {
+		return nil
+	}
+	data, _ := obj["data"].(map[string]interface{})
+	keys := []string{}
+	for key := range data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	images := []string{}
+	for _, key := range keys {
+		payload, ok := data[key].(string)
+		if !ok {
+			continue
+		}
+		var value interface{}
+		if err := yaml.Unmarshal([]byte(payload), &value); err != nil {
+			continue
+		}
+		if values, ok := value.(map[string]interface{}); ok {
+			images = append(images, istioProxyImages(values)...)
+		}
+		images = append(images, payloadImages(value)...)
+	}
+	return images
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// dockerHubServer is the server URL docker stores Docker Hub credentials
+// under.
+const dockerHubServer = "https://index.docker.io/v1/"
+
+var credStoreName = regexp.MustCompile(`^[a-z0-9-]+$`)
+
+// credStoreCache keeps the credentials found per registry, credential stores
+// may prompt the user.
+var credStoreCache = struct {
+	sync.Mutex
+	creds map[string][2]string
+}{creds: map[string][2]string{}}
+
+// credStoreHelper returns the docker credential helper of -cred-store, auto
+// being the one of the OS.
+func credStoreHelper(store string) string {
+	if store == "auto" {
+		switch runtime.GOOS {
+		case "darwin":
+			store = "osxkeychain"
+		case "windows":
+			store = "wincred"
+		default:
+			store = "secretservice"
+		}
+	}
+	return "docker-credential-" + store
+}
+
+// validateCredStore checks that the credential helper of -cred-store is
+// installed.
+func validateCredStore(store string) error {
+	if store == "" {
+		return nil
+	}
+	if !credStoreName.MatchString(store) {
+		return fmt.Errorf("invalid credential store %q", store)
+	}
+	if _, err := exec.LookPath(credStoreHelper(store)); err != nil {
+		return fmt.Errorf("credential store %v needs %v: %v", store, credStoreHelper(store), err)
+	}
+	return nil
+}
+
+// credStoreCredentials asks the credential store for the credentials of
+// server, empty if it has none.
+func credStoreCredentials(store string, server string) (string, string, error) {
+	cmd := exec.Command(credStoreHelper(store), "get")
+	cmd.Stdin = strings.NewReader(server)
+	out, err := cmd.Output()
+	if err != nil {
+		if strings.Contains(strings.ToLower(string(out)), "credentials not found") {
+			return "", "", nil
+		}
+		return "", "", fmt.Errorf("%v get: %v: %s", credStoreHelper(store), err, strings.TrimSpace(string(out)))
+	}
+	var creds struct {
+		Username string `json:"Username"`
+		Secret   string `json:"Secret"`
+	}
+	if err := json.Unmarshal(out, &creds); err != nil {
+		return "", "", fmt.Errorf("invalid output of %v: %v", credStoreHelper(store), err)
+	}
+	return creds.Username, creds.Secret, nil
+}
+
+// registryCredentials returns the credentials image is pulled with:
+// -dockeruser and -dockerpass, or those -cred-store has for its registry.
+func registryCredentials(image string, opts scanOptions) (string, string) {
+	if opts.dockerUser != "" || opts.credStore == "" {
+		return opts.dockerUser, opts.dockerPass
+	}
+	server := parseImageRef(image).Registry
+	if server == "docker.io" {
+		server = dockerHubServer
+	}
+	credStoreCache.Lock()
+	defer credStoreCache.Unlock()
+	if creds, ok := credStoreCache.creds[server]; ok {
+		return creds[0], creds[1]
+	}
+	user, password, err := credStoreCredentials(opts.credStore, server)
+	if err != nil {
+		log.Warnf("Could not get credentials of %v from %v: %v", server, opts.credStore, err)
+	} else if user == "" {
+		log.Debugf("No credentials of %v in %v", server, opts.credStore)
+	}
+	addSecrets(password)
+	credStoreCache.creds[server] = [2]string{user, password}
+	return user, password
+}
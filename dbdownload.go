@@ -0,0 +1,249 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultDBRepository is the OCI artifact trivy downloads its vulnerability
+// DB from.
+const defaultDBRepository = "ghcr.io/aquasecurity/trivy-db:2"
+
+const dbLayerType = "application/vnd.aquasec.trivy.db.layer.v1.tar+gzip"
+
+// The OCI artifact of the Java DB, used to scan JAR files.
+const (
+	javaDBRepository = "ghcr.io/aquasecurity/trivy-java-db:1"
+	javaDBLayerType  = "application/vnd.aquasec.trivy.javadb.layer.v1.tar+gzip"
+)
+
+// trivyDB is a DB trivy downloads from an OCI artifact, into a directory of
+// its cache dir.
+type trivyDB struct {
+	name       string
+	repository string
+	layerType  string
+	dir        string
+	file       string
+}
+
+// vulnerabilityDB is the vulnerability DB of -db-repository.
+func vulnerabilityDB(opts scanOptions) trivyDB {
+	return trivyDB{name: "vulnerability DB", repository: opts.dbRepository, layerType: dbLayerType, dir: "db", file: "trivy.db"}
+}
+
+var javaDB = trivyDB{name: "Java DB", repository: javaDBRepository, layerType: javaDBLayerType, dir: "java-db", file: "trivy-java.db"}
+
+// dbMetadata is the metadata.json shipped with the vulnerability DB.
+type dbMetadata struct {
+	Version    int       `json:"Version"`
+	NextUpdate time.Time `json:"NextUpdate"`
+	UpdatedAt  time.Time `json:"UpdatedAt"`
+}
+
+type dbLayer struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
+}
+
+// dbFresh tells whether the DB of dir is there and not due for an update.
+func dbFresh(db trivyDB, dir string) bool {
+	if _, err := os.Stat(filepath.Join(dir, db.file)); err != nil {
+		return false
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "metadata.json"))
+	if err != nil {
+		return false
+	}
+	var metadata dbMetadata
+	if json.Unmarshal(data, &metadata) != nil {
+		return false
+	}
+	return time.Now().Before(metadata.NextUpdate)
+}
+
+// findDBLayer returns the layer of the artifact of db.
+func findDBLayer(db trivyDB, opts scanOptions) (dbLayer, error) {
+	repository := db.repository
+	ref := parseImageRef(repository)
+	user, password := registryCredentials(repository, opts)
+	url := fmt.Sprintf("https://%s/v2/%s/manifests/%s", registryHost(ref), ref.Repository, ref.Tag)
+	resp, err := registryDo(http.MethodGet, url, ref, "application/vnd.oci.image.manifest.v1+json", user, password)
+	if err != nil {
+		return dbLayer{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return dbLayer{}, fmt.Errorf("could not get manifest of %v: %v", repository, resp.Status)
+	}
+	var manifest struct {
+		Layers []dbLayer `json:"layers"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&manifest); err != nil {
+		return dbLayer{}, fmt.Errorf("invalid manifest of %v: %v", repository, err)
+	}
+	for _, layer := range manifest.Layers {
+		if layer.MediaType == db.layerType {
+			return layer, nil
+		}
+	}
+	return dbLayer{}, fmt.Errorf("%v has no %v layer", repository, db.name)
+}
+
+// downloadBlob downloads layer into file, resuming from what file already
+// holds when the registry supports range requests. The download is
+// abandoned after timeout, keeping what was downloaded.
+func downloadBlob(repository string, layer dbLayer, file string, timeout time.Duration, opts scanOptions) error {
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	offset := info.Size()
+	if offset == layer.Size {
+		return nil
+	}
+	header := http.Header{}
+	if offset > 0 && offset < layer.Size {
+		header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	ref := parseImageRef(repository)
+	user, password := registryCredentials(repository, opts)
+	url := fmt.Sprintf("https://%s/v2/%s/blobs/%s", registryHost(ref), ref.Repository, layer.Digest)
+	resp, err := registrySend(&http.Client{Timeout: timeout}, http.MethodGet, url, ref, header, user, password)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		log.Infof("Resuming download of %v at %d of %d bytes", repository, offset, layer.Size)
+	case http.StatusOK:
+		if offset > 0 {
+			log.Infof("Registry of %v can't resume downloads, downloading %v again", repository, layer.Digest)
+		}
+		if err := f.Truncate(0); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("could not download %v: %v", layer.Digest, resp.Status)
+	}
+	_, err = io.Copy(f, resp.Body)
+	return err
+}
+
+// extractDB checks the digest of the downloaded archive of db and extracts
+// the DB and its metadata into dir.
+func extractDB(db trivyDB, archive string, digest string, dir string) error {
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return err
+	}
+	if sum := fmt.Sprintf("sha256:%x", hash.Sum(nil)); sum != digest {
+		return fmt.Errorf("downloaded %v has digest %v, expected %v", db.name, sum, digest)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(zr)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := filepath.Base(header.Name)
+		if header.Typeflag != tar.TypeReg || (name != db.file && name != "metadata.json") {
+			continue
+		}
+		// The DB is replaced at once, scans never see half of it.
+		tmp := filepath.Join(dir, name+".tmp")
+		out, err := os.Create(tmp)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(out, tr)
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = os.Rename(tmp, filepath.Join(dir, name))
+		}
+		if err != nil {
+			os.Remove(tmp)
+			return err
+		}
+	}
+}
+
+// fetchDB downloads the vulnerability DB into the cache dir, where trivy
+// looks for it, unless it is still fresh.
+func fetchDB(opts scanOptions) error {
+	return fetchTrivyDB(vulnerabilityDB(opts), opts.cacheDir, opts)
+}
+
+// fetchTrivyDB downloads db into cacheDir unless it is still fresh.
+// Interrupted downloads are retried, resuming where they stopped, and the
+// partial download is kept in the cache dir for the next run if they all
+// fail.
+func fetchTrivyDB(db trivyDB, cacheDir string, opts scanOptions) error {
+	dir := filepath.Join(cacheDir, db.dir)
+	if dbFresh(db, dir) {
+		log.Debugf("%v of %v is up to date", db.name, dir)
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	layer, err := findDBLayer(db, opts)
+	if err != nil {
+		return err
+	}
+	file := filepath.Join(dir, strings.Replace(layer.Digest, ":", "-", 1)+".tar.gz.partial")
+	log.Infof("Downloading %v from %v", db.name, db.repository)
+	for attempt := 1; ; attempt++ {
+		err := downloadBlob(db.repository, layer, file, opts.dbTimeout, opts)
+		if err == nil {
+			break
+		}
+		if attempt >= opts.dbRetries {
+			return fmt.Errorf("could not download %v after %d attempts: %v", db.name, attempt, err)
+		}
+		log.Warnf("%v download interrupted, retrying (%d/%d): %v", db.name, attempt+1, opts.dbRetries, err)
+		time.Sleep(time.Duration(attempt) * 2 * time.Second)
+	}
+	if err := extractDB(db, file, layer.Digest, dir); err != nil {
+		os.Remove(file)
+		return err
+	}
+	log.Infof("Downloaded %v", db.name)
+	return os.Remove(file)
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// scanMemo keeps the trivy report of the images scanned during a run by
+// digest, so that an image shared by several releases is scanned once.
+type scanMemo struct {
+	mu      sync.Mutex
+	keys    map[string]string
+	reports map[string]trivyReport
+}
+
+func newScanMemo() *scanMemo {
+	return &scanMemo{keys: map[string]string{}, reports: map[string]trivyReport{}}
+}
+
+// key returns the repository and digest of image, or the image itself when
+// its digest can't be resolved.
+func (m *scanMemo) key(image string, opts scanOptions) string {
+	m.mu.Lock()
+	key, ok := m.keys[image]
+	m.mu.Unlock()
+	if ok {
+		return key
+	}
+	key = normalizeImage(image)
+	if digest, err := resolveImageDigest(rewriteImage(image, opts.imageRewrites), opts); err == nil {
+		key = stripTag(key) + "@" + digest
+	} else {
+		log.Debugf("Could not resolve digest of %v: %v", image, err)
+	}
+	m.mu.Lock()
+	m.keys[image] = key
+	m.mu.Unlock()
+	return key
+}
+
+func (m *scanMemo) lookup(image string, opts scanOptions) (trivyReport, bool) {
+	key := m.key(image, opts)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	report, ok := m.reports[key]
+	report.ArtifactName = image
+	return report, ok
+}
+
+func (m *scanMemo) store(image string, report trivyReport, opts scanOptions) {
+	key := m.key(image, opts)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.reports[key] = report
+}
+
+// sharedImage is an image of the image-centric view of release scans, with
+// the releases using it.
+type sharedImage struct {
+	Image    string         `json:"Image"`
+	Releases []string       `json:"Releases"`
+	Counts   map[string]int `json:"Counts"`
+}
+
+// imageView regroups the results of releases by image digest, images used
+// by the most releases first.
+func imageView(results []releaseResult, memo *scanMemo, opts scanOptions) []sharedImage {
+	byKey := map[string]*sharedImage{}
+	for _, r := range results {
+		name := r.Release.Namespace + "/" + r.Release.Name
+		for _, image := range r.Result.Images {
+			key := normalizeImage(image.Scan.Image)
+			if memo != nil {
+				key = memo.key(image.Scan.Image, opts)
+			}
+			shared, ok := byKey[key]
+			if !ok {
+				shared = &sharedImage{Image: key, Releases: []string{}, Counts: countBySeverity(image.Report.vulnerabilities())}
+				byKey[key] = shared
+			}
+			if len(shared.Releases) == 0 || shared.Releases[len(shared.Releases)-1] != name {
+				shared.Releases = append(shared.Releases, name)
+			}
+		}
+	}
+	images := []sharedImage{}
+	for _, shared := range byKey {
+		images = append(images, *shared)
+	}
+	sort.Slice(images, func(i, j int) bool {
+		if len(images[i].Releases) != len(images[j].Releases) {
+			return len(images[i].Releases) > len(images[j].Releases)
+		}
+		return images[i].Image < images[j].Image
+	})
+	return images
+}
+
+// printImageView prints the image-centric view of release scans.
+func printImageView(w io.Writer, images []sharedImage, opts scanOptions) error {
+	if opts.json {
+		data, err := json.MarshalIndent(images, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(w, string(data))
+		return nil
+	}
+	title := "Images"
+	fmt.Fprintf(w, "%s\n%s\n", title, strings.Repeat("=", len(title)))
+	for _, image := range images {
+		counts := []string{}
+		for _, severity := range severities {
+			counts = append(counts, fmt.Sprintf("%s: %d", severity, image.Counts[severity]))
+		}
+		fmt.Fprintf(w, "\n%s (%s)\n", image.Image, strings.Join(counts, ", "))
+		fmt.Fprintf(w, "Releases: %s\n", strings.Join(image.Releases, ", "))
+	}
+	return nil
+}
+
+// keyedImage is an entry of the shared findings of the keyed view: the
+// results of an image, scanned once whatever the number of releases using
+// it.
+type keyedImage struct {
+	Image    string          `json:"Image"`
+	Releases []string        `json:"Releases"`
+	Results  json.RawMessage `json:"Results"`
+	result   imageResult
+}
+
+// keyedImageRef links an image of a release to its shared findings, with
+// what is specific to the release.
+type keyedImageRef struct {
+	Key       string          `json:"Key"`
+	Image     string          `json:"Image"`
+	Labels    []string        `json:"Labels,omitempty"`
+	Workloads []imageWorkload `json:"Workloads,omitempty"`
+}
+
+// keyedRelease is a release of the keyed view, referencing its images.
+type keyedRelease struct {
+	Namespace string          `json:"Namespace"`
+	Release   string          `json:"Release"`
+	Chart     string          `json:"Chart"`
+	Drift     []string        `json:"Drift,omitempty"`
+	Images    []keyedImageRef `json:"Images"`
+}
+
+// keyedOutput is the keyed view of release scans: the releases with the
+// keys of their images, and the findings of each key.
+type keyedOutput struct {
+	Releases []keyedRelease         `json:"Releases"`
+	Images   map[string]*keyedImage `json:"Images"`
+}
+
+// keyedView links the images of releases to findings shared by image
+// digest. Labels and workloads depend on the release, they are left out of
+// the shared findings.
+func keyedView(results []releaseResult, memo *scanMemo, opts scanOptions) (keyedOutput, error) {
+	view := keyedOutput{Releases: []keyedRelease{}, Images: map[string]*keyedImage{}}
+	for _, r := range results {
+		name := r.Release.Namespace + "/" + r.Release.Name
+		release := keyedRelease{Namespace: r.Release.Namespace, Release: r.Release.Name, Chart: r.Release.Chart, Drift: r.Drift, Images: []keyedImageRef{}}
+		for _, image := range r.Result.Images {
+			key := normalizeImage(image.Scan.Image)
+			if memo != nil {
+				key = memo.key(image.Scan.Image, opts)
+			}
+			shared, ok := view.Images[key]
+			if !ok {
+				shared = &keyedImage{Image: image.Scan.Image, Releases: []string{}, result: image}
+				shared.result.Scan.Labels, shared.result.Scan.Workloads = nil, nil
+				shared.result.Report.Labels, shared.result.Report.Workloads = nil, nil
+				view.Images[key] = shared
+			}
+			if len(shared.Releases) == 0 || shared.Releases[len(shared.Releases)-1] != name {
+				shared.Releases = append(shared.Releases, name)
+			}
+			release.Images = append(release.Images, keyedImageRef{Key: key, Image: image.Scan.Image, Labels: image.Scan.Labels, Workloads: image.Scan.Workloads})
+		}
+		view.Releases = append(view.Releases, release)
+	}
+	for _, shared := range view.Images {
+		merged, err := mergeJSONOutputs([]trivyReport{shared.result.Report})
+		if err != nil {
+			return view, err
+		}
+		shared.Results = json.RawMessage(merged)
+	}
+	return view, nil
+}
+
+// printKeyedView prints the releases with the keys of their images, then
+// the findings of each key once.
+func printKeyedView(w io.Writer, view keyedOutput, opts scanOptions) error {
+	if opts.json {
+		data, err := json.MarshalIndent(view, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(w, string(data))
+		return nil
+	}
+	namespace := ""
+	for i, r := range view.Releases {
+		if i == 0 || r.Namespace != namespace {
+			namespace = r.Namespace
+			title := "Namespace " + namespace
+			fmt.Fprintf(w, "%s\n%s\n", title, strings.Repeat("=", len(title)))
+		}
+		fmt.Fprintf(w, "\nRelease %s (%s): %d images\n", r.Release, r.Chart, len(r.Images))
+		for _, drift := range r.Drift {
+			fmt.Fprintf(w, "Drift: %s\n", drift)
+		}
+		for _, image := range r.Images {
+			fmt.Fprintf(w, "- %s\n", chartImage{Name: image.Key, Labels: image.Labels})
+			if len(image.Workloads) > 0 {
+				fmt.Fprintf(w, "  Workloads: %s\n", workloadList(image.Workloads))
+			}
+		}
+		fmt.Fprintln(w)
+	}
+	keys := []string{}
+	for key := range view.Images {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	title := "Images"
+	fmt.Fprintf(w, "%s\n%s\n", title, strings.Repeat("=", len(title)))
+	for _, key := range keys {
+		shared := view.Images[key]
+		fmt.Fprintf(w, "\n%s, used by %s\n", key, strings.Join(shared.Releases, ", "))
+		printReport(w, shared.result.Report, opts)
+	}
+	return nil
+}
+
+// validateView checks the value of -view.
+func validateView(view string) error {
+	if view != "releases" && view != "images" && view != "both" && view != "keyed" {
+		return fmt.Errorf("unknown view %v, expected releases, images, both or keyed", view)
+	}
+	return nil
+}
+
+// printViews prints the results of releases in the views of -view. Both
+// views make a single JSON object with Releases and Images.
+func printViews(w io.Writer, view string, results []releaseResult, opts scanOptions) error {
+	switch view {
+	case "releases":
+		return printReleases(w, results, opts)
+	case "images":
+		return printImageView(w, imageView(results, opts.scanMemo, opts), opts)
+	case "keyed":
+		view, err := keyedView(results, opts.scanMemo, opts)
+		if err != nil {
+			return err
+		}
+		return printKeyedView(w, view, opts)
+	}
+	images := imageView(results, opts.scanMemo, opts)
+	if !opts.json {
+		if err := printReleases(w, results, opts); err != nil {
+			return err
+		}
+		return printImageView(w, images, opts)
+	}
+	namespaces, err := namespaceOutputs(results)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(map[string]interface{}{"Releases": namespaces, "Images": images}, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(w, string(data))
+	return nil
+}
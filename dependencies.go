@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+)
+
+// dependency is an image of a chart, with the field names of the custom
+// managers of Renovate. SuggestedVersion is the suggestedTag of images with
+// fixable vulnerabilities.
+type dependency struct {
+	DepName          string `json:"depName"`
+	CurrentValue     string `json:"currentValue,omitempty"`
+	CurrentDigest    string `json:"currentDigest,omitempty"`
+	Datasource       string `json:"datasource"`
+	SuggestedVersion string `json:"suggestedVersion,omitempty"`
+	Vulnerabilities  int    `json:"vulnerabilities"`
+	Fixable          int    `json:"fixableVulnerabilities"`
+}
+
+// dependencyList is what -dependencies writes.
+type dependencyList struct {
+	Chart        string       `json:"chart"`
+	Version      string       `json:"version,omitempty"`
+	Dependencies []dependency `json:"dependencies"`
+}
+
+// chartDependencies lists the images of a chart result as dependencies.
+func chartDependencies(result chartResult, opts scanOptions) dependencyList {
+	list := dependencyList{Chart: result.Chart, Version: result.Version, Dependencies: []dependency{}}
+	for _, image := range result.Images {
+		ref := parseImageRef(image.Scan.Image)
+		d := dependency{
+			DepName:       stripTag(image.Scan.Image),
+			CurrentValue:  ref.Tag,
+			CurrentDigest: ref.Digest,
+			Datasource:    "docker",
+		}
+		for _, v := range image.Report.vulnerabilities() {
+			d.Vulnerabilities++
+			if v.FixedVersion != "" {
+				d.Fixable++
+			}
+		}
+		if d.Fixable > 0 {
+			d.SuggestedVersion = suggestedTag(image.Scan.Image, opts)
+		}
+		list.Dependencies = append(list.Dependencies, d)
+	}
+	return list
+}
+
+// writeDependencies writes the dependencies of a chart result to path as
+// JSON.
+func writeDependencies(path string, result chartResult, opts scanOptions) error {
+	data, err := json.MarshalIndent(chartDependencies(result, opts), "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(data, '\n'), 0644)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var emailTemplate = template.Must(template.New("email").Parse(`<html>
+<body>
+<h1>{{.Chart}}</h1>
+<p>Risk score: {{printf "%.1f" .Risk}}/100</p>
+<table border="1" cellpadding="4" cellspacing="0">
+<tr><th>Image</th>{{range .Severities}}<th>{{.}}</th>{{end}}<th>Notes</th></tr>
+{{range .Images}}<tr>
+  <td>{{.Name}}</td>{{range .Counts}}<td>{{.}}</td>{{end}}
+  <td>{{range .Notes}}{{.}}<br>{{end}}</td>
+</tr>{{end}}
+</table>
+</body>
+</html>
+`))
+
+type emailImage struct {
+	Name   string
+	Counts []int
+	Notes  []string
+}
+
+// emailImages sums up each image for the report mail.
+func emailImages(reports []trivyReport) []emailImage {
+	images := []emailImage{}
+	for _, report := range reports {
+		counts := countBySeverity(report.vulnerabilities())
+		image := emailImage{Name: chartImage{Name: report.ArtifactName, Labels: report.Labels}.String()}
+		for _, severity := range severities {
+			image.Counts = append(image.Counts, counts[severity])
+		}
+		if os := report.Metadata.OS; os != nil && os.EOSL {
+			image.Notes = append(image.Notes, fmt.Sprintf("end of life OS %s %s", os.Family, os.Name))
+		}
+		for _, violation := range report.Violations {
+			image.Notes = append(image.Notes, "policy violation: "+violation)
+		}
+		images = append(images, image)
+	}
+	return images
+}
+
+// reportMail builds the summary mail of a chart scan, with a plain text and
+// an HTML version.
+func reportMail(chart string, reports []trivyReport, opts scanOptions) ([]byte, error) {
+	weights, _ := parseRiskWeights(opts.riskWeights)
+	risk := riskScore(reports, weights)
+	images := emailImages(reports)
+
+	var text bytes.Buffer
+	fmt.Fprintf(&text, "%s\n\nRisk score: %.1f/100\n\n", chart, risk)
+	for _, image := range images {
+		counts := []string{}
+		for i, severity := range severities {
+			counts = append(counts, fmt.Sprintf("%s: %d", severity, image.Counts[i]))
+		}
+		fmt.Fprintf(&text, "%s\n  %s\n", image.Name, strings.Join(counts, ", "))
+		for _, note := range image.Notes {
+			fmt.Fprintf(&text, "  %s\n", note)
+		}
+	}
+	var html bytes.Buffer
+	err := emailTemplate.Execute(&html, struct {
+		Chart      string
+		Risk       float64
+		Severities []string
+		Images     []emailImage
+	}{chart, risk, severities, images})
+	if err != nil {
+		return nil, err
+	}
+
+	var msg bytes.Buffer
+	w := multipart.NewWriter(&msg)
+	fmt.Fprintf(&msg, "From: %s\r\n", opts.emailFrom)
+	fmt.Fprintf(&msg, "To: %s\r\n", opts.emailTo)
+	fmt.Fprintf(&msg, "Subject: helm-trivy report for %s: risk score %.1f/100\r\n", chart, risk)
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", w.Boundary())
+	for _, part := range []struct {
+		contentType string
+		body        []byte
+	}{{"text/plain", text.Bytes()}, {"text/html", html.Bytes()}} {
+		pw, err := w.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType + "; charset=utf-8"},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		qw := quotedprintable.NewWriter(pw)
+		if _, err := qw.Write(part.body); err != nil {
+			return nil, err
+		}
+		qw.Close()
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return msg.Bytes(), nil
+}
+
+// defaultEmailFrom returns helm-trivy@<hostname>.
+func defaultEmailFrom() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+	return "helm-trivy@" + host
+}
+
+// emailReport mails the summary of a chart scan through the SMTP server of
+// opts. The connection is upgraded with STARTTLS when the server offers it.
+func emailReport(result chartResult, opts scanOptions) error {
+	msg, err := reportMail(result.Chart, result.reports(), opts)
+	if err != nil {
+		return err
+	}
+	var auth smtp.Auth
+	if opts.smtpUser != "" {
+		host, _, err := net.SplitHostPort(opts.smtpServer)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", opts.smtpUser, opts.smtpPassword, host)
+	}
+	to := []string{}
+	for _, address := range strings.Split(opts.emailTo, ",") {
+		if address = strings.TrimSpace(address); address != "" {
+			to = append(to, address)
+		}
+	}
+	if err := smtp.SendMail(opts.smtpServer, auth, opts.emailFrom, to, msg); err != nil {
+		return err
+	}
+	log.Infof("Mailed the report to %v", opts.emailTo)
+	return nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// event is a line of the -events stream.
+type event struct {
+	Time       time.Time      `json:"time"`
+	Type       string         `json:"type"`
+	Chart      string         `json:"chart,omitempty"`
+	Image      string         `json:"image,omitempty"`
+	Counts     map[string]int `json:"counts,omitempty"`
+	Violations []string       `json:"violations,omitempty"`
+	Images     int            `json:"images,omitempty"`
+	Failed     int            `json:"failed,omitempty"`
+	Duration   float64        `json:"duration,omitempty"`
+	Error      string         `json:"error,omitempty"`
+}
+
+// eventStream writes events as newline delimited JSON. A nil stream drops
+// them.
+type eventStream struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// openEventStream opens the destination of -events-file: a path, fd:N for
+// an open file descriptor, or stderr when empty.
+func openEventStream(format string, dest string) (*eventStream, error) {
+	if format != "ndjson" {
+		return nil, fmt.Errorf("unknown event format %v", format)
+	}
+	if dest == "" {
+		return &eventStream{w: os.Stderr}, nil
+	}
+	if strings.HasPrefix(dest, "fd:") {
+		fd, err := strconv.Atoi(strings.TrimPrefix(dest, "fd:"))
+		if err != nil || fd < 0 {
+			return nil, fmt.Errorf("invalid file descriptor %v", dest)
+		}
+		return &eventStream{w: os.NewFile(uintptr(fd), dest)}, nil
+	}
+	f, err := os.Create(dest)
+	if err != nil {
+		return nil, err
+	}
+	return &eventStream{w: f}, nil
+}
+
+// emit writes e, stamped with the current time, with secrets masked. Write
+// errors are ignored, events should never fail a scan.
+func (s *eventStream) emit(e event) {
+	if s == nil {
+		return
+	}
+	e.Time = time.Now().UTC()
+	data, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	io.WriteString(s.w, redact(string(data))+"\n")
+}
+
+// imageScanned returns the image_scanned event of scan.
+func imageScanned(chart string, scan imageScan) event {
+	e := event{Type: "image_scanned", Chart: chart, Image: scan.Image, Violations: scan.Violations, Counts: map[string]int{}}
+	for severity, count := range countBySeverity(scan.Report.vulnerabilities()) {
+		e.Counts[severity] = count
+	}
+	return e
+}
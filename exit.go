@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Exit statuses of helm-trivy, see the Exit codes section of the README.
+const (
+	exitOK       = 0
+	exitFindings = 1
+	exitUsage    = 2
+	exitRender   = 3
+	exitBackend  = 4
+	exitPartial  = 5
+)
+
+// exitError is an error carrying the exit status it should end helm-trivy
+// with.
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string {
+	return e.err.Error()
+}
+
+// withExitCode returns an error ending helm-trivy with code.
+func withExitCode(code int, format string, args ...interface{}) error {
+	return &exitError{code: code, err: fmt.Errorf(format, args...)}
+}
+
+// exitCode returns the exit status err should end helm-trivy with.
+func exitCode(err error) int {
+	if e, ok := err.(*exitError); ok {
+		return e.code
+	}
+	return exitBackend
+}
+
+// validateFailOn checks the value of -fail-on.
+func validateFailOn(failOn string) error {
+	switch failOn {
+	case "", "findings", "errors", "none":
+		return nil
+	}
+	return fmt.Errorf("unknown -fail-on value %v, expected findings, errors or none", failOn)
+}
+
+// exitStatus returns the status helm-trivy ends with for code: exitOK when
+// -fail-on says this kind of outcome doesn't fail the command. Usage errors
+// always do.
+func exitStatus(code int, opts scanOptions) int {
+	switch {
+	case code == exitUsage:
+	case opts.failOn == "none":
+		code = exitOK
+	case opts.failOn == "errors" && code == exitFindings:
+		code = exitOK
+	}
+	return code
+}
+
+// cleanups are the functions run before helm-trivy exits, os.Exit skipping
+// deferred calls.
+var cleanups struct {
+	sync.Mutex
+	funcs []func()
+}
+
+// atExit registers f to run before helm-trivy exits, and returns a function
+// running it now, at most once in both cases.
+func atExit(f func()) func() {
+	var once sync.Once
+	run := func() { once.Do(f) }
+	cleanups.Lock()
+	cleanups.funcs = append(cleanups.funcs, run)
+	cleanups.Unlock()
+	return run
+}
+
+// runCleanups runs the functions registered with atExit, last first.
+func runCleanups() {
+	cleanups.Lock()
+	funcs := cleanups.funcs
+	cleanups.funcs = nil
+	cleanups.Unlock()
+	for i := len(funcs) - 1; i >= 0; i-- {
+		funcs[i]()
+	}
+}
+
+// exit ends helm-trivy with the exitStatus of code, after running the
+// cleanups registered with atExit.
+func exit(code int, opts scanOptions) {
+	status := exitStatus(code, opts)
+	runCleanups()
+	opts.tracer.close(code)
+	os.Exit(status)
+}
+
+// fatal logs an error and ends helm-trivy with code, see exit.
+func fatal(code int, opts scanOptions, format string, args ...interface{}) {
+	log.Errorf(format, args...)
+	exit(code, opts)
+}
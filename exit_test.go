@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{withExitCode(exitRender, "no images found in chart %s", "mariadb"), exitRender},
+		{withExitCode(exitPartial, "could not scan images"), exitPartial},
+		{withExitCode(exitFindings, "post-scan hook failed"), exitFindings},
+		{errors.New("could not create trivy container"), exitBackend},
+	}
+	for _, tt := range tests {
+		if got := exitCode(tt.err); got != tt.want {
+			t.Errorf("exitCode(%v) = %d, want %d", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestExitStatus(t *testing.T) {
+	tests := []struct {
+		code   int
+		failOn string
+		want   int
+	}{
+		{exitOK, "", exitOK},
+		{exitFindings, "", exitFindings},
+		{exitFindings, "findings", exitFindings},
+		{exitFindings, "errors", exitOK},
+		{exitFindings, "none", exitOK},
+		{exitRender, "errors", exitRender},
+		{exitBackend, "errors", exitBackend},
+		{exitPartial, "none", exitOK},
+		{exitUsage, "none", exitUsage},
+		{exitUsage, "errors", exitUsage},
+	}
+	for _, tt := range tests {
+		if got := exitStatus(tt.code, scanOptions{failOn: tt.failOn}); got != tt.want {
+			t.Errorf("exitStatus(%d) with -fail-on %q = %d, want %d", tt.code, tt.failOn, got, tt.want)
+		}
+	}
+}
+
+func TestValidateFailOn(t *testing.T) {
+	tests := []struct {
+		failOn string
+		valid  bool
+	}{
+		{"", true},
+		{"findings", true},
+		{"errors", true},
+		{"none", true},
+		{"warnings", false},
+	}
+	for _, tt := range tests {
+		if err := validateFailOn(tt.failOn); (err == nil) != tt.valid {
+			t.Errorf("validateFailOn(%q) = %v, want valid %v", tt.failOn, err, tt.valid)
+		}
+	}
+}
+
+func TestRunCleanups(t *testing.T) {
+	ran := []string{}
+	atExit(func() { ran = append(ran, "cache") })
+	values := atExit(func() { ran = append(ran, "values") })
+	atExit(func() { ran = append(ran, "clone") })
+	values()
+	runCleanups()
+	runCleanups()
+	if want := []string{"values", "clone", "cache"}; !reflect.DeepEqual(ran, want) {
+		t.Errorf("cleanups ran %v, want %v", ran, want)
+	}
+}
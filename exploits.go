@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	kevURL  = "https://www.cisa.gov/sites/default/files/feeds/known_exploited_vulnerabilities.json"
+	epssURL = "https://api.first.org/data/v1/epss"
+	// exploitDataTTL is how long downloaded EPSS scores and KEV catalogs are
+	// reused before being fetched again, both are updated daily.
+	exploitDataTTL = 24 * time.Hour
+)
+
+// exploitData tells how likely a vulnerability is to be exploited: its EPSS
+// score and whether CISA lists it as known exploited.
+type exploitData struct {
+	EPSS float64 `json:"epss"`
+	KEV  bool    `json:"kev"`
+}
+
+type epssCacheEntry struct {
+	EPSS    float64   `json:"epss"`
+	Fetched time.Time `json:"fetched"`
+}
+
+// userCacheDir returns where data kept between runs is cached: EPSS scores,
+// the KEV catalog and the last scan result of each image.
+func userCacheDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	dir = filepath.Join(dir, "helm-trivy")
+	return dir, os.MkdirAll(dir, 0755)
+}
+
+func fetchJSON(url string, v interface{}) error {
+	resp, err := registryClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %v: %v", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// loadKEV returns the CVEs of the CISA Known Exploited Vulnerabilities
+// catalog, downloading it when the cached copy is too old.
+func loadKEV(cacheDir string) (map[string]bool, error) {
+	var catalog struct {
+		Vulnerabilities []struct {
+			CveID string `json:"cveID"`
+		} `json:"vulnerabilities"`
+	}
+	path := filepath.Join(cacheDir, "kev.json")
+	info, err := os.Stat(path)
+	if err != nil || time.Since(info.ModTime()) > exploitDataTTL {
+		log.Debugf("Downloading KEV catalog from %v", kevURL)
+		if err := fetchJSON(kevURL, &catalog); err != nil {
+			return nil, err
+		}
+		data, _ := json.Marshal(catalog)
+		if err := ioutil.WriteFile(path, data, 0644); err != nil {
+			log.Warnf("Could not cache KEV catalog: %v", err)
+		}
+	} else {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, &catalog); err != nil {
+			return nil, err
+		}
+	}
+	kev := map[string]bool{}
+	for _, v := range catalog.Vulnerabilities {
+		kev[v.CveID] = true
+	}
+	return kev, nil
+}
+
+// loadEPSS returns the EPSS scores of cves, only asking FIRST for those that
+// are not cached or too old.
+func loadEPSS(cacheDir string, cves []string) (map[string]float64, error) {
+	path := filepath.Join(cacheDir, "epss.json")
+	cache := map[string]epssCacheEntry{}
+	if data, err := ioutil.ReadFile(path); err == nil {
+		if err := json.Unmarshal(data, &cache); err != nil {
+			log.Warnf("Ignoring invalid EPSS cache: %v", err)
+		}
+	}
+	missing := []string{}
+	for _, cve := range cves {
+		if entry, ok := cache[cve]; !ok || time.Since(entry.Fetched) > exploitDataTTL {
+			missing = append(missing, cve)
+		}
+	}
+	// The API takes up to 100 CVEs per request.
+	for len(missing) > 0 {
+		batch := missing
+		if len(batch) > 100 {
+			batch = batch[:100]
+		}
+		missing = missing[len(batch):]
+		var resp struct {
+			Data []struct {
+				CVE  string `json:"cve"`
+				EPSS string `json:"epss"`
+			} `json:"data"`
+		}
+		log.Debugf("Fetching EPSS scores of %d CVEs", len(batch))
+		if err := fetchJSON(epssURL+"?cve="+strings.Join(batch, ","), &resp); err != nil {
+			return nil, err
+		}
+		now := time.Now()
+		for _, cve := range batch {
+			cache[cve] = epssCacheEntry{Fetched: now}
+		}
+		for _, d := range resp.Data {
+			score, _ := strconv.ParseFloat(d.EPSS, 64)
+			cache[d.CVE] = epssCacheEntry{EPSS: score, Fetched: now}
+		}
+	}
+	if data, err := json.Marshal(cache); err == nil {
+		if err := ioutil.WriteFile(path, data, 0644); err != nil {
+			log.Warnf("Could not cache EPSS scores: %v", err)
+		}
+	}
+	scores := map[string]float64{}
+	for _, cve := range cves {
+		scores[cve] = cache[cve].EPSS
+	}
+	return scores, nil
+}
+
+// loadExploitData gets the EPSS score and KEV status of every CVE found in
+// reports.
+func loadExploitData(reports []trivyReport) (map[string]exploitData, error) {
+	cacheDir, err := userCacheDir()
+	if err != nil {
+		return nil, err
+	}
+	cves := []string{}
+	seen := map[string]bool{}
+	for _, report := range reports {
+		for _, v := range report.vulnerabilities() {
+			if strings.HasPrefix(v.VulnerabilityID, "CVE-") && !seen[v.VulnerabilityID] {
+				seen[v.VulnerabilityID] = true
+				cves = append(cves, v.VulnerabilityID)
+			}
+		}
+	}
+	kev, err := loadKEV(cacheDir)
+	if err != nil {
+		return nil, fmt.Errorf("could not load KEV catalog: %v", err)
+	}
+	scores, err := loadEPSS(cacheDir, cves)
+	if err != nil {
+		return nil, fmt.Errorf("could not load EPSS scores: %v", err)
+	}
+	data := map[string]exploitData{}
+	for _, cve := range cves {
+		data[cve] = exploitData{EPSS: scores[cve], KEV: kev[cve]}
+	}
+	return data, nil
+}
+
+// enrichReports sets the exploit data of every vulnerability of reports.
+func enrichReports(reports []trivyReport, data map[string]exploitData) {
+	for _, report := range reports {
+		for _, result := range report.Results {
+			for i := range result.Vulnerabilities {
+				v := &result.Vulnerabilities[i]
+				v.EPSS, v.KEV = data[v.VulnerabilityID].EPSS, data[v.VulnerabilityID].KEV
+			}
+		}
+	}
+}
+
+// hasKEV tells whether any vulnerability of reports is known exploited.
+func hasKEV(reports []trivyReport, types string) bool {
+	for _, report := range reports {
+		for _, v := range report.gatedVulnerabilities(types) {
+			if v.KEV {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// genericFinding follows the Generic Findings Import format of DefectDojo,
+// which most vulnerability management tools can import as well.
+type genericFinding struct {
+	Title            string `json:"title"`
+	Description      string `json:"description"`
+	Severity         string `json:"severity"`
+	Mitigation       string `json:"mitigation,omitempty"`
+	References       string `json:"references,omitempty"`
+	CVE              string `json:"cve,omitempty"`
+	ComponentName    string `json:"component_name"`
+	ComponentVersion string `json:"component_version"`
+	Service          string `json:"service"`
+	UniqueID         string `json:"unique_id_from_tool"`
+	VulnIDFromTool   string `json:"vuln_id_from_tool"`
+}
+
+// findingSeverities maps trivy severities to DefectDojo ones.
+var findingSeverities = map[string]string{
+	"CRITICAL": "Critical",
+	"HIGH":     "High",
+	"MEDIUM":   "Medium",
+	"LOW":      "Low",
+	"UNKNOWN":  "Info",
+}
+
+// genericFindings returns one finding per vulnerable package of each image.
+func genericFindings(reports []trivyReport) []genericFinding {
+	findings := []genericFinding{}
+	for _, report := range reports {
+		for _, v := range report.vulnerabilities() {
+			severity, ok := findingSeverities[v.Severity]
+			if !ok {
+				severity = "Info"
+			}
+			description := []string{}
+			for _, s := range []string{v.Title, v.Description, "Image: " + report.ArtifactName} {
+				if s = strings.TrimSpace(s); s != "" {
+					description = append(description, s)
+				}
+			}
+			f := genericFinding{
+				Title:            fmt.Sprintf("%s in %s %s", v.VulnerabilityID, v.PkgName, v.InstalledVersion),
+				Description:      strings.Join(description, "\n\n"),
+				Severity:         severity,
+				References:       v.PrimaryURL,
+				ComponentName:    v.PkgName,
+				ComponentVersion: v.InstalledVersion,
+				Service:          report.ArtifactName,
+				UniqueID:         report.ArtifactName + "/" + v.PkgName + "/" + v.VulnerabilityID,
+				VulnIDFromTool:   v.VulnerabilityID,
+			}
+			if strings.HasPrefix(v.VulnerabilityID, "CVE-") {
+				f.CVE = v.VulnerabilityID
+			}
+			if v.FixedVersion != "" {
+				f.Mitigation = fmt.Sprintf("Upgrade %s to %s", v.PkgName, v.FixedVersion)
+			}
+			findings = append(findings, f)
+		}
+	}
+	return findings
+}
+
+// exportFindings writes the findings of a chart scan in the generic format,
+// or imports them into DefectDojo.
+func exportFindings(result chartResult, opts scanOptions) error {
+	data, err := json.MarshalIndent(map[string]interface{}{"findings": genericFindings(result.reports())}, "", "  ")
+	if err != nil {
+		return err
+	}
+	switch opts.export {
+	case "generic":
+		return ioutil.WriteFile(opts.exportFile, data, 0644)
+	case "defectdojo":
+		return importDefectDojo(result.Chart, data, opts)
+	}
+	return fmt.Errorf("unknown export format %v", opts.export)
+}
+
+// importDefectDojo imports findings with the import-scan API. The chart is
+// the engagement, created along with the product when needed.
+func importDefectDojo(chart string, findings []byte, opts scanOptions) error {
+	product := opts.ddProduct
+	if product == "" {
+		product = chart
+	}
+	engagement := chart
+	if opts.chartVersion != "" {
+		engagement += " " + opts.chartVersion
+	}
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	for _, field := range [][2]string{
+		{"scan_type", "Generic Findings Import"},
+		{"product_type_name", "Helm charts"},
+		{"product_name", product},
+		{"engagement_name", engagement},
+		{"auto_create_context", "true"},
+		{"close_old_findings", "true"},
+		{"active", "true"},
+		{"verified", "false"},
+	} {
+		if err := w.WriteField(field[0], field[1]); err != nil {
+			return err
+		}
+	}
+	part, err := w.CreateFormFile("file", "helm-trivy.json")
+	if err != nil {
+		return err
+	}
+	if _, err := part.Write(findings); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	url := strings.TrimSuffix(opts.ddURL, "/") + "/api/v2/import-scan/"
+	req, err := http.NewRequest(http.MethodPost, url, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	req.Header.Set("Authorization", "Token "+opts.ddAPIKey)
+	resp, err := registryClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("POST %v: %v: %s", url, resp.Status, bytes.TrimSpace(msg))
+	}
+	log.Infof("Imported findings into DefectDojo product %v, engagement %v", product, engagement)
+	return nil
+}
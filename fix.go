@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	"gopkg.in/yaml.v3"
+)
+
+// imageBump is the new tag of an image of a chart, and the vulnerabilities
+// it fixes.
+type imageBump struct {
+	Image string
+	Tag   string
+	Fixed []string
+}
+
+// fixableVulnerabilities returns the IDs of the vulnerabilities of image
+// having a fix, leaving out the accepted ones.
+func fixableVulnerabilities(image chartImage, report trivyReport, opts scanOptions) map[string]bool {
+	report, _ = applyIgnores(image, report, opts.ignores, time.Now())
+	fixable := map[string]bool{}
+	for _, v := range report.vulnerabilities() {
+		if v.FixedVersion != "" {
+			fixable[v.VulnerabilityID] = true
+		}
+	}
+	return fixable
+}
+
+// nearestFix scans the tags of the same variant and major version as image
+// more recent than its own, oldest first, and returns the first one without
+// any of the fixable vulnerabilities, or "" if none of the first
+// maxCandidates tags fixes them all.
+func nearestFix(image chartImage, fixable map[string]bool, ctx context.Context, backend scanBackend, opts scanOptions, maxCandidates int) (string, error) {
+	tags, err := listTags(rewriteImage(image.Name, opts.imageRewrites), opts)
+	if err != nil {
+		return "", fmt.Errorf("could not list tags of %v: %v", image.Name, err)
+	}
+	candidates := newerTags(parseImageRef(image.Name).Tag, tags)
+	if len(candidates) > maxCandidates {
+		candidates = candidates[:maxCandidates]
+	}
+	for _, tag := range candidates {
+		candidate := chartImage{Name: stripTag(image.Name) + ":" + tag, Labels: image.Labels, Charts: image.Charts}
+		report, err := scanImageCached(candidate.Name, ctx, backend, opts)
+		if err != nil {
+			log.Warnf("Could not scan %v: %v", candidate.Name, err)
+			continue
+		}
+		report, _ = applyIgnores(candidate, report, opts.ignores, time.Now())
+		fixed := true
+		for _, v := range report.vulnerabilities() {
+			if fixable[v.VulnerabilityID] {
+				fixed = false
+				break
+			}
+		}
+		if fixed {
+			return tag, nil
+		}
+		log.Debugf("%v does not fix all the vulnerabilities of %v", tag, image.Name)
+	}
+	return "", nil
+}
+
+// valueNode returns the scalar node at path of a YAML document, nil if there
+// is none.
+func valueNode(doc *yaml.Node, path []string) *yaml.Node {
+	node := doc
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+	for _, key := range path {
+		if node.Kind != yaml.MappingNode {
+			return nil
+		}
+		if node = mappingValue(node, key); node == nil {
+			return nil
+		}
+	}
+	if node.Kind != yaml.ScalarNode {
+		return nil
+	}
+	return node
+}
+
+// setYAMLValue sets the scalar at path of a YAML file in place, its
+// comments and formatting kept as they are. It tells whether the file has
+// a value at path.
+func setYAMLValue(file string, path []string, value func(old string) string) (bool, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return false, err
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return false, fmt.Errorf("invalid %v: %v", file, err)
+	}
+	node := valueNode(&doc, path)
+	if node == nil || node.Value == "" {
+		return false, nil
+	}
+	quote := ""
+	switch node.Style {
+	case yaml.DoubleQuotedStyle:
+		quote = `"`
+	case yaml.SingleQuotedStyle:
+		quote = "'"
+	case 0:
+		// Plain scalar.
+	default:
+		return false, fmt.Errorf("can't edit %v of %v, only single line values are", setPath(path), file)
+	}
+	lines := strings.SplitAfter(string(data), "\n")
+	line := []rune(lines[node.Line-1])
+	old := []rune(quote + node.Value + quote)
+	start := node.Column - 1
+	if start+len(old) > len(line) || string(line[start:start+len(old)]) != string(old) {
+		return false, fmt.Errorf("can't edit %v of %v, it has escaped characters", setPath(path), file)
+	}
+	updated := value(node.Value)
+	if quote == "" {
+		// Tags like 1.10 would be read as numbers.
+		var v interface{}
+		if yaml.Unmarshal([]byte(updated), &v) != nil || v != updated {
+			updated = strconv.Quote(updated)
+		}
+	} else {
+		updated = quote + updated + quote
+	}
+	lines[node.Line-1] = string(line[:start]) + updated + string(line[start+len(old):])
+	return true, ioutil.WriteFile(file, []byte(strings.Join(lines, "")), 0644)
+}
+
+var patchVersion = regexp.MustCompile(`^(v?[0-9]+\.[0-9]+\.)([0-9]+)$`)
+
+// bumpChart sets the tag of image in the values.yaml of chart, or in the
+// appVersion of its Chart.yaml when the values leave the tag to it.
+func bumpChart(chart string, image string, v valuesImage, tag string) error {
+	if !v.Split {
+		set, err := setYAMLValue(filepath.Join(chart, "values.yaml"), v.Path, func(old string) string {
+			return stripTag(old) + ":" + tag
+		})
+		if err == nil && !set {
+			err = fmt.Errorf("%v is not set in values.yaml", setPath(v.Path))
+		}
+		return err
+	}
+	set, err := setYAMLValue(filepath.Join(chart, "values.yaml"), copyPath(v.Path, "tag"), func(string) string { return tag })
+	if err != nil || set {
+		return err
+	}
+	current := parseImageRef(image).Tag
+	matched := false
+	set, err = setYAMLValue(filepath.Join(chart, "Chart.yaml"), []string{"appVersion"}, func(old string) string {
+		if old != current {
+			return old
+		}
+		matched = true
+		return tag
+	})
+	if err == nil && !(set && matched) {
+		err = fmt.Errorf("the tag of %v is not set in values.yaml nor Chart.yaml", setPath(v.Path))
+	}
+	return err
+}
+
+// bumpChartVersion increments the patch version of chart, for the changed
+// chart to be published.
+func bumpChartVersion(chart string) error {
+	bumped := false
+	_, err := setYAMLValue(filepath.Join(chart, "Chart.yaml"), []string{"version"}, func(old string) string {
+		m := patchVersion.FindStringSubmatch(old)
+		if m == nil {
+			return old
+		}
+		patch, _ := strconv.Atoi(m[2])
+		bumped = true
+		return m[1] + strconv.Itoa(patch+1)
+	})
+	if err == nil && !bumped {
+		log.Warnf("Chart version of %v is not a plain x.y.z version, it is not bumped", chart)
+	}
+	return err
+}
+
+// fixChart bumps the images of a local chart with fixable vulnerabilities to
+// the nearest tag fixing them, editing its values.yaml and Chart.yaml. It
+// returns the bumps, and the number of images left with fixable
+// vulnerabilities.
+func fixChart(chart string, ctx context.Context, backend scanBackend, opts scanOptions, maxCandidates int) ([]imageBump, int, error) {
+	err, images := getChartImages(chart, opts)
+	if err != nil {
+		return nil, 0, withExitCode(exitRender, "could not find images for chart %v: %v", chart, err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(chart, "values.yaml"))
+	if err != nil {
+		return nil, 0, withExitCode(exitRender, "could not read values of chart %v: %v", chart, err)
+	}
+	defaults := map[string]interface{}{}
+	if err := yaml.Unmarshal(data, &defaults); err != nil {
+		return nil, 0, withExitCode(exitRender, "invalid values of chart %v: %v", chart, err)
+	}
+	values := findValuesImages(defaults, nil)
+	bumps := []imageBump{}
+	unfixed := 0
+	for _, image := range images {
+		report, err := scanImageCached(image.Name, ctx, backend, opts)
+		if err != nil {
+			return nil, 0, withExitCode(exitBackend, "could not scan image %v: %v", image.Name, err)
+		}
+		fixable := fixableVulnerabilities(image, report, opts)
+		if len(fixable) == 0 {
+			continue
+		}
+		v, ok := imageValues(values, image.Name)
+		if !ok || parseImageRef(image.Name).Digest != "" {
+			log.Warnf("%v has %d fixable vulnerabilities, but its tag is not set in values.yaml", image.Name, len(fixable))
+			unfixed++
+			continue
+		}
+		tag, err := nearestFix(image, fixable, ctx, backend, opts, maxCandidates)
+		if err != nil {
+			log.Warnf("No fix for %v: %v", image.Name, err)
+			unfixed++
+			continue
+		}
+		if tag == "" {
+			log.Warnf("No tag of %v fixes its %d fixable vulnerabilities", image.Name, len(fixable))
+			unfixed++
+			continue
+		}
+		if err := bumpChart(chart, image.Name, v, tag); err != nil {
+			log.Warnf("Could not bump %v: %v", image.Name, err)
+			unfixed++
+			continue
+		}
+		bump := imageBump{Image: image.Name, Tag: tag}
+		for id := range fixable {
+			bump.Fixed = append(bump.Fixed, id)
+		}
+		sort.Strings(bump.Fixed)
+		log.Infof("Bumped %v to %v, fixing %d vulnerabilities", image.Name, tag, len(bump.Fixed))
+		bumps = append(bumps, bump)
+	}
+	if len(bumps) > 0 {
+		if err := bumpChartVersion(chart); err != nil {
+			return bumps, unfixed, withExitCode(exitRender, "could not bump version of chart %v: %v", chart, err)
+		}
+	}
+	return bumps, unfixed, nil
+}
+
+// describeBumps returns the body of the commit and pull request of bumps.
+func describeBumps(bumps []imageBump) string {
+	var b strings.Builder
+	b.WriteString("Images bumped to the nearest tag fixing their fixable vulnerabilities, found by helm trivy fix:\n\n")
+	for _, bump := range bumps {
+		fmt.Fprintf(&b, "- %v to %v, fixing %v\n", bump.Image, bump.Tag, strings.Join(bump.Fixed, ", "))
+	}
+	return b.String()
+}
+
+// git runs git in dir.
+func git(dir string, args ...string) (string, error) {
+	log.Debugf("Running git cmd: git %v", args)
+	cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("git %v: %v: %v", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return string(out), nil
+}
+
+// openPullRequest commits the changes of the clone in dir to branch, pushes
+// it and opens a pull request with the GitHub CLI.
+func openPullRequest(dir string, branch string, title string, body string) error {
+	steps := [][]string{
+		{"checkout", "-b", branch},
+		{"add", "-A"},
+		{"commit", "-m", title + "\n\n" + body},
+		{"push", "--set-upstream", "origin", branch},
+	}
+	for _, step := range steps {
+		if _, err := git(dir, step...); err != nil {
+			return err
+		}
+	}
+	cmd := exec.Command("gh", "pr", "create", "--head", branch, "--title", title, "--body", body)
+	cmd.Dir = dir
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+func fixMain(args []string) {
+	var opts scanOptions
+	var repo string
+	var branch string
+	var pullRequest bool
+	var maxCandidates int
+
+	fs := flag.NewFlagSet("fix", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: helm trivy fix [options] <chart directory>\n")
+		fmt.Fprintf(fs.Output(), "Example: helm trivy fix -repo git@github.com:corp/charts.git -pull-request charts/mariadb\n\n")
+		fmt.Fprintf(fs.Output(), "Options:\n")
+		fs.PrintDefaults()
+	}
+	fs.StringVar(&repo, "repo", "", "Git repository cloned to fix the chart, the chart directory being relative to it, the chart is fixed in place if empty")
+	fs.StringVar(&branch, "branch", "helm-trivy-fix", "Branch of the -pull-request changes")
+	fs.BoolVar(&pullRequest, "pull-request", false, "Push the changes to a branch of -repo and open a pull request with the GitHub CLI")
+	fs.IntVar(&maxCandidates, "max-candidates", 5, "Maximum number of newer tags of an image scanned looking for a fix")
+	fs.StringVar(&opts.templateSet, "set", "", "Values to set for helm chart, format: 'key1=value1,key2=value2'")
+	fs.StringVar(&opts.templateValues, "values", "", "Specify chart values in a YAML file or a URL")
+	fs.StringVar(&opts.severity, "severity", "", "Comma separated severities of the vulnerabilities to fix, all if empty")
+	fs.StringVar(&opts.ignoreFile, "ignore-file", "", "File of accepted vulnerabilities, one per line: <ID> [image=...] [chart=...] [until=YYYY-MM-DD] [reason=...]")
+	addScannerFlags(fs, &opts)
+	fs.Parse(args)
+	opts.setFlags = setFlags(fs)
+
+	if fs.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "Error: A chart directory is needed.\n")
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	if pullRequest && repo == "" {
+		fmt.Fprintf(os.Stderr, "Error: -pull-request needs -repo.\n")
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	if maxCandidates < 1 {
+		fmt.Fprintf(os.Stderr, "Error: -max-candidates must be positive.\n")
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+
+	ctx, backend, cleanup := setupScanner(&opts)
+	defer cleanup()
+
+	dir, chart := "", fs.Arg(0)
+	if repo != "" {
+		clone, err := ioutil.TempDir("", "helm-trivy-fix")
+		if err != nil {
+			fatal(exitBackend, opts, "%v", err)
+		}
+		defer atExit(func() { os.RemoveAll(clone) })()
+		log.Infof("Cloning %v", repo)
+		if _, err := git(clone, "clone", "--depth", "1", repo, "."); err != nil {
+			fatal(exitRender, opts, "Could not clone %v: %v", repo, err)
+		}
+		dir, chart = clone, filepath.Join(clone, fs.Arg(0))
+	}
+	opts.scanMemo = newScanMemo()
+
+	bumps, unfixed, err := fixChart(chart, ctx, backend, opts, maxCandidates)
+	if err != nil {
+		fatal(exitCode(err), opts, "Could not fix chart %v: %v", fs.Arg(0), err)
+	}
+	if len(bumps) == 0 {
+		log.Info("No image to bump")
+	} else if diff, err := git(chart, "diff", "--", "."); err != nil {
+		log.Warnf("Could not diff the changes: %v", err)
+	} else {
+		fmt.Print(diff)
+	}
+	if len(bumps) > 0 && pullRequest {
+		title := fmt.Sprintf("Bump images of %v fixing vulnerabilities", filepath.Base(chart))
+		if err := openPullRequest(dir, branch, title, describeBumps(bumps)); err != nil {
+			fatal(exitPartial, opts, "Could not open pull request: %v", err)
+		}
+	}
+	if unfixed > 0 {
+		exit(exitFindings, opts)
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	"gopkg.in/yaml.v3"
+)
+
+// fleetHelm is the helm section of a fleet.yaml, or of one of its target
+// customizations.
+type fleetHelm struct {
+	Chart       string                 `yaml:"chart"`
+	Repo        string                 `yaml:"repo"`
+	Version     string                 `yaml:"version"`
+	ReleaseName string                 `yaml:"releaseName"`
+	Values      map[string]interface{} `yaml:"values"`
+	ValuesFiles []string               `yaml:"valuesFiles"`
+}
+
+// fleetBundle is the fleet.yaml of a Fleet bundle, with the fields
+// helm-trivy uses.
+type fleetBundle struct {
+	DefaultNamespace     string    `yaml:"defaultNamespace"`
+	Namespace            string    `yaml:"namespace"`
+	Helm                 fleetHelm `yaml:"helm"`
+	TargetCustomizations []struct {
+		Name string    `yaml:"name"`
+		Helm fleetHelm `yaml:"helm"`
+	} `yaml:"targetCustomizations"`
+}
+
+// findFleetBundles returns the directories of root holding a fleet.yaml,
+// sorted.
+func findFleetBundles(root string) ([]string, error) {
+	bundles := []string{}
+	err := filepath.Walk(root, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && info.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		if !info.IsDir() && info.Name() == "fleet.yaml" {
+			bundles = append(bundles, filepath.Dir(file))
+		}
+		return nil
+	})
+	sort.Strings(bundles)
+	return bundles, err
+}
+
+// bundleManifests returns the YAML files of a bundle of plain manifests,
+// leaving out its fleet.yaml and the bundles nested in it.
+func bundleManifests(dir string, bundles map[string]bool) ([]string, error) {
+	files := []string{}
+	err := filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && file != dir && (bundles[file] || info.Name() == ".git") {
+			return filepath.SkipDir
+		}
+		ext := strings.ToLower(filepath.Ext(file))
+		if !info.IsDir() && info.Name() != "fleet.yaml" && (ext == ".yaml" || ext == ".yml") {
+			files = append(files, file)
+		}
+		return nil
+	})
+	sort.Strings(files)
+	return files, err
+}
+
+// withTarget returns the helm section of a bundle with the target
+// customization named target applied, as Fleet does for the clusters it
+// matches.
+func (b fleetBundle) withTarget(target string) fleetHelm {
+	helm := b.Helm
+	for _, t := range b.TargetCustomizations {
+		if t.Name != target {
+			continue
+		}
+		if t.Helm.Chart != "" {
+			helm.Chart = t.Helm.Chart
+		}
+		if t.Helm.Repo != "" {
+			helm.Repo = t.Helm.Repo
+		}
+		if t.Helm.Version != "" {
+			helm.Version = t.Helm.Version
+		}
+		values := map[string]interface{}{}
+		mergeValues(values, helm.Values)
+		mergeValues(values, t.Helm.Values)
+		helm.Values = values
+		helm.ValuesFiles = append(append([]string{}, helm.ValuesFiles...), t.Helm.ValuesFiles...)
+		break
+	}
+	return helm
+}
+
+// scanFleetBundle scans the bundle of dir, for the clusters of target if not
+// empty: its helm chart, local or from a repository, rendered with its
+// values files and values, or else the chart or the plain manifests of the
+// bundle directory.
+func scanFleetBundle(root string, dir string, bundles map[string]bool, target string, ctx context.Context, backend scanBackend, opts scanOptions) (releaseResult, error) {
+	name, err := filepath.Rel(root, dir)
+	if err != nil || name == "." {
+		name = filepath.Base(dir)
+	}
+	release := releaseResult{Release: helmRelease{Name: filepath.ToSlash(name)}}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "fleet.yaml"))
+	if err != nil {
+		return release, withExitCode(exitRender, "%v", err)
+	}
+	var bundle fleetBundle
+	if err := yaml.Unmarshal(data, &bundle); err != nil {
+		return release, withExitCode(exitRender, "invalid fleet.yaml: %v", err)
+	}
+	release.Release.Namespace = bundle.Namespace
+	if release.Release.Namespace == "" {
+		release.Release.Namespace = bundle.DefaultNamespace
+	}
+	if release.Release.Namespace == "" {
+		release.Release.Namespace = "default"
+	}
+	helm := bundle.withTarget(target)
+	if helm.ReleaseName != "" {
+		release.Release.Name = helm.ReleaseName
+	}
+
+	chart := helm.Chart
+	if chart != "" && helm.Repo == "" && !strings.Contains(chart, "://") {
+		// Local charts are relative to the bundle.
+		if _, err := os.Stat(filepath.Join(dir, chart)); err == nil {
+			chart = filepath.Join(dir, chart)
+		}
+	}
+	if chart == "" {
+		if _, err := os.Stat(filepath.Join(dir, "Chart.yaml")); err == nil {
+			chart = dir
+		}
+	}
+	if chart == "" {
+		if _, err := os.Stat(filepath.Join(dir, "kustomization.yaml")); err == nil {
+			return release, withExitCode(exitRender, "kustomize bundles are not supported")
+		}
+		files, err := bundleManifests(dir, bundles)
+		if err != nil {
+			return release, withExitCode(exitRender, "%v", err)
+		}
+		if len(files) == 0 {
+			return release, withExitCode(exitRender, "no chart nor manifests in bundle")
+		}
+		release.Release.Chart = "manifests"
+		opts.manifestFiles = files
+		return scanReleaseChart(release, dir, ctx, backend, opts)
+	}
+
+	release.Release.Chart = helm.Chart
+	if release.Release.Chart == "" {
+		release.Release.Chart = release.Release.Name
+	}
+	if helm.Version != "" {
+		release.Release.Chart += " " + helm.Version
+	}
+	opts.chartRepo = helm.Repo
+	opts.chartVersion = helm.Version
+	files := []string{}
+	for _, file := range helm.ValuesFiles {
+		files = append(files, filepath.Join(dir, file))
+	}
+	if len(helm.Values) > 0 {
+		values, err := yaml.Marshal(helm.Values)
+		if err != nil {
+			return release, err
+		}
+		file, err := writeTempFile("helm-trivy-values", values)
+		if err != nil {
+			return release, err
+		}
+		defer os.Remove(file)
+		files = append(files, file)
+	}
+	opts.templateValues = strings.Join(files, ",")
+	return scanReleaseChart(release, chart, ctx, backend, opts)
+}
+
+func fleetMain(args []string) {
+	var opts scanOptions
+	var view string
+	var target string
+
+	fs := flag.NewFlagSet("fleet", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: helm trivy fleet [options] <directory>...\n")
+		fmt.Fprintf(fs.Output(), "Example: helm trivy fleet -target production ./fleet-repo\n\n")
+		fmt.Fprintf(fs.Output(), "Options:\n")
+		fs.PrintDefaults()
+	}
+	fs.BoolVar(&opts.json, "json", false, "Enable JSON output")
+	fs.StringVar(&view, "view", "releases", "Results shown: releases (by namespace and bundle), images (each image with the bundles using it), both, or keyed (each bundle with the keys of its images, the findings of each image listed once)")
+	fs.StringVar(&target, "target", "", "Apply the target customization of this name of each bundle, none if empty")
+	addScannerFlags(fs, &opts)
+	addPolicyFlags(fs, &opts)
+	fs.Parse(args)
+	opts.setFlags = setFlags(fs)
+
+	if fs.NArg() == 0 {
+		fmt.Fprintf(os.Stderr, "Error: No directory specified.\n")
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	if err := validateView(view); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v.\n", err)
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+
+	ctx, backend, cleanup := setupScanner(&opts)
+	defer cleanup()
+
+	opts.scanMemo = newScanMemo()
+	status := exitOK
+	results := []releaseResult{}
+	for _, root := range fs.Args() {
+		bundles, err := findFleetBundles(root)
+		if err != nil {
+			fatal(exitRender, opts, "Could not find bundles of %v: %v", root, err)
+		}
+		if len(bundles) == 0 {
+			log.Warnf("No fleet.yaml in %v", root)
+		}
+		isBundle := map[string]bool{}
+		for _, dir := range bundles {
+			isBundle[dir] = true
+		}
+		for _, dir := range bundles {
+			result, err := scanFleetBundle(root, dir, isBundle, target, ctx, backend, opts)
+			if err != nil {
+				log.Errorf("Could not scan bundle %v: %v", dir, err)
+				status = exitPartial
+				if len(result.Result.Images) == 0 {
+					continue
+				}
+			}
+			results = append(results, result)
+		}
+	}
+	// Results are grouped by namespace.
+	sort.SliceStable(results, func(i, j int) bool { return results[i].Release.Namespace < results[j].Release.Namespace })
+	printReleaseResults(results, view, status, opts)
+}
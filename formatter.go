@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// formatterProtocol is the version of the document formatters get on stdin,
+// raised when it changes in a way formatters need to know about.
+const formatterProtocol = 1
+
+// formatterInput is the document formatters read on stdin. Results holds the
+// JSON output of helm-trivy, Labels the -output-labels to show.
+type formatterInput struct {
+	Protocol int             `json:"protocol"`
+	Chart    string          `json:"chart"`
+	Version  string          `json:"version,omitempty"`
+	Results  json.RawMessage `json:"results"`
+	Labels   *outputLabels   `json:"labels,omitempty"`
+}
+
+// defaultFormattersDir is the directory formatters are looked up in,
+// $HELM_TRIVY_FORMATTERS or ~/.helm-trivy/formatters.
+func defaultFormattersDir() string {
+	if dir := os.Getenv("HELM_TRIVY_FORMATTERS"); dir != "" {
+		return dir
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".helm-trivy", "formatters")
+}
+
+// listFormatters returns the names of the executables of dir.
+func listFormatters(dir string) []string {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	names := []string{}
+	for _, f := range files {
+		if !f.IsDir() && f.Mode()&0111 != 0 {
+			names = append(names, f.Name())
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// formatterPath returns the executable of the formatter name in dir.
+func formatterPath(dir string, name string) (string, error) {
+	if name == "" || strings.ContainsAny(name, `/\`) || name == "." || name == ".." {
+		return "", fmt.Errorf("invalid formatter name %q", name)
+	}
+	path := filepath.Join(dir, name)
+	if info, err := os.Stat(path); err == nil && !info.IsDir() && info.Mode()&0111 != 0 {
+		return path, nil
+	}
+	available := listFormatters(dir)
+	if len(available) == 0 {
+		return "", fmt.Errorf("unknown formatter %v, no formatter in %v", name, dir)
+	}
+	return "", fmt.Errorf("unknown formatter %v, available in %v: %v", name, dir, strings.Join(available, ", "))
+}
+
+// runFormatter prints result to w with the formatter of -formatter: its
+// executable gets a formatterInput on stdin and writes the output on
+// stdout.
+func runFormatter(w io.Writer, result chartResult, opts scanOptions) error {
+	path, err := formatterPath(opts.formattersDir, opts.formatter)
+	if err != nil {
+		return err
+	}
+	var results bytes.Buffer
+	if err := writeJSONOutputs(&results, result.reports()); err != nil {
+		return err
+	}
+	input, err := json.Marshal(formatterInput{Protocol: formatterProtocol, Chart: result.Chart, Version: result.Version, Results: results.Bytes(), Labels: opts.labels})
+	if err != nil {
+		return err
+	}
+	log.Debugf("Running formatter %v", path)
+	var stderr bytes.Buffer
+	cmd := exec.Command(path)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = w
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if stderr.Len() > 0 {
+			return fmt.Errorf("formatter %v failed: %v: %s", opts.formatter, err, bytes.TrimSpace(stderr.Bytes()))
+		}
+		return fmt.Errorf("formatter %v failed: %v", opts.formatter, err)
+	}
+	return nil
+}
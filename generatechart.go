@@ -0,0 +1,339 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// chartFiles are the files of the chart written by generate-chart. It runs
+// the server and scheduled scans with the k8s-job backend, the trivy cache
+// being kept in a PersistentVolumeClaim. CHART_NAME and IMAGE are replaced
+// with the values given to generate-chart.
+var chartFiles = map[string]string{
+	"Chart.yaml": `apiVersion: v2
+name: CHART_NAME
+description: Scan charts and releases for vulnerabilities with helm-trivy
+type: application
+version: 0.1.0
+`,
+	"values.yaml": `# Image running helm-trivy, with helm, kubectl and the trivy plugin installed.
+image: IMAGE
+imagePullPolicy: IfNotPresent
+
+server:
+  # Run helm trivy serve, the dashboard and JSON API.
+  enabled: true
+  port: 8080
+  # Secret whose token key holds the token of the dashboard and API.
+  tokenSecret: ""
+  # Serve without a token, letting anyone reaching the service submit scans.
+  insecureNoToken: false
+
+# Cron schedule of the scans of the charts and releases below, no scheduled
+# scans if empty.
+schedule: "0 3 * * *"
+
+# Chart repositories added before scanning.
+repositories: []
+#  - name: bitnami
+#    url: https://charts.bitnami.com/bitnami
+
+# Charts scanned on schedule.
+charts: []
+#  - bitnami/mariadb
+
+# Releases of the cluster scanned on schedule, in the release namespace when
+# no namespace is given.
+releases: []
+#  - name: db
+#    namespace: prod
+
+# Extra options of the server and of the scheduled scans.
+args: []
+#  - -severity
+#  - HIGH,CRITICAL
+
+# Volume of the trivy cache, shared by the scan jobs.
+cache:
+  size: 5Gi
+  storageClass: ""
+  accessMode: ReadWriteOnce
+`,
+	"templates/_helpers.tpl": `{{- define "helm-trivy.labels" -}}
+app.kubernetes.io/name: {{ .Chart.Name }}
+app.kubernetes.io/instance: {{ .Release.Name }}
+app.kubernetes.io/managed-by: {{ .Release.Service }}
+{{- end }}
+
+{{- define "helm-trivy.args" -}}
+- -backend
+- k8s-job
+- -k8s-namespace
+- {{ .Release.Namespace }}
+- -k8s-cache-pvc
+- {{ .Release.Name }}-cache
+{{- range .Values.args }}
+- {{ . | quote }}
+{{- end }}
+{{- end }}
+
+{{- define "helm-trivy.repositories" -}}
+{{- range .Values.repositories }}
+helm repo add {{ .name | quote }} {{ .url | quote }} || exit 1
+{{- end }}
+{{- if .Values.repositories }}
+helm repo update || exit 1
+{{- end }}
+{{- end }}
+`,
+	"templates/serviceaccount.yaml": `apiVersion: v1
+kind: ServiceAccount
+metadata:
+  name: {{ .Release.Name }}
+  labels:
+    {{- include "helm-trivy.labels" . | nindent 4 }}
+`,
+	"templates/rbac.yaml": `# Scan jobs of the k8s-job backend.
+apiVersion: rbac.authorization.k8s.io/v1
+kind: Role
+metadata:
+  name: {{ .Release.Name }}
+  labels:
+    {{- include "helm-trivy.labels" . | nindent 4 }}
+rules:
+  - apiGroups: ["batch"]
+    resources: ["jobs"]
+    verbs: ["create", "get", "delete"]
+  # Registry credentials are passed to the jobs in secrets they own.
+  - apiGroups: [""]
+    resources: ["secrets"]
+    verbs: ["create", "patch", "delete"]
+  - apiGroups: [""]
+    resources: ["pods", "pods/log"]
+    verbs: ["get", "list"]
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: RoleBinding
+metadata:
+  name: {{ .Release.Name }}
+  labels:
+    {{- include "helm-trivy.labels" . | nindent 4 }}
+roleRef:
+  apiGroup: rbac.authorization.k8s.io
+  kind: Role
+  name: {{ .Release.Name }}
+subjects:
+  - kind: ServiceAccount
+    name: {{ .Release.Name }}
+    namespace: {{ .Release.Namespace }}
+{{- if .Values.releases }}
+---
+# Helm keeps releases in secrets of their namespace.
+apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRole
+metadata:
+  name: {{ .Release.Namespace }}-{{ .Release.Name }}-releases
+  labels:
+    {{- include "helm-trivy.labels" . | nindent 4 }}
+rules:
+  - apiGroups: [""]
+    resources: ["secrets"]
+    verbs: ["get", "list"]
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRoleBinding
+metadata:
+  name: {{ .Release.Namespace }}-{{ .Release.Name }}-releases
+  labels:
+    {{- include "helm-trivy.labels" . | nindent 4 }}
+roleRef:
+  apiGroup: rbac.authorization.k8s.io
+  kind: ClusterRole
+  name: {{ .Release.Namespace }}-{{ .Release.Name }}-releases
+subjects:
+  - kind: ServiceAccount
+    name: {{ .Release.Name }}
+    namespace: {{ .Release.Namespace }}
+{{- end }}
+`,
+	"templates/pvc.yaml": `apiVersion: v1
+kind: PersistentVolumeClaim
+metadata:
+  name: {{ .Release.Name }}-cache
+  labels:
+    {{- include "helm-trivy.labels" . | nindent 4 }}
+spec:
+  accessModes:
+    - {{ .Values.cache.accessMode }}
+  {{- if .Values.cache.storageClass }}
+  storageClassName: {{ .Values.cache.storageClass }}
+  {{- end }}
+  resources:
+    requests:
+      storage: {{ .Values.cache.size }}
+`,
+	"templates/deployment.yaml": `{{- if .Values.server.enabled }}
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: {{ .Release.Name }}
+  labels:
+    {{- include "helm-trivy.labels" . | nindent 4 }}
+spec:
+  replicas: 1
+  selector:
+    matchLabels:
+      app.kubernetes.io/name: {{ .Chart.Name }}
+      app.kubernetes.io/instance: {{ .Release.Name }}
+  template:
+    metadata:
+      labels:
+        {{- include "helm-trivy.labels" . | nindent 8 }}
+    spec:
+      serviceAccountName: {{ .Release.Name }}
+      containers:
+        - name: server
+          image: {{ required "image is required" .Values.image }}
+          imagePullPolicy: {{ .Values.imagePullPolicy }}
+          command:
+            - sh
+            - -c
+            - |
+              {{- include "helm-trivy.repositories" . | nindent 14 }}
+              exec helm trivy serve -listen 0.0.0.0 -port {{ .Values.server.port }}{{ if .Values.server.insecureNoToken }} -insecure-no-token{{ end }} "$@"
+            - serve
+          args:
+            {{- include "helm-trivy.args" . | nindent 12 }}
+          {{- if .Values.server.tokenSecret }}
+          env:
+            - name: HELM_TRIVY_SERVER_TOKEN
+              valueFrom:
+                secretKeyRef:
+                  name: {{ .Values.server.tokenSecret }}
+                  key: token
+          {{- else if not .Values.server.insecureNoToken }}
+          {{- fail "server.tokenSecret is required, or server.insecureNoToken to serve without a token" }}
+          {{- end }}
+          ports:
+            - name: http
+              containerPort: {{ .Values.server.port }}
+          readinessProbe:
+            httpGet:
+              path: /healthz
+              port: http
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: {{ .Release.Name }}
+  labels:
+    {{- include "helm-trivy.labels" . | nindent 4 }}
+spec:
+  selector:
+    app.kubernetes.io/name: {{ .Chart.Name }}
+    app.kubernetes.io/instance: {{ .Release.Name }}
+  ports:
+    - name: http
+      port: {{ .Values.server.port }}
+      targetPort: http
+{{- end }}
+`,
+	"templates/cronjob.yaml": `{{- if and .Values.schedule (or .Values.charts .Values.releases) }}
+apiVersion: batch/v1
+kind: CronJob
+metadata:
+  name: {{ .Release.Name }}-scan
+  labels:
+    {{- include "helm-trivy.labels" . | nindent 4 }}
+spec:
+  schedule: {{ .Values.schedule | quote }}
+  concurrencyPolicy: Forbid
+  jobTemplate:
+    spec:
+      backoffLimit: 0
+      template:
+        metadata:
+          labels:
+            {{- include "helm-trivy.labels" . | nindent 12 }}
+        spec:
+          serviceAccountName: {{ .Release.Name }}
+          restartPolicy: Never
+          containers:
+            - name: scan
+              image: {{ required "image is required" .Values.image }}
+              imagePullPolicy: {{ .Values.imagePullPolicy }}
+              command:
+                - sh
+                - -c
+                - |
+                  {{- include "helm-trivy.repositories" . | nindent 18 }}
+                  status=0
+                  {{- range .Values.charts }}
+                  helm trivy "$@" {{ . | quote }} || status=1
+                  {{- end }}
+                  {{- range .Values.releases }}
+                  helm get manifest {{ .name | quote }} --namespace {{ .namespace | default $.Release.Namespace | quote }} | helm trivy "$@" - || status=1
+                  {{- end }}
+                  exit $status
+                - scan
+              args:
+                {{- include "helm-trivy.args" . | nindent 16 }}
+{{- end }}
+`,
+}
+
+// writeChart writes the chartFiles to dir, which must not exist yet.
+func writeChart(dir string, name string, image string) error {
+	if _, err := os.Stat(dir); err == nil {
+		return fmt.Errorf("%v already exists", dir)
+	}
+	replacer := strings.NewReplacer("CHART_NAME", name, "IMAGE", fmt.Sprintf("%q", image))
+	files := []string{}
+	for file := range chartFiles {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	for _, file := range files {
+		path := filepath.Join(dir, filepath.FromSlash(file))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(path, []byte(replacer.Replace(chartFiles[file])), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func generateChartMain(args []string) {
+	var name string
+	var image string
+
+	fs := flag.NewFlagSet("generate-chart", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: helm trivy generate-chart [options] <directory>\n")
+		fmt.Fprintf(fs.Output(), "Example: helm trivy generate-chart -image registry.corp.local/helm-trivy:latest ./helm-trivy\n\n")
+		fmt.Fprintf(fs.Output(), "Options:\n")
+		fs.PrintDefaults()
+	}
+	fs.StringVar(&name, "name", "helm-trivy", "Name of the chart")
+	fs.StringVar(&image, "image", "", "Image running helm-trivy, with helm, kubectl and the plugin installed, to be set at install time if empty")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "Error: A directory is needed.\n")
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	if err := writeChart(fs.Arg(0), name, image); err != nil {
+		fatal(exitCode(err), scanOptions{}, "Could not write chart: %v", err)
+	}
+	log.Infof("Chart written to %v", fs.Arg(0))
+}
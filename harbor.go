@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// harborReportMimeType is the vulnerability report format Harbor scanners
+// produce.
+const harborReportMimeType = "application/vnd.security.vulnerability.report; version=1.1"
+
+type harborVulnerabilityReport struct {
+	GeneratedAt time.Time `json:"generated_at"`
+	Scanner     struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	} `json:"scanner"`
+	Vulnerabilities []struct {
+		ID          string   `json:"id"`
+		Package     string   `json:"package"`
+		Version     string   `json:"version"`
+		FixVersion  string   `json:"fix_version"`
+		Severity    string   `json:"severity"`
+		Description string   `json:"description"`
+		Links       []string `json:"links"`
+	} `json:"vulnerabilities"`
+}
+
+// harborSeverity maps Harbor severities to trivy ones.
+func harborSeverity(severity string) string {
+	switch strings.ToLower(severity) {
+	case "critical", "high", "medium", "low":
+		return strings.ToUpper(severity)
+	case "negligible":
+		return "LOW"
+	}
+	return "UNKNOWN"
+}
+
+// isHarborImage tells whether image is hosted by one of the Harbor registries
+// of opts.
+func isHarborImage(image string, opts scanOptions) bool {
+	registry := parseImageRef(image).Registry
+	for _, host := range strings.Split(opts.harborHosts, ",") {
+		if host != "" && host == registry {
+			return true
+		}
+	}
+	return false
+}
+
+// harborReport returns the vulnerabilities Harbor found in image as a trivy
+// report. The boolean is false when Harbor has no report for it, or when it
+// is older than opts.harborMaxAge.
+func harborReport(image string, opts scanOptions) (trivyReport, bool, error) {
+	ref := parseImageRef(image)
+	parts := strings.SplitN(ref.Repository, "/", 2)
+	if len(parts) != 2 {
+		return trivyReport{}, false, fmt.Errorf("%v is not in a Harbor project", image)
+	}
+	reference := ref.Tag
+	if ref.Digest != "" {
+		reference = ref.Digest
+	}
+	// Harbor wants slashes in repository names encoded twice.
+	u := fmt.Sprintf("https://%s/api/v2.0/projects/%s/repositories/%s/artifacts/%s/additions/vulnerabilities",
+		ref.Registry, url.PathEscape(parts[0]), url.PathEscape(url.PathEscape(parts[1])), url.PathEscape(reference))
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return trivyReport{}, false, err
+	}
+	if user, password := registryCredentials(image, opts); user != "" {
+		req.SetBasicAuth(user, password)
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := registryClient.Do(req)
+	if err != nil {
+		return trivyReport{}, false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return trivyReport{}, false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return trivyReport{}, false, fmt.Errorf("GET %v: %v", u, resp.Status)
+	}
+	var reports map[string]harborVulnerabilityReport
+	if err := json.NewDecoder(resp.Body).Decode(&reports); err != nil {
+		return trivyReport{}, false, err
+	}
+	report, ok := reports[harborReportMimeType]
+	if !ok || time.Since(report.GeneratedAt) > opts.harborMaxAge {
+		return trivyReport{}, false, nil
+	}
+	result := trivyResult{
+		Target:          fmt.Sprintf("%s (Harbor, %s %s)", image, report.Scanner.Name, report.Scanner.Version),
+		Vulnerabilities: []trivyVulnerability{},
+	}
+	for _, v := range report.Vulnerabilities {
+		vuln := trivyVulnerability{
+			VulnerabilityID:  v.ID,
+			PkgName:          v.Package,
+			InstalledVersion: v.Version,
+			FixedVersion:     v.FixVersion,
+			Severity:         harborSeverity(v.Severity),
+			Description:      v.Description,
+		}
+		if len(v.Links) > 0 {
+			vuln.PrimaryURL = v.Links[0]
+		}
+		result.Vulnerabilities = append(result.Vulnerabilities, vuln)
+	}
+	return trivyReport{ArtifactName: image, Results: []trivyResult{result}}, true, nil
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	"gopkg.in/yaml.v3"
+)
+
+// helmChartResource is a HelmChart or HelmChartConfig resource of the helm
+// controller of k3s and RKE2, with the fields helm-trivy uses.
+type helmChartResource struct {
+	APIVersion string `yaml:"apiVersion"`
+	Kind       string `yaml:"kind"`
+	Metadata   struct {
+		Name      string `yaml:"name"`
+		Namespace string `yaml:"namespace"`
+	} `yaml:"metadata"`
+	Spec struct {
+		Chart           string                 `yaml:"chart"`
+		Repo            string                 `yaml:"repo"`
+		Version         string                 `yaml:"version"`
+		TargetNamespace string                 `yaml:"targetNamespace"`
+		ValuesContent   string                 `yaml:"valuesContent"`
+		Set             map[string]interface{} `yaml:"set"`
+		ChartContent    string                 `yaml:"chartContent"`
+	} `yaml:"spec"`
+	// Items holds the resources of a kubectl get List.
+	Items []helmChartResource `yaml:"items"`
+}
+
+// namespace returns the namespace of the resource, the controller defaulting
+// it like kubectl does.
+func (r helmChartResource) namespace() string {
+	if r.Metadata.Namespace == "" {
+		return "default"
+	}
+	return r.Metadata.Namespace
+}
+
+// readHelmCharts returns the HelmChart resources of the given files and
+// directories, or of stdin for "-", along with the HelmChartConfig values
+// of each, by namespace/name.
+func readHelmCharts(paths []string) ([]helmChartResource, map[string]string, error) {
+	var manifests string
+	var err error
+	if len(paths) == 1 && paths[0] == stdinChart {
+		manifests, err = readStdinManifests()
+	} else {
+		manifests, err = readManifestFiles(paths)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	resources := []helmChartResource{}
+	decoder := yaml.NewDecoder(strings.NewReader(manifests))
+	for {
+		var r helmChartResource
+		err := decoder.Decode(&r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid manifest: %v", err)
+		}
+		resources = append(append(resources, r), r.Items...)
+	}
+	charts := []helmChartResource{}
+	configs := map[string]string{}
+	for _, r := range resources {
+		if !strings.HasPrefix(r.APIVersion, "helm.cattle.io/") {
+			continue
+		}
+		switch r.Kind {
+		case "HelmChart":
+			charts = append(charts, r)
+		case "HelmChartConfig":
+			configs[r.namespace()+"/"+r.Metadata.Name] = r.Spec.ValuesContent
+		}
+	}
+	sort.SliceStable(charts, func(i, j int) bool {
+		if charts[i].namespace() != charts[j].namespace() {
+			return charts[i].namespace() < charts[j].namespace()
+		}
+		return charts[i].Metadata.Name < charts[j].Metadata.Name
+	})
+	return charts, configs, nil
+}
+
+// helmChartSet returns the set field of a HelmChart as a --set option.
+func helmChartSet(set map[string]interface{}) string {
+	keys := []string{}
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	values := []string{}
+	for _, key := range keys {
+		value := strings.Replace(fmt.Sprint(set[key]), ",", `\,`, -1)
+		values = append(values, key+"="+value)
+	}
+	return strings.Join(values, ",")
+}
+
+// scanHelmChart scans the chart of a HelmChart resource, rendered with its
+// valuesContent, then the one of its HelmChartConfig, and its set values,
+// as the helm controller installs it. The result is the one of the release
+// the controller names after the resource.
+func scanHelmChart(r helmChartResource, config string, ctx context.Context, backend scanBackend, opts scanOptions) (releaseResult, error) {
+	namespace := r.Spec.TargetNamespace
+	if namespace == "" {
+		namespace = r.namespace()
+	}
+	label := r.Spec.Chart
+	if r.Spec.Version != "" {
+		label += " " + r.Spec.Version
+	}
+	release := releaseResult{Release: helmRelease{Name: r.Metadata.Name, Namespace: namespace, Chart: label}}
+	chart := r.Spec.Chart
+	if r.Spec.ChartContent != "" {
+		data, err := base64.StdEncoding.DecodeString(r.Spec.ChartContent)
+		if err != nil {
+			return release, withExitCode(exitRender, "invalid chartContent: %v", err)
+		}
+		if chart, err = writeTempFile("helm-trivy-chart*.tgz", data); err != nil {
+			return release, err
+		}
+		defer os.Remove(chart)
+	} else if strings.Contains(chart, "%{") {
+		return release, withExitCode(exitRender, "chart %v is served by the k3s API server, it can't be fetched", chart)
+	}
+	opts.chartRepo = r.Spec.Repo
+	opts.chartVersion = r.Spec.Version
+	opts.templateSet = helmChartSet(r.Spec.Set)
+	files := []string{}
+	for _, content := range []string{r.Spec.ValuesContent, config} {
+		if strings.TrimSpace(content) == "" {
+			continue
+		}
+		file, err := writeTempFile("helm-trivy-values", []byte(content))
+		if err != nil {
+			return release, err
+		}
+		defer os.Remove(file)
+		files = append(files, file)
+	}
+	opts.templateValues = strings.Join(files, ",")
+	return scanReleaseChart(release, chart, ctx, backend, opts)
+}
+
+func helmChartsMain(args []string) {
+	var opts scanOptions
+	var view string
+
+	fs := flag.NewFlagSet("helmcharts", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: helm trivy helmcharts [options] <manifest file or directory>...\n")
+		fmt.Fprintf(fs.Output(), "       kubectl get helmcharts,helmchartconfigs -A -o yaml | helm trivy helmcharts [options] -\n")
+		fmt.Fprintf(fs.Output(), "Example: helm trivy helmcharts /var/lib/rancher/k3s/server/manifests\n\n")
+		fmt.Fprintf(fs.Output(), "Options:\n")
+		fs.PrintDefaults()
+	}
+	fs.BoolVar(&opts.json, "json", false, "Enable JSON output")
+	fs.StringVar(&view, "view", "releases", "Results shown: releases (by namespace and HelmChart), images (each image with the HelmCharts using it), both, or keyed (each HelmChart with the keys of its images, the findings of each image listed once)")
+	addScannerFlags(fs, &opts)
+	addPolicyFlags(fs, &opts)
+	fs.Parse(args)
+	opts.setFlags = setFlags(fs)
+
+	if fs.NArg() == 0 {
+		fmt.Fprintf(os.Stderr, "Error: No manifest specified.\n")
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	if err := validateView(view); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v.\n", err)
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+
+	ctx, backend, cleanup := setupScanner(&opts)
+	defer cleanup()
+
+	charts, configs, err := readHelmCharts(fs.Args())
+	if err != nil {
+		fatal(exitRender, opts, "Could not read HelmCharts: %v", err)
+	}
+	if len(charts) == 0 {
+		log.Warn("No HelmChart to scan")
+		return
+	}
+
+	opts.scanMemo = newScanMemo()
+	status := exitOK
+	results := []releaseResult{}
+	for _, r := range charts {
+		result, err := scanHelmChart(r, configs[r.namespace()+"/"+r.Metadata.Name], ctx, backend, opts)
+		if err != nil {
+			log.Errorf("Could not scan HelmChart %v/%v: %v", r.namespace(), r.Metadata.Name, err)
+			status = exitPartial
+			if len(result.Result.Images) == 0 {
+				continue
+			}
+		}
+		results = append(results, result)
+	}
+	printReleaseResults(results, view, status, opts)
+}
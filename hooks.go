@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// hook is a command given with -hook, run through sh at stage.
+type hook struct {
+	stage   string
+	command string
+}
+
+// parseHooks parses the STAGE=COMMAND values of -hook.
+func parseHooks(values []string) ([]hook, error) {
+	hooks := []hook{}
+	for _, value := range values {
+		parts := strings.SplitN(value, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[1]) == "" {
+			return nil, fmt.Errorf("invalid hook %q, expected STAGE=COMMAND", value)
+		}
+		switch parts[0] {
+		case "pre-render", "post-discover", "post-scan":
+		default:
+			return nil, fmt.Errorf("unknown hook stage %v, expected pre-render, post-discover or post-scan", parts[0])
+		}
+		hooks = append(hooks, hook{stage: parts[0], command: parts[1]})
+	}
+	return hooks, nil
+}
+
+// hasHook tells whether a hook runs at stage.
+func hasHook(hooks []hook, stage string) bool {
+	for _, h := range hooks {
+		if h.stage == stage {
+			return true
+		}
+	}
+	return false
+}
+
+// runHooks runs the hooks of stage in turn with input on their stdin. Their
+// output goes to stderr, so that it does not mix with the results. A hook
+// exiting with a non-zero status fails the scan like findings would.
+func runHooks(stage string, chart string, input []byte, opts scanOptions) error {
+	for _, h := range opts.hooks {
+		if h.stage != stage {
+			continue
+		}
+		log.Debugf("Running %v hook: %v", stage, h.command)
+		cmd := exec.Command("sh", "-c", h.command)
+		cmd.Stdin = bytes.NewReader(input)
+		cmd.Stdout = os.Stderr
+		cmd.Stderr = os.Stderr
+		cmd.Env = append(os.Environ(), "HELM_TRIVY_HOOK="+stage, "HELM_TRIVY_CHART="+chart)
+		if err := cmd.Run(); err != nil {
+			return withExitCode(exitFindings, "%v hook %q failed: %v", stage, h.command, err)
+		}
+	}
+	return nil
+}
+
+// hookChart is the input of pre-render hooks, and with the images found, of
+// post-discover hooks.
+type hookChart struct {
+	Chart   string      `json:"chart"`
+	Version string      `json:"version,omitempty"`
+	Images  []hookImage `json:"images,omitempty"`
+}
+
+type hookImage struct {
+	Name   string   `json:"name"`
+	Labels []string `json:"labels,omitempty"`
+}
+
+// runChartHooks runs the hooks of stage with the chart and its images as
+// input.
+func runChartHooks(stage string, chart string, images []chartImage, opts scanOptions) error {
+	if !hasHook(opts.hooks, stage) {
+		return nil
+	}
+	input := hookChart{Chart: chart, Version: opts.chartVersion}
+	for _, image := range images {
+		input.Images = append(input.Images, hookImage{Name: image.Name, Labels: image.Labels})
+	}
+	data, err := json.Marshal(input)
+	if err != nil {
+		return err
+	}
+	return runHooks(stage, chart, data, opts)
+}
+
+// runPostScanHooks runs the post-scan hooks with the JSON results of the
+// chart as input.
+func runPostScanHooks(result chartResult, opts scanOptions) error {
+	if !hasHook(opts.hooks, "post-scan") {
+		return nil
+	}
+	var buf bytes.Buffer
+	if err := writeJSONOutputs(&buf, result.reports()); err != nil {
+		return err
+	}
+	return runHooks("post-scan", result.Chart, buf.Bytes(), opts)
+}
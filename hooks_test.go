@@ -0,0 +1,35 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseHooks(t *testing.T) {
+	tests := []struct {
+		values  []string
+		want    []hook
+		wantErr bool
+	}{
+		{nil, []hook{}, false},
+		{[]string{"pre-render=./decrypt.sh"}, []hook{{stage: "pre-render", command: "./decrypt.sh"}}, false},
+		{
+			[]string{"post-discover=jq -r .[]", "post-scan=notify --level=high"},
+			[]hook{{stage: "post-discover", command: "jq -r .[]"}, {stage: "post-scan", command: "notify --level=high"}},
+			false,
+		},
+		{[]string{"pre-render"}, nil, true},
+		{[]string{"pre-render=  "}, nil, true},
+		{[]string{"post-render=./check.sh"}, nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseHooks(tt.values)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseHooks(%q) error = %v, want error %v", tt.values, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseHooks(%q) = %+v, want %+v", tt.values, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ignoreRule accepts the risk of a vulnerability, optionally until a date.
+// Rules are read from lines like:
+//
+//	CVE-2023-1234 image=bitnami/redis-exporter until=2024-09-01 reason=not reachable
+//
+// A bare vulnerability ID, as found in .trivyignore files, never expires and
+// applies to every image. Rules can be scoped to an image, with or without
+// tag, or to the images used by a subchart.
+type ignoreRule struct {
+	ID     string
+	Image  string
+	Chart  string
+	Until  time.Time
+	Reason string
+}
+
+// acceptedVulnerability is a finding hidden by an active ignore rule.
+type acceptedVulnerability struct {
+	VulnerabilityID string `json:"VulnerabilityID"`
+	PkgName         string `json:"PkgName"`
+	Until           string `json:"Until,omitempty"`
+	Reason          string `json:"Reason,omitempty"`
+}
+
+// expired tells whether the rule stopped applying, rules are valid through
+// their until day.
+func (r ignoreRule) expired(now time.Time) bool {
+	return !r.Until.IsZero() && !now.Before(r.Until.AddDate(0, 0, 1))
+}
+
+func (r ignoreRule) until() string {
+	if r.Until.IsZero() {
+		return ""
+	}
+	return r.Until.Format("2006-01-02")
+}
+
+// warnExpired logs the rules that expired, their vulnerabilities are
+// reported again.
+func warnExpired(rules []ignoreRule) {
+	for _, rule := range rules {
+		if rule.expired(time.Now()) {
+			log.Warnf("Ignore rule for %v expired on %v, it is reported again", rule.ID, rule.until())
+		}
+	}
+}
+
+func loadIgnoreFile(path string) ([]ignoreRule, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	rules := []ignoreRule{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule, err := parseIgnoreRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, scanner.Err()
+}
+
+// parseIgnoreRule parses one line of an ignore file. The reason takes the
+// rest of the line, so it has to come last.
+func parseIgnoreRule(line string) (ignoreRule, error) {
+	rule := ignoreRule{}
+	if i := strings.Index(line, "reason="); i >= 0 {
+		rule.Reason = strings.TrimSpace(line[i+len("reason="):])
+		line = line[:i]
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return rule, fmt.Errorf("missing vulnerability ID")
+	}
+	rule.ID = fields[0]
+	for _, field := range fields[1:] {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			return rule, fmt.Errorf("expected key=value, got %q", field)
+		}
+		switch kv[0] {
+		case "image":
+			rule.Image = kv[1]
+		case "chart":
+			rule.Chart = kv[1]
+		case "until":
+			until, err := time.Parse("2006-01-02", kv[1])
+			if err != nil {
+				return rule, fmt.Errorf("invalid until date %q, expected YYYY-MM-DD", kv[1])
+			}
+			rule.Until = until
+		default:
+			return rule, fmt.Errorf("unknown key %q", kv[0])
+		}
+	}
+	return rule, nil
+}
+
+// matches tells whether the rule scope includes image. An image given
+// without tag nor digest matches every version of it.
+func (r ignoreRule) matches(image chartImage) bool {
+	if r.Image != "" {
+		want, got := normalizeImage(r.Image), normalizeImage(image.Name)
+		if stripTag(want) == want {
+			got = stripTag(got)
+		}
+		if want != got {
+			return false
+		}
+	}
+	if r.Chart != "" {
+		for _, chart := range image.Charts {
+			if chart == r.Chart {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// activeIgnores returns the rules that still apply to image, keyed by
+// vulnerability ID.
+func activeIgnores(image chartImage, rules []ignoreRule, now time.Time) map[string]ignoreRule {
+	active := map[string]ignoreRule{}
+	for _, rule := range rules {
+		if _, ok := active[rule.ID]; !ok && !rule.expired(now) && rule.matches(image) {
+			active[rule.ID] = rule
+		}
+	}
+	return active
+}
+
+// rewriteVulnerabilities returns report with each of its vulnerability lists
+// replaced by the one fn returns for it. fn gets a copy of each list, report
+// itself is left untouched.
+func rewriteVulnerabilities(report trivyReport, fn func(vulns []trivyVulnerability) []trivyVulnerability) trivyReport {
+	if report.Results == nil {
+		return report
+	}
+	results := make([]trivyResult, len(report.Results))
+	for i, result := range report.Results {
+		if result.Vulnerabilities != nil {
+			result.Vulnerabilities = fn(append([]trivyVulnerability{}, result.Vulnerabilities...))
+		}
+		results[i] = result
+	}
+	report.Results = results
+	return report
+}
+
+// applyIgnores removes the vulnerabilities accepted by rules from the trivy
+// report of image, and returns them.
+func applyIgnores(image chartImage, report trivyReport, rules []ignoreRule, now time.Time) (trivyReport, []acceptedVulnerability) {
+	active := activeIgnores(image, rules, now)
+	if len(active) == 0 {
+		return report, nil
+	}
+	accepted := []acceptedVulnerability{}
+	report = rewriteVulnerabilities(report, func(vulns []trivyVulnerability) []trivyVulnerability {
+		kept := []trivyVulnerability{}
+		for _, v := range vulns {
+			rule, ok := active[v.VulnerabilityID]
+			if !ok {
+				kept = append(kept, v)
+				continue
+			}
+			accepted = append(accepted, acceptedVulnerability{v.VulnerabilityID, v.PkgName, rule.until(), rule.Reason})
+		}
+		return kept
+	})
+	return report, accepted
+}
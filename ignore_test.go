@@ -0,0 +1,122 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseIgnoreRule(t *testing.T) {
+	tests := []struct {
+		line    string
+		want    ignoreRule
+		wantErr bool
+	}{
+		{"CVE-2023-1234", ignoreRule{ID: "CVE-2023-1234"}, false},
+		{
+			"CVE-2023-1234 until=2024-06-30",
+			ignoreRule{ID: "CVE-2023-1234", Until: time.Date(2024, 6, 30, 0, 0, 0, 0, time.UTC)},
+			false,
+		},
+		{
+			"CVE-2023-1234 until=2024-06-30 reason=not reachable, until=x is only a word here",
+			ignoreRule{ID: "CVE-2023-1234", Until: time.Date(2024, 6, 30, 0, 0, 0, 0, time.UTC), Reason: "not reachable, until=x is only a word here"},
+			false,
+		},
+		{
+			"CVE-2023-1234 image=nginx:1.25 chart=mariadb until=2024-06-30",
+			ignoreRule{ID: "CVE-2023-1234", Image: "nginx:1.25", Chart: "mariadb", Until: time.Date(2024, 6, 30, 0, 0, 0, 0, time.UTC)},
+			false,
+		},
+		{
+			"CVE-2023-1234 image=nginx reason=not reachable, image=x is only a word here",
+			ignoreRule{ID: "CVE-2023-1234", Image: "nginx", Reason: "not reachable, image=x is only a word here"},
+			false,
+		},
+		{"", ignoreRule{}, true},
+		{"reason=no ID", ignoreRule{}, true},
+		{"CVE-2023-1234 nginx", ignoreRule{}, true},
+		{"CVE-2023-1234 until=30/06/2024", ignoreRule{}, true},
+		{"CVE-2023-1234 owner=me", ignoreRule{}, true},
+	}
+	for _, tt := range tests {
+		got, err := parseIgnoreRule(tt.line)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseIgnoreRule(%q) error = %v, want error %v", tt.line, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseIgnoreRule(%q) = %+v, want %+v", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestApplyIgnores(t *testing.T) {
+	now := time.Date(2024, 6, 30, 12, 0, 0, 0, time.UTC)
+	day := func(s string) time.Time {
+		d, _ := time.Parse("2006-01-02", s)
+		return d
+	}
+	report := trivyReport{ArtifactName: "nginx:1.25", Results: []trivyResult{
+		{Target: "nginx:1.25 (debian 12.1)", Vulnerabilities: []trivyVulnerability{
+			{VulnerabilityID: "CVE-2023-1", PkgName: "libc6"},
+			{VulnerabilityID: "CVE-2023-2", PkgName: "openssl"},
+		}},
+		{Target: "app/go.mod"},
+	}}
+	tests := []struct {
+		name     string
+		rules    []ignoreRule
+		kept     []string
+		accepted []acceptedVulnerability
+	}{
+		{"no rules", nil, []string{"CVE-2023-1", "CVE-2023-2"}, nil},
+		{
+			"bare ID",
+			[]ignoreRule{{ID: "CVE-2023-1"}},
+			[]string{"CVE-2023-2"},
+			[]acceptedVulnerability{{"CVE-2023-1", "libc6", "", ""}},
+		},
+		{
+			"until today",
+			[]ignoreRule{{ID: "CVE-2023-2", Until: day("2024-06-30"), Reason: "not reachable"}},
+			[]string{"CVE-2023-1"},
+			[]acceptedVulnerability{{"CVE-2023-2", "openssl", "2024-06-30", "not reachable"}},
+		},
+		{"expired", []ignoreRule{{ID: "CVE-2023-2", Until: day("2024-06-29")}}, []string{"CVE-2023-1", "CVE-2023-2"}, nil},
+		{"other vulnerability", []ignoreRule{{ID: "CVE-2023-3"}}, []string{"CVE-2023-1", "CVE-2023-2"}, []acceptedVulnerability{}},
+		{
+			"image without tag",
+			[]ignoreRule{{ID: "CVE-2023-1", Image: "docker.io/library/nginx"}},
+			[]string{"CVE-2023-2"},
+			[]acceptedVulnerability{{"CVE-2023-1", "libc6", "", ""}},
+		},
+		{"other tag", []ignoreRule{{ID: "CVE-2023-1", Image: "nginx:1.24"}}, []string{"CVE-2023-1", "CVE-2023-2"}, nil},
+		{
+			"subchart",
+			[]ignoreRule{{ID: "CVE-2023-1", Chart: "other"}, {ID: "CVE-2023-1", Chart: "web", Reason: "web only"}},
+			[]string{"CVE-2023-2"},
+			[]acceptedVulnerability{{"CVE-2023-1", "libc6", "", "web only"}},
+		},
+		{"other subchart", []ignoreRule{{ID: "CVE-2023-1", Chart: "db"}}, []string{"CVE-2023-1", "CVE-2023-2"}, nil},
+	}
+	for _, tt := range tests {
+		got, accepted := applyIgnores(chartImage{Name: "nginx:1.25", Charts: []string{"web"}}, report, tt.rules, now)
+		kept := []string{}
+		for _, v := range got.vulnerabilities() {
+			kept = append(kept, v.VulnerabilityID)
+		}
+		if !reflect.DeepEqual(kept, tt.kept) {
+			t.Errorf("%v: kept %q, want %q", tt.name, kept, tt.kept)
+		}
+		if !reflect.DeepEqual(accepted, tt.accepted) {
+			t.Errorf("%v: accepted %+v, want %+v", tt.name, accepted, tt.accepted)
+		}
+		if got.Results[1].Vulnerabilities != nil {
+			t.Errorf("%v: result without vulnerabilities got %+v", tt.name, got.Results[1].Vulnerabilities)
+		}
+	}
+	if len(report.Results[0].Vulnerabilities) != 2 {
+		t.Errorf("applyIgnores() changed the report it was given: %+v", report.Results[0].Vulnerabilities)
+	}
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// Labels attached to images that are not plain workload containers.
+const (
+	labelHook     = "hook"
+	labelInferred = "inferred"
+	// labelNotInManifest marks the images -verify-running found in pods
+	// but not in the release manifest.
+	labelNotInManifest = "not-in-manifest"
+	// labelInjected marks the service mesh sidecars injected in the pods
+	// of a release.
+	labelInjected = "injected"
+	// labelOptional marks the images -expand-conditions only found with
+	// optional dependencies enabled or disabled.
+	labelOptional = "optional"
+	// labelEmbedded marks the images -embedded-manifests found in
+	// manifests embedded in ConfigMap data.
+	labelEmbedded = "embedded"
+)
+
+// kindPattern matches the kind of a manifest.
+var kindPattern = regexp.MustCompile(`(?m)^kind:\s*["']?([A-Za-z0-9]+)`)
+
+// imagePattern matches image references having a tag or a digest.
+var imagePattern = regexp.MustCompile(`^([a-zA-Z0-9.-]+(:[0-9]+)?/)?[a-z0-9]+([._/-][a-z0-9]+)*(:[a-zA-Z0-9_][a-zA-Z0-9_.-]{0,127}|@sha256:[a-f0-9]{64})$`)
+
+// chartImage is an image referenced by a rendered chart. Charts lists the
+// chart or subcharts whose templates use it.
+type chartImage struct {
+	Name   string
+	Labels []string
+	Charts []string
+	// Workloads lists the workloads whose containers run the image.
+	Workloads []imageWorkload
+}
+
+func (i chartImage) String() string {
+	if len(i.Labels) == 0 {
+		return i.Name
+	}
+	return i.Name + " [" + strings.Join(i.Labels, ", ") + "]"
+}
+
+type manifestMetadata struct {
+	Metadata struct {
+		Annotations map[string]string `yaml:"annotations"`
+	} `yaml:"metadata"`
+}
+
+// isHook tells whether a rendered manifest is a helm hook.
+func isHook(doc string) bool {
+	var m manifestMetadata
+	if err := yaml.Unmarshal([]byte(doc), &m); err != nil {
+		return false
+	}
+	_, ok := m.Metadata.Annotations["helm.sh/hook"]
+	return ok
+}
+
+// sourceChart returns the name of the chart or subchart a manifest rendered by
+// helm template comes from, read from its "# Source:" comment.
+func sourceChart(doc string) string {
+	scanner := bufio.NewScanner(strings.NewReader(doc))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, "# Source: ") {
+			continue
+		}
+		parts := strings.Split(strings.TrimPrefix(line, "# Source: "), "/")
+		chart := parts[0]
+		for i := 1; i+1 < len(parts) && parts[i] == "charts"; i += 2 {
+			chart = parts[i+1]
+		}
+		return chart
+	}
+	return ""
+}
+
+// looksLikeImage tells whether value is an image reference. Without a
+// registry or namespace, "redis:6379" could as well be an address, so those
+// are only accepted when the name they are given mentions an image.
+func looksLikeImage(name string, value string) bool {
+	if !imagePattern.MatchString(value) {
+		return false
+	}
+	return strings.Contains(value, "/") || strings.Contains(strings.ToLower(name), "image")
+}
+
+// inferredImages looks for image references in the env vars and args of the
+// containers found in obj.
+func inferredImages(obj interface{}) []string {
+	images := []string{}
+	switch v := obj.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			list, ok := value.([]interface{})
+			if !ok || (key != "containers" && key != "initContainers") {
+				images = append(images, inferredImages(value)...)
+				continue
+			}
+			for _, c := range list {
+				c, _ := c.(map[string]interface{})
+				env, _ := c["env"].([]interface{})
+				for _, e := range env {
+					e, _ := e.(map[string]interface{})
+					name, _ := e["name"].(string)
+					value, _ := e["value"].(string)
+					if looksLikeImage(name, value) {
+						images = append(images, value)
+					}
+				}
+				args, _ := c["args"].([]interface{})
+				command, _ := c["command"].([]interface{})
+				list := append(args, command...)
+				for j, arg := range list {
+					arg, _ := arg.(string)
+					if !strings.HasPrefix(arg, "-") {
+						continue
+					}
+					if i := strings.Index(arg, "="); i > 0 {
+						if looksLikeImage(arg[:i], arg[i+1:]) {
+							images = append(images, arg[i+1:])
+						}
+					} else if j+1 < len(list) {
+						// The value of the flag is the next arg.
+						if next, _ := list[j+1].(string); looksLikeImage(arg, next) {
+							images = append(images, next)
+						}
+					}
+				}
+			}
+		}
+	case []interface{}:
+		for _, value := range v {
+			images = append(images, inferredImages(value)...)
+		}
+	}
+	return images
+}
+
+// manifestKind returns the kind of a manifest without decoding it.
+func manifestKind(doc string) string {
+	if match := kindPattern.FindStringSubmatch(doc); match != nil {
+		return match[1]
+	}
+	return ""
+}
+
+// extractImages finds the images referenced by rendered manifests, in order
+// of appearance, with the workloads running them. Images only used by hooks
+// are labelled as such, images guessed from env vars and args are labelled as
+// inferred, as are the images found in the payloads of ConfigMaps. With
+// -embedded-manifests, the images of manifests embedded in ConfigMaps are
+// labelled as embedded. The -crd-rules apply before the -extract-rules, only
+// manifests of their kinds are decoded for them.
+func extractImages(manifests string, opts scanOptions) []chartImage {
+	images := []chartImage{}
+	hookOnly := map[string]bool{}
+	charts := map[string][]string{}
+	inferred := []string{}
+	embedded := []chartImage{}
+	rules, _ := parseCRDRules(opts.crdRules)
+	crdKinds := map[string]bool{}
+	for _, rule := range rules {
+		crdKinds[rule.Kind] = true
+	}
+	rules = append(rules, opts.extractRules...)
+	for _, doc := range strings.Split(manifests, "\n---") {
+		hook := isHook(doc)
+		chart := sourceChart(doc)
+		addChart := func(image string) {
+			if chart == "" {
+				return
+			}
+			for _, c := range charts[image] {
+				if c == chart {
+					return
+				}
+			}
+			charts[image] = append(charts[image], chart)
+		}
+		inEmbedded := map[string]bool{}
+		if opts.embeddedManifests {
+			for _, image := range embeddedImages(doc, opts) {
+				addChart(image.Name)
+				inEmbedded[image.Name] = true
+				embedded = append(embedded, image)
+			}
+		}
+		scanner := bufio.NewScanner(strings.NewReader(doc))
+		for scanner.Scan() {
+			line := scanner.Text()
+			if !strings.Contains(line, "image: ") {
+				continue
+			}
+			image := strings.Split(line, "image: ")[1]
+			image = strings.Trim(image, "\"")
+			if strings.Contains(image, "{{") {
+				// Templates embedded in ConfigMaps, like the istio
+				// injection templates, are not images.
+				continue
+			}
+			if inEmbedded[image] {
+				continue
+			}
+			addChart(image)
+			if seen, ok := hookOnly[image]; ok {
+				hookOnly[image] = seen && hook
+				continue
+			}
+			log.Debugf("Found image %v", image)
+			hookOnly[image] = hook
+			images = append(images, chartImage{Name: image})
+		}
+		if !opts.inferImages && len(opts.extractRules) == 0 && !crdKinds[manifestKind(doc)] {
+			continue
+		}
+		var obj map[string]interface{}
+		if err := yaml.Unmarshal([]byte(doc), &obj); err != nil {
+			continue
+		}
+		for _, rule := range rules {
+			for _, image := range rule.apply(doc, obj) {
+				addChart(image)
+				if _, ok := hookOnly[image]; !ok {
+					log.Debugf("Found image %v with extraction rule", image)
+					hookOnly[image] = hook
+					images = append(images, chartImage{Name: image})
+				}
+			}
+		}
+		if opts.inferImages {
+			for _, image := range append(inferredImages(obj), configMapImages(obj)...) {
+				addChart(image)
+				inferred = append(inferred, image)
+			}
+		}
+	}
+	for _, image := range embedded {
+		if _, ok := hookOnly[image.Name]; ok {
+			continue
+		}
+		log.Debugf("Found embedded image %v", image.Name)
+		hookOnly[image.Name] = false
+		images = append(images, chartImage{Name: image.Name, Labels: append(image.Labels, labelEmbedded), Workloads: image.Workloads})
+	}
+	for _, image := range inferred {
+		if _, ok := hookOnly[image]; ok {
+			continue
+		}
+		log.Debugf("Inferred image %v", image)
+		hookOnly[image] = false
+		images = append(images, chartImage{Name: image, Labels: []string{labelInferred}})
+	}
+	workloads := imageWorkloads(manifests)
+	for i := range images {
+		if hookOnly[images[i].Name] {
+			images[i].Labels = append(images[i].Labels, labelHook)
+		}
+		images[i].Charts = charts[images[i].Name]
+		images[i].Workloads = append(workloads[images[i].Name], images[i].Workloads...)
+	}
+	return images
+}
+
+// normalizeImage expands image to its fully qualified form, the way docker
+// does: nginx:1.25 is docker.io/library/nginx:1.25.
+func normalizeImage(image string) string {
+	parts := strings.SplitN(image, "/", 2)
+	if len(parts) == 1 {
+		return "docker.io/library/" + image
+	}
+	if !strings.ContainsAny(parts[0], ".:") && parts[0] != "localhost" {
+		return "docker.io/" + image
+	}
+	return image
+}
+
+// validateRewrites checks image rewrites are given as from=to.
+func validateRewrites(rewrites []string) error {
+	for _, rewrite := range rewrites {
+		kv := strings.SplitN(rewrite, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return fmt.Errorf("invalid image rewrite %q, expected from=to", rewrite)
+		}
+	}
+	return nil
+}
+
+// rewriteImage replaces the registry or repository prefix of image with the
+// one it is mirrored under. The longest matching prefix wins.
+func rewriteImage(image string, rewrites []string) string {
+	normalized := normalizeImage(image)
+	from, to := "", ""
+	for _, rewrite := range rewrites {
+		kv := strings.SplitN(rewrite, "=", 2)
+		prefix := strings.TrimSuffix(kv[0], "/")
+		if len(prefix) <= len(from) || !strings.HasPrefix(normalized, prefix) {
+			continue
+		}
+		if rest := normalized[len(prefix):]; rest != "" && !strings.ContainsAny(rest[:1], "/:@") {
+			continue
+		}
+		from, to = prefix, strings.TrimSuffix(kv[1], "/")
+	}
+	if from == "" {
+		return image
+	}
+	return to + normalized[len(from):]
+}
+
+// validateImageInputs checks image inputs are given as image=path, path
+// being a docker save tar or an OCI layout directory.
+func validateImageInputs(inputs []string) error {
+	for _, input := range inputs {
+		kv := strings.SplitN(input, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return fmt.Errorf("invalid image input %q, expected image=path", input)
+		}
+		if _, err := os.Stat(kv[1]); err != nil {
+			return fmt.Errorf("invalid image input %q: %v", input, err)
+		}
+	}
+	return nil
+}
+
+// imageInput returns the absolute path of the archive or OCI layout image is
+// read from, if any.
+func imageInput(image string, inputs []string) string {
+	normalized := normalizeImage(image)
+	for _, input := range inputs {
+		kv := strings.SplitN(input, "=", 2)
+		if normalizeImage(kv[0]) == normalized {
+			if path, err := filepath.Abs(kv[1]); err == nil {
+				return path
+			}
+			return kv[1]
+		}
+	}
+	return ""
+}
+
+// embeddedImages finds the images of the manifests embedded in the data of a
+// ConfigMap, like the ones addon installers apply, going through the
+// ConfigMaps they embed in turn. Payloads without a kind are not manifests
+// and are skipped.
+func embeddedImages(doc string, opts scanOptions) []chartImage {
+	if manifestKind(doc) != "ConfigMap" {
+		return nil
+	}
+	var cm struct {
+		Data map[string]string `yaml:"data"`
+	}
+	if err := yaml.Unmarshal([]byte(doc), &cm); err != nil {
+		return nil
+	}
+	keys := []string{}
+	for key := range cm.Data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	images := []chartImage{}
+	for _, key := range keys {
+		payload := cm.Data[key]
+		if manifestKind(payload) == "" {
+			continue
+		}
+		images = append(images, extractImages(payload, opts)...)
+	}
+	return images
+}
@@ -0,0 +1,51 @@
+package main
+
+import "testing"
+
+func TestNormalizeImage(t *testing.T) {
+	tests := []struct {
+		image string
+		want  string
+	}{
+		{"nginx", "docker.io/library/nginx"},
+		{"nginx:1.25", "docker.io/library/nginx:1.25"},
+		{"bitnami/mariadb:10.6", "docker.io/bitnami/mariadb:10.6"},
+		{"docker.io/bitnami/mariadb:10.6", "docker.io/bitnami/mariadb:10.6"},
+		{"quay.io/prometheus/prometheus:v2.45.0", "quay.io/prometheus/prometheus:v2.45.0"},
+		{"registry:5000/app", "registry:5000/app"},
+		{"localhost/app:dev", "localhost/app:dev"},
+	}
+	for _, tt := range tests {
+		if got := normalizeImage(tt.image); got != tt.want {
+			t.Errorf("normalizeImage(%q) = %q, want %q", tt.image, got, tt.want)
+		}
+	}
+}
+
+func TestRewriteImage(t *testing.T) {
+	rewrites := []string{
+		"docker.io=registry.corp.local/dockerhub",
+		"docker.io/bitnami=registry.corp.local/bitnami/",
+		"quay.io/prometheus/=mirror.corp.local/prom",
+	}
+	tests := []struct {
+		image string
+		want  string
+	}{
+		{"nginx:1.25", "registry.corp.local/dockerhub/library/nginx:1.25"},
+		{"bitnami/mariadb:10.6", "registry.corp.local/bitnami/mariadb:10.6"},
+		{"docker.io/bitnami/mariadb@sha256:abc", "registry.corp.local/bitnami/mariadb@sha256:abc"},
+		{"docker.io/bitnamilegacy/mariadb:10.6", "registry.corp.local/dockerhub/bitnamilegacy/mariadb:10.6"},
+		{"quay.io/prometheus/prometheus:v2.45.0", "mirror.corp.local/prom/prometheus:v2.45.0"},
+		{"quay.io/jetstack/cert-manager:v1.13.0", "quay.io/jetstack/cert-manager:v1.13.0"},
+		{"ghcr.io/org/app", "ghcr.io/org/app"},
+	}
+	for _, tt := range tests {
+		if got := rewriteImage(tt.image, rewrites); got != tt.want {
+			t.Errorf("rewriteImage(%q) = %q, want %q", tt.image, got, tt.want)
+		}
+	}
+	if got := rewriteImage("nginx", nil); got != "nginx" {
+		t.Errorf("rewriteImage(%q) without rewrites = %q", "nginx", got)
+	}
+}
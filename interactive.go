@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+const browserHelp = `Commands:
+  <n>          open entry n
+  b            go back
+  f <text>     only show vulnerabilities matching text (empty to clear)
+  e <file>     export the vulnerabilities currently shown as JSON
+  h            show this help
+  q            quit`
+
+// browser keeps track of where the user is in the image -> severity ->
+// vulnerability hierarchy.
+type browser struct {
+	reports  []trivyReport
+	out      io.Writer
+	image    int
+	severity string
+	vuln     int
+	filter   string
+}
+
+// browseReports is a line-based browser of scan results: it reads one
+// command per line from in until it is closed or the user quits.
+func browseReports(reports []trivyReport, in io.Reader, out io.Writer) error {
+	b := browser{reports: reports, out: out, image: -1, vuln: -1}
+	fmt.Fprintln(out, browserHelp)
+	b.render()
+	scanner := bufio.NewScanner(in)
+	for fmt.Fprint(out, "> "); scanner.Scan(); fmt.Fprint(out, "> ") {
+		line := strings.TrimSpace(scanner.Text())
+		cmd, arg := line, ""
+		if i := strings.Index(line, " "); i > 0 {
+			cmd, arg = line[:i], strings.TrimSpace(line[i+1:])
+		}
+		switch cmd {
+		case "":
+		case "q":
+			return nil
+		case "h":
+			fmt.Fprintln(out, browserHelp)
+		case "b":
+			b.back()
+		case "f":
+			b.filter = arg
+			b.vuln = -1
+		case "e":
+			if arg == "" {
+				fmt.Fprintln(out, "Missing file name")
+				continue
+			}
+			if err := b.export(arg); err != nil {
+				fmt.Fprintf(out, "Could not export to %v: %v\n", arg, err)
+				continue
+			}
+			fmt.Fprintf(out, "Exported to %v\n", arg)
+			continue
+		default:
+			n, err := strconv.Atoi(cmd)
+			if err != nil || !b.open(n-1) {
+				fmt.Fprintf(out, "Unknown command or entry %q, type h for help\n", line)
+				continue
+			}
+		}
+		b.render()
+	}
+	return scanner.Err()
+}
+
+func (b *browser) back() {
+	switch {
+	case b.vuln >= 0:
+		b.vuln = -1
+	case b.severity != "":
+		b.severity = ""
+	default:
+		b.image = -1
+	}
+}
+
+func (b *browser) open(n int) bool {
+	if n < 0 {
+		return false
+	}
+	switch {
+	case b.image < 0:
+		if n >= len(b.reports) {
+			return false
+		}
+		b.image = n
+	case b.severity == "":
+		if n >= len(severities) {
+			return false
+		}
+		b.severity = severities[n]
+	case b.vuln < 0:
+		if n >= len(b.shown()) {
+			return false
+		}
+		b.vuln = n
+	default:
+		return false
+	}
+	return true
+}
+
+func (b *browser) matches(v trivyVulnerability) bool {
+	if b.filter == "" {
+		return true
+	}
+	filter := strings.ToLower(b.filter)
+	for _, field := range []string{v.VulnerabilityID, v.PkgName, v.Title} {
+		if strings.Contains(strings.ToLower(field), filter) {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *browser) filtered(report trivyReport) []trivyVulnerability {
+	vulns := []trivyVulnerability{}
+	for _, v := range report.vulnerabilities() {
+		if b.matches(v) && (b.severity == "" || v.Severity == b.severity) {
+			vulns = append(vulns, v)
+		}
+	}
+	return vulns
+}
+
+// shown returns the vulnerabilities listed for the selected image.
+func (b *browser) shown() []trivyVulnerability {
+	return b.filtered(b.reports[b.image])
+}
+
+func (b *browser) export(path string) error {
+	reports := []trivyReport{}
+	for i, report := range b.reports {
+		if b.image >= 0 && i != b.image {
+			continue
+		}
+		reports = append(reports, trivyReport{
+			ArtifactName: report.ArtifactName,
+			Results:      []trivyResult{{Target: report.ArtifactName, Vulnerabilities: b.filtered(report)}},
+		})
+	}
+	data, err := json.MarshalIndent(reports, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+func (b *browser) render() {
+	if b.filter != "" {
+		fmt.Fprintf(b.out, "Filter: %q\n", b.filter)
+	}
+	switch {
+	case b.image < 0:
+		for i, report := range b.reports {
+			counts := countBySeverity(b.filtered(report))
+			fmt.Fprintf(b.out, "%3d) %s\t", i+1, chartImage{Name: report.ArtifactName, Labels: report.Labels})
+			for _, severity := range severities {
+				fmt.Fprintf(b.out, " %s:%d", severity, counts[severity])
+			}
+			fmt.Fprintln(b.out)
+		}
+	case b.severity == "":
+		counts := countBySeverity(b.filtered(b.reports[b.image]))
+		fmt.Fprintf(b.out, "%s\n", b.reports[b.image].ArtifactName)
+		if os := b.reports[b.image].Metadata.OS; os != nil && os.EOSL {
+			fmt.Fprintf(b.out, "End of life OS: %s %s\n", os.Family, os.Name)
+		}
+		for _, violation := range b.reports[b.image].Violations {
+			fmt.Fprintf(b.out, "Policy violation: %s\n", violation)
+		}
+		for _, a := range b.reports[b.image].Accepted {
+			printAccepted(b.out, a, nil)
+		}
+		for i, severity := range severities {
+			fmt.Fprintf(b.out, "%3d) %-8s %d\n", i+1, severity, counts[severity])
+		}
+	case b.vuln < 0:
+		fmt.Fprintf(b.out, "%s > %s\n", b.reports[b.image].ArtifactName, b.severity)
+		for i, v := range b.shown() {
+			fmt.Fprintf(b.out, "%3d) %-20s %s %s", i+1, v.VulnerabilityID, v.PkgName, v.InstalledVersion)
+			if v.FixedVersion != "" {
+				fmt.Fprintf(b.out, " (fixed in %s)", v.FixedVersion)
+			}
+			fmt.Fprintln(b.out)
+		}
+	default:
+		v := b.shown()[b.vuln]
+		fmt.Fprintf(b.out, "%s > %s > %s\n", b.reports[b.image].ArtifactName, b.severity, v.VulnerabilityID)
+		fmt.Fprintf(b.out, "Package:   %s %s\n", v.PkgName, v.InstalledVersion)
+		fmt.Fprintf(b.out, "Fixed in:  %s\n", v.FixedVersion)
+		fmt.Fprintf(b.out, "Severity:  %s\n", v.Severity)
+		if v.EPSS > 0 || v.KEV {
+			fmt.Fprintf(b.out, "EPSS:      %.3f\n", v.EPSS)
+			fmt.Fprintf(b.out, "Known exploited: %v\n", v.KEV)
+		}
+		fmt.Fprintf(b.out, "Title:     %s\n", v.Title)
+		fmt.Fprintf(b.out, "URL:       %s\n", v.PrimaryURL)
+		if vector, score := v.cvss(); vector != "" {
+			fmt.Fprintf(b.out, "CVSS:      %.1f %s\n", score, vector)
+		}
+		fmt.Fprintf(b.out, "Published: %s\n", v.PublishedDate)
+		fmt.Fprintf(b.out, "\n%s\n", v.Description)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// inventoryItem is an entry of the -format inventory asset list: an image,
+// and the container of the chart running it.
+type inventoryItem struct {
+	Registry     string `json:"registry"`
+	Repository   string `json:"repository"`
+	Tag          string `json:"tag,omitempty"`
+	Digest       string `json:"digest,omitempty"`
+	Chart        string `json:"chart,omitempty"`
+	ChartVersion string `json:"chartVersion,omitempty"`
+	Subchart     string `json:"subchart,omitempty"`
+	WorkloadKind string `json:"workloadKind,omitempty"`
+	WorkloadName string `json:"workloadName,omitempty"`
+	Namespace    string `json:"namespace,omitempty"`
+	Container    string `json:"container,omitempty"`
+}
+
+// validateFormat checks the -format of the output.
+func validateFormat(format string) error {
+	switch format {
+	case "text", "json", "snyk", "inventory":
+		return nil
+	}
+	return fmt.Errorf("unknown format %v, expected text, json, snyk or inventory", format)
+}
+
+// chartInventory lists the images of chart with the containers running them,
+// one item per container. Images not found in a container, from extraction
+// rules or inferred, get an item of their own. Digests are resolved from the
+// registries for the images not pinned by digest, images whose digest can't
+// be resolved are kept without one.
+func chartInventory(chart string, opts scanOptions) ([]inventoryItem, error) {
+	manifests := ""
+	var images []chartImage
+	var err error
+	if len(opts.composeFiles) > 0 {
+		if images, err = composeImages(opts.composeFiles); err != nil {
+			return nil, withExitCode(exitRender, "could not read images of %v: %v", chart, err)
+		}
+	} else {
+		if manifests, err = renderChart(chart, opts); err != nil {
+			return nil, withExitCode(exitRender, "could not render chart %v: %v", chart, err)
+		}
+		images = extractImages(manifests, opts)
+	}
+	// Rendered manifests tell their chart in their templates.
+	rendered := chart == stdinChart || len(opts.manifestFiles) > 0
+	containers := map[string][]workloadContainer{}
+	for _, c := range manifestWorkloads(manifests) {
+		containers[c.Image] = append(containers[c.Image], c)
+	}
+	items := []inventoryItem{}
+	for _, image := range images {
+		ref := parseImageRef(image.Name)
+		if ref.Digest == "" {
+			digest, err := resolveImageDigest(rewriteImage(image.Name, opts.imageRewrites), opts)
+			if err != nil {
+				log.Warnf("Could not resolve digest of %v: %v", image.Name, err)
+			}
+			ref.Digest = digest
+		}
+		item := inventoryItem{
+			Registry:     ref.Registry,
+			Repository:   ref.Repository,
+			Tag:          ref.Tag,
+			Digest:       ref.Digest,
+			ChartVersion: opts.chartVersion,
+		}
+		if !rendered {
+			item.Chart = chart
+		}
+		if len(containers[image.Name]) == 0 {
+			items = append(items, item)
+			continue
+		}
+		for _, c := range containers[image.Name] {
+			item.Subchart = c.Subchart
+			item.WorkloadKind, item.WorkloadName, item.Namespace, item.Container = c.Kind, c.Name, c.Namespace, c.Container
+			if rendered {
+				item.Chart = c.Chart
+			}
+			items = append(items, item)
+		}
+	}
+	return items, nil
+}
+
+// writeInventory writes the inventory of chart to w as JSON.
+func writeInventory(w io.Writer, chart string, opts scanOptions) error {
+	items, err := chartInventory(chart, opts)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(items, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", data)
+	return err
+}
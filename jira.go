@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// maxJiraFindings caps the findings listed in an issue, Jira rejects very
+// long descriptions.
+const maxJiraFindings = 100
+
+var jiraLabelChars = regexp.MustCompile(`[^a-zA-Z0-9_.-]+`)
+
+// jiraLabel is the label identifying the issue of chart, used to find it
+// again on the next scans.
+func jiraLabel(chart string) string {
+	return "helm-trivy-" + strings.Trim(jiraLabelChars.ReplaceAllString(chart, "-"), "-")
+}
+
+// jiraFindings lists the vulnerabilities of the given severities, as Jira
+// wiki markup.
+func jiraFindings(reports []trivyReport, severities []string) []string {
+	findings := []string{}
+	for _, report := range reports {
+		for _, v := range report.vulnerabilities() {
+			for _, severity := range severities {
+				if v.Severity != severity {
+					continue
+				}
+				line := fmt.Sprintf("* %s: *%s* (%s) in %s %s", report.ArtifactName, v.VulnerabilityID, v.Severity, v.PkgName, v.InstalledVersion)
+				if v.FixedVersion != "" {
+					line += ", fixed in " + v.FixedVersion
+				}
+				findings = append(findings, line)
+			}
+		}
+	}
+	return findings
+}
+
+func jiraRequest(method string, path string, body interface{}, result interface{}, opts scanOptions) error {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	u := strings.TrimSuffix(opts.jiraURL, "/") + path
+	req, err := http.NewRequest(method, u, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if opts.jiraUser != "" {
+		req.SetBasicAuth(opts.jiraUser, opts.jiraToken)
+	} else {
+		req.Header.Set("Authorization", "Bearer "+opts.jiraToken)
+	}
+	resp, err := registryClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%v %v: %v: %s", method, path, resp.Status, bytes.TrimSpace(msg))
+	}
+	if result != nil {
+		return json.NewDecoder(resp.Body).Decode(result)
+	}
+	return nil
+}
+
+// reportToJira opens an issue for chart when it has findings of the Jira
+// severities, or comments the open one found by label.
+func reportToJira(result chartResult, opts scanOptions) error {
+	chart := result.Chart
+	findings := jiraFindings(result.reports(), strings.Split(strings.ToUpper(opts.jiraSeverity), ","))
+	if len(findings) == 0 {
+		log.Debugf("No %v vulnerabilities, not reporting to Jira", opts.jiraSeverity)
+		return nil
+	}
+	label := jiraLabel(chart)
+	text := fmt.Sprintf("helm-trivy found %d %v vulnerabilities in chart %v:\n\n", len(findings), opts.jiraSeverity, chart)
+	if len(findings) > maxJiraFindings {
+		findings = append(findings[:maxJiraFindings], fmt.Sprintf("* and %d more", len(findings)-maxJiraFindings))
+	}
+	text += strings.Join(findings, "\n")
+
+	var search struct {
+		Issues []struct {
+			Key string `json:"key"`
+		} `json:"issues"`
+	}
+	jql := fmt.Sprintf(`project = "%s" AND labels = "%s" AND statusCategory != Done`, opts.jiraProject, label)
+	if err := jiraRequest(http.MethodGet, "/rest/api/2/search?fields=key&jql="+url.QueryEscape(jql), nil, &search, opts); err != nil {
+		return err
+	}
+	if len(search.Issues) > 0 {
+		key := search.Issues[0].Key
+		if err := jiraRequest(http.MethodPost, "/rest/api/2/issue/"+key+"/comment", map[string]string{"body": text}, nil, opts); err != nil {
+			return err
+		}
+		log.Infof("Updated Jira issue %v", key)
+		return nil
+	}
+	issue := map[string]interface{}{
+		"fields": map[string]interface{}{
+			"project":     map[string]string{"key": opts.jiraProject},
+			"issuetype":   map[string]string{"name": opts.jiraIssueType},
+			"summary":     fmt.Sprintf("Vulnerabilities in chart %v", chart),
+			"description": text,
+			"labels":      []string{"helm-trivy", label},
+		},
+	}
+	var created struct {
+		Key string `json:"key"`
+	}
+	if err := jiraRequest(http.MethodPost, "/rest/api/2/issue", issue, &created, opts); err != nil {
+		return err
+	}
+	log.Infof("Opened Jira issue %v", created.Key)
+	return nil
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+)
+
+// k8sJobBackend runs each trivy scan as a Kubernetes Job, through kubectl.
+// Scans then only need access to the cluster and can reach images that are
+// only pullable from inside it.
+type k8sJobBackend struct {
+	namespace    string
+	nodeSelector map[string]string
+	pullSecrets  []string
+	cachePVC     string
+	pullPolicy   string
+}
+
+func newK8sJobBackend(opts scanOptions) (k8sJobBackend, error) {
+	b := k8sJobBackend{
+		namespace:    opts.k8sNamespace,
+		nodeSelector: map[string]string{},
+		cachePVC:     opts.k8sCachePVC,
+		pullPolicy:   k8sPullPolicies[opts.pullPolicy],
+	}
+	for _, selector := range strings.Split(opts.k8sNodeSelector, ",") {
+		if selector == "" {
+			continue
+		}
+		kv := strings.SplitN(selector, "=", 2)
+		if len(kv) != 2 {
+			return b, fmt.Errorf("invalid node selector %q, expected key=value", selector)
+		}
+		b.nodeSelector[kv[0]] = kv[1]
+	}
+	for _, secret := range strings.Split(opts.k8sPullSecrets, ",") {
+		if secret != "" {
+			b.pullSecrets = append(b.pullSecrets, secret)
+		}
+	}
+	return b, nil
+}
+
+func (b k8sJobBackend) kubectl(ctx context.Context, stdin []byte, args ...string) (string, error) {
+	args = kubectlArgs(append([]string{"--namespace", b.namespace}, args...)...)
+	log.Debugf("Running kubectl cmd: kubectl %v", args)
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "kubectl", args...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return string(out), fmt.Errorf("kubectl %v: %v: %v", args[2], err, strings.TrimSpace(stderr.String()))
+	}
+	return string(out), nil
+}
+
+// k8sPullPolicies maps -pull-policy to the imagePullPolicy of the Jobs.
+var k8sPullPolicies = map[string]string{
+	"always":       "Always",
+	"ifnotpresent": "IfNotPresent",
+	"never":        "Never",
+}
+
+// pull does nothing, the Job pulls trivy itself, with its imagePullPolicy
+// and imagePullSecrets.
+func (b k8sJobBackend) pull(ctx context.Context, image string, username string, password string) error {
+	return nil
+}
+
+// present tells the image is there, as the Job pulls it itself.
+func (b k8sJobBackend) present(ctx context.Context, image string) (bool, error) {
+	return true, nil
+}
+
+// manifest returns the Job running c. Its environment, which holds registry
+// credentials, is read from the Secret of the same name.
+func (b k8sJobBackend) manifest(name string, c trivyContainer) map[string]interface{} {
+	env := []interface{}{}
+	for _, e := range c.Env {
+		key := strings.SplitN(e, "=", 2)[0]
+		env = append(env, map[string]interface{}{
+			"name":      key,
+			"valueFrom": map[string]interface{}{"secretKeyRef": map[string]string{"name": name, "key": key}},
+		})
+	}
+	trivy := map[string]interface{}{
+		"name":            "trivy",
+		"image":           c.Image,
+		"args":            c.Cmd,
+		"env":             env,
+		"imagePullPolicy": b.pullPolicy,
+		"volumeMounts":    []interface{}{map[string]string{"name": "cache", "mountPath": "/.cache"}},
+	}
+	limits := map[string]string{}
+	if c.CPU != "" {
+		limits["cpu"] = c.CPU
+	}
+	if c.Memory != "" {
+		limits["memory"] = c.Memory
+	}
+	if len(limits) > 0 {
+		trivy["resources"] = map[string]interface{}{"limits": limits}
+	}
+	if uid, err := strconv.Atoi(c.User); err == nil {
+		trivy["securityContext"] = map[string]int{"runAsUser": uid}
+	}
+	cache := map[string]interface{}{"name": "cache", "emptyDir": map[string]string{}}
+	if b.cachePVC != "" {
+		cache = map[string]interface{}{"name": "cache", "persistentVolumeClaim": map[string]string{"claimName": b.cachePVC}}
+	}
+	pullSecrets := []map[string]string{}
+	for _, secret := range b.pullSecrets {
+		pullSecrets = append(pullSecrets, map[string]string{"name": secret})
+	}
+	return map[string]interface{}{
+		"apiVersion": "batch/v1",
+		"kind":       "Job",
+		"metadata": map[string]interface{}{
+			"name":   name,
+			"labels": map[string]string{"app.kubernetes.io/managed-by": "helm-trivy"},
+		},
+		"spec": map[string]interface{}{
+			"backoffLimit":            0,
+			"ttlSecondsAfterFinished": 600,
+			"template": map[string]interface{}{
+				"spec": map[string]interface{}{
+					"restartPolicy":    "Never",
+					"nodeSelector":     b.nodeSelector,
+					"imagePullSecrets": pullSecrets,
+					"containers":       []interface{}{trivy},
+					"volumes":          []interface{}{cache},
+				},
+			},
+		},
+	}
+}
+
+// secretManifest returns the Secret holding the environment of the Job
+// running c.
+func (b k8sJobBackend) secretManifest(name string, c trivyContainer) map[string]interface{} {
+	data := map[string]string{}
+	for _, e := range c.Env {
+		kv := strings.SplitN(e, "=", 2)
+		data[kv[0]] = kv[1]
+	}
+	return map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Secret",
+		"metadata": map[string]interface{}{
+			"name":   name,
+			"labels": map[string]string{"app.kubernetes.io/managed-by": "helm-trivy"},
+		},
+		"type":       "Opaque",
+		"stringData": data,
+	}
+}
+
+// ownSecret makes the Job the owner of its Secret, for Kubernetes to delete
+// the Secret along with the Job should helm-trivy not get to it.
+func (b k8sJobBackend) ownSecret(ctx context.Context, name string) error {
+	uid, err := b.kubectl(ctx, nil, "get", "job", name, "-o", "jsonpath={.metadata.uid}")
+	if err != nil {
+		return err
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"ownerReferences": []interface{}{map[string]interface{}{
+				"apiVersion": "batch/v1",
+				"kind":       "Job",
+				"name":       name,
+				"uid":        strings.TrimSpace(uid),
+			}},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = b.kubectl(ctx, nil, "patch", "secret", name, "--type", "merge", "--patch", string(patch))
+	return err
+}
+
+func (b k8sJobBackend) run(ctx context.Context, c trivyContainer, output interface{}) error {
+	name := fmt.Sprintf("helm-trivy-%x", time.Now().UnixNano())
+	secret, err := json.Marshal(b.secretManifest(name, c))
+	if err != nil {
+		return err
+	}
+	manifest, err := json.Marshal(b.manifest(name, c))
+	if err != nil {
+		return err
+	}
+	if _, err := b.kubectl(ctx, secret, "create", "-f", "-"); err != nil {
+		return fmt.Errorf("could not create trivy job secret: %v", err)
+	}
+	defer func() {
+		if _, err := b.kubectl(context.Background(), nil, "delete", "secret", name, "--ignore-not-found", "--wait=false"); err != nil {
+			log.Warnf("Could not delete secret %v: %v", name, err)
+		}
+	}()
+	if _, err := b.kubectl(ctx, manifest, "create", "-f", "-"); err != nil {
+		return fmt.Errorf("could not create trivy job: %v", err)
+	}
+	defer func() {
+		if _, err := b.kubectl(context.Background(), nil, "delete", "job", name, "--cascade=background", "--wait=false"); err != nil {
+			log.Warnf("Could not delete job %v: %v", name, err)
+		}
+	}()
+	if err := b.ownSecret(ctx, name); err != nil {
+		log.Warnf("Could not make job %v the owner of its secret: %v", name, err)
+	}
+	log.Debugf("Started job %v with command: %v", name, c.Cmd)
+	var status string
+	for {
+		status, err = b.kubectl(ctx, nil, "get", "job", name, "-o", "jsonpath={.status.succeeded},{.status.failed}")
+		if err != nil {
+			return fmt.Errorf("could not get trivy job status: %v", err)
+		}
+		if status != "," {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(2 * time.Second):
+		}
+	}
+	terminated, err := b.kubectl(ctx, nil, "get", "pods", "-l", "job-name="+name, "-o", `jsonpath={.items[*].status.containerStatuses[?(@.name=="trivy")].state.terminated.reason},{.items[*].status.containerStatuses[?(@.name=="trivy")].state.terminated.exitCode}`)
+	if err == nil && strings.Contains(terminated, "OOMKilled") {
+		return errOutOfMemory
+	}
+	if strings.SplitN(status, ",", 2)[1] != "" {
+		return withExitCode(exitBackend, "trivy job %v failed: %v", name, b.failure(ctx, name, terminated))
+	}
+	out, err := b.kubectl(ctx, nil, "logs", "job/"+name, "-c", "trivy")
+	if err != nil {
+		return fmt.Errorf("cannot get trivy job logs: %v", err)
+	}
+	return decodeOutput(strings.NewReader(out), output)
+}
+
+// failure explains why the trivy container of a job failed, from the reason
+// and exit code it terminated with and the end of its logs, or from the
+// condition of the job when its pod never ran.
+func (b k8sJobBackend) failure(ctx context.Context, name string, terminated string) string {
+	state := strings.SplitN(terminated, ",", 2)
+	if state[0] == "" {
+		condition, err := b.kubectl(ctx, nil, "get", "job", name, "-o", `jsonpath={.status.conditions[?(@.type=="Failed")].message}`)
+		if err != nil || strings.TrimSpace(condition) == "" {
+			return "the trivy container did not run"
+		}
+		return strings.TrimSpace(condition)
+	}
+	failure := fmt.Sprintf("trivy container terminated with %v, exit code %v", state[0], state[1])
+	if logs, err := b.kubectl(ctx, nil, "logs", "job/"+name, "-c", "trivy", "--tail", "20"); err == nil && strings.TrimSpace(logs) != "" {
+		failure += ": " + strings.TrimSpace(logs)
+	}
+	return failure
+}
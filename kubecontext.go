@@ -0,0 +1,23 @@
+package main
+
+// kubeContext is the kubeconfig context of the cluster commands, the current
+// one if empty. Like other helm plugins, it defaults to the --kube-context
+// helm was given, which helm passes as $HELM_KUBECONTEXT.
+var kubeContext = ""
+
+// kubectlArgs adds the -kube-context to the args of a kubectl command.
+func kubectlArgs(args ...string) []string {
+	if kubeContext == "" {
+		return args
+	}
+	return append(args, "--context", kubeContext)
+}
+
+// helmClusterArgs adds the -kube-context to the args of a helm command
+// reading releases.
+func helmClusterArgs(args ...string) []string {
+	if kubeContext == "" {
+		return args
+	}
+	return append(args, "--kube-context", kubeContext)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// outputLabels is the -output-labels file, renaming the severities and the
+// headings of the reports to the vocabulary of an organization, or
+// translating them. Names not in the file are kept.
+type outputLabels struct {
+	// Severities maps trivy severities to the names shown instead, like
+	// CRITICAL to P1.
+	Severities map[string]string `yaml:"severities" json:"severities,omitempty"`
+	// Text maps the headings and the column names of the text output to
+	// the ones shown instead, like Total to Gesamt.
+	Text map[string]string `yaml:"text" json:"text,omitempty"`
+}
+
+// loadOutputLabels reads an -output-labels file.
+func loadOutputLabels(path string) (*outputLabels, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file outputLabels
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	labels := &outputLabels{Severities: map[string]string{}, Text: file.Text}
+	for severity, label := range file.Severities {
+		severity = strings.ToUpper(severity)
+		if severityRank(severity) == len(severities) {
+			return nil, fmt.Errorf("unknown severity %q, expected one of %v", severity, strings.Join(severities, ","))
+		}
+		labels.Severities[severity] = label
+	}
+	return labels, nil
+}
+
+// severity returns the label of a severity.
+func (l *outputLabels) severity(severity string) string {
+	if l == nil || l.Severities[severity] == "" {
+		return severity
+	}
+	return l.Severities[severity]
+}
+
+// text returns the label of a heading of the text output.
+func (l *outputLabels) text(s string) string {
+	if l == nil || l.Text[s] == "" {
+		return s
+	}
+	return l.Text[s]
+}
+
+// header returns the labels of the tab separated columns of a table header.
+func (l *outputLabels) header(header string) string {
+	columns := strings.Split(header, "\t")
+	for i, column := range columns {
+		columns[i] = l.text(column)
+	}
+	return strings.Join(columns, "\t")
+}
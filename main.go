@@ -1,211 +1,1452 @@
 package main
 
 import (
-	"bufio"
+	"bytes"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"os"
 	"os/exec"
 	"os/signal"
+	"sort"
 	"strings"
 	"syscall"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
-	"github.com/docker/docker/api/types"
-	"github.com/docker/docker/api/types/container"
-	"github.com/docker/docker/client"
 	"golang.org/x/net/context"
 )
 
 var debug = false
 
-func getChartImages(chart string, set string, values string, version string) (error, []string) {
-	images := []string{}
+// stringList is a flag that can be repeated.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// joinedList is a flag that can be repeated, its values being joined with
+// commas into a string.
+type joinedList struct {
+	value *string
+}
+
+func (l joinedList) String() string {
+	if l.value == nil {
+		return ""
+	}
+	return *l.value
+}
+
+func (l joinedList) Set(value string) error {
+	if *l.value != "" {
+		value = *l.value + "," + value
+	}
+	*l.value = value
+	return nil
+}
+
+func getChartImages(chart string, opts scanOptions) (error, []chartImage) {
+	if opts.images != nil {
+		return nil, opts.images
+	}
+	if len(opts.composeFiles) > 0 {
+		images, err := composeImages(opts.composeFiles)
+		return err, images
+	}
+	if opts.expandConditions {
+		images, err := expandedImages(chart, opts)
+		return err, images
+	}
+	span := startSpan(opts, "render")
+	out, err := renderChart(chart, opts)
+	span.end(err)
+	if err != nil {
+		return err, nil
+	}
+	span = startSpan(opts, "discover")
+	images := extractImages(out, opts)
+	span.set("helm_trivy.images", len(images))
+	span.end(nil)
+	return nil, images
+}
+
+// stdinChart is the chart argument reading already rendered manifests from
+// stdin, as in helm template ... | helm trivy -.
+const stdinChart = "-"
+
+var stdinManifests *string
+
+// readStdinManifests reads the manifests of stdin, once.
+func readStdinManifests() (string, error) {
+	if stdinManifests == nil {
+		data, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return "", fmt.Errorf("could not read manifests from stdin: %v", err)
+		}
+		manifests := string(data)
+		stdinManifests = &manifests
+	}
+	return *stdinManifests, nil
+}
+
+// renderChart returns the manifests of chart rendered by helm template, or
+// the manifests of stdin for stdinChart, or of the -f files.
+func renderChart(chart string, opts scanOptions) (string, error) {
+	if chart == stdinChart {
+		return readStdinManifests()
+	}
+	if len(opts.manifestFiles) > 0 {
+		return readManifestFiles(opts.manifestFiles)
+	}
+	out, err := runHelm(templateArgs(chart, opts), opts)
+	if exitErr, ok := err.(*exec.ExitError); ok && len(exitErr.Stderr) > 0 {
+		err = fmt.Errorf("%v: %s", err, bytes.TrimSpace(exitErr.Stderr))
+	}
+	return string(out), err
+}
+
+// templateArgs returns the arguments of the helm template command rendering
+// chart.
+func templateArgs(chart string, opts scanOptions) []string {
 	cmd := []string{"template"}
-	if len(set) > 0 {
-		cmd = append(cmd, "--set", set)
+	if len(opts.templateSet) > 0 {
+		cmd = append(cmd, "--set", opts.templateSet)
 	}
-	if len(values) > 0 {
-		cmd = append(cmd, "--values", values)
+	if len(opts.templateValues) > 0 {
+		cmd = append(cmd, "--values", opts.templateValues)
 	}
-	if len(version) > 0 {
-		cmd = append(cmd, "--version", version)
+	if len(opts.chartVersion) > 0 {
+		cmd = append(cmd, "--version", opts.chartVersion)
+	}
+	// Hooks are rendered by default, make sure it stays that way as
+	// migration jobs and tests often use images of their own.
+	cmd = append(cmd, "--no-hooks=false")
+	return append(cmd, chartArgs(chart, opts)...)
+}
+
+type scanOptions struct {
+	json                bool
+	snyk                bool
+	schemaVersion       int
+	detail              string
+	interactive         bool
+	noPull              bool
+	pullPolicy          string
+	trivyImage          string
+	trivyVersion        string
+	backend             string
+	containerdAddress   string
+	containerdNamespace string
+	k8sNamespace        string
+	k8sNodeSelector     string
+	k8sPullSecrets      string
+	k8sCachePVC         string
+	scanCPU             string
+	scanMemory          string
+	scanNetwork         string
+	httpProxy           string
+	httpsProxy          string
+	noProxy             string
+	imageRewrites       stringList
+	allowedRegistries   string
+	denyLatestTag       bool
+	riskWeights         string
+	exploits            bool
+	failOnKEV           bool
+	failSeverity        string
+	failMax             int
+	severity            string
+	severitySource      string
+	severityMap         string
+	severityRules       []severityRule
+	vulnType            string
+	noChartConfig       bool
+	setFlags            map[string]bool
+	ignoreFile          string
+	ignores             []ignoreRule
+	inferImages         bool
+	embeddedManifests   bool
+	extractRules        []extractRule
+	crdRules            string
+	cacheDir            string
+	scanners            string
+	skipDirs            stringList
+	skipFiles           stringList
+	javaDB              string
+	timeBudget          time.Duration
+	skipLibraries       bool
+	trivyArgs           string
+	trivyUser           string
+	dockerUser          string
+	dockerPass          string
+	credStore           string
+	secretsResolved     bool
+	hooks               []hook
+	formatter           string
+	formattersDir       string
+	releaseStorage      string
+	images              []chartImage
+	scanMemo            *scanMemo
+	remediation         bool
+	expandConditions    bool
+	expandLimit         int
+	templateSet         string
+	templateValues      string
+	valuesSources       string
+	valuesHeaders       stringList
+	valuesToken         string
+	chartVersion        string
+	chartRepo           string
+	devel               bool
+	namespace           string
+	outputDir           string
+	outputFormat        string
+	maxTableRows        int
+	groupBy             string
+	pager               bool
+	repoAliases         stringList
+	repoUsername        string
+	repoPassword        string
+	repoCAFile          string
+	repoCertFile        string
+	repoKeyFile         string
+	registryConfig      string
+	since               string
+	resultCacheURL      string
+	resultCache         resultCache
+	dbVersion           string
+	useOperatorReports  bool
+	operatorMaxAge      time.Duration
+	reusedReports       operatorReports
+	harborHosts         string
+	harborMaxAge        time.Duration
+	export              string
+	exportFile          string
+	ddURL               string
+	ddAPIKey            string
+	ddProduct           string
+	jiraURL             string
+	jiraUser            string
+	jiraToken           string
+	jiraProject         string
+	jiraIssueType       string
+	jiraSeverity        string
+	emailTo             string
+	emailFrom           string
+	smtpServer          string
+	smtpUser            string
+	smtpPassword        string
+	failOn              string
+	strategy            string
+	record              string
+	scanner             string
+	grypeImage          string
+	clairURL            string
+	clairToken          string
+	replay              string
+	labels              *outputLabels
+	events              *eventStream
+	stats               *scanStats
+	tracer              *tracer
+	span                *traceSpan
+	helmContext         context.Context
+	manifestFiles       stringList
+	composeFiles        stringList
+	keyring             string
+	cosignKey           string
+	chartVerification   *chartVerification
+	rekor               bool
+	rekorURL            string
+	imageInputs         stringList
+	fetchDB             bool
+	offline             bool
+	dbRepository        string
+	dbRetries           int
+	dbTimeout           time.Duration
+}
+
+// imageScan is the trivy report of one image of a chart.
+type imageScan struct {
+	Image      string
+	Labels     []string
+	Violations []string
+	Accepted   []acceptedVulnerability
+	Report     trivyReport
+	// ChartVerification is the -verify-chart result of the chart.
+	ChartVerification *chartVerification
+	// Rekor lists the transparency log entries of the image, with -rekor.
+	Rekor []rekorEntry
+	// Remediation is the --set option upgrading the image, with
+	// -remediation.
+	Remediation string
+	// Workloads lists the workloads of the chart running the image.
+	Workloads []imageWorkload
+}
+
+// newTrivyContainer returns the container running trivy with the credentials,
+// proxies and limits of opts, the trivy command still has to be completed.
+func newTrivyContainer(opts scanOptions) trivyContainer {
+	c := trivyContainer{
+		Image:    opts.trivyImage,
+		Cmd:      []string{"--cache-dir", "/.cache"},
+		User:     opts.trivyUser,
+		Env:      []string{"TRIVY_USERNAME=" + opts.dockerUser, "TRIVY_PASSWORD=" + opts.dockerPass},
+		CacheDir: opts.cacheDir,
+		CPU:      opts.scanCPU,
+		Memory:   opts.scanMemory,
+		Network:  opts.scanNetwork,
 	}
-	cmd = append(cmd, chart)
-	log.Debugf("Running helm cmd: helm %v", cmd)
-	out, err := exec.Command("helm", cmd...).Output()
+	for _, proxy := range [][2]string{{"HTTP_PROXY", opts.httpProxy}, {"HTTPS_PROXY", opts.httpsProxy}, {"NO_PROXY", opts.noProxy}} {
+		if proxy[1] != "" {
+			c.Env = append(c.Env, proxy[0]+"="+proxy[1], strings.ToLower(proxy[0])+"="+proxy[1])
+		}
+	}
+	return c
+}
+
+// scanContainer returns the trivy container scanning image, the image is the
+// last argument of its command. Images with an -image-input are read from
+// their input, mounted at /input, instead.
+func scanContainer(image string, opts scanOptions) trivyContainer {
+	c := newTrivyContainer(opts)
+	// Results are always read as JSON, text output is rendered from them.
+	c.Cmd = append(c.Cmd, "-f", "json")
+	if debug {
+		c.Cmd = append(c.Cmd, "-d")
+	} else {
+		c.Cmd = append(c.Cmd, "-q")
+	}
+	if opts.severity != "" && !severityFiltered(opts) {
+		c.Cmd = append(c.Cmd, "--severity", strings.ToUpper(opts.severity))
+	}
+	if opts.fetchDB || opts.offline {
+		c.Cmd = append(c.Cmd, "--skip-db-update")
+	}
+	if opts.offline {
+		c.Cmd = append(c.Cmd, "--offline-scan")
+	}
+	if opts.scanners != "" {
+		c.Cmd = append(c.Cmd, "--scanners", opts.scanners)
+	}
+	for _, dir := range opts.skipDirs {
+		c.Cmd = append(c.Cmd, "--skip-dirs", dir)
+	}
+	for _, file := range opts.skipFiles {
+		c.Cmd = append(c.Cmd, "--skip-files", file)
+	}
+	c.Cmd = append(c.Cmd, analyzerArgs(image, opts)...)
+	args, _ := splitArgs(opts.trivyArgs)
+	c.Cmd = append(c.Cmd, args...)
+	if c.Input = imageInput(image, opts.imageInputs); c.Input != "" {
+		c.Cmd = trivyCommand(append(c.Cmd, "--input", "/input"), opts.trivyVersion)
+		return c
+	}
+	image = rewriteImage(image, opts.imageRewrites)
+	if opts.dockerUser == "" && opts.credStore != "" {
+		user, password := registryCredentials(image, opts)
+		for i, env := range c.Env {
+			if strings.HasPrefix(env, "TRIVY_USERNAME=") {
+				c.Env[i] = "TRIVY_USERNAME=" + user
+			} else if strings.HasPrefix(env, "TRIVY_PASSWORD=") {
+				c.Env[i] = "TRIVY_PASSWORD=" + password
+			}
+		}
+	}
+	c.Cmd = trivyCommand(append(c.Cmd, image), opts.trivyVersion)
+	return c
+}
+
+// splitArgs splits s into arguments the way a shell does: arguments are
+// separated by spaces unless quoted, and backslashes escape the next
+// character outside of single quotes.
+func splitArgs(s string) ([]string, error) {
+	args := []string{}
+	var current strings.Builder
+	inArg, escaped := false, false
+	var quote rune
+	for _, r := range s {
+		switch {
+		case escaped:
+			current.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped, inArg = true, true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				current.WriteRune(r)
+			}
+		case r == '"' || r == '\'':
+			quote, inArg = r, true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote in %q", quote, s)
+	}
+	if escaped {
+		return nil, fmt.Errorf("trailing backslash in %q", s)
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	return args, nil
+}
+
+// trivyScanners lists the scanners trivy can run on images.
+var trivyScanners = []string{"vuln", "secret", "misconfig", "license"}
+
+// validateScanners checks the scanners, skipped paths and extra args passed
+// to trivy.
+func validateScanners(opts scanOptions) error {
+	if opts.scanners != "" {
+		for _, scanner := range strings.Split(opts.scanners, ",") {
+			known := false
+			for _, s := range trivyScanners {
+				known = known || scanner == s
+			}
+			if !known {
+				return fmt.Errorf("unknown scanner %q, expected one of %v", scanner, strings.Join(trivyScanners, ","))
+			}
+		}
+	}
+	if _, err := splitArgs(opts.trivyArgs); err != nil {
+		return fmt.Errorf("invalid trivy args: %v", err)
+	}
+	for _, path := range append(append([]string{}, opts.skipDirs...), opts.skipFiles...) {
+		if path == "" || strings.Contains(path, ",") {
+			return fmt.Errorf("invalid skipped path %q, repeat the flag to skip several paths", path)
+		}
+	}
+	return nil
+}
+
+// scanChart renders chart and scans each image it references. progress, if
+// not nil, is called before each image is scanned.
+func scanChart(chart string, ctx context.Context, backend scanBackend, opts scanOptions, progress func(image string, done int, total int)) ([]imageScan, error) {
+	log.Infof("Scanning chart %s", chart)
+	start := time.Now()
+	opts.events.emit(event{Type: "scan_started", Chart: chart})
+	span := startSpan(opts, "scan chart")
+	span.set("helm.chart", chart)
+	opts.span = span
+	scans, failed, err := scanChartImages(chart, ctx, backend, opts, progress)
+	span.set("helm_trivy.images", len(scans)+failed)
+	span.set("helm_trivy.failed", failed)
+	span.end(err)
+	finished := event{Type: "scan_finished", Chart: chart, Images: len(scans) + failed, Failed: failed, Duration: time.Since(start).Seconds()}
 	if err != nil {
-		return err, images
+		finished.Error = err.Error()
 	}
-	scanner := bufio.NewScanner(strings.NewReader(string(out)))
-ScannerLoop:
-	for scanner.Scan() {
-		line := scanner.Text()
-		if !strings.Contains(line, "image: ") {
+	opts.events.emit(finished)
+	return scans, err
+}
+
+// scanChartImages does the work of scanChart, also returning the number of
+// images that could not be scanned.
+func scanChartImages(chart string, ctx context.Context, backend scanBackend, opts scanOptions, progress func(image string, done int, total int)) ([]imageScan, int, error) {
+	if err := runChartHooks("pre-render", chart, nil, opts); err != nil {
+		return nil, 0, err
+	}
+	if !opts.noChartConfig && chart != stdinChart && len(opts.manifestFiles) == 0 && len(opts.composeFiles) == 0 {
+		annotations, err := chartAnnotations(chart, opts)
+		if err != nil {
+			return nil, 0, withExitCode(exitRender, "could not read chart %v: %v", chart, err)
+		}
+		if opts, err = applyChartConfig(annotations, opts); err != nil {
+			return nil, 0, withExitCode(exitRender, "%v", err)
+		}
+	}
+	err, images := getChartImages(chart, opts)
+	if err != nil {
+		return nil, 0, withExitCode(exitRender, "could not find images for chart %v: %v. Did you run 'helm repo update', or does it need -repo?", chart, err)
+	}
+	if len(images) == 0 {
+		return nil, 0, withExitCode(exitRender, "no images found in chart %s", chart)
+	}
+	log.Debugf("Found images for chart %v: %v", chart, images)
+	if err := runChartHooks("post-discover", chart, images, opts); err != nil {
+		return nil, 0, err
+	}
+	for _, image := range images {
+		opts.events.emit(event{Type: "image_discovered", Chart: chart, Image: image.Name})
+	}
+	if opts.since != "" {
+		if images, err = changedImages(chart, images, opts); err != nil {
+			return nil, 0, withExitCode(exitRender, "%v", err)
+		}
+		if len(images) == 0 {
+			log.Infof("No image changed since %v", opts.since)
+		}
+	}
+	var deadline time.Time
+	if opts.timeBudget > 0 {
+		images = prioritizeImages(images, opts)
+		deadline = time.Now().Add(opts.timeBudget)
+	}
+	var values []valuesImage
+	if opts.remediation && chart != stdinChart && len(opts.manifestFiles) == 0 && len(opts.composeFiles) == 0 {
+		defaults, err := chartValues(chart, opts)
+		if err != nil {
+			log.Warnf("Could not get values of chart %v, no remediation hints: %v", chart, err)
+		} else {
+			values = findValuesImages(defaults, nil)
+		}
+	}
+	scans := []imageScan{}
+	failed := []string{}
+	skipped := []string{}
+	stopped := []string{}
+	failing := ""
+	for i, image := range images {
+		if failing != "" {
+			opts.events.emit(event{Type: "image_skipped", Chart: chart, Image: image.Name})
+			stopped = append(stopped, image.Name)
 			continue
 		}
-		image := strings.Split(line, "image: ")[1]
-		image = strings.Trim(image, "\"")
-		log.Debugf("Found image %v", image)
-		for _, v := range images {
-			if v == image {
-				continue ScannerLoop
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			opts.events.emit(event{Type: "image_skipped", Chart: chart, Image: image.Name})
+			skipped = append(skipped, image.Name)
+			continue
+		}
+		if progress != nil {
+			progress(image.Name, i, len(images))
+		}
+		log.Debugf("Scanning image %v", image)
+		report, err := scanImageCached(image.Name, ctx, backend, opts)
+		if err != nil {
+			log.Errorf("Could not scan image %v: %v", image.Name, err)
+			opts.events.emit(event{Type: "image_scanned", Chart: chart, Image: image.Name, Error: err.Error()})
+			failed = append(failed, image.Name)
+			continue
+		}
+		// Images read from an -image-input have no digest in a registry.
+		if imageInput(image.Name, opts.imageInputs) == "" {
+			if err := saveScan(image.Name, report, opts); err != nil {
+				log.Warnf("Could not cache scan of %v: %v", image.Name, err)
+			}
+		}
+		report, accepted := applyIgnores(image, applySeverities(report, opts), opts.ignores, time.Now())
+		report = sortVulnerabilities(report)
+		scan := imageScan{
+			Image:             image.Name,
+			Labels:            image.Labels,
+			Violations:        imageViolations(image.Name, opts),
+			Accepted:          accepted,
+			Report:            report,
+			ChartVerification: opts.chartVerification,
+			Workloads:         image.Workloads,
+		}
+		if opts.rekor {
+			if scan.Rekor, err = rekorEntries(image.Name, opts); err != nil {
+				log.Warnf("Could not look %v up in Rekor: %v", image.Name, err)
+			}
+		}
+		if values != nil {
+			scan.Remediation = remediationHint(image.Name, report, values, opts)
+		}
+		opts.events.emit(imageScanned(chart, scan))
+		scans = append(scans, scan)
+		if opts.strategy == strategyFailFast {
+			fails, err := failsChecks(scan, opts)
+			if err != nil {
+				log.Warnf("Could not check image %v: %v", image.Name, err)
+			}
+			if fails {
+				failing = image.Name
 			}
 		}
-		images = append(images, image)
 	}
-	return nil, images
+	if len(stopped) > 0 {
+		log.Warnf("Image %v fails the checks, %d of %d images not scanned: %v", failing, len(stopped), len(images), strings.Join(stopped, ", "))
+	}
+	// Images are scanned in the order of the chart, or by priority with
+	// -time-budget, but reported by name.
+	sort.SliceStable(scans, func(i, j int) bool { return scans[i].Image < scans[j].Image })
+	if len(skipped) > 0 {
+		log.Warnf("Time budget of %v exhausted, %d of %d images not scanned: %v", opts.timeBudget, len(skipped), len(images), strings.Join(skipped, ", "))
+	}
+	if len(failed) == len(images)-len(skipped)-len(stopped) {
+		return scans, len(failed), withExitCode(exitBackend, "could not scan any image of chart %v", chart)
+	}
+	if len(failed) > 0 {
+		return scans, len(failed), withExitCode(exitPartial, "could not scan images %v", strings.Join(failed, ", "))
+	}
+	return scans, 0, nil
+}
+
+// printScans prints the results of a chart scan.
+func printScans(result chartResult, opts scanOptions) {
+	weights, _ := parseRiskWeights(opts.riskWeights)
+	reports := result.reports()
+	switch {
+	case opts.interactive:
+		if err := browseReports(reports, os.Stdin, os.Stdout); err != nil {
+			fatal(exitPartial, opts, "Results browser failed: %v", err)
+		}
+	case opts.snyk:
+		if err := writeSnykReport(redactingWriter{os.Stdout}, reports); err != nil {
+			fatal(exitPartial, opts, "Could not write snyk report: %v", err)
+		}
+	case opts.json:
+		if err := writeJSONReport(redactingWriter{os.Stdout}, result, opts.schemaVersion); err != nil {
+			fatal(exitBackend, opts, "Could not merge trivy outputs: %v", err)
+		}
+		fmt.Println()
+		if summary := eolSummary(reports); summary != "" {
+			log.Warn(summary)
+		}
+		log.Info(vulnTypeSummary(reports, opts.vulnType))
+		log.Infof("Risk score: %.1f/100", riskScore(reports, weights))
+	case opts.formatter != "":
+		if err := runFormatter(redactingWriter{os.Stdout}, result, opts); err != nil {
+			fatal(exitPartial, opts, "%v", err)
+		}
+	default:
+		w := io.Writer(os.Stdout)
+		if opts.pager {
+			var done func()
+			w, done = openPager()
+			defer done()
+		}
+		w = redactingWriter{w}
+		if opts.groupBy != "image" {
+			printGrouped(w, result, opts)
+		} else {
+			for _, report := range reports {
+				printReport(w, report, opts)
+			}
+		}
+		if summary := eolSummary(reports); summary != "" {
+			fmt.Fprintln(w, summary)
+		}
+		fmt.Fprintln(w, vulnTypeSummary(reports, opts.vulnType))
+		fmt.Fprintf(w, "Risk score: %.1f/100\n", riskScore(reports, weights))
+		if opts.chartVerification != nil {
+			fmt.Fprintln(w, opts.chartVerification)
+		}
+	}
 }
 
-func scanImage(image string, ctx context.Context, cli *client.Client, cacheDir string, json bool, trivyOpts string, trivyUser string, dockerUser string, dockerPass string) string {
-	config := container.Config{
-		Image: "aquasec/trivy",
-		Cmd:   []string{"--cache-dir", "/.cache"},
-		Tty:   true,
-		User:  trivyUser,
-		Env: []string{"TRIVY_USERNAME=" + dockerUser, "TRIVY_PASSWORD=" + dockerPass},
+// hasViolations tells whether an image breaks the image policies.
+func hasViolations(scans []imageScan) bool {
+	for _, scan := range scans {
+		if len(scan.Violations) > 0 {
+			return true
+		}
 	}
-	if json {
-		config.Cmd = append(config.Cmd, "-f", "json")
+	return false
+}
+
+// proxyEnv returns the value of a proxy environment variable, which may be
+// set in upper or lower case.
+func proxyEnv(name string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
 	}
+	return os.Getenv(strings.ToLower(name))
+}
+
+// addScannerFlags registers the flags controlling how trivy is run, shared by
+// every subcommand.
+func addScannerFlags(fs *flag.FlagSet, opts *scanOptions) {
+	fs.BoolVar(&debug, "debug", false, "Enable debug logging")
+	fs.BoolVar(&opts.noPull, "nopull", false, "Don't pull latest trivy image if present, same as -pull-policy ifnotpresent")
+	fs.StringVar(&opts.pullPolicy, "pull-policy", "always", "When the trivy image is pulled: always, ifnotpresent or never, a present image is used when the pull fails")
+	fs.StringVar(&opts.trivyImage, "trivy-image", "aquasec/trivy", "Trivy image run by the scans, pulled with the registry credentials of the images")
+	fs.StringVar(&opts.scanner, "scanner", "trivy", "Vulnerability scanner engine: trivy, grype or clair, whose results are converted to the trivy ones")
+	fs.StringVar(&opts.grypeImage, "grype-image", "anchore/grype", "Grype image run by the scans with -scanner grype")
+	fs.StringVar(&opts.clairURL, "clair-url", os.Getenv("CLAIR_URL"), "URL of the Clair v4 instance images are submitted to with -scanner clair, defaults to $CLAIR_URL")
+	fs.StringVar(&opts.clairToken, "clair-token", os.Getenv("CLAIR_TOKEN"), "Bearer token of the Clair API, defaults to $CLAIR_TOKEN")
+	fs.StringVar(&opts.trivyVersion, "trivy-version", "", "Version of the trivy image, whose flags are adapted to it, detected if empty")
+	fs.StringVar(&opts.record, "record", "", "Record the helm and trivy outputs of the run in this directory, for -replay")
+	fs.StringVar(&opts.replay, "replay", "", "Replay the helm and trivy outputs recorded in this directory by -record, without running helm, trivy nor the container runtime")
+	fs.StringVar(&opts.backend, "backend", "docker", "Container runtime running trivy: docker, containerd or k8s-job")
+	fs.StringVar(&opts.containerdAddress, "containerd-address", "", "containerd socket used by the containerd backend, nerdctl's default if empty")
+	fs.StringVar(&opts.containerdNamespace, "containerd-namespace", "default", "containerd namespace used by the containerd backend")
+	fs.StringVar(&opts.k8sNamespace, "k8s-namespace", "default", "Namespace of the scan jobs of the k8s-job backend")
+	fs.StringVar(&opts.k8sNodeSelector, "k8s-node-selector", "", "Node selector of the scan jobs of the k8s-job backend, format: 'key1=value1,key2=value2'")
+	fs.StringVar(&opts.k8sPullSecrets, "k8s-pull-secrets", "", "Comma separated imagePullSecrets of the scan jobs of the k8s-job backend")
+	fs.StringVar(&opts.k8sCachePVC, "k8s-cache-pvc", "", "PersistentVolumeClaim holding the vuln cache of the k8s-job backend, the cache is not kept if empty")
+	fs.StringVar(&opts.scanCPU, "scan-cpu", "", "CPU limit of the trivy containers, in CPUs (1.5) or millicpus (500m)")
+	fs.StringVar(&opts.scanMemory, "scan-memory", "", "Memory limit of the trivy containers (512Mi, 2Gi...)")
+	fs.StringVar(&opts.scanNetwork, "scan-network", "", "Network the trivy containers are attached to, with the docker and containerd backends")
+	fs.StringVar(&opts.httpProxy, "http-proxy", proxyEnv("HTTP_PROXY"), "HTTP proxy used by trivy, defaults to $HTTP_PROXY")
+	fs.StringVar(&opts.httpsProxy, "https-proxy", proxyEnv("HTTPS_PROXY"), "HTTPS proxy used by trivy, defaults to $HTTPS_PROXY")
+	fs.StringVar(&opts.noProxy, "no-proxy", proxyEnv("NO_PROXY"), "Hosts trivy reaches without proxy, defaults to $NO_PROXY")
+	fs.Var(&opts.imageInputs, "image-input", "Scan an image from a docker save tar or an OCI layout directory, format: 'nginx:1.25=./nginx.tar', can be repeated")
+	fs.Var(&opts.imageRewrites, "image-rewrite", "Scan images from a mirror, format: 'docker.io=registry.corp.local/dockerhub', can be repeated")
+	fs.StringVar(&opts.scanners, "scanners", "", "Comma separated trivy scanners: vuln, secret, misconfig or license, trivy's default if empty")
+	fs.Var(&opts.skipDirs, "skip-dirs", "Directory of the images trivy skips, can be repeated")
+	fs.Var(&opts.skipFiles, "skip-files", "File of the images trivy skips, can be repeated")
+	fs.StringVar(&opts.javaDB, "java-db", "auto", "Java DB download: on, off, or auto to download it only for images whose name looks like a JVM one (openjdk, tomcat, kafka...)")
+	fs.BoolVar(&opts.skipLibraries, "skip-libraries", false, "Only analyze the OS packages of the images, not their application libraries")
+	fs.StringVar(&opts.trivyArgs, "trivyargs", "", "CLI args to passthrough to trivy, quoted like in a shell")
+	fs.StringVar(&opts.trivyUser, "trivyuser", "1000", "Specify user to run Trivy as")
+	fs.StringVar(&opts.dockerUser, "dockeruser", "", "Specify Docker Auth username")
+	fs.StringVar(&opts.dockerPass, "dockerpass", "", "Specify Docker Auth password")
+	fs.StringVar(&opts.credStore, "cred-store", "", "Get registry credentials from this docker credential helper when -dockeruser is not set: osxkeychain, wincred, pass, secretservice, or auto for the one of the OS")
+	fs.StringVar(&opts.cacheDir, "cachedir", "", "Set vuln cache dir, if empty a tmp dir is used")
+	fs.BoolVar(&opts.useOperatorReports, "operator-reports", false, "Reuse the trivy-operator VulnerabilityReports of the current cluster for the images they cover")
+	fs.DurationVar(&opts.operatorMaxAge, "operator-max-age", 24*time.Hour, "Ignore VulnerabilityReports last updated longer ago than this")
+	fs.StringVar(&opts.harborHosts, "harbor", "", "Comma separated Harbor registries whose scan results are reused for the images they host")
+	fs.DurationVar(&opts.harborMaxAge, "harbor-max-age", 24*time.Hour, "Ignore Harbor scan results older than this")
+	fs.DurationVar(&opts.timeBudget, "time-budget", 0, "Stop scanning images of a chart after this time, images never or least recently scanned first, no limit if 0")
+	fs.BoolVar(&opts.fetchDB, "download-db", false, "Download the vulnerability DB into the cache dir before scanning, resuming interrupted downloads, instead of having trivy download it, keep it with -cachedir")
+	fs.BoolVar(&opts.offline, "offline", false, "Scan without network access, with the trivy image and the DBs of -cachedir already there, as helm trivy bundle import leaves them: the trivy image is not pulled and trivy doesn't update its DBs")
+	fs.StringVar(&opts.dbRepository, "db-repository", defaultDBRepository, "OCI repository the vulnerability DB is downloaded from with -download-db")
+	fs.IntVar(&opts.dbRetries, "db-retries", 5, "Attempts at downloading the vulnerability DB with -download-db")
+	fs.DurationVar(&opts.dbTimeout, "db-timeout", 5*time.Minute, "Time an attempt at downloading the vulnerability DB with -download-db is given")
+	fs.StringVar(&kubeContext, "kube-context", os.Getenv("HELM_KUBECONTEXT"), "Kubeconfig context of the cluster the releases, reports and scan jobs are read from or run in, defaults to $HELM_KUBECONTEXT, the current context if empty")
+	fs.StringVar(&opts.resultCacheURL, "result-cache", "", "Scan results cache shared by several hosts: redis://[:password@]host[:port][/db] or the URL of an HTTP cache")
+}
+
+// addChartFlags registers the flags controlling how charts are rendered.
+func addChartFlags(fs *flag.FlagSet, opts *scanOptions) {
+	fs.StringVar(&opts.templateSet, "set", "", "Values to set for helm chart, format: 'key1=value1,key2=value2'")
+	fs.Var(joinedList{&opts.templateValues}, "values", "Specify chart values in YAML files or URLs, comma separated or repeated, merged in order, the documents of multi-document files too")
+	fs.Var(&opts.valuesHeaders, "values-header", "Header sent when fetching values URLs, format: 'Name: value', can be repeated")
+	fs.StringVar(&opts.valuesToken, "values-token", "", "Bearer token sent when fetching values URLs")
+	fs.StringVar(&opts.chartVersion, "version", "", "Specify chart version, or a semver range like '^2.1' to use the highest matching version")
+	fs.BoolVar(&opts.devel, "devel", false, "Use development versions too, equivalent to version '>0.0.0-0', ignored if -version is set")
+	fs.StringVar(&opts.chartRepo, "repo", "", "Chart repository URL the chart is fetched from, without adding it with helm repo add")
+	fs.StringVar(&opts.repoUsername, "repo-username", "", "Username of the chart repository or OCI registry")
+	fs.StringVar(&opts.repoPassword, "repo-password", os.Getenv("HELM_REPO_PASSWORD"), "Password of the chart repository or OCI registry, defaults to $HELM_REPO_PASSWORD")
+	fs.StringVar(&opts.repoCAFile, "repo-ca-file", "", "CA bundle verifying the certificate of the chart repository or OCI registry")
+	fs.StringVar(&opts.repoCertFile, "repo-cert-file", "", "Client certificate of the chart repository or OCI registry")
+	fs.StringVar(&opts.repoKeyFile, "repo-key-file", "", "Key of the client certificate of the chart repository or OCI registry")
+	fs.StringVar(&opts.registryConfig, "registry-config", "", "Credentials file of OCI registries, as written by helm registry login, helm's default if empty")
+	fs.Var(&opts.repoAliases, "repo-alias", "Fetch the charts of a repository not added with helm repo add, format: 'bitnami=https://charts.bitnami.com/bitnami', can be repeated")
+}
+
+// addPolicyFlags registers the flags of the image policies.
+func addPolicyFlags(fs *flag.FlagSet, opts *scanOptions) {
+	fs.StringVar(&opts.allowedRegistries, "allowed-registries", "", "Comma separated registries (or registry/namespace prefixes) images may come from")
+	fs.BoolVar(&opts.denyLatestTag, "deny-latest-tag", false, "Flag images using the latest tag, or no tag")
+	fs.StringVar(&opts.severity, "severity", "", "Comma separated severities to report, all if empty")
+	fs.StringVar(&opts.severitySource, "severity-source", "", "Comma separated sources the severities are taken from, in order of preference: nvd, vendor (the distribution or ecosystem advisories), ghsa, redhat..., trivy's choice if empty")
+	fs.StringVar(&opts.severityMap, "severity-map", "", "Comma separated severity re-mappings applied after -severity-source, format: '[source:]FROM=TO', like 'ubuntu:LOW=UNKNOWN'")
+	fs.BoolVar(&opts.noChartConfig, "no-chart-config", false, "Ignore the scan settings recommended by the helm-trivy/ annotations of the chart")
+	fs.StringVar(&opts.riskWeights, "risk-weights", defaultRiskWeights, "Weights of the chart risk score, by severity, for fixable and for known exploited vulnerabilities")
+	fs.StringVar(&opts.ignoreFile, "ignore-file", "", "File of accepted vulnerabilities, one per line: <ID> [image=...] [chart=...] [until=YYYY-MM-DD] [reason=...]")
+	fs.BoolVar(&opts.exploits, "exploits", false, "Add EPSS scores and CISA KEV status to vulnerabilities")
+	fs.StringVar(&opts.vulnType, "vuln-type", "os,library", "Comma separated package types whose vulnerabilities fail checks: os or library, the others are only reported")
+	fs.BoolVar(&opts.failOnKEV, "fail-on-kev", false, "Exit with status 1 when a known exploited vulnerability is found, implies -exploits")
+	fs.StringVar(&opts.failSeverity, "fail-severity", "", "Comma separated severities counted against -fail-max, vulnerabilities never fail the scan if empty")
+	fs.IntVar(&opts.failMax, "fail-max", 0, "Exit with status 1 when an image has more vulnerabilities of -fail-severity than this")
+	fs.StringVar(&opts.strategy, "strategy", strategyCollectAll, "collect-all (scan every image, for a complete report) or fail-fast (stop at the first image failing the checks)")
+}
+
+// setupScanner connects to the container runtime, pulls trivy and prepares
+// the vuln cache directory. The returned function cleans up what was created.
+func setupScanner(opts *scanOptions) (context.Context, scanBackend, func()) {
 	if debug {
-		config.Cmd = append(config.Cmd, "-d")
-	} else {
-		config.Cmd = append(config.Cmd, "-q")
+		log.SetLevel(log.DebugLevel)
+	}
+	if err := resolveSecretRefs(opts); err != nil {
+		fatal(exitUsage, *opts, "%v", err)
+	}
+	registerSecrets(*opts)
+	tracer, err := newTracer()
+	if err != nil {
+		log.Warnf("Not exporting traces: %v", err)
+	}
+	opts.tracer = tracer
+
+	if err := validateRewrites(opts.imageRewrites); err != nil {
+		fatal(exitUsage, *opts, "%v", err)
+	}
+	if err := validateRepoAliases(opts.repoAliases); err != nil {
+		fatal(exitUsage, *opts, "%v", err)
+	}
+	if err := validateImageInputs(opts.imageInputs); err != nil {
+		fatal(exitUsage, *opts, "%v", err)
+	}
+	if len(opts.imageInputs) > 0 && opts.backend == "k8s-job" {
+		fatal(exitUsage, *opts, "Image inputs can't be used with the k8s-job backend")
+	}
+	if opts.noPull && !opts.setFlags["pull-policy"] {
+		opts.pullPolicy = "ifnotpresent"
+	}
+	if opts.offline && !opts.setFlags["pull-policy"] {
+		opts.pullPolicy = "never"
+	}
+	if err := validatePullPolicy(opts.pullPolicy); err != nil {
+		fatal(exitUsage, *opts, "%v", err)
+	}
+	if opts.fetchDB && opts.backend == "k8s-job" {
+		fatal(exitUsage, *opts, "-download-db can't be used with the k8s-job backend")
+	}
+	if opts.offline && (opts.fetchDB || opts.cacheDir == "") {
+		fatal(exitUsage, *opts, "-offline needs the -cachedir holding the DBs, and can't be used with -download-db")
+	}
+	if opts.dbRetries < 1 {
+		fatal(exitUsage, *opts, "-db-retries must be positive")
+	}
+	if _, err := parseRiskWeights(opts.riskWeights); err != nil {
+		fatal(exitUsage, *opts, "%v", err)
+	}
+	if err := validateSeverities(opts.severity); err != nil {
+		fatal(exitUsage, *opts, "%v", err)
+	}
+	if err := validateSeverities(opts.failSeverity); err != nil {
+		fatal(exitUsage, *opts, "Invalid -fail-severity: %v", err)
+	}
+	if opts.failMax < 0 {
+		fatal(exitUsage, *opts, "-fail-max can't be negative")
 	}
-	config.Cmd = append(config.Cmd, strings.Fields(trivyOpts)...)
-	config.Cmd = append(config.Cmd, image)
-	resp, err := cli.ContainerCreate(ctx, &config, &container.HostConfig{
-		Binds: []string{cacheDir + ":/.cache"},
-	}, nil, "")
+	rules, err := parseSeverityMap(opts.severityMap)
 	if err != nil {
-		log.Fatalf("Could not create trivy container: %v", err)
+		fatal(exitUsage, *opts, "%v", err)
 	}
-	log.Debugf("Starting container with command: %v", config.Cmd)
-	if err := cli.ContainerStart(ctx, resp.ID, types.ContainerStartOptions{}); err != nil {
-		log.Fatalf("Could not start trivy container: %v", err)
+	opts.severityRules = rules
+	if err := validateVulnTypes(opts.vulnType); err != nil {
+		fatal(exitUsage, *opts, "%v", err)
 	}
-	statusCh, errCh := cli.ContainerWait(ctx, resp.ID, container.WaitConditionNotRunning)
-	select {
-	case err := <-errCh:
+	if err := validateScanners(*opts); err != nil {
+		fatal(exitUsage, *opts, "%v", err)
+	}
+	if err := validateJavaDB(opts.javaDB); err != nil {
+		fatal(exitUsage, *opts, "%v", err)
+	}
+	if err := validateCredStore(opts.credStore); err != nil {
+		fatal(exitUsage, *opts, "%v", err)
+	}
+	if err := validateStrategy(opts.strategy); err != nil {
+		fatal(exitUsage, *opts, "%v", err)
+	}
+	if err := validateRecordReplay(*opts); err != nil {
+		fatal(exitUsage, *opts, "%v", err)
+	}
+	if err := validateScanner(*opts); err != nil {
+		fatal(exitUsage, *opts, "%v", err)
+	}
+	opts.exploits = opts.exploits || opts.failOnKEV
+	if opts.ignoreFile != "" {
+		rules, err := loadIgnoreFile(opts.ignoreFile)
 		if err != nil {
-			log.Fatalf("Error while waiting for container: %v", err)
+			fatal(exitUsage, *opts, "Invalid ignore file %v: %v", opts.ignoreFile, err)
 		}
-	case <-statusCh:
+		warnExpired(rules)
+		opts.ignores = rules
 	}
 
-	out, err := cli.ContainerLogs(ctx, resp.ID, types.ContainerLogsOptions{ShowStdout: true, ShowStderr: false})
+	ctx := context.Background()
+	if opts.replay != "" {
+		// Scans are replayed, without trivy nor its DB.
+		log.Infof("Replaying helm and trivy outputs from %v", opts.replay)
+		return ctx, nil, func() {}
+	}
+	if opts.scanner == "clair" {
+		// Images are submitted to Clair, no container runs.
+		if opts.useOperatorReports {
+			if opts.reusedReports, err = loadOperatorReports(opts.operatorMaxAge); err != nil {
+				log.Warnf("Not reusing trivy-operator reports: %v", err)
+			}
+		}
+		return ctx, nil, func() {}
+	}
+	backend, err := newBackend(*opts)
 	if err != nil {
-		log.Fatalf("Cannot get container logs: %v", err)
+		fatal(exitBackend, *opts, "Could not set up %v backend: %v", opts.backend, err)
 	}
-	outputContent, _ := ioutil.ReadAll(out)
-	return string(outputContent)
-}
 
-func scanChart(chart string, json bool, ctx context.Context, cli *client.Client, cacheDir string, trivyOpts string, trivyUser string, dockerUser string, dockerPass string, templateSet string, templateValues string, chartversion string) {
-	log.Infof("Scanning chart %s", chart)
-	jsonOutput := ""
-	if err, images := getChartImages(chart, templateSet, templateValues, chartversion); err != nil {
-		log.Fatalf("Could not find images for chart %v: %v. Did you run 'helm repo update' ?", chart, err)
-	} else {
-		if len(images) == 0 {
-			log.Fatalf("No images found in chart %s.", chart)
-		}
-		log.Debugf("Found images for chart %v: %v", chart, images)
-		for _, image := range images {
-			log.Debugf("Scanning image %v", image)
-			output := scanImage(image, ctx, cli, cacheDir, json, trivyOpts, trivyUser, dockerUser, dockerPass)
-			if json {
-				jsonOutput += output
-			} else {
-				fmt.Println(output)
-			}
+	if err := pullScanner(ctx, backend, *opts); err != nil {
+		fatal(exitBackend, *opts, "%v", err)
+	}
+	cleanup := func() {}
+	if opts.cacheDir == "" {
+		cacheDir, err := ioutil.TempDir("", "helm-trivy")
+		if err != nil {
+			fatal(exitBackend, *opts, "Could not create cache dir: %v", err)
+		}
+		opts.cacheDir = cacheDir
+		cleanup = atExit(func() { os.RemoveAll(cacheDir) })
+
+		go func() {
+			sigCh := make(chan os.Signal, 1)
+			signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+			<-sigCh
+			runCleanups()
+			os.Exit(0)
+		}()
+	}
+	log.Debugf("Using %v as cache directory for vuln db", opts.cacheDir)
+	if opts.fetchDB {
+		if err := fetchDB(*opts); err != nil {
+			fatal(exitBackend, *opts, "%v", err)
 		}
 	}
-	if json {
-		fmt.Println(strings.ReplaceAll(jsonOutput, "][", ","))
+	if opts.trivyVersion == "" && opts.scanner != "grype" {
+		opts.trivyVersion = detectTrivyVersion(ctx, backend, *opts)
+	}
+	log.Debugf("Using %v as user for vulnerability scanning", opts.trivyUser)
+
+	if opts.useOperatorReports {
+		if opts.reusedReports, err = loadOperatorReports(opts.operatorMaxAge); err != nil {
+			log.Warnf("Not reusing trivy-operator reports: %v", err)
+		}
+	}
+	if opts.resultCacheURL != "" {
+		cache, err := newResultCache(opts.resultCacheURL)
+		if err != nil {
+			fatal(exitUsage, *opts, "%v", err)
+		}
+		// Results are shared per vulnerability DB, so it is downloaded
+		// first to know its version.
+		if opts.dbVersion, err = downloadDB(ctx, backend, *opts); err != nil {
+			log.Warnf("Not using the result cache, could not get the vulnerability DB version: %v", err)
+		} else {
+			opts.resultCache = cache
+		}
 	}
+	return ctx, backend, cleanup
 }
 
 func main() {
-	var jsonOutput bool
-	var noPull bool
+	log.SetFormatter(redactingFormatter{log.StandardLogger().Formatter})
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "serve":
+			serveMain(os.Args[2:])
+			return
+		case "webhook":
+			webhookMain(os.Args[2:])
+			return
+		case "pin":
+			pinMain(os.Args[2:])
+			return
+		case "quick":
+			quickMain(os.Args[2:])
+			return
+		case "verify-manifest":
+			verifyManifestMain(os.Args[2:])
+			return
+		case "upgrade-check":
+			upgradeCheckMain(os.Args[2:])
+			return
+		case "releases":
+			releasesMain(os.Args[2:])
+			return
+		case "generate-chart":
+			generateChartMain(os.Args[2:])
+			return
+		case "fix":
+			fixMain(os.Args[2:])
+			return
+		case "helmcharts":
+			helmChartsMain(os.Args[2:])
+			return
+		case "fleet":
+			fleetMain(os.Args[2:])
+			return
+		case "convert":
+			convertMain(os.Args[2:])
+			return
+		case "bundle":
+			bundleMain(os.Args[2:])
+			return
+		case "scan":
+			// Explicit name of the default command.
+			os.Args = append(os.Args[:1], os.Args[2:]...)
+		}
+	}
+
+	var opts scanOptions
 	var chart string = ""
-	var templateSet = ""
-	var templateValues = ""
-	var chartVersion = ""
-	var trivyArgs = ""
-	var trivyUser = ""
-	var cacheDir = ""
-	
-	var dockerUser = ""
-	var dockerPass = ""
+	var extractRules = ""
+	var manifest = ""
+	var annotateOutput = ""
+	var dependencies = ""
+	var matrix = ""
+	var valuesGlob = ""
+	var events = ""
+	var verify = false
+	var reuseValues = ""
+	var eventsFile = ""
+	var stats = false
+	var printPlan = false
+	var summaryLine = false
+	var outputLabelsFile = ""
+	var format = "text"
+	var hooks stringList
 
 	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage: helm trivy [options] <helm chart>\n")
+		fmt.Fprintf(os.Stderr, "Usage: helm trivy [scan] [options] <helm chart>\n")
+		fmt.Fprintf(os.Stderr, "       helm template ... | helm trivy [scan] [options] -\n")
+		fmt.Fprintf(os.Stderr, "       helm trivy [scan] [options] -f <manifest file or directory>\n")
+		fmt.Fprintf(os.Stderr, "       helm trivy [scan] [options] -compose <compose file>\n")
+		fmt.Fprintf(os.Stderr, "       helm trivy serve [options]\n")
+		fmt.Fprintf(os.Stderr, "       helm trivy webhook [options]\n")
+		fmt.Fprintf(os.Stderr, "       helm trivy pin [options] <helm chart>\n")
+		fmt.Fprintf(os.Stderr, "       helm trivy quick [options] <helm chart>\n")
+		fmt.Fprintf(os.Stderr, "       helm trivy verify-manifest [options] <scan manifest>\n")
+		fmt.Fprintf(os.Stderr, "       helm trivy upgrade-check [options] <release> <helm chart>\n")
+		fmt.Fprintf(os.Stderr, "       helm trivy releases [options]\n")
+		fmt.Fprintf(os.Stderr, "       helm trivy generate-chart [options] <directory>\n")
+		fmt.Fprintf(os.Stderr, "       helm trivy fix [options] <chart directory>\n")
+		fmt.Fprintf(os.Stderr, "       helm trivy helmcharts [options] <manifest file or directory>...\n")
+		fmt.Fprintf(os.Stderr, "       helm trivy fleet [options] <directory>...\n")
+		fmt.Fprintf(os.Stderr, "       helm trivy convert [options] [report]\n")
+		fmt.Fprintf(os.Stderr, "       helm trivy bundle export|import [options] <bundle file>\n")
 		fmt.Fprintf(os.Stderr, "Example: helm trivy -json stable/mariadb\n\n")
 		fmt.Fprintf(os.Stderr, "Options:\n")
 		flag.PrintDefaults()
 	}
 
-	flag.BoolVar(&jsonOutput, "json", false, "Enable JSON output")
-	flag.BoolVar(&debug, "debug", false, "Enable debug logging")
-	flag.BoolVar(&noPull, "nopull", false, "Don't pull latest trivy image")
-	flag.StringVar(&trivyArgs, "trivyargs", "", "CLI args to passthrough to trivy")
-	flag.StringVar(&trivyUser, "trivyuser", "1000", "Specify user to run Trivy as")
-	flag.StringVar(&dockerUser, "dockeruser", "", "Specify Docker Auth username")
-	flag.StringVar(&dockerPass, "dockerpass", "", "Specify Docker Auth password")
-	flag.StringVar(&templateSet, "set", "", "Values to set for helm chart, format: 'key1=value1,key2=value2'")
-	flag.StringVar(&templateValues, "values", "", "Specify chart values in a YAML file or a URL")
-	flag.StringVar(&chartVersion, "version", "", "Specify chart version")
-	flag.StringVar(&cacheDir, "cachedir", "", "Set vuln cache dir, if empty a tmp dir is used")
+	flag.BoolVar(&opts.json, "json", false, "Enable JSON output")
+	flag.StringVar(&format, "format", "text", "Output format: text, json (same as -json), snyk (the JSON of snyk container test, one project per image), or inventory for the list of the images of the chart with their registry, digest, subchart and containers, without scanning")
+	flag.IntVar(&opts.schemaVersion, "schema-version", jsonSchemaVersion, "Schema version of the JSON output, 1 for the bare array of results of earlier releases, see convert")
+	flag.BoolVar(&opts.interactive, "interactive", false, "Browse results with line commands once the scan is done")
+	flag.StringVar(&opts.failOn, "fail-on", "findings", "What makes helm-trivy exit with a non-zero status: findings (findings and errors), errors or none")
+	flag.StringVar(&opts.outputDir, "output-dir", "", "Also write the results of each image to a file of this directory, along with an index.json")
+	flag.StringVar(&opts.outputFormat, "output-format", "json", "Format of the -output-dir files: json or sarif")
+	flag.IntVar(&opts.maxTableRows, "max-table-rows", 0, "Show at most this many vulnerabilities per table, the most severe ones, all if 0")
+	flag.StringVar(&opts.groupBy, "group-by", "image", "Text output grouping: image (a section per image), severity, package or workload (a section per severity, package or workload, across images)")
+	flag.BoolVar(&opts.pager, "pager", false, "Page the text output with $PAGER, less by default, when writing to a terminal")
+	flag.StringVar(&opts.formatter, "formatter", "", "Print the results with this formatter of -formatters-dir instead")
+	flag.StringVar(&opts.formattersDir, "formatters-dir", defaultFormattersDir(), "Directory of the formatter executables, defaults to $HELM_TRIVY_FORMATTERS")
+	flag.StringVar(&outputLabelsFile, "output-labels", "", "YAML file renaming the severities (like CRITICAL to P1) and the headings of the reports")
+	flag.StringVar(&opts.detail, "detail", "compact", "Text output detail: compact (tables) or full (URL, CVSS, dates and descriptions)")
+	addScannerFlags(flag.CommandLine, &opts)
+	addChartFlags(flag.CommandLine, &opts)
+	addPolicyFlags(flag.CommandLine, &opts)
+	flag.BoolVar(&opts.inferImages, "infer-images", false, "Also scan image-looking values of container env vars and args, and of ConfigMap payloads")
+	flag.BoolVar(&opts.embeddedManifests, "embedded-manifests", false, "Also scan the images of manifests embedded in ConfigMap data, labelled embedded")
+	flag.StringVar(&extractRules, "extract-rules", "", "YAML file with extra rules to find images in rendered manifests")
+	flag.StringVar(&opts.crdRules, "crd-rules", "all", "Comma separated built-in rules finding the images of custom resources: tekton, argo-workflows, knative, keda, kserve, all or none")
+	flag.StringVar(&opts.export, "export", "", "Export findings: generic (DefectDojo generic findings JSON, see -export-file) or defectdojo (import with the DefectDojo API)")
+	flag.StringVar(&opts.exportFile, "export-file", "findings.json", "File the generic export is written to")
+	flag.StringVar(&opts.ddURL, "dd-url", "", "DefectDojo URL")
+	flag.StringVar(&opts.ddAPIKey, "dd-api-key", os.Getenv("DD_API_KEY"), "DefectDojo API key, defaults to $DD_API_KEY")
+	flag.StringVar(&opts.ddProduct, "dd-product", "", "DefectDojo product the chart findings are imported into, the chart name if empty")
+	flag.StringVar(&opts.jiraURL, "jira-url", "", "Open or update a Jira issue for the chart on this Jira server when vulnerabilities of -jira-severity are found")
+	flag.StringVar(&opts.jiraUser, "jira-user", "", "Jira user, the token is sent as a bearer token if empty")
+	flag.StringVar(&opts.jiraToken, "jira-token", os.Getenv("JIRA_API_TOKEN"), "Jira API token, defaults to $JIRA_API_TOKEN")
+	flag.StringVar(&opts.jiraProject, "jira-project", "", "Key of the Jira project issues are opened in")
+	flag.StringVar(&opts.jiraIssueType, "jira-issue-type", "Bug", "Type of the Jira issues")
+	flag.StringVar(&opts.jiraSeverity, "jira-severity", "CRITICAL", "Comma separated severities reported to Jira")
+	flag.StringVar(&opts.emailTo, "email-to", "", "Comma separated addresses the summary report is mailed to")
+	flag.StringVar(&opts.emailFrom, "email-from", defaultEmailFrom(), "Sender of the report mails")
+	flag.StringVar(&opts.smtpServer, "smtp-server", "localhost:25", "SMTP server report mails are sent through, as host:port")
+	flag.StringVar(&opts.smtpUser, "smtp-user", "", "SMTP user, no authentication if empty")
+	flag.StringVar(&opts.smtpPassword, "smtp-password", os.Getenv("SMTP_PASSWORD"), "SMTP password, defaults to $SMTP_PASSWORD")
+	flag.StringVar(&opts.since, "since", "", "Only scan the images a local chart did not use at this git ref")
+	flag.StringVar(&events, "events", "", "Stream scan events in this format while scanning: ndjson")
+	flag.StringVar(&eventsFile, "events-file", "", "File the events are written to, fd:N for an open file descriptor, stderr if empty")
+	flag.BoolVar(&printPlan, "print-commands", false, "Print the helm template command and the trivy container (image, command, environment with secrets masked, mounts) of each image instead of scanning")
+	flag.BoolVar(&summaryLine, "summary-line", false, "Print a single line with the chart, the number of images, the vulnerability counts by severity and the result instead of the report")
+	flag.BoolVar(&stats, "stats", false, "Write the duration, source, cache hit and pulled bytes of each image scan, and the wall time, to stderr as JSON")
+	flag.Var(&opts.composeFiles, "compose", "Scan the service images of this docker compose file instead of a chart, can be repeated")
+	flag.Var(&opts.manifestFiles, "f", "Scan the images of this Kubernetes manifest file, or of the YAML files of this directory, instead of a chart, can be repeated")
+	flag.StringVar(&reuseValues, "reuse-values", "", "Render the chart with the user-supplied values of this release, under the -values and -set given")
+	flag.StringVar(&opts.namespace, "namespace", os.Getenv("HELM_NAMESPACE"), "Namespace of the -reuse-values release, defaults to $HELM_NAMESPACE, the one of the current context if empty")
+	flag.StringVar(&opts.releaseStorage, "release-storage", "helm", "Where releases are read from: helm (helm list and helm get), or the release secret or configmap objects of helm, only needing read access to them")
+	flag.BoolVar(&verify, "verify-chart", false, "Verify the provenance file of the chart, or the cosign signature of OCI charts, before scanning it")
+	flag.StringVar(&opts.keyring, "keyring", defaultKeyring(), "Keyring of the public keys provenance files are verified with")
+	flag.StringVar(&opts.cosignKey, "cosign-key", "", "Public key OCI chart signatures are verified with")
+	flag.BoolVar(&opts.expandConditions, "expand-conditions", false, "Also render the chart with every combination of the conditions and tags of its dependencies, scanning the images of optional subcharts")
+	flag.IntVar(&opts.expandLimit, "expand-limit", 32, "Maximum number of combinations rendered by -expand-conditions, the ones enabling the most dependencies first")
+	flag.BoolVar(&opts.remediation, "remediation", false, "Suggest the --set option upgrading each image with fixable vulnerabilities to the latest tag of its variant and major version")
+	flag.BoolVar(&opts.rekor, "rekor", false, "Look the images up in the Rekor transparency log and report their entries with inclusion proofs")
+	flag.StringVar(&opts.rekorURL, "rekor-url", "https://rekor.sigstore.dev", "Rekor server used by -rekor")
+	flag.StringVar(&matrix, "matrix", "", "Comma separated values files to scan the chart with in turn, comparing the results with the first one")
+	flag.StringVar(&valuesGlob, "values-glob", "", "Scan the chart with each values file matching this pattern, like 'values-*.yaml', relative to the chart directory for local charts, comparing them like -matrix")
+	flag.StringVar(&manifest, "manifest", "", "Write the templates, image digests and scanner versions of the scan to this file, see verify-manifest")
+	flag.Var(&hooks, "hook", "Run this STAGE=COMMAND hook with the chart, its images or its results as JSON on stdin, the stage being pre-render, post-discover or post-scan, can be repeated")
+	flag.StringVar(&dependencies, "dependencies", "", "Write the images of the chart to this file as JSON dependencies a Renovate custom manager reads, with the suggested version of images with fixable vulnerabilities")
+	flag.StringVar(&annotateOutput, "annotate-output", "", "Write the rendered manifests to this file, annotated with the scan time and the vulnerability counts of each container")
 	flag.Parse()
+	opts.setFlags = setFlags(flag.CommandLine)
 
-	if debug {
-		log.SetLevel(log.DebugLevel)
+	if extractRules != "" {
+		rules, err := loadExtractRules(extractRules)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Invalid extraction rules %v: %v\n", extractRules, err)
+			os.Exit(exitUsage)
+		}
+		opts.extractRules = rules
+	}
+	if _, err := parseCRDRules(opts.crdRules); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v.\n", err)
+		flag.Usage()
+		os.Exit(exitUsage)
+	}
+
+	if err := validateFailOn(opts.failOn); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v.\n", err)
+		flag.Usage()
+		os.Exit(exitUsage)
+	}
+
+	if events != "" {
+		stream, err := openEventStream(events, eventsFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Invalid -events: %v.\n", err)
+			os.Exit(exitUsage)
+		}
+		opts.events = stream
+	}
+
+	if stats {
+		opts.stats = newScanStats()
+	}
+
+	if parsed, err := parseHooks(hooks); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: Invalid -hook: %v.\n", err)
+		os.Exit(exitUsage)
+	} else {
+		opts.hooks = parsed
+	}
+
+	if err := validateFormat(format); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v.\n", err)
+		flag.Usage()
+		os.Exit(exitUsage)
+	}
+	opts.json = opts.json || format == "json"
+	opts.snyk = format == "snyk"
+	if err := validateSchemaVersion(opts.schemaVersion); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v.\n", err)
+		flag.Usage()
+		os.Exit(exitUsage)
+	}
+	if err := validateGroupBy(opts.groupBy); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v.\n", err)
+		flag.Usage()
+		os.Exit(exitUsage)
+	}
+	if err := validateOutputFormat(opts.outputFormat); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v.\n", err)
+		flag.Usage()
+		os.Exit(exitUsage)
+	}
+
+	if opts.formatter != "" {
+		if opts.json || opts.snyk || opts.interactive {
+			fmt.Fprintf(os.Stderr, "Error: -formatter can't be used with -json, -format snyk or -interactive.\n")
+			flag.Usage()
+			os.Exit(exitUsage)
+		}
+		if _, err := formatterPath(opts.formattersDir, opts.formatter); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v.\n", err)
+			os.Exit(exitUsage)
+		}
+	}
+
+	if outputLabelsFile != "" {
+		labels, err := loadOutputLabels(outputLabelsFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Invalid output labels %v: %v.\n", outputLabelsFile, err)
+			os.Exit(exitUsage)
+		}
+		opts.labels = labels
+	}
+
+	if opts.detail != "compact" && opts.detail != "full" {
+		fmt.Fprintf(os.Stderr, "Error: Unknown detail level %v.\n", opts.detail)
+		flag.Usage()
+		os.Exit(exitUsage)
+	}
+
+	if opts.export != "" && opts.export != "generic" && opts.export != "defectdojo" {
+		fmt.Fprintf(os.Stderr, "Error: Unknown export format %v.\n", opts.export)
+		flag.Usage()
+		os.Exit(exitUsage)
+	}
+	if opts.export == "defectdojo" && (opts.ddURL == "" || opts.ddAPIKey == "") {
+		fmt.Fprintf(os.Stderr, "Error: -export defectdojo needs -dd-url and -dd-api-key.\n")
+		flag.Usage()
+		os.Exit(exitUsage)
+	}
+
+	if opts.jiraURL != "" {
+		if opts.jiraProject == "" || opts.jiraToken == "" {
+			fmt.Fprintf(os.Stderr, "Error: -jira-url needs -jira-project and -jira-token.\n")
+			flag.Usage()
+			os.Exit(exitUsage)
+		}
+		if err := validateSeverities(opts.jiraSeverity); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Invalid -jira-severity: %v.\n", err)
+			os.Exit(exitUsage)
+		}
+	}
+
+	if opts.emailTo != "" {
+		if _, _, err := net.SplitHostPort(opts.smtpServer); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Invalid -smtp-server: %v.\n", err)
+			os.Exit(exitUsage)
+		}
 	}
 
-	if len(flag.Args()) == 0 {
+	if valuesGlob != "" {
+		if matrix != "" {
+			fmt.Fprintf(os.Stderr, "Error: -values-glob can't be used with -matrix.\n")
+			flag.Usage()
+			os.Exit(exitUsage)
+		}
+		files, err := globValues(flag.Arg(0), valuesGlob)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v.\n", err)
+			os.Exit(exitUsage)
+		}
+		if len(files) < 2 {
+			fmt.Fprintf(os.Stderr, "Error: -values-glob matches %d values files, at least two are needed to compare them.\n", len(files))
+			os.Exit(exitUsage)
+		}
+		matrix = strings.Join(files, ",")
+	}
+	if matrix != "" && (len(strings.Split(matrix, ",")) < 2 || opts.interactive || opts.snyk || manifest != "") {
+		fmt.Fprintf(os.Stderr, "Error: -matrix takes at least two values files and can't be used with -interactive, -format snyk or -manifest.\n")
+		flag.Usage()
+		os.Exit(exitUsage)
+	}
+	if matrix != "" && hasHook(opts.hooks, "post-scan") {
+		fmt.Fprintf(os.Stderr, "Error: post-scan hooks can't be used with -matrix.\n")
+		flag.Usage()
+		os.Exit(exitUsage)
+	}
+	if annotateOutput != "" && (matrix != "" || len(opts.composeFiles) > 0) {
+		fmt.Fprintf(os.Stderr, "Error: -annotate-output can't be used with -matrix or -compose.\n")
+		flag.Usage()
+		os.Exit(exitUsage)
+	}
+	if dependencies != "" && matrix != "" {
+		fmt.Fprintf(os.Stderr, "Error: -dependencies can't be used with -matrix.\n")
+		flag.Usage()
+		os.Exit(exitUsage)
+	}
+
+	if inputs := append(append([]string{}, opts.manifestFiles...), opts.composeFiles...); len(inputs) > 0 {
+		if len(flag.Args()) > 0 || (len(opts.manifestFiles) > 0 && len(opts.composeFiles) > 0) || verify || reuseValues != "" ||
+			opts.templateSet != "" || opts.templateValues != "" || opts.chartVersion != "" ||
+			opts.since != "" || matrix != "" || manifest != "" {
+			fmt.Fprintf(os.Stderr, "Error: -f and -compose can't be used together, nor with a chart, -set, -values, -version, -since, -matrix, -manifest, -verify-chart or -reuse-values.\n")
+			flag.Usage()
+			os.Exit(exitUsage)
+		}
+		chart = strings.Join(inputs, ",")
+	} else if len(flag.Args()) == 0 {
 		fmt.Fprintf(os.Stderr, "Error: No chart specified.\n")
 		flag.Usage()
-		os.Exit(2)
+		os.Exit(exitUsage)
 	} else {
 		chart = flag.Args()[0]
 	}
+	if chart == stdinChart && (opts.templateSet != "" || opts.templateValues != "" || opts.chartVersion != "" ||
+		opts.since != "" || matrix != "" || manifest != "" || opts.interactive || verify || reuseValues != "") {
+		fmt.Fprintf(os.Stderr, "Error: Manifests read from stdin can't be used with -set, -values, -version, -since, -matrix, -manifest, -interactive, -verify-chart or -reuse-values.\n")
+		flag.Usage()
+		os.Exit(exitUsage)
+	}
 
-	ctx := context.Background()
-	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if opts.expandConditions && (chart == stdinChart || len(opts.manifestFiles) > 0 || len(opts.composeFiles) > 0) {
+		fmt.Fprintf(os.Stderr, "Error: -expand-conditions needs a chart.\n")
+		flag.Usage()
+		os.Exit(exitUsage)
+	}
+	if opts.expandLimit < 1 {
+		fmt.Fprintf(os.Stderr, "Error: -expand-limit must be positive.\n")
+		flag.Usage()
+		os.Exit(exitUsage)
+	}
+	if err := validateReleaseStorage(opts.releaseStorage); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v.\n", err)
+		flag.Usage()
+		os.Exit(exitUsage)
+	}
+	if reuseValues != "" && manifest != "" {
+		fmt.Fprintf(os.Stderr, "Error: -reuse-values can't be used with -manifest.\n")
+		flag.Usage()
+		os.Exit(exitUsage)
+	}
+	// Chart repository credentials are needed before the scanner is set up.
+	if err := resolveSecretRefs(&opts); err != nil {
+		fatal(exitUsage, opts, "%v", err)
+	}
+	cleanupValues, err := fetchValues(&opts)
 	if err != nil {
-		log.Fatalf("Could not get docker client: %v", err)
+		fatal(exitRender, opts, "%v", err)
 	}
+	defer cleanupValues()
 
-	if !noPull {
-		log.Info("Pulling latest trivy image")
-		_, err := cli.ImagePull(ctx, "aquasec/trivy", types.ImagePullOptions{})
+	if chart != stdinChart && len(opts.manifestFiles) == 0 && len(opts.composeFiles) == 0 {
+		version, err := resolveChartVersion(chart, opts)
 		if err != nil {
-			panic(err)
+			fatal(exitRender, opts, "%v", err)
 		}
-		log.Info("Pulled latest trivy image")
+		opts.chartVersion = version
 	}
-	if cacheDir == "" {
-		cacheDir, err := ioutil.TempDir("", "helm-trivy")
+
+	if reuseValues != "" {
+		valuesFile, err := releaseValuesFile(reuseValues, opts)
 		if err != nil {
-			log.Fatalf("Could not create cache dir: %v", err)
+			fatal(exitRender, opts, "%v", err)
+		}
+		defer os.Remove(valuesFile)
+		if opts.templateValues != "" {
+			valuesFile += "," + opts.templateValues
 		}
-		defer os.RemoveAll(cacheDir)
+		opts.templateValues = valuesFile
+	}
 
-		go func(cacheDir string) {
-			sigCh := make(chan os.Signal)
-			signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
-			<-sigCh
-			os.RemoveAll(cacheDir)
-			os.Exit(0)
-		}(cacheDir)
+	if format == "inventory" {
+		registerSecrets(opts)
+		if err := writeInventory(redactingWriter{os.Stdout}, chart, opts); err != nil {
+			fatal(exitCode(err), opts, "%v", err)
+		}
+		return
+	}
+	if printPlan {
+		registerSecrets(opts)
+		if err := printCommands(os.Stdout, chart, opts); err != nil {
+			fatal(exitCode(err), opts, "%v", err)
+		}
+		return
 	}
-	log.Debugf("Using %v as cache directory for vuln db", cacheDir)
-	log.Debugf("Using %v as user for vulnerability scanning", trivyUser)
 
-	scanChart(chart, jsonOutput, ctx, cli, cacheDir, trivyArgs, trivyUser, dockerUser, dockerPass, templateSet, templateValues, chartVersion)
+	status := exitOK
+	if verify {
+		verification := verifyChart(chart, opts)
+		if verification.Verified {
+			log.Info(verification)
+		} else {
+			log.Error(verification)
+			status = exitFindings
+		}
+		opts.chartVerification = &verification
+	}
+
+	ctx, backend, cleanup := setupScanner(&opts)
+	defer cleanup()
+	defer opts.tracer.close(exitOK)
+	opts.span = startSpan(opts, "helm-trivy")
+	opts.span.set("helm.chart", chart)
+
+	if matrix != "" {
+		results, scans, err := scanMatrix(chart, strings.Split(matrix, ","), ctx, backend, opts)
+		if err != nil {
+			fatal(exitCode(err), opts, "Could not scan chart %v: %v", chart, err)
+		}
+		if err := printMatrix(os.Stdout, results, opts); err != nil {
+			fatal(exitPartial, opts, "%v", err)
+		}
+		if status == exitOK && hasViolations(scans) {
+			status = exitFindings
+		}
+		if err := opts.stats.write(os.Stderr, opts); err != nil {
+			log.Errorf("Could not write stats: %v", err)
+		}
+		if status != exitOK {
+			exit(status, opts)
+		}
+		return
+	}
+
+	scans, err := scanChart(chart, ctx, backend, opts, nil)
+	if err != nil {
+		if exitCode(err) != exitPartial {
+			fatal(exitCode(err), opts, "Could not scan chart %v: %v", chart, err)
+		}
+		log.Errorf("Partial results for chart %v: %v", chart, err)
+		status = exitPartial
+	}
+	report := startSpan(opts, "report")
+	result, err := newChartResult(chart, scans, opts)
+	if err != nil {
+		fatal(exitCode(err), opts, "%v", err)
+	}
+	if !summaryLine {
+		printScans(result, opts)
+	}
+	if err := runPostScanHooks(result, opts); err != nil {
+		log.Error(err)
+		if status == exitOK {
+			status = exitCode(err)
+		}
+	}
+	if opts.outputDir != "" {
+		if err := writeOutputDir(opts.outputDir, result, opts); err != nil {
+			log.Errorf("Could not write results to %v: %v", opts.outputDir, err)
+			status = exitPartial
+		}
+	}
+	if opts.export != "" {
+		if err := exportFindings(result, opts); err != nil {
+			log.Errorf("Could not export findings: %v", err)
+			status = exitPartial
+		}
+	}
+	if opts.emailTo != "" {
+		if err := emailReport(result, opts); err != nil {
+			log.Errorf("Could not mail the report: %v", err)
+			status = exitPartial
+		}
+	}
+	if opts.jiraURL != "" {
+		if err := reportToJira(result, opts); err != nil {
+			log.Errorf("Could not report to Jira: %v", err)
+			status = exitPartial
+		}
+	}
+	if manifest != "" {
+		if err := writeScanManifest(manifest, chart, ctx, backend, opts); err != nil {
+			log.Errorf("Could not write scan manifest %v: %v", manifest, err)
+			status = exitPartial
+		}
+	}
+	if annotateOutput != "" {
+		if err := writeAnnotatedManifests(annotateOutput, chart, result, opts); err != nil {
+			log.Errorf("Could not write annotated manifests to %v: %v", annotateOutput, err)
+			status = exitPartial
+		}
+	}
+	if dependencies != "" {
+		if err := writeDependencies(dependencies, result, opts); err != nil {
+			log.Errorf("Could not write dependencies to %v: %v", dependencies, err)
+			status = exitPartial
+		}
+	}
+	report.end(nil)
+	if status == exitOK && hasViolations(scans) {
+		status = exitFindings
+	}
+	if images := overThreshold(result.reports(), opts); status == exitOK && len(images) > 0 {
+		log.Errorf("More than %d %v vulnerabilities found in %v", opts.failMax, strings.ToUpper(opts.failSeverity), strings.Join(images, ", "))
+		status = exitFindings
+	}
+	if status == exitOK && opts.failOnKEV && hasKEV(result.reports(), opts.vulnType) {
+		log.Error("Known exploited vulnerabilities found")
+		status = exitFindings
+	}
+	if summaryLine {
+		if err := writeSummaryLine(redactingWriter{os.Stdout}, result, status, opts); err != nil {
+			log.Errorf("Could not write summary line: %v", err)
+		}
+	}
+	if err := opts.stats.write(os.Stderr, opts); err != nil {
+		log.Errorf("Could not write stats: %v", err)
+	}
+	if status != exitOK {
+		exit(status, opts)
+	}
 }
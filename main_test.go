@@ -0,0 +1,38 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitArgs(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    []string
+		wantErr bool
+	}{
+		{"", []string{}, false},
+		{"  ", []string{}, false},
+		{"--skip-dirs /usr/lib", []string{"--skip-dirs", "/usr/lib"}, false},
+		{"--ignore-policy \"my policy.rego\"", []string{"--ignore-policy", "my policy.rego"}, false},
+		{"--ignore-policy 'my policy.rego'", []string{"--ignore-policy", "my policy.rego"}, false},
+		{"--ignore-policy my\\ policy.rego", []string{"--ignore-policy", "my policy.rego"}, false},
+		{"'it''s' \"a \\\"b\\\"\"", []string{"its", "a \"b\""}, false},
+		{"'a\\b'", []string{"a\\b"}, false},
+		{"\"\" x", []string{"", "x"}, false},
+		{"a\tb\nc", []string{"a", "b", "c"}, false},
+		{"--ignore-policy \"my policy.rego", nil, true},
+		{"--ignore-policy 'my policy.rego", nil, true},
+		{"--skip-dirs \\", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := splitArgs(tt.s)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("splitArgs(%q) error = %v, want error %v", tt.s, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitArgs(%q) = %q, want %q", tt.s, got, tt.want)
+		}
+	}
+}
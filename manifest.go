@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	"gopkg.in/yaml.v3"
+)
+
+// scanManifest records what a chart scan covered: the rendered templates,
+// the images and their digests, and the scanner used. It can be committed
+// next to the chart and checked later with verify-manifest.
+type scanManifest struct {
+	Chart     string          `yaml:"chart"`
+	Version   string          `yaml:"version,omitempty"`
+	Set       string          `yaml:"set,omitempty"`
+	Values    string          `yaml:"values,omitempty"`
+	Templates []string        `yaml:"templates"`
+	Images    []manifestImage `yaml:"images"`
+	Scanner   manifestScanner `yaml:"scanner,omitempty"`
+	Created   time.Time       `yaml:"created"`
+}
+
+type manifestImage struct {
+	Name   string   `yaml:"name"`
+	Digest string   `yaml:"digest,omitempty"`
+	Labels []string `yaml:"labels,omitempty"`
+}
+
+type manifestScanner struct {
+	Backend     string `yaml:"backend,omitempty"`
+	Trivy       string `yaml:"trivy,omitempty"`
+	DBVersion   int    `yaml:"dbVersion,omitempty"`
+	DBUpdatedAt string `yaml:"dbUpdatedAt,omitempty"`
+}
+
+// trivyVersion is what trivy --version -f json prints.
+type trivyVersion struct {
+	Version         string `json:"Version"`
+	VulnerabilityDB struct {
+		Version   int    `json:"Version"`
+		UpdatedAt string `json:"UpdatedAt"`
+	} `json:"VulnerabilityDB"`
+}
+
+// sourceTemplates lists the templates helm rendered manifests from.
+func sourceTemplates(manifests string) []string {
+	seen := map[string]bool{}
+	templates := []string{}
+	scanner := bufio.NewScanner(strings.NewReader(manifests))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, "# Source: ") {
+			continue
+		}
+		template := strings.TrimPrefix(line, "# Source: ")
+		if !seen[template] {
+			seen[template] = true
+			templates = append(templates, template)
+		}
+	}
+	sort.Strings(templates)
+	return templates
+}
+
+// chartManifest renders chart and resolves the digests of its images. Images
+// whose digest can't be resolved are kept without one.
+func chartManifest(chart string, opts scanOptions) (scanManifest, error) {
+	m := scanManifest{
+		Chart:   chart,
+		Version: opts.chartVersion,
+		Set:     opts.templateSet,
+		Values:  opts.templateValues,
+		Created: time.Now().UTC(),
+	}
+	if opts.valuesSources != "" {
+		// The values URLs rather than the files they were fetched to.
+		m.Values = opts.valuesSources
+	}
+	manifests, err := renderChart(chart, opts)
+	if err != nil {
+		return m, fmt.Errorf("could not render chart %v: %v", chart, err)
+	}
+	m.Templates = sourceTemplates(manifests)
+	for _, image := range extractImages(manifests, opts) {
+		digest, err := resolveImageDigest(rewriteImage(image.Name, opts.imageRewrites), opts)
+		if err != nil {
+			log.Warnf("Could not resolve digest of %v: %v", image.Name, err)
+		}
+		m.Images = append(m.Images, manifestImage{Name: image.Name, Digest: digest, Labels: image.Labels})
+	}
+	return m, nil
+}
+
+// scannerInfo asks trivy for its version and the version of its DB.
+func scannerInfo(ctx context.Context, backend scanBackend, opts scanOptions) (manifestScanner, error) {
+	info := manifestScanner{Backend: opts.backend}
+	if opts.replay != "" {
+		return info, fmt.Errorf("trivy is not run by -replay")
+	}
+	if opts.scanner != "" && opts.scanner != "trivy" {
+		return info, fmt.Errorf("only trivy versions are recorded, not %v ones", opts.scanner)
+	}
+	c := newTrivyContainer(opts)
+	c.Cmd = append(c.Cmd, "--version", "-f", "json")
+	var version trivyVersion
+	if err := backend.run(ctx, c, &version); err != nil {
+		return info, fmt.Errorf("unexpected trivy version output: %v", err)
+	}
+	info.Trivy = version.Version
+	info.DBVersion = version.VulnerabilityDB.Version
+	info.DBUpdatedAt = version.VulnerabilityDB.UpdatedAt
+	return info, nil
+}
+
+// writeScanManifest writes the scan manifest of chart to path.
+func writeScanManifest(path string, chart string, ctx context.Context, backend scanBackend, opts scanOptions) error {
+	m, err := chartManifest(chart, opts)
+	if err != nil {
+		return err
+	}
+	if m.Scanner, err = scannerInfo(ctx, backend, opts); err != nil {
+		log.Warnf("Could not get trivy version: %v", err)
+		m.Scanner = manifestScanner{Backend: opts.backend}
+	}
+	data, err := yaml.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+func readScanManifest(path string) (scanManifest, error) {
+	var m scanManifest
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return m, err
+	}
+	err = yaml.Unmarshal(data, &m)
+	return m, err
+}
+
+// compareManifests lists the differences between a recorded scan manifest
+// and the current one.
+func compareManifests(recorded scanManifest, current scanManifest) []string {
+	diffs := []string{}
+	templates := map[string]bool{}
+	for _, t := range current.Templates {
+		templates[t] = true
+	}
+	for _, t := range recorded.Templates {
+		if !templates[t] {
+			diffs = append(diffs, fmt.Sprintf("template %v is no longer rendered", t))
+		}
+		delete(templates, t)
+	}
+	for _, t := range current.Templates {
+		if templates[t] {
+			diffs = append(diffs, fmt.Sprintf("template %v is new", t))
+		}
+	}
+	images := map[string]manifestImage{}
+	for _, image := range current.Images {
+		images[image.Name] = image
+	}
+	for _, image := range recorded.Images {
+		now, ok := images[image.Name]
+		switch {
+		case !ok:
+			diffs = append(diffs, fmt.Sprintf("image %v is no longer used", image.Name))
+		case image.Digest != "" && now.Digest == "":
+			diffs = append(diffs, fmt.Sprintf("digest of image %v could not be resolved", image.Name))
+		case image.Digest != now.Digest:
+			diffs = append(diffs, fmt.Sprintf("image %v now points to %v instead of %v", image.Name, now.Digest, image.Digest))
+		}
+		delete(images, image.Name)
+	}
+	for _, image := range current.Images {
+		if _, ok := images[image.Name]; ok {
+			diffs = append(diffs, fmt.Sprintf("image %v is new", image.Name))
+		}
+	}
+	return diffs
+}
+
+func verifyManifestMain(args []string) {
+	var opts scanOptions
+
+	fs := flag.NewFlagSet("verify-manifest", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: helm trivy verify-manifest [options] <scan manifest>\n")
+		fmt.Fprintf(fs.Output(), "Example: helm trivy verify-manifest helm-trivy.lock\n\n")
+		fmt.Fprintf(fs.Output(), "Options:\n")
+		fs.PrintDefaults()
+	}
+	fs.BoolVar(&debug, "debug", false, "Enable debug logging")
+	fs.StringVar(&opts.dockerUser, "dockeruser", "", "Specify Docker Auth username")
+	fs.StringVar(&opts.dockerPass, "dockerpass", "", "Specify Docker Auth password")
+	fs.Var(&opts.imageRewrites, "image-rewrite", "Resolve images from a mirror, format: 'docker.io=registry.corp.local/dockerhub', can be repeated")
+	fs.Parse(args)
+
+	if debug {
+		log.SetLevel(log.DebugLevel)
+	}
+	if err := validateRewrites(opts.imageRewrites); err != nil {
+		fatal(exitUsage, opts, "%v", err)
+	}
+	if fs.NArg() == 0 {
+		fmt.Fprintf(os.Stderr, "Error: No scan manifest specified.\n")
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+
+	recorded, err := readScanManifest(fs.Arg(0))
+	if err != nil {
+		fatal(exitUsage, opts, "Could not read scan manifest %v: %v", fs.Arg(0), err)
+	}
+	opts.chartVersion, opts.templateSet, opts.templateValues = recorded.Version, recorded.Set, recorded.Values
+	current, err := chartManifest(recorded.Chart, opts)
+	if err != nil {
+		fatal(exitRender, opts, "%v", err)
+	}
+	diffs := compareManifests(recorded, current)
+	for _, diff := range diffs {
+		fmt.Println(diff)
+	}
+	if len(diffs) > 0 {
+		log.Errorf("Chart %v no longer matches the scan manifest of %v", recorded.Chart, recorded.Created.Format(time.RFC3339))
+		exit(exitFindings, opts)
+	}
+	log.Infof("Chart %v matches the scan manifest", recorded.Chart)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// readManifestFiles returns the Kubernetes manifests of the given files and
+// directories, joined as helm template would. Directories are walked for
+// .yaml and .yml files.
+func readManifestFiles(paths []string) (string, error) {
+	files := []string{}
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return "", err
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+		found := []string{}
+		err = filepath.Walk(path, func(file string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			ext := strings.ToLower(filepath.Ext(file))
+			if !info.IsDir() && (ext == ".yaml" || ext == ".yml") {
+				found = append(found, file)
+			}
+			return nil
+		})
+		if err != nil {
+			return "", err
+		}
+		if len(found) == 0 {
+			return "", fmt.Errorf("no YAML file in %v", path)
+		}
+		sort.Strings(found)
+		files = append(files, found...)
+	}
+	docs := []string{}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return "", err
+		}
+		docs = append(docs, strings.TrimPrefix(string(data), "---\n"))
+	}
+	return "---\n" + strings.Join(docs, "\n---\n"), nil
+}
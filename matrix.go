@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+)
+
+// matrixResult sums up the scan of a chart rendered with one values file of
+// a matrix, and how it differs from the first one.
+type matrixResult struct {
+	Values                 string         `json:"Values"`
+	Images                 []string       `json:"Images"`
+	Counts                 map[string]int `json:"Counts"`
+	RiskScore              float64        `json:"RiskScore"`
+	AddedImages            []string       `json:"AddedImages,omitempty"`
+	RemovedImages          []string       `json:"RemovedImages,omitempty"`
+	AddedVulnerabilities   []string       `json:"AddedVulnerabilities,omitempty"`
+	RemovedVulnerabilities []string       `json:"RemovedVulnerabilities,omitempty"`
+
+	vulns map[string]string
+}
+
+// scanMatrix scans chart once per values file, on top of the values given
+// with -values if any.
+func scanMatrix(chart string, valuesFiles []string, ctx context.Context, backend scanBackend, opts scanOptions) ([]matrixResult, []imageScan, error) {
+	weights, _ := parseRiskWeights(opts.riskWeights)
+	results := []matrixResult{}
+	all := []imageScan{}
+	for _, values := range valuesFiles {
+		configOpts := opts
+		configOpts.templateValues = values
+		if opts.templateValues != "" {
+			configOpts.templateValues = opts.templateValues + "," + values
+		}
+		log.Infof("Scanning chart %v with values %v", chart, values)
+		scans, err := scanChart(chart, ctx, backend, configOpts, nil)
+		if err != nil {
+			return nil, nil, withExitCode(exitCode(err), "with values %v: %v", values, err)
+		}
+		all = append(all, scans...)
+		results = append(results, summarizeScans(values, scans, weights))
+	}
+	for i := 1; i < len(results); i++ {
+		diffMatrixResults(&results[i], results[0])
+	}
+	return results, all, nil
+}
+
+// globValues returns the values files matching pattern, relative to the
+// chart directory for local charts, to the current directory otherwise.
+func globValues(chart string, pattern string) ([]string, error) {
+	if info, err := os.Stat(chart); err == nil && info.IsDir() && !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(chart, pattern)
+	}
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -values-glob pattern %q: %v", pattern, err)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// summarizeScans returns the matrixResult of the scans of a chart, named
+// after name.
+func summarizeScans(name string, scans []imageScan, weights riskWeights) matrixResult {
+	result := matrixResult{Values: name, Images: []string{}, vulns: map[string]string{}}
+	reports := []trivyReport{}
+	for _, scan := range scans {
+		report := scan.annotatedReport()
+		reports = append(reports, report)
+		result.Images = append(result.Images, scan.Image)
+		for _, v := range report.vulnerabilities() {
+			result.vulns[v.VulnerabilityID] = v.Severity
+		}
+	}
+	result.Counts = map[string]int{}
+	for _, severity := range result.vulns {
+		result.Counts[severity]++
+	}
+	result.RiskScore = riskScore(reports, weights)
+	return result
+}
+
+// diffMatrixResults records what result adds and removes compared to base.
+func diffMatrixResults(result *matrixResult, base matrixResult) {
+	result.AddedImages, result.RemovedImages = diffLists(result.Images, base.Images)
+	ids, baseIDs := []string{}, []string{}
+	for id := range result.vulns {
+		ids = append(ids, id)
+	}
+	for id := range base.vulns {
+		baseIDs = append(baseIDs, id)
+	}
+	added, removed := diffLists(ids, baseIDs)
+	for _, id := range added {
+		result.AddedVulnerabilities = append(result.AddedVulnerabilities, fmt.Sprintf("%s (%s)", id, result.vulns[id]))
+	}
+	for _, id := range removed {
+		result.RemovedVulnerabilities = append(result.RemovedVulnerabilities, fmt.Sprintf("%s (%s)", id, base.vulns[id]))
+	}
+}
+
+// diffLists returns the sorted items only found in a, and only found in b.
+func diffLists(a []string, b []string) ([]string, []string) {
+	inA, inB := map[string]bool{}, map[string]bool{}
+	for _, item := range a {
+		inA[item] = true
+	}
+	for _, item := range b {
+		inB[item] = true
+	}
+	onlyA, onlyB := []string{}, []string{}
+	for item := range inA {
+		if !inB[item] {
+			onlyA = append(onlyA, item)
+		}
+	}
+	for item := range inB {
+		if !inA[item] {
+			onlyB = append(onlyB, item)
+		}
+	}
+	sort.Strings(onlyA)
+	sort.Strings(onlyB)
+	return onlyA, onlyB
+}
+
+func printMatrix(w io.Writer, results []matrixResult, opts scanOptions) error {
+	if opts.json {
+		data, err := json.MarshalIndent(results, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(w, string(data))
+		return nil
+	}
+	for _, result := range results {
+		counts := []string{}
+		for _, severity := range severities {
+			counts = append(counts, fmt.Sprintf("%s: %d", severity, result.Counts[severity]))
+		}
+		fmt.Fprintf(w, "%s: %d images, %s, risk score %.1f/100\n", result.Values, len(result.Images), strings.Join(counts, ", "), result.RiskScore)
+	}
+	for _, result := range results[1:] {
+		fmt.Fprintf(w, "\n%s compared to %s:\n", result.Values, results[0].Values)
+		for _, image := range result.AddedImages {
+			fmt.Fprintf(w, "  + image %s\n", image)
+		}
+		for _, image := range result.RemovedImages {
+			fmt.Fprintf(w, "  - image %s\n", image)
+		}
+		for _, vuln := range result.AddedVulnerabilities {
+			fmt.Fprintf(w, "  + %s\n", vuln)
+		}
+		for _, vuln := range result.RemovedVulnerabilities {
+			fmt.Fprintf(w, "  - %s\n", vuln)
+		}
+		if len(result.AddedImages)+len(result.RemovedImages)+len(result.AddedVulnerabilities)+len(result.RemovedVulnerabilities) == 0 {
+			fmt.Fprintln(w, "  no difference")
+		}
+	}
+	return nil
+}
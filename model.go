@@ -0,0 +1,75 @@
+package main
+
+// chartResult is the outcome of a chart scan, as the output formats consume
+// it: each image with its annotated trivy report, and the exploit data the
+// reports were enriched with.
+type chartResult struct {
+	Chart    string
+	Version  string
+	Images   []imageResult
+	Exploits map[string]exploitData
+}
+
+// imageResult is the scan of an image along with its annotated report.
+type imageResult struct {
+	Scan   imageScan
+	Report trivyReport
+}
+
+// finding is a vulnerability, with the image it was found in.
+type finding struct {
+	image string
+	vuln  trivyVulnerability
+}
+
+// newChartResult annotates the reports of the scans of chart, and adds
+// exploit data to their vulnerabilities with -exploits.
+func newChartResult(chart string, scans []imageScan, opts scanOptions) (chartResult, error) {
+	result := chartResult{Chart: chart, Version: opts.chartVersion, Images: []imageResult{}, Exploits: map[string]exploitData{}}
+	for _, scan := range scans {
+		result.Images = append(result.Images, imageResult{Scan: scan, Report: scan.annotatedReport()})
+	}
+	if opts.exploits {
+		exploits, err := loadExploitData(result.reports())
+		if err != nil {
+			return result, withExitCode(exitPartial, "could not get exploit data: %v", err)
+		}
+		result.Exploits = exploits
+		enrichReports(result.reports(), exploits)
+	}
+	return result, nil
+}
+
+func (r chartResult) scans() []imageScan {
+	scans := []imageScan{}
+	for _, image := range r.Images {
+		scans = append(scans, image.Scan)
+	}
+	return scans
+}
+
+func (r chartResult) reports() []trivyReport {
+	reports := []trivyReport{}
+	for _, image := range r.Images {
+		reports = append(reports, image.Report)
+	}
+	return reports
+}
+
+// findings returns the vulnerabilities of every image of the chart.
+func (r chartResult) findings() []finding {
+	findings := []finding{}
+	for _, image := range r.Images {
+		findings = append(findings, image.findings()...)
+	}
+	return findings
+}
+
+// findings returns the vulnerabilities of the image.
+func (i imageResult) findings() []finding {
+	findings := []finding{}
+	for _, v := range i.Report.vulnerabilities() {
+		findings = append(findings, finding{image: i.Scan.Image, vuln: v})
+	}
+	return findings
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// operatorVulnerabilityReport carries the fields of trivy-operator
+// VulnerabilityReports helm-trivy uses.
+type operatorVulnerabilityReport struct {
+	Metadata struct {
+		Namespace string `json:"namespace"`
+		Name      string `json:"name"`
+	} `json:"metadata"`
+	Report struct {
+		UpdateTimestamp time.Time `json:"updateTimestamp"`
+		Registry        struct {
+			Server string `json:"server"`
+		} `json:"registry"`
+		Artifact struct {
+			Repository string `json:"repository"`
+			Tag        string `json:"tag"`
+			Digest     string `json:"digest"`
+		} `json:"artifact"`
+		OS *struct {
+			Family string `json:"family"`
+			Name   string `json:"name"`
+			EOSL   bool   `json:"eosl"`
+		} `json:"os"`
+		Vulnerabilities []struct {
+			VulnerabilityID  string `json:"vulnerabilityID"`
+			Resource         string `json:"resource"`
+			InstalledVersion string `json:"installedVersion"`
+			FixedVersion     string `json:"fixedVersion"`
+			Severity         string `json:"severity"`
+			Title            string `json:"title"`
+			Description      string `json:"description"`
+			PrimaryLink      string `json:"primaryLink"`
+		} `json:"vulnerabilities"`
+	} `json:"report"`
+}
+
+// operatorReports holds the trivy reports rebuilt from VulnerabilityReports,
+// keyed by normalized image reference, with tag or with digest.
+type operatorReports map[string]trivyReport
+
+// loadOperatorReports reads the VulnerabilityReports of every namespace of
+// the cluster, leaving out the ones older than maxAge.
+func loadOperatorReports(maxAge time.Duration) (operatorReports, error) {
+	out, err := exec.Command("kubectl", kubectlArgs("get", "vulnerabilityreports.aquasecurity.github.io", "--all-namespaces", "-o", "json")...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("could not list VulnerabilityReports: %v", err)
+	}
+	var list struct {
+		Items []operatorVulnerabilityReport `json:"items"`
+	}
+	if err := json.Unmarshal(out, &list); err != nil {
+		return nil, err
+	}
+	reports := operatorReports{}
+	for _, item := range list.Items {
+		if time.Since(item.Report.UpdateTimestamp) > maxAge {
+			log.Debugf("Skipping VulnerabilityReport %v/%v, last updated %v", item.Metadata.Namespace, item.Metadata.Name, item.Report.UpdateTimestamp)
+			continue
+		}
+		server := item.Report.Registry.Server
+		if server == "index.docker.io" || server == "" {
+			server = "docker.io"
+		}
+		name := normalizeImage(server + "/" + item.Report.Artifact.Repository)
+		output := item.converted(name)
+		if tag := item.Report.Artifact.Tag; tag != "" {
+			reports[name+":"+tag] = output
+		}
+		if digest := item.Report.Artifact.Digest; digest != "" {
+			reports[name+"@"+digest] = output
+		}
+	}
+	log.Infof("Found recent trivy-operator VulnerabilityReports for %d images", len(reports))
+	return reports, nil
+}
+
+// converted converts the report to a trivy report.
+func (r operatorVulnerabilityReport) converted(image string) trivyReport {
+	report := trivyReport{ArtifactName: image}
+	if os := r.Report.OS; os != nil {
+		report.Metadata.OS = &trivyOS{Family: os.Family, Name: os.Name, EOSL: os.EOSL}
+	}
+	result := trivyResult{
+		Target:          fmt.Sprintf("%s (trivy-operator %s/%s)", image, r.Metadata.Namespace, r.Metadata.Name),
+		Vulnerabilities: []trivyVulnerability{},
+	}
+	for _, v := range r.Report.Vulnerabilities {
+		result.Vulnerabilities = append(result.Vulnerabilities, trivyVulnerability{
+			VulnerabilityID:  v.VulnerabilityID,
+			PkgName:          v.Resource,
+			InstalledVersion: v.InstalledVersion,
+			FixedVersion:     v.FixedVersion,
+			Severity:         v.Severity,
+			Title:            v.Title,
+			Description:      v.Description,
+			PrimaryURL:       v.PrimaryLink,
+		})
+	}
+	report.Results = []trivyResult{result}
+	return report
+}
+
+// lookup returns the trivy report rebuilt from the report of image, if any.
+func (r operatorReports) lookup(image string) (trivyReport, bool) {
+	ref := parseImageRef(image)
+	if ref.Digest != "" {
+		output, ok := r[ref.Name()+"@"+ref.Digest]
+		return output, ok
+	}
+	output, ok := r[ref.Name()+":"+ref.Tag]
+	return output, ok
+}
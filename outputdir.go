@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// outputIndex is the index.json of -output-dir, linking the chart to the
+// result file of each of its images.
+type outputIndex struct {
+	Chart   string             `json:"chart"`
+	Version string             `json:"version,omitempty"`
+	Format  string             `json:"format"`
+	Images  []outputIndexImage `json:"images"`
+}
+
+type outputIndexImage struct {
+	Image      string         `json:"image"`
+	Labels     []string       `json:"labels,omitempty"`
+	File       string         `json:"file"`
+	Counts     map[string]int `json:"counts"`
+	Violations []string       `json:"violations,omitempty"`
+}
+
+var unsafeFileChars = regexp.MustCompile(`[^a-zA-Z0-9_.-]+`)
+
+// imageFileName returns the name of the result file of image, without
+// extension.
+func imageFileName(image string) string {
+	return strings.Trim(unsafeFileChars.ReplaceAllString(normalizeImage(image), "_"), "_")
+}
+
+// writeOutputDir writes one result file per image of a chart scan in dir,
+// in the JSON helm-trivy prints or in SARIF, and an index.json.
+func writeOutputDir(dir string, result chartResult, opts scanOptions) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	index := outputIndex{Chart: result.Chart, Version: result.Version, Format: opts.outputFormat, Images: []outputIndexImage{}}
+	for _, image := range result.Images {
+		scan := image.Scan
+		var data []byte
+		switch opts.outputFormat {
+		case "sarif":
+			var err error
+			if data, err = json.MarshalIndent(sarifReport(image.Report), "", "  "); err != nil {
+				return err
+			}
+		default:
+			merged, err := mergeJSONOutputs([]trivyReport{image.Report})
+			if err != nil {
+				return err
+			}
+			data = []byte(merged)
+		}
+		file := imageFileName(scan.Image) + "." + opts.outputFormat
+		if err := ioutil.WriteFile(filepath.Join(dir, file), data, 0644); err != nil {
+			return err
+		}
+		index.Images = append(index.Images, outputIndexImage{
+			Image:      scan.Image,
+			Labels:     scan.Labels,
+			File:       file,
+			Counts:     countBySeverity(image.Report.vulnerabilities()),
+			Violations: scan.Violations,
+		})
+	}
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, "index.json"), data, 0644)
+}
+
+// validateOutputFormat checks the value of -output-format.
+func validateOutputFormat(format string) error {
+	if format != "json" && format != "sarif" {
+		return fmt.Errorf("unknown output format %v, expected json or sarif", format)
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"io"
+	"os"
+	"os/exec"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// openPager starts $PAGER, less by default, when stdout is a terminal. Text
+// written to the returned writer is paged, the returned function waits for
+// the user to quit the pager.
+func openPager() (io.Writer, func()) {
+	info, err := os.Stdout.Stat()
+	if err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return os.Stdout, func() {}
+	}
+	pager := os.Getenv("PAGER")
+	if pager == "" {
+		pager = "less -FRX"
+	}
+	args, err := splitArgs(pager)
+	if err != nil || len(args) == 0 {
+		log.Warnf("Invalid $PAGER %q, not paging", pager)
+		return os.Stdout, func() {}
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	in, err := cmd.StdinPipe()
+	if err == nil {
+		err = cmd.Start()
+	}
+	if err != nil {
+		log.Warnf("Could not start pager %v: %v", pager, err)
+		return os.Stdout, func() {}
+	}
+	return in, func() {
+		in.Close()
+		cmd.Wait()
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+type kustomizeImage struct {
+	Name   string `yaml:"name"`
+	Digest string `yaml:"digest"`
+}
+
+// pinChart resolves the digest of every image of chart and returns a values
+// overlay, or a kustomize images list, pinning them.
+func pinChart(chart string, opts scanOptions, format string) (interface{}, error) {
+	err, images := getChartImages(chart, opts)
+	if err != nil {
+		return nil, fmt.Errorf("could not find images for chart %v: %v", chart, err)
+	}
+	var values []valuesImage
+	if format == "values" {
+		defaults, err := chartValues(chart, opts)
+		if err != nil {
+			return nil, fmt.Errorf("could not get values of chart %v: %v", chart, err)
+		}
+		values = findValuesImages(defaults, nil)
+	}
+	overlay := map[string]interface{}{}
+	kustomize := []kustomizeImage{}
+	for _, image := range images {
+		ref := parseImageRef(image.Name)
+		if ref.Digest == "" {
+			if ref.Tag == "latest" {
+				log.Warnf("%v uses the latest tag, it changes with every release", image.Name)
+			} else {
+				log.Warnf("%v is referenced by tag, tags can be moved", image.Name)
+			}
+		}
+		digest, err := resolveImageDigest(rewriteImage(image.Name, opts.imageRewrites), opts)
+		if err != nil {
+			return nil, fmt.Errorf("could not resolve digest of %v: %v", image.Name, err)
+		}
+		log.Debugf("Resolved %v to %v", image.Name, digest)
+		if format == "kustomize" {
+			kustomize = append(kustomize, kustomizeImage{Name: stripTag(image.Name), Digest: digest})
+			continue
+		}
+		v, ok := imageValues(values, image.Name)
+		if !ok {
+			log.Warnf("Could not find which value sets %v, it is not pinned", image.Name)
+			continue
+		}
+		switch {
+		case ref.Tag == "" && v.Split:
+			// The tag value can't hold a digest alone, and the image is
+			// pinned already.
+			log.Debugf("%v is pinned by digest already", image.Name)
+		case ref.Tag == "":
+			setValue(overlay, v.Path, stripTag(image.Name)+"@"+digest)
+		case v.Split:
+			setValue(overlay, copyPath(v.Path, "tag"), ref.Tag+"@"+digest)
+		default:
+			setValue(overlay, v.Path, stripTag(image.Name)+":"+ref.Tag+"@"+digest)
+		}
+	}
+	if format == "kustomize" {
+		return map[string]interface{}{"images": kustomize}, nil
+	}
+	return overlay, nil
+}
+
+func pinMain(args []string) {
+	var opts scanOptions
+	var format string
+
+	fs := flag.NewFlagSet("pin", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: helm trivy pin [options] <helm chart>\n")
+		fmt.Fprintf(fs.Output(), "Example: helm trivy pin stable/mariadb > pinned-values.yaml\n\n")
+		fmt.Fprintf(fs.Output(), "Options:\n")
+		fs.PrintDefaults()
+	}
+	fs.StringVar(&format, "format", "values", "Output format: values (a values file) or kustomize (an images list)")
+	fs.BoolVar(&debug, "debug", false, "Enable debug logging")
+	fs.StringVar(&opts.dockerUser, "dockeruser", "", "Specify Docker Auth username")
+	fs.StringVar(&opts.dockerPass, "dockerpass", "", "Specify Docker Auth password")
+	fs.Var(&opts.imageRewrites, "image-rewrite", "Resolve images from a mirror, format: 'docker.io=registry.corp.local/dockerhub', can be repeated")
+	addChartFlags(fs, &opts)
+	fs.Parse(args)
+
+	if debug {
+		log.SetLevel(log.DebugLevel)
+	}
+	if format != "values" && format != "kustomize" {
+		fmt.Fprintf(os.Stderr, "Error: Unknown format %v.\n", format)
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	if err := validateRewrites(opts.imageRewrites); err != nil {
+		fatal(exitUsage, opts, "%v", err)
+	}
+	if err := validateRepoAliases(opts.repoAliases); err != nil {
+		fatal(exitUsage, opts, "%v", err)
+	}
+	if fs.NArg() == 0 {
+		fmt.Fprintf(os.Stderr, "Error: No chart specified.\n")
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	chart := fs.Arg(0)
+	if err := resolveSecretRefs(&opts); err != nil {
+		fatal(exitUsage, opts, "%v", err)
+	}
+	registerSecrets(opts)
+	cleanupValues, err := fetchValues(&opts)
+	if err != nil {
+		fatal(exitRender, opts, "%v", err)
+	}
+	defer cleanupValues()
+	version, err := resolveChartVersion(chart, opts)
+	if err != nil {
+		fatal(exitRender, opts, "%v", err)
+	}
+	opts.chartVersion = version
+
+	pinned, err := pinChart(chart, opts, format)
+	if err != nil {
+		fatal(exitCode(err), opts, "Could not pin chart %v: %v", chart, err)
+	}
+	out, err := yaml.Marshal(pinned)
+	if err != nil {
+		fatal(exitRender, opts, "%v", err)
+	}
+	fmt.Print(string(out))
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestPinChart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helm-trivy-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	const digest = "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	opts := scanOptions{replay: dir, images: []chartImage{
+		{Name: "bitnami/mariadb:10.6@" + digest},
+		{Name: "bitnami/os-shell@" + digest},
+		{Name: "prom/mysqld-exporter@" + digest},
+	}}
+	values := "image:\n  repository: bitnami/mariadb\n  tag: \"10.6\"\n" +
+		"volumePermissions:\n  image:\n    repository: bitnami/os-shell\n" +
+		"metrics:\n  image: prom/mysqld-exporter:v0.15.0\n"
+	fixture := filepath.Join(dir, helmFixture(append([]string{"show", "values"}, chartArgs("mariadb", opts)...), opts))
+	if err := os.MkdirAll(filepath.Dir(fixture), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(fixture, []byte(values), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		format string
+		want   interface{}
+	}{
+		{
+			"values",
+			map[string]interface{}{
+				"image":   map[string]interface{}{"tag": "10.6@" + digest},
+				"metrics": map[string]interface{}{"image": "prom/mysqld-exporter@" + digest},
+			},
+		},
+		{
+			"kustomize",
+			map[string]interface{}{"images": []kustomizeImage{
+				{Name: "bitnami/mariadb", Digest: digest},
+				{Name: "bitnami/os-shell", Digest: digest},
+				{Name: "prom/mysqld-exporter", Digest: digest},
+			}},
+		},
+	}
+	for _, tt := range tests {
+		got, err := pinChart("mariadb", opts, tt.format)
+		if err != nil {
+			t.Errorf("pinChart() with format %v: %v", tt.format, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("pinChart() with format %v = %#v, want %#v", tt.format, got, tt.want)
+		}
+	}
+}
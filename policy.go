@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// imageViolations checks image against the registry and tag policies, which
+// are reported alongside its vulnerabilities.
+func imageViolations(image string, opts scanOptions) []string {
+	violations := []string{}
+	ref := parseImageRef(image)
+	if opts.allowedRegistries != "" {
+		allowed := false
+		for _, registry := range strings.Split(opts.allowedRegistries, ",") {
+			registry = strings.TrimSuffix(strings.TrimSpace(registry), "/")
+			if ref.Registry == registry || strings.HasPrefix(ref.Name(), registry+"/") {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			violations = append(violations, fmt.Sprintf("registry %v is not allowed", ref.Registry))
+		}
+	}
+	if opts.denyLatestTag && ref.Digest == "" && ref.Tag == "latest" {
+		violations = append(violations, "latest tag is not allowed")
+	}
+	return violations
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestImageViolations(t *testing.T) {
+	tests := []struct {
+		image string
+		opts  scanOptions
+		want  []string
+	}{
+		{"nginx", scanOptions{}, []string{}},
+		{"registry.corp.local/app:1.0", scanOptions{allowedRegistries: "registry.corp.local"}, []string{}},
+		{"registry.corp.local/team/app:1.0", scanOptions{allowedRegistries: "quay.io, registry.corp.local/team/"}, []string{}},
+		{"registry.corp.local/other/app:1.0", scanOptions{allowedRegistries: "registry.corp.local/team"}, []string{"registry registry.corp.local is not allowed"}},
+		{"nginx:1.25", scanOptions{allowedRegistries: "registry.corp.local"}, []string{"registry docker.io is not allowed"}},
+		{"registry.corp.local/app", scanOptions{denyLatestTag: true}, []string{"latest tag is not allowed"}},
+		{"registry.corp.local/app:latest@sha256:0000000000000000000000000000000000000000000000000000000000000000", scanOptions{denyLatestTag: true}, []string{}},
+		{"nginx:latest", scanOptions{allowedRegistries: "registry.corp.local", denyLatestTag: true}, []string{"registry docker.io is not allowed", "latest tag is not allowed"}},
+	}
+	for _, tt := range tests {
+		if got := imageViolations(tt.image, tt.opts); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("imageViolations(%v) = %q, want %q", tt.image, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// containerPlan is the trivy container -print-commands shows for an image.
+type containerPlan struct {
+	Image   string   `json:"image" yaml:"image"`
+	Command []string `json:"command" yaml:"command"`
+	Env     []string `json:"env,omitempty" yaml:"env,omitempty"`
+	User    string   `json:"user,omitempty" yaml:"user,omitempty"`
+	Mounts  []string `json:"mounts" yaml:"mounts"`
+	CPU     string   `json:"cpu,omitempty" yaml:"cpu,omitempty"`
+	Memory  string   `json:"memory,omitempty" yaml:"memory,omitempty"`
+	Network string   `json:"network,omitempty" yaml:"network,omitempty"`
+}
+
+// imagePlan is an image of the chart with the container scanning it.
+type imagePlan struct {
+	Name      string        `json:"name" yaml:"name"`
+	Container containerPlan `json:"container" yaml:"container"`
+}
+
+// commandPlan is what -print-commands prints: the command rendering the
+// chart and the trivy container of each of its images.
+type commandPlan struct {
+	Backend string      `json:"backend" yaml:"backend"`
+	Render  string      `json:"render" yaml:"render"`
+	Images  []imagePlan `json:"images" yaml:"images"`
+}
+
+// quoteArg quotes arg for a shell when it needs to.
+func quoteArg(arg string) string {
+	if arg != "" && !strings.ContainsAny(arg, " \t\n'\"\\$`*?[]{}()<>|&;#~") {
+		return arg
+	}
+	return "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
+}
+
+// redactEnv masks the values of the credentials of a container environment,
+// and the passwords of the proxy URLs.
+func redactEnv(env []string) []string {
+	redacted := []string{}
+	for _, e := range env {
+		parts := strings.SplitN(e, "=", 2)
+		name := strings.ToUpper(parts[0])
+		if len(parts) == 2 && parts[1] != "" && (strings.Contains(name, "PASSWORD") || strings.Contains(name, "TOKEN") || strings.Contains(name, "SECRET")) {
+			e = parts[0] + "=***"
+		} else if u, err := url.Parse(parts[len(parts)-1]); err == nil && u.User != nil {
+			if password, ok := u.User.Password(); ok && password != "" {
+				e = strings.Replace(e, ":"+password+"@", ":***@", 1)
+			}
+		}
+		redacted = append(redacted, redact(e))
+	}
+	return redacted
+}
+
+// renderCommand describes how the manifests of chart are read.
+func renderCommand(chart string, opts scanOptions) string {
+	switch {
+	case chart == stdinChart:
+		return "read manifests from stdin"
+	case len(opts.manifestFiles) > 0:
+		return "read manifests from " + strings.Join(opts.manifestFiles, ", ")
+	case len(opts.composeFiles) > 0:
+		return "read images from " + strings.Join(opts.composeFiles, ", ")
+	}
+	args := []string{"helm"}
+	for _, arg := range redactArgs(templateArgs(chart, opts)) {
+		args = append(args, quoteArg(arg))
+	}
+	return redact(strings.Join(args, " "))
+}
+
+// planContainer returns the container scanning image, as the backend of
+// opts runs it with the -scanner of opts.
+func planContainer(image string, opts scanOptions) containerPlan {
+	c := scanContainer(image, opts)
+	scanner, _ := newScanner(opts)
+	if s, ok := scanner.(containerScanner); ok {
+		c = s.container(image, opts)
+	} else if scanner != nil {
+		// Services scanning images run no container.
+		return containerPlan{Command: []string{opts.scanner, image}, Mounts: []string{}}
+	}
+	plan := containerPlan{
+		Image:   c.Image,
+		Command: redactArgs(c.Cmd),
+		Env:     redactEnv(c.Env),
+		User:    c.User,
+		CPU:     c.CPU,
+		Memory:  c.Memory,
+		Network: c.Network,
+	}
+	cache := c.CacheDir
+	switch {
+	case opts.backend == "k8s-job" && opts.k8sCachePVC != "":
+		cache = "persistentVolumeClaim " + opts.k8sCachePVC
+	case opts.backend == "k8s-job":
+		cache = "emptyDir"
+	case cache == "":
+		cache = "<temporary directory>"
+	}
+	plan.Mounts = []string{cache + ":/.cache"}
+	if c.Input != "" {
+		plan.Mounts = append(plan.Mounts, c.Input+":/input:ro")
+	}
+	return plan
+}
+
+// printCommands writes the commands scanning chart would run to w, as YAML
+// or as JSON with -json. The chart is rendered to find its images, trivy is
+// neither pulled nor run.
+func printCommands(w io.Writer, chart string, opts scanOptions) error {
+	err, images := getChartImages(chart, opts)
+	if err != nil {
+		return withExitCode(exitRender, "could not find images for chart %v: %v", chart, err)
+	}
+	plan := commandPlan{Backend: opts.backend, Render: renderCommand(chart, opts)}
+	for _, image := range images {
+		plan.Images = append(plan.Images, imagePlan{Name: image.Name, Container: planContainer(image.Name, opts)})
+	}
+	var data []byte
+	if opts.json {
+		data, err = json.MarshalIndent(plan, "", "  ")
+	} else {
+		data, err = yaml.Marshal(plan)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(redactingWriter{w}, "%s\n", strings.TrimRight(string(data), "\n"))
+	return err
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// cachedScan is the last trivy output of an image, kept for quick mode.
+type cachedScan struct {
+	Image   string    `json:"image"`
+	Digest  string    `json:"digest"`
+	Scanned time.Time `json:"scanned"`
+	Output  string    `json:"output"`
+}
+
+// scanCacheKey returns the repository and digest of image, which scans are
+// cached by: an image whose tag was moved since it was scanned has no cached
+// scan. Only images written without a digest take a request to their
+// registry.
+func scanCacheKey(image string, opts scanOptions) (string, error) {
+	ref := parseImageRef(image)
+	if ref.Digest != "" {
+		return ref.Name() + "@" + ref.Digest, nil
+	}
+	digest, err := resolveImageDigest(rewriteImage(image, opts.imageRewrites), opts)
+	if err != nil {
+		return "", fmt.Errorf("could not resolve digest of %v: %v", image, err)
+	}
+	return ref.Name() + "@" + digest, nil
+}
+
+func scanCachePath(key string) (string, error) {
+	dir, err := userCacheDir()
+	if err != nil {
+		return "", err
+	}
+	dir = filepath.Join(dir, "scans")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, fmt.Sprintf("%x.json", sha256.Sum256([]byte(key)))), nil
+}
+
+// saveScan caches the trivy report of image, before ignore rules are applied.
+func saveScan(image string, report trivyReport, opts scanOptions) error {
+	key, err := scanCacheKey(image, opts)
+	if err != nil {
+		return err
+	}
+	path, err := scanCachePath(key)
+	if err != nil {
+		return err
+	}
+	output, err := trivyOutput(report)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(cachedScan{Image: image, Digest: key, Scanned: time.Now().UTC(), Output: output})
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// loadCachedScan returns the last trivy output of image, if the image its
+// reference resolves to was scanned.
+func loadCachedScan(image string, opts scanOptions) (cachedScan, bool, error) {
+	var scan cachedScan
+	key, err := scanCacheKey(image, opts)
+	if err != nil {
+		return scan, false, err
+	}
+	path, err := scanCachePath(key)
+	if err != nil {
+		return scan, false, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return scan, false, nil
+	}
+	if err != nil {
+		return scan, false, err
+	}
+	err = json.Unmarshal(data, &scan)
+	return scan, err == nil, err
+}
+
+// quickMain checks a chart against the cached scan results of its images,
+// without pulling nor scanning anything, to run as a pre-commit hook. Images
+// are looked up by the digest their reference resolves to.
+func quickMain(args []string) {
+	var opts scanOptions
+	var severity string
+
+	fs := flag.NewFlagSet("quick", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: helm trivy quick [options] <helm chart>\n")
+		fmt.Fprintf(fs.Output(), "Example: helm trivy quick -severity HIGH,CRITICAL ./charts/mariadb\n\n")
+		fmt.Fprintf(fs.Output(), "Options:\n")
+		fs.PrintDefaults()
+	}
+	fs.BoolVar(&debug, "debug", false, "Enable debug logging")
+	fs.StringVar(&severity, "severity", "CRITICAL", "Comma separated severities making the check fail")
+	fs.StringVar(&opts.severitySource, "severity-source", "", "Comma separated sources the severities are taken from, in order of preference, see helm trivy -help")
+	fs.StringVar(&opts.severityMap, "severity-map", "", "Comma separated severity re-mappings, format: '[source:]FROM=TO'")
+	fs.StringVar(&opts.vulnType, "vuln-type", "os,library", "Comma separated package types whose vulnerabilities fail the check: os or library")
+	fs.StringVar(&opts.ignoreFile, "ignore-file", "", "File of accepted vulnerabilities, one per line: <ID> [image=...] [chart=...] [until=YYYY-MM-DD] [reason=...]")
+	fs.StringVar(&opts.dockerUser, "dockeruser", "", "Specify Docker Auth username")
+	fs.StringVar(&opts.dockerPass, "dockerpass", "", "Specify Docker Auth password")
+	fs.Var(&opts.imageRewrites, "image-rewrite", "Resolve images from a mirror, format: 'docker.io=registry.corp.local/dockerhub', can be repeated")
+	addChartFlags(fs, &opts)
+	fs.Parse(args)
+
+	if debug {
+		log.SetLevel(log.DebugLevel)
+	}
+	if err := resolveSecretRefs(&opts); err != nil {
+		fatal(exitUsage, opts, "%v", err)
+	}
+	registerSecrets(opts)
+	if err := validateSeverities(severity); err != nil {
+		fatal(exitUsage, opts, "%v", err)
+	}
+	if err := validateRewrites(opts.imageRewrites); err != nil {
+		fatal(exitUsage, opts, "%v", err)
+	}
+	if err := validateRepoAliases(opts.repoAliases); err != nil {
+		fatal(exitUsage, opts, "%v", err)
+	}
+	rules, err := parseSeverityMap(opts.severityMap)
+	if err != nil {
+		fatal(exitUsage, opts, "%v", err)
+	}
+	opts.severityRules = rules
+	if err := validateVulnTypes(opts.vulnType); err != nil {
+		fatal(exitUsage, opts, "%v", err)
+	}
+	if fs.NArg() == 0 {
+		fmt.Fprintf(os.Stderr, "Error: No chart specified.\n")
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	if opts.ignoreFile != "" {
+		rules, err := loadIgnoreFile(opts.ignoreFile)
+		if err != nil {
+			fatal(exitUsage, opts, "Invalid ignore file %v: %v", opts.ignoreFile, err)
+		}
+		warnExpired(rules)
+		opts.ignores = rules
+	}
+	cleanupValues, err := fetchValues(&opts)
+	if err != nil {
+		fatal(exitRender, opts, "%v", err)
+	}
+	defer cleanupValues()
+	chart := fs.Arg(0)
+	if chart != stdinChart {
+		version, err := resolveChartVersion(chart, opts)
+		if err != nil {
+			fatal(exitRender, opts, "%v", err)
+		}
+		opts.chartVersion = version
+	}
+
+	err, images := getChartImages(chart, opts)
+	if err != nil {
+		fatal(exitRender, opts, "Could not find images for chart %v: %v", chart, err)
+	}
+	failed := false
+	for _, image := range images {
+		cached, ok, err := loadCachedScan(image.Name, opts)
+		if err != nil {
+			log.Warnf("Could not read cached scan of %v: %v", image.Name, err)
+		}
+		if !ok {
+			fmt.Printf("?  %v: not scanned yet\n", image)
+			continue
+		}
+		report, err := parseTrivyOutput(image.Name, cached.Output)
+		if err != nil {
+			fatal(exitBackend, opts, "Invalid cached scan of %v: %v", image.Name, err)
+		}
+		report, _ = applyIgnores(image, applySeverities(report, opts), opts.ignores, time.Now())
+		counts := countBySeverity(report.gatedVulnerabilities(opts.vulnType))
+		found := []string{}
+		for _, s := range strings.Split(strings.ToUpper(severity), ",") {
+			if counts[s] > 0 {
+				found = append(found, fmt.Sprintf("%d %s", counts[s], s))
+			}
+		}
+		scanned := cached.Scanned.Format("2006-01-02")
+		if len(found) > 0 {
+			failed = true
+			fmt.Printf("KO %v: %v (scanned %v)\n", image, strings.Join(found, ", "), scanned)
+		} else {
+			fmt.Printf("OK %v (scanned %v)\n", image, scanned)
+		}
+	}
+	if failed {
+		exit(exitFindings, opts)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"io"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// minSecretLength is the length under which values aren't redacted, masking
+// every occurrence of a one or two characters password would garble logs.
+const minSecretLength = 4
+
+var secrets struct {
+	mu       sync.RWMutex
+	replacer *strings.Replacer
+	values   []string
+}
+
+// registerSecrets records the passwords, tokens and keys of opts, masked in
+// logs and in what helm-trivy prints from then on.
+func registerSecrets(opts scanOptions) {
+	values := []string{opts.dockerPass, opts.repoPassword, opts.ddAPIKey, opts.jiraToken, opts.smtpPassword, opts.valuesToken, opts.clairToken}
+	for _, header := range opts.valuesHeaders {
+		if name, value, ok := splitHeader(header); ok && credentialHeader(name) {
+			values = append(values, value)
+		}
+	}
+	if u, err := url.Parse(opts.resultCacheURL); err == nil && u.User != nil {
+		password, _ := u.User.Password()
+		values = append(values, password)
+	}
+	addSecrets(values...)
+}
+
+// addSecrets records secret values, masked from then on.
+func addSecrets(values ...string) {
+	secrets.mu.Lock()
+	defer secrets.mu.Unlock()
+	for _, value := range values {
+		if len(value) >= minSecretLength {
+			secrets.values = append(secrets.values, value)
+		}
+	}
+	// Longer secrets first, in case one contains another.
+	sort.Slice(secrets.values, func(i, j int) bool { return len(secrets.values[i]) > len(secrets.values[j]) })
+	pairs := []string{}
+	for _, value := range secrets.values {
+		pairs = append(pairs, value, "***")
+	}
+	secrets.replacer = strings.NewReplacer(pairs...)
+}
+
+// redact masks the registered secrets in s.
+func redact(s string) string {
+	secrets.mu.RLock()
+	defer secrets.mu.RUnlock()
+	if secrets.replacer == nil {
+		return s
+	}
+	return secrets.replacer.Replace(s)
+}
+
+// redactingFormatter masks the registered secrets in log entries.
+type redactingFormatter struct {
+	log.Formatter
+}
+
+func (f redactingFormatter) Format(entry *log.Entry) ([]byte, error) {
+	data, err := f.Formatter.Format(entry)
+	return []byte(redact(string(data))), err
+}
+
+// redactingWriter masks the registered secrets in what is written through
+// it. Secrets split across writes are not masked, output is written a line
+// or a result at a time.
+type redactingWriter struct {
+	w io.Writer
+}
+
+func (r redactingWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(r.w, redact(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// redactArgs returns command arguments with passwords masked, for logging:
+// the value of --password and of the --env variables named like secrets.
+func redactArgs(args []string) []string {
+	redacted := append([]string{}, args...)
+	for i := 1; i < len(redacted); i++ {
+		switch redacted[i-1] {
+		case "--password":
+			redacted[i] = "***"
+		case "--env":
+			parts := strings.SplitN(redacted[i], "=", 2)
+			name := strings.ToUpper(parts[0])
+			if len(parts) == 2 && (strings.Contains(name, "PASSWORD") || strings.Contains(name, "TOKEN") || strings.Contains(name, "SECRET")) {
+				redacted[i] = parts[0] + "=***"
+			}
+		}
+	}
+	return redacted
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRedactArgs(t *testing.T) {
+	tests := []struct {
+		args []string
+		want []string
+	}{
+		{[]string{}, []string{}},
+		{[]string{"login", "--username", "ci", "--password", "s3cr3t", "registry"}, []string{"login", "--username", "ci", "--password", "***", "registry"}},
+		{[]string{"run", "--env", "TRIVY_PASSWORD=s3cr3t"}, []string{"run", "--env", "TRIVY_PASSWORD=***"}},
+		{[]string{"run", "--env", "GITHUB_TOKEN=ghp_x", "--env", "aws_secret_access_key=y"}, []string{"run", "--env", "GITHUB_TOKEN=***", "--env", "aws_secret_access_key=***"}},
+		{[]string{"run", "--env", "TRIVY_USERNAME=ci", "--env", "TRIVY_PASSWORD"}, []string{"run", "--env", "TRIVY_USERNAME=ci", "--env", "TRIVY_PASSWORD"}},
+		{[]string{"--password"}, []string{"--password"}},
+	}
+	for _, tt := range tests {
+		args := append([]string{}, tt.args...)
+		if got := redactArgs(args); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("redactArgs(%q) = %q, want %q", tt.args, got, tt.want)
+		}
+		if !reflect.DeepEqual(args, tt.args) {
+			t.Errorf("redactArgs(%q) changed its argument to %q", tt.args, args)
+		}
+	}
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// imageRef is a fully qualified image reference.
+type imageRef struct {
+	Registry   string
+	Repository string
+	Tag        string
+	Digest     string
+}
+
+func parseImageRef(image string) imageRef {
+	ref := imageRef{}
+	name := normalizeImage(image)
+	if i := strings.Index(name, "@"); i >= 0 {
+		name, ref.Digest = name[:i], name[i+1:]
+	}
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name, ref.Tag = name[:i], name[i+1:]
+	}
+	parts := strings.SplitN(name, "/", 2)
+	ref.Registry, ref.Repository = parts[0], parts[1]
+	if ref.Tag == "" && ref.Digest == "" {
+		ref.Tag = "latest"
+	}
+	return ref
+}
+
+// stripTag removes the tag and digest of image, leaving it as written.
+func stripTag(image string) string {
+	if i := strings.Index(image, "@"); i >= 0 {
+		image = image[:i]
+	}
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		image = image[:i]
+	}
+	return image
+}
+
+// Name returns the reference without tag nor digest.
+func (r imageRef) Name() string {
+	return r.Registry + "/" + r.Repository
+}
+
+func (r imageRef) String() string {
+	s := r.Name()
+	if r.Tag != "" {
+		s += ":" + r.Tag
+	}
+	if r.Digest != "" {
+		s += "@" + r.Digest
+	}
+	return s
+}
+
+var registryClient = &http.Client{Timeout: 30 * time.Second}
+
+var challengeParam = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// registryToken gets a bearer token as asked by a registry challenge.
+func registryToken(challenge string, username string, password string) (string, error) {
+	params := map[string]string{}
+	for _, m := range challengeParam.FindAllStringSubmatch(challenge, -1) {
+		params[m[1]] = m[2]
+	}
+	req, err := http.NewRequest(http.MethodGet, params["realm"], nil)
+	if err != nil {
+		return "", err
+	}
+	q := req.URL.Query()
+	for _, key := range []string{"service", "scope"} {
+		if params[key] != "" {
+			q.Set(key, params[key])
+		}
+	}
+	req.URL.RawQuery = q.Encode()
+	if username != "" {
+		req.SetBasicAuth(username, password)
+	}
+	resp, err := registryClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token request failed: %v", resp.Status)
+	}
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", err
+	}
+	if token.Token != "" {
+		return token.Token, nil
+	}
+	return token.AccessToken, nil
+}
+
+// resolveImageDigest is resolveDigest with the credentials of image.
+func resolveImageDigest(image string, opts scanOptions) (string, error) {
+	user, password := registryCredentials(image, opts)
+	return resolveDigest(image, user, password)
+}
+
+// registryDo sends a request to the registry of ref, authenticating as
+// asked by its challenge when it needs it. The caller closes the body.
+func registryDo(method string, url string, ref imageRef, accept string, username string, password string) (*http.Response, error) {
+	header := http.Header{}
+	if accept != "" {
+		header.Set("Accept", accept)
+	}
+	return registrySend(registryClient, method, url, ref, header, username, password)
+}
+
+// registrySend is registryDo with the client and the headers of the
+// request.
+func registrySend(client *http.Client, method string, url string, ref imageRef, header http.Header, username string, password string) (*http.Response, error) {
+	do := func(auth string) (*http.Response, error) {
+		req, err := http.NewRequest(method, url, nil)
+		if err != nil {
+			return nil, err
+		}
+		for key, values := range header {
+			req.Header[key] = values
+		}
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		return client.Do(req)
+	}
+	resp, err := do("")
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	resp.Body.Close()
+	auth, err := registryAuthorization(resp.Header.Get("WWW-Authenticate"), ref, username, password)
+	if err != nil {
+		return nil, err
+	}
+	return do(auth)
+}
+
+// registryAuthorization returns the Authorization header answering the
+// challenge of the registry of ref.
+func registryAuthorization(challenge string, ref imageRef, username string, password string) (string, error) {
+	if strings.HasPrefix(strings.ToLower(challenge), "basic") {
+		req, _ := http.NewRequest(http.MethodGet, "/", nil)
+		req.SetBasicAuth(username, password)
+		return req.Header.Get("Authorization"), nil
+	}
+	token, err := registryToken(challenge, username, password)
+	if err != nil {
+		return "", fmt.Errorf("could not authenticate to %v: %v", ref.Registry, err)
+	}
+	return "Bearer " + token, nil
+}
+
+// registryHost is the host serving the registry API of ref.
+func registryHost(ref imageRef) string {
+	if ref.Registry == "docker.io" {
+		return "registry-1.docker.io"
+	}
+	return ref.Registry
+}
+
+// manifestTypes accepts the image manifests and indexes of the registries.
+var manifestTypes = strings.Join([]string{
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+}, ", ")
+
+// resolveDigest asks the registry of image for the digest its tag currently
+// points to. Images already pinned by digest are returned as they are.
+func resolveDigest(image string, username string, password string) (string, error) {
+	ref := parseImageRef(image)
+	if ref.Digest != "" {
+		return ref.Digest, nil
+	}
+	url := fmt.Sprintf("https://%s/v2/%s/manifests/%s", registryHost(ref), ref.Repository, ref.Tag)
+	resp, err := registryDo(http.MethodHead, url, ref, manifestTypes, username, password)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("could not get manifest of %v: %v", ref, resp.Status)
+	}
+	digest := resp.Header.Get("Docker-Content-Digest")
+	if digest == "" {
+		return "", fmt.Errorf("registry %v did not return the digest of %v", ref.Registry, ref)
+	}
+	return digest, nil
+}
+
+// imageSize returns the compressed size of the config and layers of image,
+// what pulling it downloads, for linux/amd64 when it is a multi-platform
+// image.
+func imageSize(image string, opts scanOptions) (int64, error) {
+	ref := parseImageRef(image)
+	user, password := registryCredentials(image, opts)
+	reference := ref.Tag
+	if ref.Digest != "" {
+		reference = ref.Digest
+	}
+	// An index leads to the manifest of the platform.
+	for depth := 0; depth < 2; depth++ {
+		url := fmt.Sprintf("https://%s/v2/%s/manifests/%s", registryHost(ref), ref.Repository, reference)
+		resp, err := registryDo(http.MethodGet, url, ref, manifestTypes, user, password)
+		if err != nil {
+			return 0, err
+		}
+		var manifest struct {
+			Config struct {
+				Size int64 `json:"size"`
+			} `json:"config"`
+			Layers []struct {
+				Size int64 `json:"size"`
+			} `json:"layers"`
+			Manifests []indexManifest `json:"manifests"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&manifest)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return 0, fmt.Errorf("could not get manifest of %v: %v", ref, resp.Status)
+		}
+		if err != nil {
+			return 0, fmt.Errorf("invalid manifest of %v: %v", ref, err)
+		}
+		if len(manifest.Manifests) == 0 {
+			size := manifest.Config.Size
+			for _, layer := range manifest.Layers {
+				size += layer.Size
+			}
+			return size, nil
+		}
+		reference = platformDigest(manifest.Manifests)
+	}
+	return 0, fmt.Errorf("no image manifest in the index of %v", ref)
+}
+
+// indexManifest is a manifest of an image index.
+type indexManifest struct {
+	Digest   string `json:"digest"`
+	Platform struct {
+		OS           string `json:"os"`
+		Architecture string `json:"architecture"`
+	} `json:"platform"`
+}
+
+// platformDigest returns the digest of the linux/amd64 manifest of an
+// index, or of its first manifest when it has none.
+func platformDigest(manifests []indexManifest) string {
+	digest := manifests[0].Digest
+	for _, m := range manifests {
+		if m.Platform.OS == "linux" && m.Platform.Architecture == "amd64" {
+			digest = m.Digest
+		}
+	}
+	return digest
+}
+
+// maxTagPages caps the pages of tags read from a registry.
+const maxTagPages = 20
+
+var nextLink = regexp.MustCompile(`<([^>]+)>;\s*rel="next"`)
+
+// listTags returns the tags of the repository of image.
+func listTags(image string, opts scanOptions) ([]string, error) {
+	ref := parseImageRef(image)
+	user, password := registryCredentials(image, opts)
+	base := "https://" + registryHost(ref)
+	url := fmt.Sprintf("%s/v2/%s/tags/list?n=1000", base, ref.Repository)
+	tags := []string{}
+	for page := 0; url != "" && page < maxTagPages; page++ {
+		resp, err := registryDo(http.MethodGet, url, ref, "application/json", user, password)
+		if err != nil {
+			return nil, err
+		}
+		var list struct {
+			Tags []string `json:"tags"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&list)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("could not list tags of %v: %v", ref.Name(), resp.Status)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid tag list of %v: %v", ref.Name(), err)
+		}
+		tags = append(tags, list.Tags...)
+		url = ""
+		if m := nextLink.FindStringSubmatch(resp.Header.Get("Link")); m != nil {
+			url = m[1]
+			if strings.HasPrefix(url, "/") {
+				url = base + url
+			}
+		}
+	}
+	return tags, nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// maxRekorEntries caps the entries fetched for an image, keeping the most
+// recent ones.
+const maxRekorEntries = 20
+
+// rekorEntry is a Rekor transparency log entry about an image, with the
+// proof of its inclusion in the log.
+type rekorEntry struct {
+	UUID                 string               `json:"uuid"`
+	Kind                 string               `json:"kind"`
+	LogIndex             int64                `json:"logIndex"`
+	IntegratedTime       time.Time            `json:"integratedTime"`
+	SignedEntryTimestamp string               `json:"signedEntryTimestamp,omitempty"`
+	InclusionProof       *rekorInclusionProof `json:"inclusionProof,omitempty"`
+}
+
+type rekorInclusionProof struct {
+	LogIndex   int64    `json:"logIndex"`
+	RootHash   string   `json:"rootHash"`
+	TreeSize   int64    `json:"treeSize"`
+	Hashes     []string `json:"hashes"`
+	Checkpoint string   `json:"checkpoint,omitempty"`
+}
+
+// rekorLogEntry is an entry as returned by the Rekor API.
+type rekorLogEntry struct {
+	Body           string `json:"body"`
+	IntegratedTime int64  `json:"integratedTime"`
+	LogIndex       int64  `json:"logIndex"`
+	Verification   struct {
+		InclusionProof       *rekorInclusionProof `json:"inclusionProof"`
+		SignedEntryTimestamp string               `json:"signedEntryTimestamp"`
+	} `json:"verification"`
+}
+
+func rekorRequest(url string, body interface{}, result interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	resp, err := registryClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("POST %v: %v", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// rekorEntries returns the Rekor entries indexed under the digest of image,
+// signatures and attestations recorded by cosign among them.
+func rekorEntries(image string, opts scanOptions) ([]rekorEntry, error) {
+	digest, err := resolveImageDigest(rewriteImage(image, opts.imageRewrites), opts)
+	if err != nil {
+		return nil, fmt.Errorf("could not resolve digest of %v: %v", image, err)
+	}
+	base := strings.TrimSuffix(opts.rekorURL, "/")
+	var uuids []string
+	if err := rekorRequest(base+"/api/v1/index/retrieve", map[string]string{"hash": digest}, &uuids); err != nil {
+		return nil, err
+	}
+	entries := []rekorEntry{}
+	if len(uuids) == 0 {
+		return entries, nil
+	}
+	var found []map[string]rekorLogEntry
+	if err := rekorRequest(base+"/api/v1/log/entries/retrieve", map[string][]string{"entryUUIDs": uuids}, &found); err != nil {
+		return nil, err
+	}
+	for _, m := range found {
+		for uuid, e := range m {
+			entry := rekorEntry{
+				UUID:                 uuid,
+				LogIndex:             e.LogIndex,
+				IntegratedTime:       time.Unix(e.IntegratedTime, 0).UTC(),
+				SignedEntryTimestamp: e.Verification.SignedEntryTimestamp,
+				InclusionProof:       e.Verification.InclusionProof,
+			}
+			var body struct {
+				Kind string `json:"kind"`
+			}
+			if data, err := base64.StdEncoding.DecodeString(e.Body); err == nil && json.Unmarshal(data, &body) == nil {
+				entry.Kind = body.Kind
+			}
+			entries = append(entries, entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].IntegratedTime.After(entries[j].IntegratedTime) })
+	if len(entries) > maxRekorEntries {
+		entries = entries[:maxRekorEntries]
+	}
+	return entries, nil
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+)
+
+// helmRelease is a release as listed by helm list.
+type helmRelease struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+	Chart     string `json:"chart"`
+	Status    string `json:"status"`
+}
+
+// releaseScope selects the releases scanned by the releases command.
+type releaseScope struct {
+	namespaces    []string
+	allNamespaces bool
+	selector      string
+	exclude       []string
+	verifyRunning bool
+	runningLabel  string
+	sidecars      bool
+	excludeImages []string
+}
+
+// systemNamespaces and systemImages are left out with -exclude-system: the
+// namespaces and registries of the control plane and cluster add-ons.
+var (
+	systemNamespaces = []string{"kube-system", "kube-public", "kube-node-lease"}
+	systemImages     = []string{
+		"registry.k8s.io",
+		"k8s.gcr.io",
+		"gcr.io/gke-release",
+		"mcr.microsoft.com/oss/kubernetes",
+		"mcr.microsoft.com/aks",
+		"public.ecr.aws/eks",
+		"public.ecr.aws/eks-distro",
+	}
+)
+
+// excludeImages leaves out the images of the given registries or
+// registry/namespace prefixes.
+func excludeImages(images []chartImage, prefixes []string) []chartImage {
+	kept := []chartImage{}
+	for _, image := range images {
+		ref := parseImageRef(image.Name)
+		excluded := false
+		for _, prefix := range prefixes {
+			if ref.Registry == prefix || strings.HasPrefix(ref.Name(), prefix+"/") {
+				excluded = true
+				break
+			}
+		}
+		if excluded {
+			log.Debugf("Leaving out image %v", image.Name)
+			continue
+		}
+		kept = append(kept, image)
+	}
+	return kept
+}
+
+// excluded tells whether an -exclude pattern matches the namespace of r or
+// namespace/name.
+func (s releaseScope) excluded(r helmRelease) bool {
+	for _, pattern := range s.exclude {
+		if ok, _ := path.Match(pattern, r.Namespace); ok {
+			return true
+		}
+		if ok, _ := path.Match(pattern, r.Namespace+"/"+r.Name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// listReleases runs helm list on namespace, on every namespace if empty and
+// all is set, on the namespace of the current context otherwise. With the
+// secret or configmap storage, the release objects of helm are read instead.
+func listReleases(namespace string, all bool, storage string) ([]helmRelease, error) {
+	if storage == "secret" || storage == "configmap" {
+		stored, err := storedReleases(storage, namespace, all, "")
+		if err != nil {
+			return nil, err
+		}
+		releases := []helmRelease{}
+		for _, r := range stored {
+			chart := r.Chart.Metadata.Name + "-" + r.Chart.Metadata.Version
+			releases = append(releases, helmRelease{Name: r.Name, Namespace: r.Namespace, Chart: chart, Status: r.Info.Status})
+		}
+		return releases, nil
+	}
+	cmd := []string{"list", "--output", "json", "--max", "0"}
+	if all {
+		cmd = append(cmd, "--all-namespaces")
+	} else if namespace != "" {
+		cmd = append(cmd, "--namespace", namespace)
+	}
+	cmd = helmClusterArgs(cmd...)
+	log.Debugf("Running helm cmd: helm %v", cmd)
+	out, err := exec.Command("helm", cmd...).Output()
+	if exitErr, ok := err.(*exec.ExitError); ok && len(exitErr.Stderr) > 0 {
+		err = fmt.Errorf("%v: %s", err, bytes.TrimSpace(exitErr.Stderr))
+	}
+	if err != nil {
+		return nil, err
+	}
+	releases := []helmRelease{}
+	if err := json.Unmarshal(out, &releases); err != nil {
+		return nil, fmt.Errorf("invalid helm list output: %v", err)
+	}
+	return releases, nil
+}
+
+// selectedNamespaces returns the namespaces matching a label selector.
+func selectedNamespaces(selector string) (map[string]bool, error) {
+	out, err := exec.Command("kubectl", kubectlArgs("get", "namespaces", "--selector", selector, "-o", "jsonpath={.items[*].metadata.name}")...).Output()
+	if exitErr, ok := err.(*exec.ExitError); ok && len(exitErr.Stderr) > 0 {
+		err = fmt.Errorf("%v: %s", err, bytes.TrimSpace(exitErr.Stderr))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not list namespaces: %v", err)
+	}
+	namespaces := map[string]bool{}
+	for _, ns := range strings.Fields(string(out)) {
+		namespaces[ns] = true
+	}
+	return namespaces, nil
+}
+
+// findReleases lists the releases of scope from storage, sorted by namespace
+// and name.
+func findReleases(scope releaseScope, storage string) ([]helmRelease, error) {
+	found := []helmRelease{}
+	if scope.allNamespaces || scope.selector != "" || len(scope.namespaces) == 0 {
+		releases, err := listReleases("", scope.allNamespaces || scope.selector != "", storage)
+		if err != nil {
+			return nil, err
+		}
+		found = releases
+	} else {
+		for _, ns := range scope.namespaces {
+			releases, err := listReleases(ns, false, storage)
+			if err != nil {
+				return nil, err
+			}
+			found = append(found, releases...)
+		}
+	}
+	var namespaces map[string]bool
+	if scope.selector != "" {
+		var err error
+		if namespaces, err = selectedNamespaces(scope.selector); err != nil {
+			return nil, err
+		}
+	}
+	releases := []helmRelease{}
+	for _, r := range found {
+		if (namespaces != nil && !namespaces[r.Namespace]) || scope.excluded(r) {
+			continue
+		}
+		releases = append(releases, r)
+	}
+	sort.Slice(releases, func(i, j int) bool {
+		if releases[i].Namespace != releases[j].Namespace {
+			return releases[i].Namespace < releases[j].Namespace
+		}
+		return releases[i].Name < releases[j].Name
+	})
+	return releases, nil
+}
+
+// scanRelease scans the images of the deployed manifest of r, along with
+// the mesh sidecars of its pods with -include-sidecars. With -verify-running,
+// the images the pods of the release run are scanned instead, and the drift
+// from the manifest is returned.
+func scanRelease(r helmRelease, ctx context.Context, backend scanBackend, scope releaseScope, opts scanOptions) (releaseResult, error) {
+	release := releaseResult{Release: r}
+	opts.namespace = r.Namespace
+	manifest, err := releaseData("manifest", r.Name, opts)
+	if err != nil {
+		return release, withExitCode(exitRender, "could not get manifest of release %v: %v", r.Name, err)
+	}
+	file, err := writeTempFile("helm-trivy-manifest", manifest)
+	if err != nil {
+		return release, err
+	}
+	defer os.Remove(file)
+	opts.manifestFiles = stringList{file}
+	images := extractImages(string(manifest), opts)
+	if scope.verifyRunning || scope.sidecars {
+		running, err := runningImages(r.Name, r.Namespace, scope.runningLabel)
+		if err != nil {
+			return release, withExitCode(exitRender, "%v", err)
+		}
+		if scope.verifyRunning {
+			images, release.Drift = reconcileImages(images, running)
+			for _, drift := range release.Drift {
+				log.Warnf("Release %v/%v: %v", r.Namespace, r.Name, drift)
+			}
+		} else {
+			images = withSidecars(images, running)
+		}
+	}
+	if opts.images = excludeImages(images, scope.excludeImages); len(opts.images) == 0 {
+		log.Infof("No image to scan in release %v/%v", r.Namespace, r.Name)
+		return release, nil
+	}
+	return scanReleaseChart(release, r.Namespace+"/"+r.Name, ctx, backend, opts)
+}
+
+// scanReleaseChart scans chart, or the images of opts, as the chart of
+// release.
+func scanReleaseChart(release releaseResult, chart string, ctx context.Context, backend scanBackend, opts scanOptions) (releaseResult, error) {
+	scans, err := scanChart(chart, ctx, backend, opts, nil)
+	if err != nil && exitCode(err) != exitPartial {
+		return release, err
+	}
+	result, resultErr := newChartResult(release.Release.Chart, scans, opts)
+	release.Result = result
+	if resultErr != nil {
+		return release, resultErr
+	}
+	return release, err
+}
+
+// releaseResult is the scan of a release, as printed by the releases
+// command.
+type releaseResult struct {
+	Release helmRelease
+	Result  chartResult
+	Drift   []string
+}
+
+type namespaceOutput struct {
+	Namespace string          `json:"Namespace"`
+	Releases  []releaseOutput `json:"Releases"`
+}
+
+type releaseOutput struct {
+	Release string          `json:"Release"`
+	Chart   string          `json:"Chart"`
+	Drift   []string        `json:"Drift,omitempty"`
+	Results json.RawMessage `json:"Results"`
+}
+
+// namespaceOutputs returns the JSON output of the releases, grouped by
+// namespace.
+func namespaceOutputs(results []releaseResult) ([]namespaceOutput, error) {
+	namespaces := []namespaceOutput{}
+	for _, r := range results {
+		if len(namespaces) == 0 || namespaces[len(namespaces)-1].Namespace != r.Release.Namespace {
+			namespaces = append(namespaces, namespaceOutput{Namespace: r.Release.Namespace, Releases: []releaseOutput{}})
+		}
+		merged, err := mergeJSONOutputs(r.Result.reports())
+		if err != nil {
+			return nil, err
+		}
+		ns := &namespaces[len(namespaces)-1]
+		ns.Releases = append(ns.Releases, releaseOutput{Release: r.Release.Name, Chart: r.Release.Chart, Drift: r.Drift, Results: json.RawMessage(merged)})
+	}
+	return namespaces, nil
+}
+
+// printReleases prints the results of the releases, one section per
+// namespace.
+func printReleases(w io.Writer, results []releaseResult, opts scanOptions) error {
+	weights, _ := parseRiskWeights(opts.riskWeights)
+	if opts.json {
+		namespaces, err := namespaceOutputs(results)
+		if err != nil {
+			return err
+		}
+		data, err := json.MarshalIndent(namespaces, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(w, string(data))
+		return nil
+	}
+	namespace := ""
+	for i, r := range results {
+		if i == 0 || r.Release.Namespace != namespace {
+			namespace = r.Release.Namespace
+			title := "Namespace " + namespace
+			fmt.Fprintf(w, "%s\n%s\n", title, strings.Repeat("=", len(title)))
+		}
+		summary := summarizeScans(r.Release.Name, r.Result.scans(), weights)
+		counts := []string{}
+		for _, severity := range severities {
+			counts = append(counts, fmt.Sprintf("%s: %d", severity, summary.Counts[severity]))
+		}
+		fmt.Fprintf(w, "\nRelease %s (%s): %d images, %s, risk score %.1f/100\n", r.Release.Name, r.Release.Chart, len(summary.Images), strings.Join(counts, ", "), summary.RiskScore)
+		for _, drift := range r.Drift {
+			fmt.Fprintf(w, "Drift: %s\n", drift)
+		}
+		fmt.Fprintln(w)
+		for _, report := range r.Result.reports() {
+			printReport(w, report, opts)
+		}
+		fmt.Fprintln(w)
+	}
+	return nil
+}
+
+func releasesMain(args []string) {
+	var opts scanOptions
+	var scope releaseScope
+	var namespaces string
+	var exclude string
+	var excludeImages string
+	var excludeSystem bool
+	var view string
+
+	fs := flag.NewFlagSet("releases", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: helm trivy releases [options]\n")
+		fmt.Fprintf(fs.Output(), "Example: helm trivy releases -all-namespaces -exclude 'kube-*'\n\n")
+		fmt.Fprintf(fs.Output(), "Options:\n")
+		fs.PrintDefaults()
+	}
+	fs.BoolVar(&opts.json, "json", false, "Enable JSON output")
+	fs.StringVar(&view, "view", "releases", "Results shown: releases (by namespace and release), images (each image with the releases using it), both, or keyed (each release with the keys of its images, the findings of each image listed once)")
+	fs.StringVar(&namespaces, "namespace", os.Getenv("HELM_NAMESPACE"), "Comma separated namespaces whose releases are scanned, defaults to $HELM_NAMESPACE, the one of the current context if empty")
+	fs.BoolVar(&scope.allNamespaces, "all-namespaces", false, "Scan the releases of every namespace")
+	fs.StringVar(&scope.selector, "selector", "", "Only scan the releases of the namespaces matching this label selector, of every namespace")
+	fs.StringVar(&opts.releaseStorage, "release-storage", "helm", "Where releases are read from: helm (helm list and helm get), or the release secret or configmap objects of helm, only needing read access to them")
+	fs.BoolVar(&scope.verifyRunning, "verify-running", false, "Scan the images the pods of each release run, with the digest they were resolved to, and report the drift from the release manifest")
+	fs.BoolVar(&scope.sidecars, "include-sidecars", false, "Also scan the Istio and Linkerd sidecars injected in the pods of each release")
+	fs.StringVar(&scope.runningLabel, "running-label", "app.kubernetes.io/instance", "Label of the pods of a release holding the release name, for -verify-running and -include-sidecars")
+	fs.StringVar(&exclude, "exclude", "", "Comma separated namespaces or namespace/release not to scan, shell patterns allowed")
+	fs.StringVar(&excludeImages, "exclude-images", "", "Comma separated registries (or registry/namespace prefixes) whose images are not scanned")
+	fs.BoolVar(&excludeSystem, "exclude-system", false, "Leave out the kube-system, kube-public and kube-node-lease namespaces and the images of the Kubernetes and cloud provider registries")
+	addScannerFlags(fs, &opts)
+	addPolicyFlags(fs, &opts)
+	fs.Parse(args)
+	opts.setFlags = setFlags(fs)
+
+	if fs.NArg() != 0 {
+		fmt.Fprintf(os.Stderr, "Error: releases takes no chart.\n")
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	// $HELM_NAMESPACE, always set when run by helm, gives way to
+	// -all-namespaces and -selector.
+	if !opts.setFlags["namespace"] && (scope.allNamespaces || scope.selector != "") {
+		namespaces = ""
+	}
+	for _, ns := range strings.Split(namespaces, ",") {
+		if ns = strings.TrimSpace(ns); ns != "" {
+			scope.namespaces = append(scope.namespaces, ns)
+		}
+	}
+	if err := validateView(view); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v.\n", err)
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	if err := validateReleaseStorage(opts.releaseStorage); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v.\n", err)
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	if len(scope.namespaces) > 0 && (scope.allNamespaces || scope.selector != "") {
+		fmt.Fprintf(os.Stderr, "Error: -namespace can't be used with -all-namespaces or -selector.\n")
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	for _, pattern := range strings.Split(exclude, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern == "" {
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Invalid -exclude pattern %q: %v.\n", pattern, err)
+			os.Exit(exitUsage)
+		}
+		scope.exclude = append(scope.exclude, pattern)
+	}
+	for _, prefix := range strings.Split(excludeImages, ",") {
+		if prefix = strings.TrimSuffix(strings.TrimSpace(prefix), "/"); prefix != "" {
+			scope.excludeImages = append(scope.excludeImages, prefix)
+		}
+	}
+	if excludeSystem {
+		scope.exclude = append(scope.exclude, systemNamespaces...)
+		scope.excludeImages = append(scope.excludeImages, systemImages...)
+	}
+
+	ctx, backend, cleanup := setupScanner(&opts)
+	defer cleanup()
+
+	releases, err := findReleases(scope, opts.releaseStorage)
+	if err != nil {
+		fatal(exitRender, opts, "Could not list releases: %v", err)
+	}
+	if len(releases) == 0 {
+		log.Warn("No release to scan")
+		return
+	}
+
+	// Releases often share images, each digest is only scanned once.
+	opts.scanMemo = newScanMemo()
+	status := exitOK
+	results := []releaseResult{}
+	for _, r := range releases {
+		result, err := scanRelease(r, ctx, backend, scope, opts)
+		if err != nil {
+			log.Errorf("Could not scan release %v/%v: %v", r.Namespace, r.Name, err)
+			status = exitPartial
+			if len(result.Result.Images) == 0 {
+				continue
+			}
+		}
+		results = append(results, result)
+	}
+	printReleaseResults(results, view, status, opts)
+}
+
+// printReleaseResults prints the results of releases in the views of -view,
+// and exits with status, or exitFindings for drift, policy violations and
+// known exploited vulnerabilities when all scans succeeded.
+func printReleaseResults(results []releaseResult, view string, status int, opts scanOptions) {
+	if err := printViews(redactingWriter{os.Stdout}, view, results, opts); err != nil {
+		fatal(exitBackend, opts, "%v", err)
+	}
+	for _, r := range results {
+		if status == exitOK && (len(r.Drift) > 0 || hasViolations(r.Result.scans()) || (opts.failOnKEV && hasKEV(r.Result.reports(), opts.vulnType))) {
+			status = exitFindings
+		}
+	}
+	if status != exitOK {
+		exit(status, opts)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+
+	log "github.com/sirupsen/logrus"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// storedRelease carries the fields of the releases helm stores in Secrets or
+// ConfigMaps that helm-trivy uses.
+type storedRelease struct {
+	Name      string                 `json:"name"`
+	Namespace string                 `json:"namespace"`
+	Version   int                    `json:"version"`
+	Manifest  string                 `json:"manifest"`
+	Config    map[string]interface{} `json:"config"`
+	Chart     struct {
+		Metadata struct {
+			Name    string `json:"name"`
+			Version string `json:"version"`
+		} `json:"metadata"`
+	} `json:"chart"`
+	Info struct {
+		Status string `json:"status"`
+	} `json:"info"`
+}
+
+// validateReleaseStorage checks the value of -release-storage.
+func validateReleaseStorage(storage string) error {
+	if storage != "helm" && storage != "secret" && storage != "configmap" {
+		return fmt.Errorf("unknown release storage %v, expected helm, secret or configmap", storage)
+	}
+	return nil
+}
+
+// decodeRelease decodes the release payload of a storage object, base64
+// encoded and gzipped JSON.
+func decodeRelease(payload string) (storedRelease, error) {
+	var r storedRelease
+	data, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		return r, err
+	}
+	if bytes.HasPrefix(data, []byte{0x1f, 0x8b, 0x08}) {
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return r, err
+		}
+		if data, err = ioutil.ReadAll(zr); err != nil {
+			return r, err
+		}
+	}
+	err = json.Unmarshal(data, &r)
+	return r, err
+}
+
+// storedReleases reads the deployed releases of the Secrets or ConfigMaps of
+// helm with kubectl, which only needs to read these objects. The releases
+// are the ones of namespace, of every namespace if all is set, and only the
+// release name if not empty.
+func storedReleases(storage string, namespace string, all bool, name string) ([]storedRelease, error) {
+	selector := "owner=helm,status=deployed"
+	if name != "" {
+		selector += ",name=" + name
+	}
+	args := []string{"get", storage + "s", "--selector", selector, "-o", "json"}
+	if all {
+		args = append(args, "--all-namespaces")
+	} else if namespace != "" {
+		args = append(args, "--namespace", namespace)
+	}
+	args = kubectlArgs(args...)
+	log.Debugf("Running kubectl cmd: kubectl %v", args)
+	out, err := exec.Command("kubectl", args...).Output()
+	if exitErr, ok := err.(*exec.ExitError); ok && len(exitErr.Stderr) > 0 {
+		err = fmt.Errorf("%v: %s", err, bytes.TrimSpace(exitErr.Stderr))
+	}
+	if err != nil {
+		return nil, err
+	}
+	var list struct {
+		Items []struct {
+			Metadata struct {
+				Name string `json:"name"`
+			} `json:"metadata"`
+			Data map[string]string `json:"data"`
+		} `json:"items"`
+	}
+	if err := json.Unmarshal(out, &list); err != nil {
+		return nil, fmt.Errorf("invalid kubectl output: %v", err)
+	}
+	latest := map[string]storedRelease{}
+	for _, item := range list.Items {
+		payload := item.Data["release"]
+		if storage == "secret" {
+			// Secret data is base64 encoded once more.
+			data, err := base64.StdEncoding.DecodeString(payload)
+			if err != nil {
+				return nil, fmt.Errorf("invalid release %v: %v", item.Metadata.Name, err)
+			}
+			payload = string(data)
+		}
+		r, err := decodeRelease(payload)
+		if err != nil {
+			return nil, fmt.Errorf("invalid release %v: %v", item.Metadata.Name, err)
+		}
+		key := r.Namespace + "/" + r.Name
+		if previous, ok := latest[key]; !ok || r.Version > previous.Version {
+			latest[key] = r
+		}
+	}
+	releases := []storedRelease{}
+	for _, r := range latest {
+		releases = append(releases, r)
+	}
+	return releases, nil
+}
+
+// storedReleaseData returns the values or the manifest of release, like
+// releaseData, from the storage objects of helm.
+func storedReleaseData(what string, release string, opts scanOptions) ([]byte, error) {
+	releases, err := storedReleases(opts.releaseStorage, opts.namespace, false, release)
+	if err != nil {
+		return nil, err
+	}
+	if len(releases) == 0 {
+		return nil, fmt.Errorf("release %v not found", release)
+	}
+	if what == "manifest" {
+		return []byte(releases[0].Manifest), nil
+	}
+	if len(releases[0].Config) == 0 {
+		return []byte{}, nil
+	}
+	return yaml.Marshal(releases[0].Config)
+}
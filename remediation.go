@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var tagNumbers = regexp.MustCompile(`[0-9]+`)
+
+// tagVersion returns the numbers of a tag, and its shape: the tag with
+// numbers replaced, telling apart the variants of an image like -alpine or
+// -debian-11-r5.
+func tagVersion(tag string) ([]int, string) {
+	numbers := []int{}
+	for _, n := range tagNumbers.FindAllString(tag, -1) {
+		i, err := strconv.Atoi(n)
+		if err != nil {
+			return nil, ""
+		}
+		numbers = append(numbers, i)
+	}
+	return numbers, tagNumbers.ReplaceAllString(tag, "0")
+}
+
+// compareVersions compares the numbers of two tags of the same shape.
+func compareVersions(a []int, b []int) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			if a[i] < b[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return len(a) - len(b)
+}
+
+// newerTags returns the tags of the same variant and major version as tag
+// that are more recent, oldest first.
+func newerTags(tag string, tags []string) []string {
+	current, shape := tagVersion(tag)
+	if len(current) == 0 {
+		return nil
+	}
+	type candidate struct {
+		tag     string
+		version []int
+	}
+	candidates := []candidate{}
+	for _, t := range tags {
+		version, s := tagVersion(t)
+		if s != shape || version[0] != current[0] || compareVersions(version, current) <= 0 {
+			continue
+		}
+		candidates = append(candidates, candidate{tag: t, version: version})
+	}
+	sort.Slice(candidates, func(i, j int) bool { return compareVersions(candidates[i].version, candidates[j].version) < 0 })
+	newer := []string{}
+	for _, c := range candidates {
+		newer = append(newer, c.tag)
+	}
+	return newer
+}
+
+// setPath returns a values path in the syntax of helm --set, escaping dots
+// in keys.
+func setPath(path []string) string {
+	keys := []string{}
+	for _, key := range path {
+		keys = append(keys, strings.Replace(key, ".", `\.`, -1))
+	}
+	return strings.Join(keys, ".")
+}
+
+// setTag returns the --set option setting the tag of the image of v.
+func setTag(v valuesImage, image string, tag string) string {
+	if v.Split {
+		return fmt.Sprintf("--set %s=%s", setPath(copyPath(v.Path, "tag")), tag)
+	}
+	return fmt.Sprintf("--set %s=%s:%s", setPath(v.Path), stripTag(image), tag)
+}
+
+// suggestedTag returns the most recent tag of the same variant and major
+// version as the tag of image, "" if there is none or image is pinned by
+// digest.
+func suggestedTag(image string, opts scanOptions) string {
+	ref := parseImageRef(image)
+	if ref.Digest != "" {
+		return ""
+	}
+	tags, err := listTags(rewriteImage(image, opts.imageRewrites), opts)
+	if err != nil {
+		log.Warnf("Could not list tags of %v: %v", image, err)
+		return ""
+	}
+	newer := newerTags(ref.Tag, tags)
+	if len(newer) == 0 {
+		log.Debugf("No newer tag for %v", image)
+		return ""
+	}
+	return newer[len(newer)-1]
+}
+
+// remediationHint returns the --set option upgrading image to its
+// suggestedTag, when the image has fixable vulnerabilities and its tag is
+// set through the chart values.
+func remediationHint(image string, report trivyReport, values []valuesImage, opts scanOptions) string {
+	fixable := 0
+	for _, v := range report.vulnerabilities() {
+		if v.FixedVersion != "" {
+			fixable++
+		}
+	}
+	if fixable == 0 {
+		return ""
+	}
+	v, ok := imageValues(values, image)
+	if !ok {
+		log.Debugf("Could not find which value sets %v, no remediation hint", image)
+		return ""
+	}
+	tag := suggestedTag(image, opts)
+	if tag == "" {
+		return ""
+	}
+	return setTag(v, image, tag)
+}
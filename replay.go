@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+)
+
+// helmFixture returns the fixture of the helm command run with args, under
+// -record or -replay. Fetched values are read from temporary files, so the
+// command is known by the -values given instead.
+func helmFixture(args []string, opts scanOptions) string {
+	key := []string{}
+	for _, arg := range args {
+		if opts.valuesSources != "" && arg == opts.templateValues {
+			arg = opts.valuesSources
+		}
+		key = append(key, arg)
+	}
+	sum := sha256.Sum256([]byte(strings.Join(key, "\x00")))
+	return filepath.Join("helm", hex.EncodeToString(sum[:8])+".yaml")
+}
+
+// trivyFixture returns the fixture of the scan of image, under -record or
+// -replay, named after the image so that tests can edit it.
+func trivyFixture(image string) string {
+	name := strings.NewReplacer("/", "_", ":", "_", "@", "_").Replace(image)
+	return filepath.Join("trivy", name+".json")
+}
+
+// recordFixture writes the fixture name of the -record directory dir.
+func recordFixture(dir string, name string, data []byte) error {
+	path := filepath.Join(dir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	log.Debugf("Recording %v", path)
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// replayFixture reads the fixture name of the -replay directory dir.
+func replayFixture(dir string, name string) ([]byte, error) {
+	path := filepath.Join(dir, name)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("nothing recorded in %v, record it with -record %v", path, dir)
+	}
+	log.Debugf("Replaying %v", path)
+	return data, err
+}
+
+// runHelm runs helm with args and returns its output. With -replay, the
+// output recorded by -record is returned instead.
+func runHelm(args []string, opts scanOptions) ([]byte, error) {
+	log.Debugf("Running helm cmd: helm %v", redactArgs(args))
+	if opts.replay != "" {
+		return replayFixture(opts.replay, helmFixture(args, opts))
+	}
+	ctx := opts.helmContext
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	out, err := exec.CommandContext(ctx, "helm", args...).Output()
+	if err == nil && opts.record != "" {
+		if err := recordFixture(opts.record, helmFixture(args, opts), out); err != nil {
+			log.Warnf("Could not record helm %v: %v", args[0], err)
+		}
+	}
+	return out, err
+}
+
+// validateRecordReplay checks -record and -replay.
+func validateRecordReplay(opts scanOptions) error {
+	if opts.record != "" && opts.replay != "" {
+		return fmt.Errorf("-record and -replay can't be used together")
+	}
+	if opts.replay != "" {
+		if info, err := os.Stat(opts.replay); err != nil || !info.IsDir() {
+			return fmt.Errorf("-replay needs a directory written by -record, %v is not one", opts.replay)
+		}
+	}
+	return nil
+}
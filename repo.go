@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// exactVersion matches chart versions that are not semver ranges.
+var exactVersion = regexp.MustCompile(`^v?[0-9]+\.[0-9]+\.[0-9]+(-[0-9A-Za-z.-]+)?(\+[0-9A-Za-z.-]+)?$`)
+
+// resolveChartVersion returns the version of chart a semver range, or
+// -devel, resolves to, the highest matching one as helm picks it. Exact
+// versions are returned as is.
+func resolveChartVersion(chart string, opts scanOptions) (string, error) {
+	if exactVersion.MatchString(opts.chartVersion) || (opts.chartVersion == "" && !opts.devel) {
+		return opts.chartVersion, nil
+	}
+	if info, err := os.Stat(chart); err == nil && info.IsDir() {
+		return opts.chartVersion, nil
+	}
+	metadata, err := showChart(chart, opts)
+	if err != nil {
+		return "", fmt.Errorf("could not resolve version %q of chart %v: %v", opts.chartVersion, chart, err)
+	}
+	if opts.chartVersion != "" {
+		log.Infof("Using version %v of chart %v, the highest matching %v", metadata.Version, chart, opts.chartVersion)
+	} else {
+		log.Infof("Using version %v of chart %v, including development versions", metadata.Version, chart)
+	}
+	return metadata.Version, nil
+}
+
+// validateRepoAliases checks repository aliases are given as alias=url.
+func validateRepoAliases(aliases []string) error {
+	for _, alias := range aliases {
+		kv := strings.SplitN(alias, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || strings.Contains(kv[0], "/") || !strings.Contains(kv[1], "://") {
+			return fmt.Errorf("invalid repository alias %q, expected alias=url", alias)
+		}
+	}
+	return nil
+}
+
+// chartArgs returns the helm arguments naming chart, along with the
+// credentials of its repository or OCI registry. Charts of -repo, or of a
+// -repo-alias repository, are fetched with --repo so that the repository
+// doesn't need to be added first.
+func chartArgs(chart string, opts scanOptions) []string {
+	args := []string{}
+	for _, flag := range [][2]string{
+		{"--username", opts.repoUsername},
+		{"--password", opts.repoPassword},
+		{"--ca-file", opts.repoCAFile},
+		{"--cert-file", opts.repoCertFile},
+		{"--key-file", opts.repoKeyFile},
+		{"--registry-config", opts.registryConfig},
+	} {
+		if flag[1] != "" {
+			args = append(args, flag[0], flag[1])
+		}
+	}
+	if opts.devel {
+		args = append(args, "--devel")
+	}
+	// The chart comes last after --, so that helm never takes it for a flag.
+	if opts.chartRepo != "" {
+		return append(args, "--repo", opts.chartRepo, "--", chart)
+	}
+	parts := strings.SplitN(chart, "/", 2)
+	if len(parts) == 2 {
+		for _, alias := range opts.repoAliases {
+			kv := strings.SplitN(alias, "=", 2)
+			if kv[0] == parts[0] {
+				return append(args, "--repo", kv[1], "--", parts[1])
+			}
+		}
+	}
+	return append(args, "--", chart)
+}
+
+// validateChartRef checks a chart reference and version given by a client of
+// the server or by a cluster object, which must not pass for helm flags.
+func validateChartRef(chart string, version string) error {
+	if chart == "" {
+		return fmt.Errorf("missing chart")
+	}
+	if strings.HasPrefix(chart, "-") {
+		return fmt.Errorf("invalid chart %q", chart)
+	}
+	if strings.HasPrefix(version, "-") {
+		return fmt.Errorf("invalid chart version %q", version)
+	}
+	return nil
+}
+
+// isLocalChart tells whether chart is a path on the disk rather than a chart
+// of a repository or an URL, helm reading files and directories as charts.
+func isLocalChart(chart string) bool {
+	if strings.HasPrefix(chart, "file://") {
+		return true
+	}
+	if strings.Contains(chart, "://") {
+		return false
+	}
+	if strings.HasPrefix(chart, ".") || strings.HasPrefix(chart, "~") || filepath.IsAbs(chart) {
+		return true
+	}
+	_, err := os.Stat(chart)
+	return err == nil
+}
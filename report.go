@@ -0,0 +1,416 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// severities lists trivy severities from the most to the least severe.
+var severities = []string{"CRITICAL", "HIGH", "MEDIUM", "LOW", "UNKNOWN"}
+
+// The trivy types below keep the fields of the trivy output helm-trivy
+// doesn't know about in extra, to write them back in the JSON output.
+
+type trivyVulnerability struct {
+	VulnerabilityID  string `json:"VulnerabilityID"`
+	PkgName          string `json:"PkgName"`
+	PkgPath          string `json:"PkgPath,omitempty"`
+	InstalledVersion string `json:"InstalledVersion"`
+	FixedVersion     string `json:"FixedVersion,omitempty"`
+	Severity         string `json:"Severity"`
+	SeveritySource   string `json:"SeveritySource,omitempty"`
+	Title            string `json:"Title,omitempty"`
+	Description      string `json:"Description,omitempty"`
+	PrimaryURL       string `json:"PrimaryURL,omitempty"`
+	PublishedDate    string `json:"PublishedDate,omitempty"`
+	// VendorSeverity is the level each source rates the vulnerability,
+	// from 0 for UNKNOWN to 4 for CRITICAL.
+	VendorSeverity map[string]int `json:"VendorSeverity,omitempty"`
+	// CVSS is keyed by source, nvd, redhat...
+	CVSS map[string]trivyCVSS `json:"CVSS,omitempty"`
+
+	EPSS float64 `json:"HelmTrivyEPSS,omitempty"`
+	KEV  bool    `json:"HelmTrivyKEV,omitempty"`
+	// OriginalSeverity is the severity given by trivy, when -severity-source
+	// or -severity-map changed it.
+	OriginalSeverity string `json:"HelmTrivyOriginalSeverity,omitempty"`
+	// ChosenSource is the source -severity-source picked.
+	ChosenSource string `json:"HelmTrivySeveritySource,omitempty"`
+
+	extra map[string]json.RawMessage
+}
+
+func (v *trivyVulnerability) UnmarshalJSON(data []byte) error {
+	type plain trivyVulnerability
+	extra, err := unmarshalExtra(data, (*plain)(v))
+	v.extra = extra
+	return err
+}
+
+func (v trivyVulnerability) MarshalJSON() ([]byte, error) {
+	type plain trivyVulnerability
+	return marshalExtra(plain(v), v.extra)
+}
+
+type trivyCVSS struct {
+	V2Vector string  `json:"V2Vector,omitempty"`
+	V3Vector string  `json:"V3Vector,omitempty"`
+	V2Score  float64 `json:"V2Score,omitempty"`
+	V3Score  float64 `json:"V3Score,omitempty"`
+}
+
+// cvss returns the most relevant CVSS vector and score of the vulnerability,
+// preferring the source picked by -severity-source, then NVD and CVSS v3.
+func (v trivyVulnerability) cvss() (string, float64) {
+	sources := []string{"nvd"}
+	if v.ChosenSource != "" && v.ChosenSource != "nvd" {
+		sources = []string{v.ChosenSource, "nvd"}
+	}
+	first := len(sources)
+	for source := range v.CVSS {
+		if source != "nvd" && source != v.ChosenSource {
+			sources = append(sources, source)
+		}
+	}
+	sort.Strings(sources[first:])
+	for _, source := range sources {
+		if c, ok := v.CVSS[source]; ok && c.V3Vector != "" {
+			return c.V3Vector, c.V3Score
+		}
+	}
+	for _, source := range sources {
+		if c, ok := v.CVSS[source]; ok && c.V2Vector != "" {
+			return c.V2Vector, c.V2Score
+		}
+	}
+	return "", 0
+}
+
+// trivySecret is a finding of the secret scanner. The matched content is
+// left out on purpose.
+type trivySecret struct {
+	RuleID    string `json:"RuleID"`
+	Category  string `json:"Category,omitempty"`
+	Severity  string `json:"Severity"`
+	Title     string `json:"Title"`
+	StartLine int    `json:"StartLine"`
+	EndLine   int    `json:"EndLine"`
+}
+
+type trivyMisconfiguration struct {
+	ID         string `json:"ID"`
+	Title      string `json:"Title"`
+	Message    string `json:"Message,omitempty"`
+	Resolution string `json:"Resolution,omitempty"`
+	Severity   string `json:"Severity"`
+	Status     string `json:"Status,omitempty"`
+
+	extra map[string]json.RawMessage
+}
+
+func (m *trivyMisconfiguration) UnmarshalJSON(data []byte) error {
+	type plain trivyMisconfiguration
+	extra, err := unmarshalExtra(data, (*plain)(m))
+	m.extra = extra
+	return err
+}
+
+func (m trivyMisconfiguration) MarshalJSON() ([]byte, error) {
+	type plain trivyMisconfiguration
+	return marshalExtra(plain(m), m.extra)
+}
+
+type trivyResult struct {
+	Target            string                  `json:"Target"`
+	Class             string                  `json:"Class,omitempty"`
+	Type              string                  `json:"Type,omitempty"`
+	Vulnerabilities   []trivyVulnerability    `json:"Vulnerabilities,omitempty"`
+	Secrets           []trivySecret           `json:"Secrets,omitempty"`
+	Misconfigurations []trivyMisconfiguration `json:"Misconfigurations,omitempty"`
+
+	extra map[string]json.RawMessage
+}
+
+func (r *trivyResult) UnmarshalJSON(data []byte) error {
+	type plain trivyResult
+	extra, err := unmarshalExtra(data, (*plain)(r))
+	r.extra = extra
+	return err
+}
+
+func (r trivyResult) MarshalJSON() ([]byte, error) {
+	type plain trivyResult
+	return marshalExtra(plain(r), r.extra)
+}
+
+type trivyOS struct {
+	Family string `json:"Family"`
+	Name   string `json:"Name"`
+	EOSL   bool   `json:"EOSL,omitempty"`
+}
+
+type trivyMetadata struct {
+	OS *trivyOS `json:"OS,omitempty"`
+
+	extra map[string]json.RawMessage
+}
+
+func (m *trivyMetadata) UnmarshalJSON(data []byte) error {
+	type plain trivyMetadata
+	extra, err := unmarshalExtra(data, (*plain)(m))
+	m.extra = extra
+	return err
+}
+
+func (m trivyMetadata) MarshalJSON() ([]byte, error) {
+	type plain trivyMetadata
+	return marshalExtra(plain(m), m.extra)
+}
+
+type trivyReport struct {
+	SchemaVersion int             `json:"SchemaVersion,omitempty"`
+	ArtifactName  string          `json:"ArtifactName"`
+	ArtifactType  string          `json:"ArtifactType,omitempty"`
+	Metadata      trivyMetadata   `json:"Metadata"`
+	Labels        []string        `json:"HelmTrivyLabels,omitempty"`
+	Violations    []string        `json:"HelmTrivyViolations,omitempty"`
+	Remediation   string          `json:"HelmTrivyRemediation,omitempty"`
+	Workloads     []imageWorkload `json:"HelmTrivyWorkloads,omitempty"`
+	// Accepted lists the vulnerabilities hidden by ignore rules.
+	Accepted          []acceptedVulnerability `json:"HelmTrivyAccepted,omitempty"`
+	Rekor             []rekorEntry            `json:"HelmTrivyRekor,omitempty"`
+	ChartVerification *chartVerification      `json:"HelmTrivyChartVerification,omitempty"`
+	Results           []trivyResult           `json:"Results"`
+
+	// legacy is set for the bare list of results older trivy releases
+	// print instead of a report object, which is written back as such.
+	legacy bool
+	extra  map[string]json.RawMessage
+}
+
+func (r *trivyReport) UnmarshalJSON(data []byte) error {
+	type plain trivyReport
+	data = bytes.TrimSpace(data)
+	if bytes.Equal(data, []byte("null")) || bytes.HasPrefix(data, []byte("[")) {
+		*r = trivyReport{legacy: true}
+		return json.Unmarshal(data, &r.Results)
+	}
+	extra, err := unmarshalExtra(data, (*plain)(r))
+	r.extra = extra
+	return err
+}
+
+func (r trivyReport) MarshalJSON() ([]byte, error) {
+	type plain trivyReport
+	if r.legacy {
+		return json.Marshal(r.Results)
+	}
+	return marshalExtra(plain(r), r.extra)
+}
+
+// parseTrivyOutput decodes the JSON of a trivy report for one image, as kept
+// in caches and recordings. Older trivy releases print a bare list of
+// results, newer ones wrap it in a report object.
+func parseTrivyOutput(image string, output string) (trivyReport, error) {
+	report := trivyReport{}
+	if strings.TrimSpace(output) != "" {
+		if err := json.Unmarshal([]byte(output), &report); err != nil {
+			return report, err
+		}
+	}
+	report.ArtifactName = image
+	return report, nil
+}
+
+// trivyOutput encodes report as the JSON parseTrivyOutput reads.
+func trivyOutput(report trivyReport) (string, error) {
+	data, err := json.Marshal(report)
+	return string(data), err
+}
+
+// annotatedReport returns the report of the scan, with the image labels and
+// the other helm-trivy fields of the scan.
+func (scan imageScan) annotatedReport() trivyReport {
+	report := scan.Report
+	report.ArtifactName = scan.Image
+	report.Labels = scan.Labels
+	report.Violations = scan.Violations
+	report.Accepted = scan.Accepted
+	report.Rekor = scan.Rekor
+	report.Remediation = scan.Remediation
+	report.Workloads = scan.Workloads
+	report.ChartVerification = scan.ChartVerification
+	return report
+}
+
+func (r trivyReport) vulnerabilities() []trivyVulnerability {
+	vulns := []trivyVulnerability{}
+	for _, result := range r.Results {
+		vulns = append(vulns, result.Vulnerabilities...)
+	}
+	return vulns
+}
+
+// sortVulnerabilities sorts the vulnerabilities of report by severity, ID,
+// package and installed version, for results to be diffed between runs.
+func sortVulnerabilities(report trivyReport) trivyReport {
+	return rewriteVulnerabilities(report, func(vulns []trivyVulnerability) []trivyVulnerability {
+		sort.SliceStable(vulns, func(i, j int) bool {
+			a, b := vulns[i], vulns[j]
+			if ra, rb := severityRank(a.Severity), severityRank(b.Severity); ra != rb {
+				return ra < rb
+			}
+			for _, f := range [][2]string{{a.VulnerabilityID, b.VulnerabilityID}, {a.PkgName, b.PkgName}, {a.InstalledVersion, b.InstalledVersion}, {a.PkgPath, b.PkgPath}} {
+				if f[0] != f[1] {
+					return f[0] < f[1]
+				}
+			}
+			return false
+		})
+		return vulns
+	})
+}
+
+// validateSeverities checks a comma separated list of severities.
+func validateSeverities(list string) error {
+	if list == "" {
+		return nil
+	}
+	for _, s := range strings.Split(list, ",") {
+		known := false
+		for _, severity := range severities {
+			known = known || strings.EqualFold(s, severity)
+		}
+		if !known {
+			return fmt.Errorf("unknown severity %q, expected one of %v", s, strings.Join(severities, ","))
+		}
+	}
+	return nil
+}
+
+func countBySeverity(vulns []trivyVulnerability) map[string]int {
+	counts := map[string]int{}
+	for _, v := range vulns {
+		counts[v.Severity]++
+	}
+	return counts
+}
+
+// writeSummaryLine writes the -summary-line of a chart scan to w: a single
+// line of key=value fields, with the vulnerability counts by severity and
+// the result, FAIL when status fails the command.
+func writeSummaryLine(w io.Writer, result chartResult, status int, opts scanOptions) error {
+	counts := map[string]int{}
+	for _, report := range result.reports() {
+		for severity, count := range countBySeverity(report.vulnerabilities()) {
+			counts[severity] += count
+		}
+	}
+	fields := []string{"chart=" + quoteArg(result.Chart), fmt.Sprintf("images=%d", len(result.Images))}
+	for _, severity := range severities {
+		fields = append(fields, fmt.Sprintf("%s=%d", strings.ToLower(severity), counts[severity]))
+	}
+	if exitStatus(status, opts) == exitOK {
+		fields = append(fields, "result=PASS")
+	} else {
+		fields = append(fields, "result=FAIL")
+	}
+	_, err := fmt.Fprintln(w, strings.Join(fields, " "))
+	return err
+}
+
+// mergeJSONOutputs merges the trivy reports of every image, as
+// annotatedReport returns them, in a single array.
+// Results of labelled images carry their labels in HelmTrivyLabels, policy
+// violations are in HelmTrivyViolations and vulnerabilities hidden by ignore
+// rules in HelmTrivyAccepted. The -verify-chart result is repeated in the
+// HelmTrivyChartVerification of each result, Rekor entries are in
+// HelmTrivyRekor, -remediation hints in HelmTrivyRemediation and the
+// workloads running the image in HelmTrivyWorkloads.
+func mergeJSONOutputs(reports []trivyReport) (string, error) {
+	var out strings.Builder
+	err := writeJSONOutputs(&out, reports)
+	return out.String(), err
+}
+
+// writeJSONOutputs writes the array of mergeJSONOutputs to w, encoding the
+// report of one image at a time.
+func writeJSONOutputs(w io.Writer, reports []trivyReport) error {
+	return writeIndentedJSONOutputs(w, reports, "")
+}
+
+// writeIndentedJSONOutputs is writeJSONOutputs for an array nested in other
+// JSON, its lines after the first being prefixed with prefix.
+func writeIndentedJSONOutputs(w io.Writer, reports []trivyReport, prefix string) error {
+	written := 0
+	for _, report := range reports {
+		items := []interface{}{report}
+		if report.legacy {
+			var err error
+			if items, err = legacyItems(report); err != nil {
+				return err
+			}
+		}
+		for _, item := range items {
+			data, err := json.MarshalIndent(item, prefix+"  ", "  ")
+			if err != nil {
+				return err
+			}
+			sep := ",\n" + prefix + "  "
+			if written == 0 {
+				sep = "[\n" + prefix + "  "
+			}
+			if _, err := fmt.Fprintf(w, "%s%s", sep, data); err != nil {
+				return err
+			}
+			written++
+		}
+	}
+	end := "\n" + prefix + "]"
+	if written == 0 {
+		end = "[]"
+	}
+	_, err := io.WriteString(w, end)
+	return err
+}
+
+// legacyItems returns the results of a report older trivy releases printed as
+// a bare list, each with the helm-trivy fields of the report. A report without
+// results is only written when it has violations or accepted vulnerabilities.
+func legacyItems(report trivyReport) ([]interface{}, error) {
+	results := report.Results
+	if len(results) == 0 && (len(report.Violations) > 0 || len(report.Accepted) > 0) {
+		results = []trivyResult{{Target: report.ArtifactName}}
+	}
+	report.legacy, report.Results = false, nil
+	data, err := json.Marshal(report)
+	if err != nil {
+		return nil, err
+	}
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	items := []interface{}{}
+	for _, result := range results {
+		data, err := json.Marshal(result)
+		if err != nil {
+			return nil, err
+		}
+		item := map[string]json.RawMessage{}
+		if err := json.Unmarshal(data, &item); err != nil {
+			return nil, err
+		}
+		for name, value := range fields {
+			if strings.HasPrefix(name, "HelmTrivy") {
+				item[name] = value
+			}
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestMergeJSONOutputs(t *testing.T) {
+	parse := func(output string) trivyReport {
+		var report trivyReport
+		if err := json.Unmarshal([]byte(output), &report); err != nil {
+			t.Fatal(err)
+		}
+		return report
+	}
+	scans := []imageScan{
+		{
+			Image:  "nginx:1.25",
+			Labels: []string{"team=web"},
+			Report: parse(`{"SchemaVersion": 2, "ArtifactName": "nginx:1.25", "Metadata": {"ImageID": "sha256:42"},
+				"Results": [{"Target": "nginx", "Vulnerabilities": [{"VulnerabilityID": "CVE-2023-1", "PkgName": "libc6", "InstalledVersion": "2.36", "Severity": "HIGH", "PkgID": "libc6@2.36"}]}]}`),
+		},
+		{Image: "redis:7", Violations: []string{"latest tag is not allowed"}, Report: parse(`[{"Target": "redis", "Vulnerabilities": null}]`)},
+		{Image: "busybox:1.36", Violations: []string{"registry docker.io is not allowed"}, Report: parse(`null`)},
+		{Image: "alpine:3.18", Report: parse(`null`)},
+	}
+	reports := []trivyReport{}
+	for _, scan := range scans {
+		reports = append(reports, scan.annotatedReport())
+	}
+	enrichReports(reports, map[string]exploitData{"CVE-2023-1": {EPSS: 0.5, KEV: true}})
+	output, err := mergeJSONOutputs(reports)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got, want interface{}
+	if err := json.Unmarshal([]byte(output), &got); err != nil {
+		t.Fatalf("invalid JSON %s: %v", output, err)
+	}
+	json.Unmarshal([]byte(`[
+		{"SchemaVersion": 2, "ArtifactName": "nginx:1.25", "Metadata": {"ImageID": "sha256:42"}, "HelmTrivyLabels": ["team=web"],
+		 "Results": [{"Target": "nginx", "Vulnerabilities": [{"VulnerabilityID": "CVE-2023-1", "PkgName": "libc6", "InstalledVersion": "2.36",
+		   "Severity": "HIGH", "PkgID": "libc6@2.36", "HelmTrivyEPSS": 0.5, "HelmTrivyKEV": true}]}]},
+		{"Target": "redis", "HelmTrivyViolations": ["latest tag is not allowed"]},
+		{"Target": "busybox:1.36", "HelmTrivyViolations": ["registry docker.io is not allowed"]}
+	]`), &want)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("mergeJSONOutputs() = %s", output)
+	}
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+)
+
+// resultCacheTTL is how long results stay in a shared cache. They are only
+// reused with the same vulnerability DB anyway.
+const resultCacheTTL = 7 * 24 * time.Hour
+
+// resultCache stores trivy outputs shared by a team or a CI fleet, so that
+// each image is scanned once per vulnerability DB update.
+type resultCache interface {
+	get(key string) (string, bool, error)
+	set(key string, value string) error
+}
+
+// newResultCache returns the cache at rawURL, either redis://[:password@]host[:port][/db]
+// or the base URL of an HTTP API answering GET and PUT on <base>/<key>.
+func newResultCache(rawURL string) (resultCache, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "redis":
+		c := redisCache{addr: u.Host}
+		if u.Port() == "" {
+			c.addr = net.JoinHostPort(u.Hostname(), "6379")
+		}
+		if u.User != nil {
+			c.password, _ = u.User.Password()
+		}
+		if db := strings.Trim(u.Path, "/"); db != "" {
+			if c.db, err = strconv.Atoi(db); err != nil {
+				return nil, fmt.Errorf("invalid redis database %q", db)
+			}
+		}
+		return c, nil
+	case "http", "https":
+		return httpCache{base: strings.TrimSuffix(rawURL, "/")}, nil
+	}
+	return nil, fmt.Errorf("unsupported result cache %q, expected a redis:// or http(s):// URL", rawURL)
+}
+
+type redisCache struct {
+	addr     string
+	password string
+	db       int
+}
+
+// do runs a redis command on a new connection, after authenticating and
+// selecting the database.
+func (c redisCache) do(args ...string) (string, bool, error) {
+	conn, err := net.DialTimeout("tcp", c.addr, 10*time.Second)
+	if err != nil {
+		return "", false, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Minute))
+	r := bufio.NewReader(conn)
+	if c.password != "" {
+		if _, _, err := redisCommand(conn, r, "AUTH", c.password); err != nil {
+			return "", false, err
+		}
+	}
+	if c.db != 0 {
+		if _, _, err := redisCommand(conn, r, "SELECT", strconv.Itoa(c.db)); err != nil {
+			return "", false, err
+		}
+	}
+	return redisCommand(conn, r, args...)
+}
+
+// redisCommand sends a command with the RESP protocol and reads its reply.
+// The boolean is false for nil replies.
+func redisCommand(w io.Writer, r *bufio.Reader, args ...string) (string, bool, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&buf, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		return "", false, err
+	}
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", false, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return "", false, fmt.Errorf("empty redis reply")
+	}
+	switch line[0] {
+	case '+', ':':
+		return line[1:], true, nil
+	case '-':
+		return "", false, fmt.Errorf("redis: %v", line[1:])
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return "", false, fmt.Errorf("invalid redis reply %q", line)
+		}
+		if n < 0 {
+			return "", false, nil
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return "", false, err
+		}
+		return string(data[:n]), true, nil
+	}
+	return "", false, fmt.Errorf("unexpected redis reply %q", line)
+}
+
+func (c redisCache) get(key string) (string, bool, error) {
+	return c.do("GET", key)
+}
+
+func (c redisCache) set(key string, value string) error {
+	_, _, err := c.do("SET", key, value, "EX", strconv.Itoa(int(resultCacheTTL.Seconds())))
+	return err
+}
+
+type httpCache struct {
+	base string
+}
+
+func (c httpCache) get(key string) (string, bool, error) {
+	resp, err := registryClient.Get(c.base + "/" + key)
+	if err != nil {
+		return "", false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return "", false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", false, fmt.Errorf("GET %v/%v: %v", c.base, key, resp.Status)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	return string(data), err == nil, err
+}
+
+func (c httpCache) set(key string, value string) error {
+	req, err := http.NewRequest(http.MethodPut, c.base+"/"+key, strings.NewReader(value))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := registryClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("PUT %v/%v: %v", c.base, key, resp.Status)
+	}
+	return nil
+}
+
+// downloadDB has trivy download its vulnerability DB into the cache dir,
+// unless -download-db did or -offline, and returns the time it was last updated.
+func downloadDB(ctx context.Context, backend scanBackend, opts scanOptions) (string, error) {
+	if !opts.fetchDB && !opts.offline {
+		c := newTrivyContainer(opts)
+		c.Cmd = trivyCommand(append(c.Cmd, "--download-db-only", "-q"), opts.trivyVersion)
+		if err := backend.run(ctx, c, nil); err != nil {
+			return "", err
+		}
+	}
+	info, err := scannerInfo(ctx, backend, opts)
+	if err != nil {
+		return "", err
+	}
+	if info.DBUpdatedAt == "" {
+		return "", fmt.Errorf("trivy did not report its vulnerability DB")
+	}
+	log.Debugf("Using vulnerability DB of %v", info.DBUpdatedAt)
+	return info.DBUpdatedAt, nil
+}
+
+// resultCacheKey identifies the result of scanning image: its digest, the
+// vulnerability DB and the trivy options used.
+func resultCacheKey(image string, opts scanOptions) (string, error) {
+	c := scanContainer(image, opts)
+	image = c.Cmd[len(c.Cmd)-1]
+	digest, err := resolveImageDigest(image, opts)
+	if err != nil {
+		return "", fmt.Errorf("could not resolve digest: %v", err)
+	}
+	args := strings.Join(c.Cmd[:len(c.Cmd)-1], " ")
+	sum := sha256.Sum256([]byte(stripTag(normalizeImage(image)) + "@" + digest + "\n" + opts.dbVersion + "\n" + args))
+	return fmt.Sprintf("helm-trivy:%x", sum), nil
+}
+
+// scanImageCached is scanImage reusing trivy-operator reports and Harbor
+// scan results, or going through the shared result cache, when configured.
+// Images read from an -image-input are always scanned. With a scan memo,
+// an image is scanned once per digest. The scan is recorded in the -stats.
+func scanImageCached(image string, ctx context.Context, backend scanBackend, opts scanOptions) (trivyReport, error) {
+	start := time.Now()
+	span := startSpan(opts, "scan image")
+	span.set("container.image.name", image)
+	var report trivyReport
+	var source string
+	var err error
+	if opts.replay != "" {
+		var data []byte
+		source = sourceReplay
+		if data, err = replayFixture(opts.replay, trivyFixture(image)); err == nil {
+			report, err = parseTrivyOutput(image, string(data))
+		}
+	} else {
+		report, source, err = scanImageMemo(image, ctx, backend, opts)
+	}
+	if err == nil && opts.record != "" {
+		data, err := json.Marshal(report)
+		if err == nil {
+			err = recordFixture(opts.record, trivyFixture(image), data)
+		}
+		if err != nil {
+			log.Warnf("Could not record scan of %v: %v", image, err)
+		}
+	}
+	if opts.stats != nil {
+		stat := imageStat{Image: image, Source: source, CacheHit: source != sourceTrivy, Duration: time.Since(start).Seconds()}
+		if err != nil {
+			stat.Error = err.Error()
+		} else if source == sourceTrivy && imageInput(image, opts.imageInputs) == "" {
+			if stat.Bytes, err = imageSize(rewriteImage(image, opts.imageRewrites), opts); err != nil {
+				log.Debugf("Could not get size of %v: %v", image, err)
+			}
+		}
+		opts.stats.record(stat)
+	}
+	span.set("helm_trivy.source", source)
+	span.end(err)
+	return report, err
+}
+
+// scanImageMemo does the work of scanImageCached, returning where the
+// result came from.
+func scanImageMemo(image string, ctx context.Context, backend scanBackend, opts scanOptions) (trivyReport, string, error) {
+	if opts.scanMemo == nil || imageInput(image, opts.imageInputs) != "" {
+		return scanImageReusing(image, ctx, backend, opts)
+	}
+	if output, ok := opts.scanMemo.lookup(image, opts); ok {
+		log.Infof("Reusing the scan of %v", opts.scanMemo.key(image, opts))
+		return output, sourceMemo, nil
+	}
+	output, source, err := scanImageReusing(image, ctx, backend, opts)
+	if err == nil {
+		opts.scanMemo.store(image, output, opts)
+	}
+	return output, source, err
+}
+
+// scanImageReusing does the work of scanImageMemo, without the scan memo.
+func scanImageReusing(image string, ctx context.Context, backend scanBackend, opts scanOptions) (trivyReport, string, error) {
+	if imageInput(image, opts.imageInputs) != "" {
+		output, err := scanImage(image, ctx, backend, opts)
+		return output, sourceTrivy, err
+	}
+	if output, ok := opts.reusedReports.lookup(image); ok {
+		log.Infof("Using trivy-operator report for %v", image)
+		return output, sourceOperator, nil
+	}
+	if isHarborImage(image, opts) {
+		output, ok, err := harborReport(image, opts)
+		if err != nil {
+			log.Warnf("Could not get Harbor scan results for %v: %v", image, err)
+		} else if ok {
+			log.Infof("Using Harbor scan results for %v", image)
+			return output, sourceHarbor, nil
+		} else {
+			log.Debugf("No recent Harbor scan results for %v", image)
+		}
+	}
+	if opts.resultCache == nil {
+		output, err := scanImage(image, ctx, backend, opts)
+		return output, sourceTrivy, err
+	}
+	key, err := resultCacheKey(image, opts)
+	if err != nil {
+		log.Warnf("Not using the result cache for %v: %v", image, err)
+		output, err := scanImage(image, ctx, backend, opts)
+		return output, sourceTrivy, err
+	}
+	if output, ok, err := opts.resultCache.get(key); err != nil {
+		log.Warnf("Could not read the result cache: %v", err)
+	} else if ok {
+		report, err := parseTrivyOutput(image, output)
+		if err == nil {
+			log.Infof("Using cached result for %v", image)
+			return report, sourceResultCache, nil
+		}
+		log.Warnf("Invalid cached result for %v: %v", image, err)
+	}
+	report, err := scanImage(image, ctx, backend, opts)
+	if err != nil {
+		return report, sourceTrivy, err
+	}
+	if output, err := trivyOutput(report); err != nil {
+		log.Warnf("Could not write the result cache: %v", err)
+	} else if err := opts.resultCache.set(key, output); err != nil {
+		log.Warnf("Could not write the result cache: %v", err)
+	}
+	return report, sourceTrivy, nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// defaultRiskWeights weighs vulnerabilities by severity. Vulnerabilities
+// having a fix count fixable times more, as they can be acted on right away,
+// known exploited ones count kev times more.
+const defaultRiskWeights = "critical=10,high=5,medium=2,low=0.5,unknown=0.5,fixable=2,kev=3"
+
+type riskWeights map[string]float64
+
+// parseRiskWeights parses weights, weights that are not given keep their
+// default value.
+func parseRiskWeights(weights string) (riskWeights, error) {
+	w := riskWeights{}
+	for _, list := range []string{defaultRiskWeights, weights} {
+		for _, kv := range strings.Split(list, ",") {
+			parts := strings.SplitN(kv, "=", 2)
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("invalid risk weight %q, expected name=weight", kv)
+			}
+			value, err := strconv.ParseFloat(parts[1], 64)
+			if err != nil || value < 0 {
+				return nil, fmt.Errorf("invalid risk weight %q", kv)
+			}
+			name := strings.ToLower(strings.TrimSpace(parts[0]))
+			if _, ok := w[name]; !ok && list != defaultRiskWeights {
+				return nil, fmt.Errorf("unknown risk weight %v", name)
+			}
+			w[name] = value
+		}
+	}
+	return w, nil
+}
+
+// riskScore sums the weights of the vulnerabilities of a chart and maps the
+// sum to 0-100: a weighted sum of 100 scores 50, more only gets closer to
+// 100, so scores of charts of any size can be compared.
+func riskScore(reports []trivyReport, weights riskWeights) float64 {
+	sum := 0.0
+	for _, report := range reports {
+		for _, v := range report.vulnerabilities() {
+			weight := weights[strings.ToLower(v.Severity)]
+			if v.FixedVersion != "" {
+				weight *= weights["fixable"]
+			}
+			if v.KEV {
+				weight *= weights["kev"]
+			}
+			sum += weight
+		}
+	}
+	return math.Round(1000*sum/(sum+100)) / 10
+}
@@ -0,0 +1,47 @@
+package main
+
+import "testing"
+
+func TestParseRiskWeights(t *testing.T) {
+	w, err := parseRiskWeights("critical=20, KEV=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w["critical"] != 20 || w["kev"] != 1 || w["high"] != 5 || w["fixable"] != 2 {
+		t.Errorf("parseRiskWeights() = %v", w)
+	}
+	for _, weights := range []string{"critical", "critical=-1", "critical=many", "exploited=2"} {
+		if _, err := parseRiskWeights(weights); err == nil {
+			t.Errorf("parseRiskWeights(%q) succeeded", weights)
+		}
+	}
+}
+
+func TestRiskScore(t *testing.T) {
+	weights, _ := parseRiskWeights(defaultRiskWeights)
+	vulns := func(vulns ...trivyVulnerability) []trivyReport {
+		return []trivyReport{{Results: []trivyResult{{Target: "nginx", Vulnerabilities: vulns}}}}
+	}
+	tests := []struct {
+		name    string
+		reports []trivyReport
+		want    float64
+	}{
+		{"no vulnerabilities", nil, 0},
+		{"critical", vulns(trivyVulnerability{Severity: "CRITICAL"}), 9.1},
+		{"fixable", vulns(trivyVulnerability{Severity: "HIGH", FixedVersion: "1.2"}), 9.1},
+		{"known exploited", vulns(trivyVulnerability{Severity: "CRITICAL", FixedVersion: "1.2", KEV: true}), 37.5},
+		{"weighted sum of 100", vulns(
+			trivyVulnerability{Severity: "CRITICAL", FixedVersion: "1.2", KEV: true},
+			trivyVulnerability{Severity: "CRITICAL", FixedVersion: "1.2"},
+			trivyVulnerability{Severity: "CRITICAL"},
+			trivyVulnerability{Severity: "HIGH"},
+			trivyVulnerability{Severity: "HIGH"},
+		), 50},
+	}
+	for _, tt := range tests {
+		if got := riskScore(tt.reports, weights); got != tt.want {
+			t.Errorf("%v: riskScore() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
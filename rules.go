@@ -0,0 +1,241 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// extractRule teaches the image extraction about custom resources. Path is a
+// JSONPath subset (fields, [n] and [*]) selecting values in manifests of the
+// given kind, and API group when set, regex is matched against those values
+// or, without a path, against the whole manifest. The first capture group is
+// the image when the regex has one.
+type extractRule struct {
+	Kind  string `yaml:"kind"`
+	Group string `yaml:"group"`
+	Path  string `yaml:"path"`
+	Regex string `yaml:"regex"`
+
+	regex *regexp.Regexp
+}
+
+type extractRulesFile struct {
+	Rules []extractRule `yaml:"rules"`
+}
+
+// kindRules returns the rules selecting the paths of a kind of an API group.
+func kindRules(group string, kinds []string, paths ...string) []extractRule {
+	rules := []extractRule{}
+	for _, kind := range kinds {
+		for _, path := range paths {
+			rules = append(rules, extractRule{Kind: kind, Group: group, Path: path})
+		}
+	}
+	return rules
+}
+
+// argoTemplatePaths are the image fields of the templates of an Argo
+// workflow spec at prefix.
+func argoTemplatePaths(prefix string) []string {
+	paths := []string{}
+	for _, field := range []string{"container.image", "script.image", "initContainers[*].image", "sidecars[*].image", "containerSet.containers[*].image"} {
+		paths = append(paths, prefix+".templates[*]."+field)
+	}
+	return paths
+}
+
+// tektonTaskPaths are the image fields of a Tekton task spec at prefix.
+func tektonTaskPaths(prefix string) []string {
+	return []string{prefix + ".steps[*].image", prefix + ".sidecars[*].image", prefix + ".stepTemplate.image"}
+}
+
+// tektonRules find the images of the steps and sidecars of Tekton tasks,
+// standalone or embedded in pipelines and runs.
+func tektonRules() []extractRule {
+	rules := kindRules("tekton.dev", []string{"Task", "ClusterTask"}, tektonTaskPaths(".spec")...)
+	rules = append(rules, kindRules("tekton.dev", []string{"TaskRun"}, tektonTaskPaths(".spec.taskSpec")...)...)
+	for _, tasks := range []string{"tasks", "finally"} {
+		rules = append(rules, kindRules("tekton.dev", []string{"Pipeline"}, tektonTaskPaths(".spec."+tasks+"[*].taskSpec")...)...)
+		rules = append(rules, kindRules("tekton.dev", []string{"PipelineRun"}, tektonTaskPaths(".spec.pipelineSpec."+tasks+"[*].taskSpec")...)...)
+	}
+	return append(rules, kindRules("tekton.dev", []string{"StepAction"}, ".spec.image")...)
+}
+
+// argoRules find the images of the templates of Argo workflows.
+func argoRules() []extractRule {
+	rules := kindRules("argoproj.io", []string{"Workflow", "WorkflowTemplate", "ClusterWorkflowTemplate"}, argoTemplatePaths(".spec")...)
+	return append(rules, kindRules("argoproj.io", []string{"CronWorkflow"}, argoTemplatePaths(".spec.workflowSpec")...)...)
+}
+
+// podSpecPaths are the image fields of a pod spec at prefix.
+func podSpecPaths(prefix string) []string {
+	return []string{prefix + ".containers[*].image", prefix + ".initContainers[*].image"}
+}
+
+// knativeRules find the images of Knative Serving services, configurations
+// and revisions, and of Knative Eventing container sources.
+func knativeRules() []extractRule {
+	rules := kindRules("serving.knative.dev", []string{"Service", "Configuration"}, podSpecPaths(".spec.template.spec")...)
+	rules = append(rules, kindRules("serving.knative.dev", []string{"Revision"}, podSpecPaths(".spec")...)...)
+	return append(rules, kindRules("sources.knative.dev", []string{"ContainerSource"}, podSpecPaths(".spec.template.spec")...)...)
+}
+
+// kedaRules find the images of the jobs KEDA scaled jobs run.
+func kedaRules() []extractRule {
+	return kindRules("keda.sh", []string{"ScaledJob"}, podSpecPaths(".spec.jobTargetRef.template.spec")...)
+}
+
+// kserveRules find the images of the components of KServe inference
+// services, and of their serving runtimes.
+func kserveRules() []extractRule {
+	rules := []extractRule{}
+	for _, component := range []string{"predictor", "transformer", "explainer"} {
+		rules = append(rules, kindRules("serving.kserve.io", []string{"InferenceService"}, podSpecPaths(".spec."+component)...)...)
+	}
+	return append(rules, kindRules("serving.kserve.io", []string{"ServingRuntime", "ClusterServingRuntime"}, podSpecPaths(".spec")...)...)
+}
+
+// builtinRules are the extraction rules of -crd-rules, for the custom
+// resources of the platforms charts commonly ship, whose images are not in
+// the pod specs of workloads. builtinRuleNames lists them in order.
+var (
+	builtinRules = map[string][]extractRule{
+		"tekton":         tektonRules(),
+		"argo-workflows": argoRules(),
+		"knative":        knativeRules(),
+		"keda":           kedaRules(),
+		"kserve":         kserveRules(),
+	}
+	builtinRuleNames = []string{"tekton", "argo-workflows", "knative", "keda", "kserve"}
+)
+
+// parseCRDRules returns the built-in rules of a comma separated list of
+// -crd-rules names, all of them for "all" or an empty list and none for
+// "none".
+func parseCRDRules(names string) ([]extractRule, error) {
+	if strings.TrimSpace(names) == "" {
+		names = "all"
+	}
+	rules := []extractRule{}
+	for _, name := range strings.Split(names, ",") {
+		switch name = strings.TrimSpace(name); name {
+		case "none":
+		case "all":
+			for _, set := range builtinRuleNames {
+				rules = append(rules, builtinRules[set]...)
+			}
+		default:
+			set, ok := builtinRules[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown built-in rules %v, expected one of %v, all or none", name, strings.Join(builtinRuleNames, ", "))
+			}
+			rules = append(rules, set...)
+		}
+	}
+	return rules, nil
+}
+
+func loadExtractRules(path string) ([]extractRule, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file extractRulesFile
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	for i := range file.Rules {
+		rule := &file.Rules[i]
+		if rule.Path == "" && rule.Regex == "" {
+			return nil, fmt.Errorf("rule %d: a path or a regex is required", i+1)
+		}
+		if rule.Regex != "" {
+			if rule.regex, err = regexp.Compile(rule.Regex); err != nil {
+				return nil, fmt.Errorf("rule %d: %v", i+1, err)
+			}
+		}
+	}
+	return file.Rules, nil
+}
+
+// apply returns the images found by the rule in a manifest, given both as
+// text and decoded.
+func (r extractRule) apply(doc string, obj map[string]interface{}) []string {
+	if r.Kind != "" && obj["kind"] != r.Kind {
+		return nil
+	}
+	if apiVersion, _ := obj["apiVersion"].(string); r.Group != "" && !strings.HasPrefix(apiVersion, r.Group+"/") {
+		return nil
+	}
+	values := []string{doc}
+	if r.Path != "" {
+		values = []string{}
+		for _, v := range jsonPathValues(obj, r.Path) {
+			if s, ok := v.(string); ok {
+				values = append(values, s)
+			}
+		}
+	}
+	if r.regex == nil {
+		return values
+	}
+	images := []string{}
+	for _, value := range values {
+		for _, match := range r.regex.FindAllStringSubmatch(value, -1) {
+			image := match[0]
+			if len(match) > 1 {
+				image = match[1]
+			}
+			if image != "" {
+				images = append(images, image)
+			}
+		}
+	}
+	return images
+}
+
+// jsonPathValues returns the values selected by path in value. Only fields,
+// list indexes and [*] are supported, which covers image fields of CRDs.
+func jsonPathValues(value interface{}, path string) []interface{} {
+	path = strings.TrimSuffix(strings.TrimPrefix(path, "{"), "}")
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	values := []interface{}{value}
+	for _, part := range strings.Split(path, ".") {
+		name, index := part, ""
+		if i := strings.Index(part, "["); i >= 0 {
+			name, index = part[:i], strings.Trim(part[i:], "[]")
+		}
+		next := []interface{}{}
+		for _, v := range values {
+			if name != "" {
+				m, ok := v.(map[string]interface{})
+				if !ok {
+					continue
+				}
+				if v, ok = m[name]; !ok {
+					continue
+				}
+			}
+			if index == "" {
+				next = append(next, v)
+				continue
+			}
+			list, ok := v.([]interface{})
+			if !ok {
+				continue
+			}
+			if index == "*" {
+				next = append(next, list...)
+			} else if n, err := strconv.Atoi(index); err == nil && n >= 0 && n < len(list) {
+				next = append(next, list[n])
+			}
+		}
+		values = next
+	}
+	return values
+}
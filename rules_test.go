@@ -0,0 +1,91 @@
+package main
+
+import (
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+func TestJSONPathValues(t *testing.T) {
+	obj := map[string]interface{}{
+		"spec": map[string]interface{}{
+			"image": "nginx:1.25",
+			"sidecars": []interface{}{
+				map[string]interface{}{"image": "envoy:1.28"},
+				map[string]interface{}{"name": "no-image"},
+				map[string]interface{}{"image": "fluentd:1.16"},
+			},
+			"tags": []interface{}{"a", "b"},
+		},
+	}
+	tests := []struct {
+		path string
+		want []interface{}
+	}{
+		{"spec.image", []interface{}{"nginx:1.25"}},
+		{"{.spec.image}", []interface{}{"nginx:1.25"}},
+		{"$.spec.image", []interface{}{"nginx:1.25"}},
+		{"spec.sidecars[*].image", []interface{}{"envoy:1.28", "fluentd:1.16"}},
+		{"spec.sidecars[2].image", []interface{}{"fluentd:1.16"}},
+		{"spec.sidecars[3].image", []interface{}{}},
+		{"spec.sidecars[-1].image", []interface{}{}},
+		{"spec.tags[1]", []interface{}{"b"}},
+		{"spec.image[0]", []interface{}{}},
+		{"spec.missing", []interface{}{}},
+		{"spec.image.name", []interface{}{}},
+	}
+	for _, tt := range tests {
+		if got := jsonPathValues(obj, tt.path); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("jsonPathValues(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestExtractRuleApply(t *testing.T) {
+	obj := map[string]interface{}{
+		"apiVersion": "apps.corp.local/v1",
+		"kind":       "WebApp",
+		"spec": map[string]interface{}{
+			"image":  "nginx:1.25",
+			"runner": "registry.corp.local/runner:2.1 --verbose",
+			"count":  3,
+		},
+	}
+	doc := "kind: WebApp\nspec:\n  image: nginx:1.25\n  runner: registry.corp.local/runner:2.1 --verbose\n"
+	tests := []struct {
+		name string
+		rule extractRule
+		want []string
+	}{
+		{"path", extractRule{Kind: "WebApp", Path: "spec.image"}, []string{"nginx:1.25"}},
+		{"other kind", extractRule{Kind: "Job", Path: "spec.image"}, nil},
+		{"group", extractRule{Kind: "WebApp", Group: "apps.corp.local", Path: "spec.image"}, []string{"nginx:1.25"}},
+		{"other group", extractRule{Kind: "WebApp", Group: "corp.local", Path: "spec.image"}, nil},
+		{"non-string values", extractRule{Kind: "WebApp", Path: "spec.count"}, []string{}},
+		{
+			"whole match without group",
+			extractRule{Path: "spec.runner", regex: regexp.MustCompile(`[a-z.]+/[a-z]+:[0-9.]+`)},
+			[]string{"registry.corp.local/runner:2.1"},
+		},
+		{
+			"first group",
+			extractRule{Path: "spec.runner", regex: regexp.MustCompile(`^(\S+):(\S+)`)},
+			[]string{"registry.corp.local/runner"},
+		},
+		{
+			"manifest text",
+			extractRule{Kind: "WebApp", regex: regexp.MustCompile(`image: (\S+)`)},
+			[]string{"nginx:1.25"},
+		},
+		{
+			"empty group skipped",
+			extractRule{Path: "spec.image", regex: regexp.MustCompile(`(registry/\S+)?nginx`)},
+			[]string{},
+		},
+	}
+	for _, tt := range tests {
+		if got := tt.rule.apply(doc, obj); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v: apply() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
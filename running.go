@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// runningImage is the image of a container as reported in the status of a
+// pod, after admission webhooks mutated it and with the digest the node
+// resolved it to. Injected tells the container is a service mesh sidecar.
+type runningImage struct {
+	Pod       string
+	Container string
+	Image     string
+	ImageID   string
+	Injected  bool
+}
+
+// meshSidecars are the names of the containers Istio and Linkerd inject.
+var meshSidecars = map[string]bool{
+	"istio-proxy":               true,
+	"istio-init":                true,
+	"istio-validation":          true,
+	"linkerd-proxy":             true,
+	"linkerd-init":              true,
+	"linkerd-network-validator": true,
+}
+
+// injectedContainers returns the containers Istio recorded injecting in the
+// sidecar.istio.io/status annotation of a pod.
+func injectedContainers(annotations map[string]string) map[string]bool {
+	injected := map[string]bool{}
+	var status struct {
+		InitContainers []string `json:"initContainers"`
+		Containers     []string `json:"containers"`
+	}
+	if json.Unmarshal([]byte(annotations["sidecar.istio.io/status"]), &status) == nil {
+		for _, name := range append(status.InitContainers, status.Containers...) {
+			injected[name] = true
+		}
+	}
+	return injected
+}
+
+// digest returns the digest the image was resolved to, if the runtime
+// reported a repository digest.
+func (i runningImage) digest() string {
+	if n := strings.Index(i.ImageID, "@"); n >= 0 {
+		return i.ImageID[n+1:]
+	}
+	return ""
+}
+
+// reference returns the image to scan, pinned to its resolved digest.
+func (i runningImage) reference() string {
+	if digest := i.digest(); digest != "" {
+		return stripTag(i.Image) + "@" + digest
+	}
+	return i.Image
+}
+
+// runningImages returns the images of the containers of the pods of
+// release, found by the label holding the release name.
+func runningImages(release string, namespace string, label string) ([]runningImage, error) {
+	args := []string{"get", "pods", "--selector", label + "=" + release, "-o", "json"}
+	if namespace != "" {
+		args = append(args, "--namespace", namespace)
+	}
+	args = kubectlArgs(args...)
+	log.Debugf("Running kubectl cmd: kubectl %v", args)
+	out, err := exec.Command("kubectl", args...).Output()
+	if exitErr, ok := err.(*exec.ExitError); ok && len(exitErr.Stderr) > 0 {
+		err = fmt.Errorf("%v: %s", err, bytes.TrimSpace(exitErr.Stderr))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not list pods of release %v: %v", release, err)
+	}
+	type containerStatus struct {
+		Name    string `json:"name"`
+		Image   string `json:"image"`
+		ImageID string `json:"imageID"`
+	}
+	var list struct {
+		Items []struct {
+			Metadata struct {
+				Name        string            `json:"name"`
+				Annotations map[string]string `json:"annotations"`
+			} `json:"metadata"`
+			Status struct {
+				InitContainerStatuses      []containerStatus `json:"initContainerStatuses"`
+				ContainerStatuses          []containerStatus `json:"containerStatuses"`
+				EphemeralContainerStatuses []containerStatus `json:"ephemeralContainerStatuses"`
+			} `json:"status"`
+		} `json:"items"`
+	}
+	if err := json.Unmarshal(out, &list); err != nil {
+		return nil, fmt.Errorf("invalid kubectl output: %v", err)
+	}
+	images := []runningImage{}
+	for _, pod := range list.Items {
+		injected := injectedContainers(pod.Metadata.Annotations)
+		statuses := append(append(pod.Status.InitContainerStatuses, pod.Status.ContainerStatuses...), pod.Status.EphemeralContainerStatuses...)
+		for _, s := range statuses {
+			if s.Image == "" {
+				continue
+			}
+			images = append(images, runningImage{
+				Pod:       pod.Metadata.Name,
+				Container: s.Name,
+				Image:     s.Image,
+				ImageID:   s.ImageID,
+				Injected:  injected[s.Name] || meshSidecars[s.Name],
+			})
+		}
+	}
+	return images, nil
+}
+
+// runsImage tells whether a container runs the image of a manifest, by tag
+// or by digest.
+func runsImage(running runningImage, image string) bool {
+	want, got := parseImageRef(image), parseImageRef(running.Image)
+	if want.Digest != "" && want.Digest == running.digest() {
+		return true
+	}
+	return want.Name() == got.Name() && want.Tag == got.Tag && (want.Digest == "" || got.Digest == "" || want.Digest == got.Digest)
+}
+
+// reconcileImages returns the images actually running, pinned to their
+// digest, with the labels of the manifest image they run. Running images
+// missing from the manifest are labelled as such, or as injected for mesh
+// sidecars, and the drift between the manifest and the pods is described.
+func reconcileImages(rendered []chartImage, running []runningImage) ([]chartImage, []string) {
+	drift := []string{}
+	images := []chartImage{}
+	seen := map[string]bool{}
+	matched := map[string]bool{}
+	for _, r := range running {
+		image := chartImage{Name: r.reference()}
+		found := false
+		for _, m := range rendered {
+			if runsImage(r, m.Name) {
+				image.Labels, image.Charts = m.Labels, m.Charts
+				matched[m.Name] = true
+				found = true
+				break
+			}
+		}
+		if seen[image.Name] {
+			continue
+		}
+		seen[image.Name] = true
+		if !found && r.Injected {
+			image.Labels = []string{labelInjected}
+		} else if !found {
+			image.Labels = []string{labelNotInManifest}
+			drift = append(drift, fmt.Sprintf("image %v runs in pod %v but is not in the release manifest", r.Image, r.Pod))
+		}
+		images = append(images, image)
+	}
+	for _, m := range rendered {
+		if !matched[m.Name] && !hasLabel(m, labelHook) && !hasLabel(m, labelInferred) {
+			drift = append(drift, fmt.Sprintf("image %v of the release manifest is not running", m.Name))
+		}
+	}
+	sort.Strings(drift)
+	return images, drift
+}
+
+// withSidecars adds the mesh sidecars of the running images to the images of
+// a manifest, labelled as injected.
+func withSidecars(images []chartImage, running []runningImage) []chartImage {
+	seen := map[string]bool{}
+	for _, image := range images {
+		seen[image.Name] = true
+	}
+	for _, r := range running {
+		if !r.Injected || seen[r.Image] {
+			continue
+		}
+		seen[r.Image] = true
+		images = append(images, chartImage{Name: r.Image, Labels: []string{labelInjected}})
+	}
+	return images
+}
+
+// hasLabel tells whether image has label.
+func hasLabel(image chartImage, label string) bool {
+	for _, l := range image.Labels {
+		if l == label {
+			return true
+		}
+	}
+	return false
+}
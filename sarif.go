@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+type sarifLog struct {
+	Version string     `json:"version"`
+	Schema  string     `json:"$schema"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool struct {
+		Driver struct {
+			Name           string      `json:"name"`
+			InformationURI string      `json:"informationUri"`
+			Rules          []sarifRule `json:"rules"`
+		} `json:"driver"`
+	} `json:"tool"`
+	Results []sarifResult `json:"results"`
+}
+
+type sarifRule struct {
+	ID               string                 `json:"id"`
+	ShortDescription sarifMessage           `json:"shortDescription"`
+	FullDescription  *sarifMessage          `json:"fullDescription,omitempty"`
+	HelpURI          string                 `json:"helpUri,omitempty"`
+	Properties       map[string]interface{} `json:"properties,omitempty"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifResult struct {
+	RuleID    string          `json:"ruleId"`
+	Level     string          `json:"level"`
+	Message   sarifMessage    `json:"message"`
+	Locations []sarifLocation `json:"locations"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation struct {
+		ArtifactLocation struct {
+			URI string `json:"uri"`
+		} `json:"artifactLocation"`
+	} `json:"physicalLocation"`
+}
+
+// sarifLevels maps trivy severities to SARIF levels.
+var sarifLevels = map[string]string{
+	"CRITICAL": "error",
+	"HIGH":     "error",
+	"MEDIUM":   "warning",
+	"LOW":      "note",
+	"UNKNOWN":  "note",
+}
+
+// sarifReport converts the vulnerabilities of a report to SARIF 2.1.0, one
+// rule per vulnerability and one result per vulnerable package.
+func sarifReport(report trivyReport) sarifLog {
+	run := sarifRun{Results: []sarifResult{}}
+	run.Tool.Driver.Name = "helm-trivy"
+	run.Tool.Driver.InformationURI = "https://github.com/ObjectifLibre/helm-trivy"
+	rules := map[string]sarifRule{}
+	for _, v := range report.vulnerabilities() {
+		if _, ok := rules[v.VulnerabilityID]; !ok {
+			rule := sarifRule{
+				ID:               v.VulnerabilityID,
+				ShortDescription: sarifMessage{Text: v.VulnerabilityID},
+				HelpURI:          v.PrimaryURL,
+				Properties:       map[string]interface{}{"tags": []string{"vulnerability", "security", v.Severity}},
+			}
+			if v.Title != "" {
+				rule.ShortDescription.Text = v.Title
+			}
+			if v.Description != "" {
+				rule.FullDescription = &sarifMessage{Text: v.Description}
+			}
+			if _, score := v.cvss(); score > 0 {
+				rule.Properties["security-severity"] = fmt.Sprintf("%.1f", score)
+			}
+			rules[v.VulnerabilityID] = rule
+		}
+		level, ok := sarifLevels[v.Severity]
+		if !ok {
+			level = "note"
+		}
+		text := fmt.Sprintf("Package %s %s in %s is affected by %s (%s)", v.PkgName, v.InstalledVersion, report.ArtifactName, v.VulnerabilityID, v.Severity)
+		if v.FixedVersion != "" {
+			text += ", fixed in " + v.FixedVersion
+		}
+		result := sarifResult{RuleID: v.VulnerabilityID, Level: level, Message: sarifMessage{Text: text}, Locations: []sarifLocation{{}}}
+		result.Locations[0].PhysicalLocation.ArtifactLocation.URI = report.ArtifactName
+		run.Results = append(run.Results, result)
+	}
+	ids := []string{}
+	for id := range rules {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	run.Tool.Driver.Rules = []sarifRule{}
+	for _, id := range ids {
+		run.Tool.Driver.Rules = append(run.Tool.Driver.Rules, rules[id])
+	}
+	return sarifLog{Version: "2.1.0", Schema: "https://json.schemastore.org/sarif-2.1.0.json", Runs: []sarifRun{run}}
+}
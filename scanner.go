@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// imageScanner is a vulnerability scanner engine. Its results are converted
+// to a trivy report, which the reporting of helm-trivy reads.
+type imageScanner interface {
+	// image returns the image of the scanner, empty for the scanners
+	// running as a service.
+	image(opts scanOptions) string
+	// scan scans image and returns its results as a trivy report.
+	scan(image string, ctx context.Context, backend scanBackend, opts scanOptions) (trivyReport, error)
+}
+
+// containerScanner is a scanner engine run in a container by the backend.
+type containerScanner interface {
+	imageScanner
+	// container returns the container scanning image.
+	container(image string, opts scanOptions) trivyContainer
+	// output returns the value the output of the container is decoded into.
+	output() interface{}
+	// results converts the decoded output of the container scanning image
+	// to a trivy report.
+	results(image string, output interface{}, opts scanOptions) (trivyReport, error)
+}
+
+// newScanner returns the -scanner engine.
+func newScanner(opts scanOptions) (imageScanner, error) {
+	switch opts.scanner {
+	case "", "trivy":
+		return trivyScanner{}, nil
+	case "grype":
+		return grypeScanner{}, nil
+	case "clair":
+		return clairScanner{}, nil
+	}
+	return nil, fmt.Errorf("unknown scanner %v, expected trivy, grype or clair", opts.scanner)
+}
+
+// validateScanner checks the -scanner engine, and that the options only
+// trivy knows about are not used with another one.
+func validateScanner(opts scanOptions) error {
+	if _, err := newScanner(opts); err != nil {
+		return err
+	}
+	if opts.scanner == "" || opts.scanner == "trivy" {
+		return nil
+	}
+	for _, flag := range []string{"scanners", "skip-dirs", "skip-files", "java-db", "trivyargs", "trivy-version", "download-db", "offline", "result-cache", "severity-source"} {
+		if opts.setFlags[flag] {
+			return fmt.Errorf("-%v can't be used with -scanner %v", flag, opts.scanner)
+		}
+	}
+	if opts.scanner == "clair" {
+		return validateClair(opts)
+	}
+	return nil
+}
+
+func scanImage(image string, ctx context.Context, backend scanBackend, opts scanOptions) (trivyReport, error) {
+	scanner, err := newScanner(opts)
+	if err != nil {
+		return trivyReport{}, err
+	}
+	return scanner.scan(image, ctx, backend, opts)
+}
+
+// runScanner scans image in the container of scanner.
+func runScanner(scanner containerScanner, image string, ctx context.Context, backend scanBackend, opts scanOptions) (trivyReport, error) {
+	c := scanner.container(image, opts)
+	if c.Input != "" {
+		log.Infof("Scanning %v from %v", image, c.Input)
+	} else if rewritten := rewriteImage(image, opts.imageRewrites); rewritten != image {
+		log.Infof("Scanning %v as %v", image, rewritten)
+	}
+	output := scanner.output()
+	err := backend.run(ctx, c, output)
+	if err == errNoOutput {
+		return trivyReport{}, withExitCode(exitBackend, "%v printed no results for %v", c.Image, image)
+	}
+	if err != nil {
+		return trivyReport{}, err
+	}
+	return scanner.results(image, output, opts)
+}
+
+// trivyScanner scans images with trivy, the default.
+type trivyScanner struct{}
+
+func (trivyScanner) image(opts scanOptions) string {
+	return opts.trivyImage
+}
+
+func (s trivyScanner) scan(image string, ctx context.Context, backend scanBackend, opts scanOptions) (trivyReport, error) {
+	return runScanner(s, image, ctx, backend, opts)
+}
+
+func (trivyScanner) container(image string, opts scanOptions) trivyContainer {
+	return scanContainer(image, opts)
+}
+
+// output decodes the JSON of trivy into a report, which keeps the fields
+// helm-trivy doesn't know about to pass them on.
+func (trivyScanner) output() interface{} {
+	return &trivyReport{}
+}
+
+func (trivyScanner) results(image string, output interface{}, opts scanOptions) (trivyReport, error) {
+	report := *output.(*trivyReport)
+	report.ArtifactName = image
+	return report, nil
+}
+
+// grypeScanner scans images with grype, its DB being kept in the cache
+// directory.
+type grypeScanner struct{}
+
+func (grypeScanner) image(opts scanOptions) string {
+	return opts.grypeImage
+}
+
+func (s grypeScanner) scan(image string, ctx context.Context, backend scanBackend, opts scanOptions) (trivyReport, error) {
+	return runScanner(s, image, ctx, backend, opts)
+}
+
+func (grypeScanner) container(image string, opts scanOptions) trivyContainer {
+	c := newTrivyContainer(opts)
+	c.Image = opts.grypeImage
+	env := []string{"GRYPE_DB_CACHE_DIR=/.cache/grype"}
+	for _, e := range c.Env {
+		if !strings.HasPrefix(e, "TRIVY_") {
+			env = append(env, e)
+		}
+	}
+	c.Env = env
+	c.Cmd = []string{"-o", "json"}
+	if debug {
+		c.Cmd = append(c.Cmd, "-v")
+	} else {
+		c.Cmd = append(c.Cmd, "-q")
+	}
+	if c.Input = imageInput(image, opts.imageInputs); c.Input != "" {
+		source := "docker-archive:/input"
+		if info, err := os.Stat(c.Input); err == nil && info.IsDir() {
+			source = "oci-dir:/input"
+		}
+		c.Cmd = append(c.Cmd, source)
+		return c
+	}
+	image = rewriteImage(image, opts.imageRewrites)
+	if user, password := registryCredentials(image, opts); user != "" {
+		authority := parseImageRef(image).Registry
+		if authority == "docker.io" {
+			authority = "index.docker.io"
+		}
+		c.Env = append(c.Env, "GRYPE_REGISTRY_AUTH_AUTHORITY="+authority, "GRYPE_REGISTRY_AUTH_USERNAME="+user, "GRYPE_REGISTRY_AUTH_PASSWORD="+password)
+	}
+	// Without a docker daemon in the container, images are pulled from
+	// their registry.
+	c.Cmd = append(c.Cmd, "registry:"+image)
+	return c
+}
+
+// wantedSeverities returns the -severity filter the scanners other than
+// trivy apply to their results, empty when they keep every severity.
+func wantedSeverities(opts scanOptions) map[string]bool {
+	wanted := map[string]bool{}
+	if opts.severity != "" && !severityFiltered(opts) {
+		for _, s := range strings.Split(strings.ToUpper(opts.severity), ",") {
+			wanted[strings.TrimSpace(s)] = true
+		}
+	}
+	return wanted
+}
+
+// grypeVulnerability is a vulnerability of the JSON output of grype.
+type grypeVulnerability struct {
+	ID          string `json:"id"`
+	DataSource  string `json:"dataSource"`
+	Severity    string `json:"severity"`
+	Description string `json:"description"`
+	Fix         struct {
+		Versions []string `json:"versions"`
+	} `json:"fix"`
+	CVSS []struct {
+		Source  string `json:"source"`
+		Version string `json:"version"`
+		Vector  string `json:"vector"`
+		Metrics struct {
+			BaseScore float64 `json:"baseScore"`
+		} `json:"metrics"`
+	} `json:"cvss"`
+}
+
+// grypeOutput is the JSON output of grype.
+type grypeOutput struct {
+	Matches []struct {
+		Vulnerability          grypeVulnerability   `json:"vulnerability"`
+		RelatedVulnerabilities []grypeVulnerability `json:"relatedVulnerabilities"`
+		Artifact               struct {
+			Name    string `json:"name"`
+			Version string `json:"version"`
+			Type    string `json:"type"`
+		} `json:"artifact"`
+	} `json:"matches"`
+	Distro struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	} `json:"distro"`
+}
+
+// grypeOSTypes are the grype package types of OS packages.
+var grypeOSTypes = map[string]bool{"apk": true, "deb": true, "rpm": true, "alpm": true, "portage": true}
+
+// grypeSeverity returns the trivy severity of a grype one.
+func grypeSeverity(severity string) string {
+	severity = strings.ToUpper(severity)
+	switch severity {
+	case "NEGLIGIBLE":
+		return "LOW"
+	case "CRITICAL", "HIGH", "MEDIUM", "LOW":
+		return severity
+	}
+	return "UNKNOWN"
+}
+
+// grypeCVSS returns the CVSS scores of a vulnerability and its related
+// ones, keyed by source like trivy does.
+func grypeCVSS(vulns []grypeVulnerability) map[string]trivyCVSS {
+	scores := map[string]trivyCVSS{}
+	for _, v := range vulns {
+		for _, c := range v.CVSS {
+			source := c.Source
+			if strings.Contains(source, "nvd") {
+				source = "nvd"
+			}
+			score := scores[source]
+			if strings.HasPrefix(c.Version, "3") && score.V3Vector == "" {
+				score.V3Vector, score.V3Score = c.Vector, c.Metrics.BaseScore
+			} else if strings.HasPrefix(c.Version, "2") && score.V2Vector == "" {
+				score.V2Vector, score.V2Score = c.Vector, c.Metrics.BaseScore
+			}
+			scores[source] = score
+		}
+	}
+	if len(scores) == 0 {
+		return nil
+	}
+	return scores
+}
+
+func (grypeScanner) output() interface{} {
+	return &grypeOutput{}
+}
+
+func (grypeScanner) results(image string, output interface{}, opts scanOptions) (trivyReport, error) {
+	out := output.(*grypeOutput)
+	wanted := wantedSeverities(opts)
+	osTarget := image
+	if out.Distro.Name != "" {
+		osTarget = fmt.Sprintf("%s (%s %s)", image, out.Distro.Name, out.Distro.Version)
+	}
+	results := map[string]*trivyResult{}
+	for _, m := range out.Matches {
+		v := m.Vulnerability
+		vuln := trivyVulnerability{
+			VulnerabilityID:  v.ID,
+			PkgName:          m.Artifact.Name,
+			InstalledVersion: m.Artifact.Version,
+			FixedVersion:     strings.Join(v.Fix.Versions, ", "),
+			Severity:         grypeSeverity(v.Severity),
+			Description:      v.Description,
+			PrimaryURL:       v.DataSource,
+			CVSS:             grypeCVSS(append([]grypeVulnerability{v}, m.RelatedVulnerabilities...)),
+		}
+		for _, related := range m.RelatedVulnerabilities {
+			if vuln.Description == "" {
+				vuln.Description = related.Description
+			}
+		}
+		if len(wanted) > 0 && !wanted[vuln.Severity] {
+			continue
+		}
+		target, class := m.Artifact.Type, "lang-pkgs"
+		if grypeOSTypes[m.Artifact.Type] {
+			target, class = osTarget, "os-pkgs"
+		} else if opts.skipLibraries {
+			continue
+		}
+		if results[target] == nil {
+			results[target] = &trivyResult{Target: target, Class: class, Type: m.Artifact.Type, Vulnerabilities: []trivyVulnerability{}}
+			if class == "os-pkgs" {
+				results[target].Type = out.Distro.Name
+			}
+		}
+		results[target].Vulnerabilities = append(results[target].Vulnerabilities, vuln)
+	}
+	var distro *trivyOS
+	if out.Distro.Name != "" {
+		distro = &trivyOS{Family: out.Distro.Name, Name: out.Distro.Version}
+	}
+	return convertedReport(image, distro, results), nil
+}
+
+// convertedReport returns the trivy report of the results of image, converted
+// from another scanner.
+func convertedReport(image string, distro *trivyOS, results map[string]*trivyResult) trivyReport {
+	report := trivyReport{SchemaVersion: 2, ArtifactName: image, ArtifactType: "container_image", Metadata: trivyMetadata{OS: distro}, Results: []trivyResult{}}
+	// The OS packages come first, then the libraries by type, as trivy
+	// orders its results.
+	targets := []string{}
+	for target := range results {
+		targets = append(targets, target)
+	}
+	sort.Slice(targets, func(i, j int) bool {
+		if ci, cj := results[targets[i]].Class, results[targets[j]].Class; ci != cj {
+			return ci == "os-pkgs"
+		}
+		return targets[i] < targets[j]
+	})
+	for _, target := range targets {
+		report.Results = append(report.Results, *results[target])
+	}
+	return report
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// jsonSchemaVersion is the version of the -json output of helm-trivy. Version
+// 1 is the bare array of trivy results of earlier releases, version 2 wraps
+// it in a jsonReport telling its version and chart.
+const jsonSchemaVersion = 2
+
+// jsonReport is the -json output of schema version 2.
+type jsonReport struct {
+	SchemaVersion int             `json:"SchemaVersion"`
+	Chart         string          `json:"Chart,omitempty"`
+	ChartVersion  string          `json:"ChartVersion,omitempty"`
+	Results       json.RawMessage `json:"Results"`
+}
+
+// validateSchemaVersion checks the -schema-version of the JSON output.
+func validateSchemaVersion(version int) error {
+	if version < 1 || version > jsonSchemaVersion {
+		return fmt.Errorf("unknown -schema-version %d, expected 1 to %d", version, jsonSchemaVersion)
+	}
+	return nil
+}
+
+// writeJSONReport writes the -json output of result to w, in the schema of
+// the given version.
+func writeJSONReport(w io.Writer, result chartResult, version int) error {
+	if version == 1 {
+		return writeJSONOutputs(w, result.reports())
+	}
+	chart, _ := json.Marshal(result.Chart)
+	if _, err := fmt.Fprintf(w, "{\n  \"SchemaVersion\": %d,\n  \"Chart\": %s,\n", version, chart); err != nil {
+		return err
+	}
+	if result.Version != "" {
+		chartVersion, _ := json.Marshal(result.Version)
+		if _, err := fmt.Fprintf(w, "  \"ChartVersion\": %s,\n", chartVersion); err != nil {
+			return err
+		}
+	}
+	if _, err := io.WriteString(w, "  \"Results\": "); err != nil {
+		return err
+	}
+	if err := writeIndentedJSONOutputs(w, result.reports(), "  "); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n}")
+	return err
+}
+
+// readJSONReport reads a -json output of any schema version as a
+// jsonReport.
+func readJSONReport(data []byte) (jsonReport, error) {
+	data = bytes.TrimSpace(data)
+	if bytes.HasPrefix(data, []byte("[")) {
+		var results []json.RawMessage
+		if err := json.Unmarshal(data, &results); err != nil {
+			return jsonReport{}, fmt.Errorf("invalid report: %v", err)
+		}
+		return jsonReport{SchemaVersion: 1, Results: data}, nil
+	}
+	var report jsonReport
+	if err := json.Unmarshal(data, &report); err != nil {
+		return report, fmt.Errorf("invalid report: %v", err)
+	}
+	if report.SchemaVersion < 2 || report.SchemaVersion > jsonSchemaVersion {
+		return report, fmt.Errorf("unknown report schema version %d", report.SchemaVersion)
+	}
+	return report, nil
+}
+
+// convertReport converts a -json output to the schema of the given version.
+// Reports of version 1 tell no chart, chart is used for them.
+func convertReport(data []byte, version int, chart string) ([]byte, error) {
+	report, err := readJSONReport(data)
+	if err != nil {
+		return nil, err
+	}
+	if report.SchemaVersion == 1 {
+		report.Chart = chart
+	}
+	if version == 1 {
+		var out bytes.Buffer
+		err := json.Indent(&out, report.Results, "", "  ")
+		return out.Bytes(), err
+	}
+	report.SchemaVersion = version
+	return json.MarshalIndent(report, "", "  ")
+}
+
+func convertMain(args []string) {
+	var to string
+	var chart string
+	var output string
+
+	fs := flag.NewFlagSet("convert", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: helm trivy convert [options] [report]\n")
+		fmt.Fprintf(fs.Output(), "Example: helm trivy convert -to v2 -chart stable/mariadb old-report.json\n\n")
+		fmt.Fprintf(fs.Output(), "Options:\n")
+		fs.PrintDefaults()
+	}
+	fs.BoolVar(&debug, "debug", false, "Enable debug logging")
+	fs.StringVar(&to, "to", fmt.Sprintf("v%d", jsonSchemaVersion), "Schema version the -json report is converted to: v1 or v2, or snyk for the -format snyk output")
+	fs.StringVar(&chart, "chart", "", "Chart of the converted v1 reports, which don't tell it")
+	fs.StringVar(&output, "o", "", "Write the converted report to this file instead of stdout")
+	fs.Parse(args)
+
+	if debug {
+		log.SetLevel(log.DebugLevel)
+	}
+	var version int
+	if _, err := fmt.Sscanf(to, "v%d", &version); to != "snyk" && (err != nil || validateSchemaVersion(version) != nil) {
+		fmt.Fprintf(os.Stderr, "Error: Unknown schema version %v, expected v1 to v%d or snyk.\n", to, jsonSchemaVersion)
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	if fs.NArg() > 1 {
+		fmt.Fprintf(os.Stderr, "Error: Only one report can be converted at once.\n")
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+
+	var data []byte
+	var err error
+	if fs.NArg() == 0 || fs.Arg(0) == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(fs.Arg(0))
+	}
+	if err != nil {
+		fatal(exitUsage, scanOptions{}, "%v", err)
+	}
+	var converted []byte
+	if to == "snyk" {
+		converted, err = convertSnyk(data)
+	} else {
+		converted, err = convertReport(data, version, chart)
+	}
+	if err != nil {
+		fatal(exitUsage, scanOptions{}, "%v", err)
+	}
+	converted = append(converted, '\n')
+	if output == "" {
+		os.Stdout.Write(converted)
+		return
+	}
+	if err := ioutil.WriteFile(output, converted, 0644); err != nil {
+		fatal(exitCode(err), scanOptions{}, "%v", err)
+	}
+}
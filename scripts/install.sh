@@ -1,46 +1,88 @@
 #! /bin/bash -e
 
-version="$(cat plugin.yaml | grep "version" | cut -d '"' -f 2)"
-latest_version=$(curl -Is "https://github.com/ObjectifLibre/helm-trivy/releases/latest" | grep -i "Location" | cut -d'/' -f 8 | tr -d "\r")
+# Installs the prebuilt helm-trivy binary of the plugin version for this
+# OS and architecture, verified against the checksums of the release. Other
+# platforms are built from source when a Go toolchain is available.
 
-echo "Installing helm-trivy version: ${latest_version} ..."
+repo="https://github.com/ObjectifLibre/helm-trivy"
 
-mkdir -p $HELM_PLUGIN_DIR
 cd $HELM_PLUGIN_DIR
+version="$(grep "^version" plugin.yaml | cut -d '"' -f 2)"
 
-unameOut="$(uname -s)"
+echo "Installing helm-trivy version: ${version} ..."
 
-case "${unameOut}" in
+case "$(uname -s)" in
     Linux*)     os=linux;;
-    Darwin*)    os=macos;;
-    *)          os="UNKNOWN:${unameOut}"
+    Darwin*)    os=darwin;;
+    *)          os="";;
 esac
 
-arch=`uname -m`
-url="https://github.com/ObjectifLibre/helm-trivy/releases/download/${latest_version}/helm-trivy-${os}"
+case "$(uname -m)" in
+    x86_64|amd64)   arch=amd64;;
+    aarch64|arm64)  arch=arm64;;
+    *)              arch="";;
+esac
 
-if [ "$url" = "" ]
-then
-    echo "Unsupported OS / architecture: ${os}_${arch}"
-    exit 1
-fi
+download() {
+    if [ -n "$(command -v curl)" ]
+    then
+        curl -fsSL -o "$2" "$1"
+    elif [ -n "$(command -v wget)" ]
+    then
+        wget -q -O "$2" "$1"
+    else
+        echo "Need curl or wget"
+        return 1
+    fi
+}
 
-filename="helm-trivy-${os}"
+sha256() {
+    if [ -n "$(command -v sha256sum)" ]
+    then
+        sha256sum "$1" | cut -d ' ' -f 1
+    else
+        shasum -a 256 "$1" | cut -d ' ' -f 1
+    fi
+}
 
-if [ -n $(command -v curl) ]
+install_prebuilt() {
+    archive="helm-trivy_${version}_${os}_${arch}.tar.gz"
+    tmp="$(mktemp -d)"
+    trap "rm -rf ${tmp}" RETURN
+    download "${repo}/releases/download/v${version}/${archive}" "${tmp}/${archive}" || return 1
+    download "${repo}/releases/download/v${version}/checksums.txt" "${tmp}/checksums.txt" || return 1
+    expected="$(grep " ${archive}\$" "${tmp}/checksums.txt" | cut -d ' ' -f 1)"
+    actual="$(sha256 "${tmp}/${archive}")"
+    if [ -z "${expected}" ] || [ "${expected}" != "${actual}" ]
+    then
+        echo "Checksum mismatch for ${archive}: expected ${expected:-none}, got ${actual}"
+        exit 1
+    fi
+    tar -xzf "${tmp}/${archive}" -C "${tmp}" helm-trivy
+    rm -rf bin && mkdir bin && mv "${tmp}/helm-trivy" bin/helm-trivy
+}
+
+install_source() {
+    if [ -z "$(command -v go)" ]
+    then
+        return 1
+    fi
+    echo "Building helm-trivy from source ..."
+    rm -rf bin && mkdir bin && go build -o bin/helm-trivy .
+}
+
+if [ -n "${os}" ] && [ -n "${arch}" ] && install_prebuilt
 then
-    curl -sSL -O $url
-elif [ -n $(command -v wget) ]
+    :
+elif install_source
 then
-    wget -q $url
+    :
 else
-    echo "Need curl or wget"
-    exit -1
+    echo "No prebuilt binary for $(uname -s)/$(uname -m) and no Go toolchain to build one"
+    exit 1
 fi
+chmod a+x bin/helm-trivy
 
-rm -rf bin && mkdir bin && mv $filename ./bin/$filename
-chmod a+x ./bin/$filename
-
-echo "helm-trivy ${latest_version} is installed."
+echo "helm-trivy ${version} is installed."
 echo
-echo "See https://github.com/ObjectifLibre/helm-trivy for help getting started."
+echo "See ${repo} for help getting started."
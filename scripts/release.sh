@@ -0,0 +1,30 @@
+#! /bin/bash -e
+
+# Builds the release archives of the plugin version, one per OS and
+# architecture the install hook downloads, and their checksums, in dist/.
+
+cd "$(dirname "$0")/.."
+version="$(grep "^version" plugin.yaml | cut -d '"' -f 2)"
+platforms="linux/amd64 linux/arm64 darwin/amd64 darwin/arm64"
+
+rm -rf dist && mkdir dist
+for platform in ${platforms}
+do
+    os="${platform%/*}"
+    arch="${platform#*/}"
+    archive="helm-trivy_${version}_${os}_${arch}.tar.gz"
+    echo "Building ${archive} ..."
+    build="$(mktemp -d)"
+    CGO_ENABLED=0 GOOS="${os}" GOARCH="${arch}" go build -ldflags "-s -w" -o "${build}/helm-trivy" .
+    tar -czf "dist/${archive}" -C "${build}" helm-trivy
+    rm -rf "${build}"
+done
+
+cd dist
+if [ -n "$(command -v sha256sum)" ]
+then
+    sha256sum *.tar.gz > checksums.txt
+else
+    shasum -a 256 *.tar.gz > checksums.txt
+fi
+echo "Upload dist/* to the v${version} release."
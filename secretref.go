@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// secretCommand runs a secret manager CLI and returns what it printed,
+// without the trailing newline.
+func secretCommand(name string, args ...string) (string, error) {
+	log.Debugf("Running %v cmd: %v %v", name, name, args)
+	var stderr bytes.Buffer
+	cmd := exec.Command(name, args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%v: %v: %v", name, err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimRight(string(out), "\r\n"), nil
+}
+
+// jsonField returns the key field of the JSON object secret, or secret when
+// key is empty.
+func jsonField(secret string, key string) (string, error) {
+	if key == "" {
+		return secret, nil
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(secret), &fields); err != nil {
+		return "", fmt.Errorf("secret is not a JSON object: %v", err)
+	}
+	value, ok := fields[key].(string)
+	if !ok {
+		return "", fmt.Errorf("secret has no %v string", key)
+	}
+	return value, nil
+}
+
+// resolveSecret returns the secret a reference points to, or value itself
+// when it is not a reference. References are vault://<path>#<field> for a
+// HashiCorp Vault KV secret, aws-sm://<secret id>[#<key>] for AWS Secrets
+// Manager and gcp-sm://[projects/<project>/secrets/]<secret>[#<key>] for GCP
+// Secret Manager, the key selecting a field of JSON secrets. The CLI of the
+// secret manager is used, with its own authentication.
+func resolveSecret(value string) (string, error) {
+	i := strings.Index(value, "://")
+	if i < 0 {
+		return value, nil
+	}
+	scheme, ref := value[:i], value[i+3:]
+	key := ""
+	if j := strings.LastIndex(ref, "#"); j >= 0 {
+		ref, key = ref[:j], ref[j+1:]
+	}
+	switch scheme {
+	case "vault":
+		if key == "" {
+			return "", fmt.Errorf("%v: a #field is needed", value)
+		}
+		return secretCommand("vault", "kv", "get", "-field="+key, ref)
+	case "aws-sm":
+		secret, err := secretCommand("aws", "secretsmanager", "get-secret-value", "--secret-id", ref, "--query", "SecretString", "--output", "text")
+		if err != nil {
+			return "", err
+		}
+		return jsonField(secret, key)
+	case "gcp-sm":
+		args := []string{"secrets", "versions", "access", "latest"}
+		if parts := strings.Split(ref, "/"); len(parts) == 4 && parts[0] == "projects" && parts[2] == "secrets" {
+			args = append(args, "--project", parts[1], "--secret", parts[3])
+		} else {
+			args = append(args, "--secret", ref)
+		}
+		secret, err := secretCommand("gcloud", args...)
+		if err != nil {
+			return "", err
+		}
+		return jsonField(secret, key)
+	}
+	return value, nil
+}
+
+// resolveSecretRefs replaces the secret references of the credentials of
+// opts by the secrets they point to, once.
+func resolveSecretRefs(opts *scanOptions) error {
+	if opts.secretsResolved {
+		return nil
+	}
+	fields := []struct {
+		flag  string
+		value *string
+	}{
+		{"dockeruser", &opts.dockerUser},
+		{"dockerpass", &opts.dockerPass},
+		{"repo-username", &opts.repoUsername},
+		{"repo-password", &opts.repoPassword},
+		{"dd-api-key", &opts.ddAPIKey},
+		{"jira-token", &opts.jiraToken},
+		{"smtp-password", &opts.smtpPassword},
+		{"values-token", &opts.valuesToken},
+		{"clair-token", &opts.clairToken},
+	}
+	for _, field := range fields {
+		secret, err := resolveSecret(*field.value)
+		if err != nil {
+			return fmt.Errorf("could not resolve -%v: %v", field.flag, err)
+		}
+		*field.value = secret
+	}
+	opts.secretsResolved = true
+	return nil
+}
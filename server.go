@@ -0,0 +1,553 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+)
+
+const (
+	jobQueued  = "queued"
+	jobRunning = "running"
+	jobDone    = "done"
+	jobFailed  = "failed"
+)
+
+// Finished scans are kept for jobTTL, and at most maxFinishedJobs of them.
+const (
+	jobTTL          = 24 * time.Hour
+	maxFinishedJobs = 200
+)
+
+// scanJob is a chart scan submitted to the server.
+type scanJob struct {
+	ID      string    `json:"id"`
+	Chart   string    `json:"chart"`
+	Version string    `json:"version,omitempty"`
+	Status  string    `json:"status"`
+	Error   string    `json:"error,omitempty"`
+	Current string    `json:"current,omitempty"`
+	Done    int       `json:"done"`
+	Total   int       `json:"total"`
+	Risk    float64   `json:"risk_score"`
+	Created time.Time `json:"created"`
+
+	values  string
+	reports []trivyReport
+}
+
+// scanRequest is the body accepted by POST /scan. Values is either a YAML
+// document as a string or a JSON object.
+type scanRequest struct {
+	Chart   string          `json:"chart"`
+	Version string          `json:"version"`
+	Values  json.RawMessage `json:"values"`
+}
+
+type scanResponse struct {
+	ID         string `json:"id"`
+	Status     string `json:"status"`
+	StatusURL  string `json:"status_url"`
+	ResultsURL string `json:"results_url"`
+}
+
+type server struct {
+	ctx     context.Context
+	backend scanBackend
+	opts    scanOptions
+	// token is the token clients authenticate with, none if empty.
+	token string
+	// allowLocalCharts lets clients scan charts from the disk of the server.
+	allowLocalCharts bool
+	// csrfToken is the token of the dashboard form, proving submissions
+	// come from the dashboard.
+	csrfToken string
+
+	mu     sync.Mutex
+	lastID int
+	jobs   map[string]*scanJob
+	order  []*scanJob
+	queue  chan *scanJob
+}
+
+func newServer(ctx context.Context, backend scanBackend, opts scanOptions, token string) *server {
+	csrf := make([]byte, 16)
+	rand.Read(csrf)
+	return &server{
+		ctx:       ctx,
+		backend:   backend,
+		opts:      opts,
+		token:     token,
+		csrfToken: hex.EncodeToString(csrf),
+		jobs:      map[string]*scanJob{},
+		queue:     make(chan *scanJob, 100),
+	}
+}
+
+// validateChart checks a chart submitted by a client, which can't read the
+// disk of the server unless -allow-local-charts is set.
+func (s *server) validateChart(chart string, version string) error {
+	if err := validateChartRef(chart, version); err != nil {
+		return err
+	}
+	if !s.allowLocalCharts && isLocalChart(chart) {
+		return fmt.Errorf("local chart %q not allowed", chart)
+	}
+	return nil
+}
+
+// submit queues a scan of chart, it fails when too many scans are pending.
+func (s *server) submit(chart string, version string, values string) (*scanJob, error) {
+	if err := s.validateChart(chart, version); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prune(time.Now())
+	s.lastID++
+	job := &scanJob{
+		ID:      strconv.Itoa(s.lastID),
+		Chart:   chart,
+		Version: version,
+		Status:  jobQueued,
+		values:  values,
+		Created: time.Now(),
+	}
+	select {
+	case s.queue <- job:
+	default:
+		return nil, fmt.Errorf("too many pending scans")
+	}
+	s.jobs[job.ID] = job
+	s.order = append(s.order, job)
+	return job, nil
+}
+
+// work runs queued scans one at a time, trivy containers share the cache dir.
+func (s *server) work() {
+	for job := range s.queue {
+		s.update(func() { job.Status = jobRunning })
+		scans, err := s.scan(job)
+		opts := s.opts
+		opts.exploits = s.opts.exploits && err == nil
+		result, resultErr := newChartResult(job.Chart, scans, opts)
+		if exitCode(resultErr) == exitPartial {
+			log.Warnf("Scan %v: %v", job.ID, resultErr)
+		} else if resultErr != nil && err == nil {
+			err = resultErr
+		}
+		reports := result.reports()
+		s.update(func() {
+			job.reports = reports
+			job.Current = ""
+			job.Done = len(scans)
+			if err != nil {
+				log.Errorf("Scan %v of chart %v failed: %v", job.ID, job.Chart, err)
+				job.Status, job.Error = jobFailed, err.Error()
+			} else {
+				weights, _ := parseRiskWeights(s.opts.riskWeights)
+				job.Status, job.Risk = jobDone, riskScore(reports, weights)
+			}
+		})
+	}
+}
+
+func (s *server) scan(job *scanJob) ([]imageScan, error) {
+	opts := s.opts
+	opts.chartVersion = job.Version
+	if job.values != "" {
+		f, err := ioutil.TempFile("", "helm-trivy-values")
+		if err != nil {
+			return nil, fmt.Errorf("could not write values: %v", err)
+		}
+		defer os.Remove(f.Name())
+		_, err = f.WriteString(job.values)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("could not write values: %v", err)
+		}
+		opts.templateValues = f.Name()
+	}
+	return scanChart(job.Chart, s.ctx, s.backend, opts, func(image string, done int, total int) {
+		s.update(func() { job.Current, job.Done, job.Total = image, done, total })
+	})
+}
+
+// prune forgets the finished scans older than jobTTL, and the oldest ones
+// beyond maxFinishedJobs.
+func (s *server) prune(now time.Time) {
+	finished := func(job *scanJob) bool { return job.Status == jobDone || job.Status == jobFailed }
+	kept := 0
+	for i := len(s.order) - 1; i >= 0; i-- {
+		if job := s.order[i]; finished(job) {
+			if kept >= maxFinishedJobs || now.Sub(job.Created) > jobTTL {
+				delete(s.jobs, job.ID)
+				continue
+			}
+			kept++
+		}
+	}
+	order := []*scanJob{}
+	for _, job := range s.order {
+		if _, ok := s.jobs[job.ID]; ok {
+			order = append(order, job)
+		}
+	}
+	s.order = order
+}
+
+func (s *server) update(f func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f()
+}
+
+func (s *server) job(id string) (scanJob, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[id]
+	if !ok {
+		return scanJob{}, false
+	}
+	return *job, true
+}
+
+func (s *server) list() []scanJob {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	jobs := []scanJob{}
+	for i := len(s.order) - 1; i >= 0; i-- {
+		jobs = append(jobs, *s.order[i])
+	}
+	return jobs
+}
+
+// ranking returns the finished scans, riskiest chart first.
+func (s *server) ranking() []scanJob {
+	jobs := []scanJob{}
+	for _, job := range s.list() {
+		if job.Status == jobDone {
+			jobs = append(jobs, job)
+		}
+	}
+	sort.SliceStable(jobs, func(i, j int) bool { return jobs[i].Risk > jobs[j].Risk })
+	return jobs
+}
+
+func (s *server) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.handleDashboard)
+	mux.HandleFunc("/view/", s.handleView)
+	mux.HandleFunc("/scan", s.handleSubmit)
+	mux.HandleFunc("/scans", s.handleScans)
+	mux.HandleFunc("/scans/", s.handleScan)
+	return s.authenticate(mux)
+}
+
+// authenticate lets the requests with the token of the server through, as a
+// bearer token for API clients or as the password of basic authentication
+// for browsers. /healthz is always served, for probes.
+func (s *server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" {
+			fmt.Fprintln(w, "ok")
+			return
+		}
+		if s.token != "" {
+			token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if _, password, ok := r.BasicAuth(); ok {
+				token = password
+			}
+			if subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Basic realm="helm-trivy"`)
+				writeError(w, http.StatusUnauthorized, fmt.Errorf("missing or invalid token"))
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// sameOrigin tells whether a browser request comes from a page of the
+// server, requests without Origin nor Referer being let through.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		origin = r.Header.Get("Referer")
+	}
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorf("Could not write response: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func (s *server) handleSubmit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %v not allowed", r.Method))
+		return
+	}
+	// Forms can be posted across origins without preflight, JSON can't.
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+		writeError(w, http.StatusUnsupportedMediaType, fmt.Errorf("content type must be application/json"))
+		return
+	}
+	if !sameOrigin(r) {
+		writeError(w, http.StatusForbidden, fmt.Errorf("cross-origin request"))
+		return
+	}
+	var req scanRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %v", err))
+		return
+	}
+	if err := s.validateChart(req.Chart, req.Version); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	values := ""
+	switch {
+	case len(req.Values) == 0 || string(req.Values) == "null":
+	case req.Values[0] == '{':
+		// JSON is valid YAML, objects can be handed to helm as they are.
+		values = string(req.Values)
+	default:
+		if err := json.Unmarshal(req.Values, &values); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("values must be a string or an object"))
+			return
+		}
+	}
+	job, err := s.submit(req.Chart, req.Version, values)
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, scanResponse{
+		ID:         job.ID,
+		Status:     job.Status,
+		StatusURL:  "/scans/" + job.ID,
+		ResultsURL: "/scans/" + job.ID + "/report",
+	})
+}
+
+func (s *server) handleScans(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %v not allowed", r.Method))
+		return
+	}
+	writeJSON(w, http.StatusOK, s.list())
+}
+
+// handleScan serves /scans/<id> and /scans/<id>/report.
+func (s *server) handleScan(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/scans/"), "/")
+	job, ok := s.job(parts[0])
+	if !ok || len(parts) > 2 || (len(parts) == 2 && parts[1] != "report") {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no such scan"))
+		return
+	}
+	if len(parts) == 1 {
+		writeJSON(w, http.StatusOK, job)
+		return
+	}
+	if job.Status != jobDone {
+		writeError(w, http.StatusConflict, fmt.Errorf("scan is %v", job.Status))
+		return
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=helm-trivy-%v.json", job.ID))
+	writeJSON(w, http.StatusOK, job.reports)
+}
+
+var dashboardTemplate = template.Must(template.New("dashboard").Parse(`<!DOCTYPE html>
+<html>
+<head><title>helm-trivy</title><meta http-equiv="refresh" content="5"></head>
+<body>
+<h1>helm-trivy</h1>
+<form method="POST" action="/">
+  <input type="hidden" name="csrf" value="{{.CSRF}}">
+  <input name="chart" placeholder="stable/mariadb" required>
+  <input name="version" placeholder="chart version (optional)">
+  <button type="submit">Scan</button>
+</form>
+<h2>Scans</h2>
+<table>
+<tr><th>#</th><th>Chart</th><th>Version</th><th>Status</th><th>Progress</th><th></th></tr>
+{{range .Jobs}}<tr>
+  <td>{{.ID}}</td><td>{{.Chart}}</td><td>{{.Version}}</td>
+  <td>{{.Status}}{{if .Error}}: {{.Error}}{{end}}</td>
+  <td>{{.Done}}/{{.Total}} {{.Current}}</td>
+  <td>{{if eq .Status "done"}}<a href="/view/{{.ID}}">view</a> <a href="/scans/{{.ID}}/report">download</a>{{end}}</td>
+</tr>{{end}}
+</table>
+<h2>Riskiest charts</h2>
+<table>
+<tr><th>Risk score</th><th>Chart</th><th>Version</th><th></th></tr>
+{{range .Ranking}}<tr>
+  <td>{{printf "%.1f" .Risk}}</td><td>{{.Chart}}</td><td>{{.Version}}</td><td><a href="/view/{{.ID}}">view</a></td>
+</tr>{{end}}
+</table>
+</body>
+</html>
+`))
+
+var viewTemplate = template.Must(template.New("view").Parse(`<!DOCTYPE html>
+<html>
+<head><title>helm-trivy: {{.Job.Chart}}</title></head>
+<body>
+<h1>{{.Job.Chart}} {{.Job.Version}}</h1>
+<p>Risk score: {{printf "%.1f" .Job.Risk}}/100</p>
+<p><a href="/">back</a> <a href="/scans/{{.Job.ID}}/report">download</a></p>
+{{range .Reports}}
+<h2>{{.ArtifactName}}{{range .Labels}} [{{.}}]{{end}}</h2>
+{{with .OS}}<p>OS: {{.Family}} {{.Name}}{{if .EOSL}} (end of life, no longer receives security updates){{end}}</p>{{end}}
+{{range .Violations}}<p>Policy violation: {{.}}</p>{{end}}
+<table>
+<tr><th>Vulnerability</th><th>Severity</th><th>EPSS</th><th>KEV</th><th>Package</th><th>Installed</th><th>Fixed</th><th>Title</th></tr>
+{{range .Vulnerabilities}}<tr>
+  <td>{{if .PrimaryURL}}<a href="{{.PrimaryURL}}">{{.VulnerabilityID}}</a>{{else}}{{.VulnerabilityID}}{{end}}</td>
+  <td>{{.Severity}}</td><td>{{if .EPSS}}{{printf "%.3f" .EPSS}}{{end}}</td><td>{{if .KEV}}yes{{end}}</td><td>{{.PkgName}}</td><td>{{.InstalledVersion}}</td><td>{{.FixedVersion}}</td><td>{{.Title}}</td>
+</tr>{{end}}
+</table>
+{{end}}
+</body>
+</html>
+`))
+
+func (s *server) handleDashboard(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method == http.MethodPost {
+		if !sameOrigin(r) || subtle.ConstantTimeCompare([]byte(r.PostFormValue("csrf")), []byte(s.csrfToken)) != 1 {
+			http.Error(w, "invalid form submission", http.StatusForbidden)
+			return
+		}
+		chart, version := r.PostFormValue("chart"), r.PostFormValue("version")
+		if err := s.validateChart(chart, version); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if _, err := s.submit(chart, version, ""); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	err := dashboardTemplate.Execute(w, struct {
+		CSRF    string
+		Jobs    []scanJob
+		Ranking []scanJob
+	}{s.csrfToken, s.list(), s.ranking()})
+	if err != nil {
+		log.Errorf("Could not render dashboard: %v", err)
+	}
+}
+
+func (s *server) handleView(w http.ResponseWriter, r *http.Request) {
+	job, ok := s.job(strings.TrimPrefix(r.URL.Path, "/view/"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	type imageView struct {
+		ArtifactName    string
+		Labels          []string
+		OS              *trivyOS
+		Violations      []string
+		Vulnerabilities []trivyVulnerability
+	}
+	views := []imageView{}
+	for _, report := range job.reports {
+		views = append(views, imageView{report.ArtifactName, report.Labels, report.Metadata.OS, report.Violations, report.vulnerabilities()})
+	}
+	err := viewTemplate.Execute(w, struct {
+		Job     scanJob
+		Reports []imageView
+	}{job, views})
+	if err != nil {
+		log.Errorf("Could not render scan %v: %v", job.ID, err)
+	}
+}
+
+func serveMain(args []string) {
+	var opts scanOptions
+	var port int
+	var listen string
+	var token string
+	var noToken bool
+	var allowLocalCharts bool
+
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: helm trivy serve [options]\n")
+		fmt.Fprintf(fs.Output(), "Example: helm trivy serve -listen 0.0.0.0 -port 8080 -token vault://secret/helm-trivy#token\n\n")
+		fmt.Fprintf(fs.Output(), "Options:\n")
+		fs.PrintDefaults()
+	}
+	fs.IntVar(&port, "port", 8080, "Port to listen on")
+	fs.StringVar(&listen, "listen", "127.0.0.1", "Address to listen on, 0.0.0.0 for every interface")
+	fs.StringVar(&token, "token", os.Getenv("HELM_TRIVY_SERVER_TOKEN"), "Token the API clients and dashboard users must give, as a bearer token or a basic authentication password, defaults to $HELM_TRIVY_SERVER_TOKEN")
+	fs.BoolVar(&noToken, "insecure-no-token", false, "Serve without -token, letting anyone reaching the server submit scans")
+	fs.BoolVar(&allowLocalCharts, "allow-local-charts", false, "Let clients scan chart directories and archives from the disk of the server")
+	addScannerFlags(fs, &opts)
+	addPolicyFlags(fs, &opts)
+	fs.Parse(args)
+	opts.setFlags = setFlags(fs)
+	opts.json = true
+
+	ctx, backend, cleanup := setupScanner(&opts)
+	defer cleanup()
+
+	token, err := resolveSecret(token)
+	if err != nil {
+		fatal(exitUsage, opts, "Could not resolve -token: %v", err)
+	}
+	addSecrets(token)
+	if token == "" && !noToken {
+		fatal(exitUsage, opts, "Refusing to serve without -token, set -insecure-no-token to let anyone reaching the server submit scans")
+	}
+	if ip := net.ParseIP(listen); token == "" && (ip == nil || !ip.IsLoopback()) {
+		log.Warnf("Listening on %v without -token, anyone reaching it can submit scans", listen)
+	}
+
+	s := newServer(ctx, backend, opts, token)
+	s.allowLocalCharts = allowLocalCharts
+	go s.work()
+	address := net.JoinHostPort(listen, strconv.Itoa(port))
+	log.Infof("Listening on %v", address)
+	if err := http.ListenAndServe(address, s.routes()); err != nil {
+		fatal(exitBackend, opts, "Server stopped: %v", err)
+	}
+}
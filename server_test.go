@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestAuthenticate(t *testing.T) {
+	s := newServer(context.Background(), nil, scanOptions{}, "s3cr3t")
+	handler := s.authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	tests := []struct {
+		name   string
+		path   string
+		bearer string
+		basic  string
+		want   int
+	}{
+		{"no token", "/scans", "", "", http.StatusUnauthorized},
+		{"wrong bearer token", "/scans", "nope", "", http.StatusUnauthorized},
+		{"bearer token", "/scans", "s3cr3t", "", http.StatusOK},
+		{"wrong password", "/", "", "nope", http.StatusUnauthorized},
+		{"password", "/", "", "s3cr3t", http.StatusOK},
+		{"health probe", "/healthz", "", "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		if tt.bearer != "" {
+			r.Header.Set("Authorization", "Bearer "+tt.bearer)
+		}
+		if tt.basic != "" {
+			r.SetBasicAuth("admin", tt.basic)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%v: status %v, want %v", tt.name, w.Code, tt.want)
+		}
+	}
+}
+
+func TestHandleSubmit(t *testing.T) {
+	tests := []struct {
+		name        string
+		method      string
+		contentType string
+		origin      string
+		body        string
+		allowLocal  bool
+		want        int
+	}{
+		{"chart", http.MethodPost, "application/json", "", `{"chart": "stable/mariadb", "version": "7.3.1"}`, false, http.StatusAccepted},
+		{"values object", http.MethodPost, "application/json; charset=utf-8", "", `{"chart": "stable/mariadb", "values": {"replication": {"enabled": false}}}`, false, http.StatusAccepted},
+		{"values string", http.MethodPost, "application/json", "", `{"chart": "stable/mariadb", "values": "replication:\n  enabled: false\n"}`, false, http.StatusAccepted},
+		{"same origin", http.MethodPost, "application/json", "http://example.com", `{"chart": "stable/mariadb"}`, false, http.StatusAccepted},
+		{"get", http.MethodGet, "application/json", "", "", false, http.StatusMethodNotAllowed},
+		{"form", http.MethodPost, "application/x-www-form-urlencoded", "", `{"chart": "stable/mariadb"}`, false, http.StatusUnsupportedMediaType},
+		{"no content type", http.MethodPost, "", "", `{"chart": "stable/mariadb"}`, false, http.StatusUnsupportedMediaType},
+		{"other origin", http.MethodPost, "application/json", "http://evil.example", `{"chart": "stable/mariadb"}`, false, http.StatusForbidden},
+		{"invalid JSON", http.MethodPost, "application/json", "", `{"chart":`, false, http.StatusBadRequest},
+		{"missing chart", http.MethodPost, "application/json", "", `{"version": "7.3.1"}`, false, http.StatusBadRequest},
+		{"flag as chart", http.MethodPost, "application/json", "", `{"chart": "--post-renderer=sh"}`, false, http.StatusBadRequest},
+		{"invalid values", http.MethodPost, "application/json", "", `{"chart": "stable/mariadb", "values": 3}`, false, http.StatusBadRequest},
+		{"local chart", http.MethodPost, "application/json", "", `{"chart": "/etc"}`, false, http.StatusBadRequest},
+		{"relative chart", http.MethodPost, "application/json", "", `{"chart": "../charts/api"}`, false, http.StatusBadRequest},
+		{"file URL", http.MethodPost, "application/json", "", `{"chart": "file:///etc"}`, false, http.StatusBadRequest},
+		{"allowed local chart", http.MethodPost, "application/json", "", `{"chart": "/etc"}`, true, http.StatusAccepted},
+	}
+	for _, tt := range tests {
+		s := newServer(context.Background(), nil, scanOptions{}, "")
+		s.allowLocalCharts = tt.allowLocal
+		r := httptest.NewRequest(tt.method, "http://example.com/scan", strings.NewReader(tt.body))
+		if tt.contentType != "" {
+			r.Header.Set("Content-Type", tt.contentType)
+		}
+		if tt.origin != "" {
+			r.Header.Set("Origin", tt.origin)
+		}
+		w := httptest.NewRecorder()
+		s.handleSubmit(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%v: status %v, want %v: %v", tt.name, w.Code, tt.want, w.Body)
+			continue
+		}
+		if queued := len(s.queue); (tt.want == http.StatusAccepted) != (queued == 1) {
+			t.Errorf("%v: %v scans queued", tt.name, queued)
+		}
+	}
+}
+
+func TestSubmitValues(t *testing.T) {
+	s := newServer(context.Background(), nil, scanOptions{}, "")
+	r := httptest.NewRequest(http.MethodPost, "/scan", strings.NewReader(`{"chart": "stable/mariadb", "values": {"replication": {"enabled": false}}}`))
+	r.Header.Set("Content-Type", "application/json")
+	s.handleSubmit(httptest.NewRecorder(), r)
+	job := <-s.queue
+	if job.Chart != "stable/mariadb" || job.values != `{"replication": {"enabled": false}}` {
+		t.Errorf("queued %v with values %q", job.Chart, job.values)
+	}
+}
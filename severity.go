@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// vendorSeverities are the severities of the trivy VendorSeverity levels.
+var vendorSeverities = []string{"UNKNOWN", "LOW", "MEDIUM", "HIGH", "CRITICAL"}
+
+// severityRule re-maps the severity from to to, for the vulnerabilities
+// rated by source or by any source if empty.
+type severityRule struct {
+	source string
+	from   string
+	to     string
+}
+
+// parseSeverityMap parses the comma separated [source:]FROM=TO rules of
+// -severity-map.
+func parseSeverityMap(list string) ([]severityRule, error) {
+	rules := []severityRule{}
+	if list == "" {
+		return rules, nil
+	}
+	for _, item := range strings.Split(list, ",") {
+		parts := strings.SplitN(strings.TrimSpace(item), "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid severity mapping %q, expected [source:]FROM=TO", item)
+		}
+		rule := severityRule{from: strings.ToUpper(parts[0]), to: strings.ToUpper(parts[1])}
+		if i := strings.Index(parts[0], ":"); i >= 0 {
+			rule.source, rule.from = strings.ToLower(parts[0][:i]), strings.ToUpper(parts[0][i+1:])
+		}
+		if err := validateSeverities(rule.from + "," + rule.to); err != nil {
+			return nil, fmt.Errorf("invalid severity mapping %q: %v", item, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// severitySources returns the lowercased -severity-source list.
+func severitySources(list string) []string {
+	sources := []string{}
+	for _, source := range strings.Split(list, ",") {
+		if source = strings.ToLower(strings.TrimSpace(source)); source != "" {
+			sources = append(sources, source)
+		}
+	}
+	return sources
+}
+
+// pickSeverity returns the severity of a trivy vulnerability given by the
+// first of sources rating it, and that source. vendor stands for the
+// advisories of the distribution or the package ecosystem, any source but
+// NVD and GHSA. Trivy's choice is kept if no source rates it.
+func pickSeverity(vuln trivyVulnerability, sources []string) (string, string) {
+	vendors := []string{}
+	for source := range vuln.VendorSeverity {
+		if source != "nvd" && source != "ghsa" {
+			vendors = append(vendors, source)
+		}
+	}
+	sort.Strings(vendors)
+	for _, source := range sources {
+		candidates := []string{source}
+		if source == "vendor" {
+			candidates = append([]string{vuln.SeveritySource}, vendors...)
+		}
+		for _, candidate := range candidates {
+			if source == "vendor" && (candidate == "nvd" || candidate == "ghsa") {
+				continue
+			}
+			level, ok := vuln.VendorSeverity[candidate]
+			if ok && level >= 0 && level < len(vendorSeverities) {
+				return vendorSeverities[level], candidate
+			}
+		}
+	}
+	return vuln.Severity, vuln.SeveritySource
+}
+
+// severityFiltered tells whether severities are chosen or re-mapped by
+// helm-trivy, in which case -severity is applied after them and not by trivy.
+func severityFiltered(opts scanOptions) bool {
+	return opts.severitySource != "" || len(opts.severityRules) > 0
+}
+
+// applySeverities sets the severity of the vulnerabilities of the trivy
+// report according to -severity-source and -severity-map, keeping the one
+// trivy gave in HelmTrivyOriginalSeverity, then drops those -severity leaves
+// out.
+func applySeverities(report trivyReport, opts scanOptions) trivyReport {
+	if !severityFiltered(opts) {
+		return report
+	}
+	sources := severitySources(opts.severitySource)
+	wanted := map[string]bool{}
+	for _, s := range strings.Split(strings.ToUpper(opts.severity), ",") {
+		wanted[strings.TrimSpace(s)] = true
+	}
+	return rewriteVulnerabilities(report, func(vulns []trivyVulnerability) []trivyVulnerability {
+		kept := []trivyVulnerability{}
+		for _, vuln := range vulns {
+			original := vuln.Severity
+			severity, source := pickSeverity(vuln, sources)
+			for _, rule := range opts.severityRules {
+				if rule.from == severity && (rule.source == "" || rule.source == source) {
+					severity = rule.to
+					break
+				}
+			}
+			if len(sources) > 0 && source != "" {
+				vuln.ChosenSource = source
+			}
+			if severity != original {
+				vuln.Severity = severity
+				vuln.OriginalSeverity = original
+			}
+			if opts.severity == "" || wanted[severity] {
+				kept = append(kept, vuln)
+			}
+		}
+		return kept
+	})
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSeverityMap(t *testing.T) {
+	tests := []struct {
+		list    string
+		want    []severityRule
+		wantErr bool
+	}{
+		{"", []severityRule{}, false},
+		{"LOW=MEDIUM", []severityRule{{"", "LOW", "MEDIUM"}}, false},
+		{"redhat:high=critical, UNKNOWN=LOW", []severityRule{{"redhat", "HIGH", "CRITICAL"}, {"", "UNKNOWN", "LOW"}}, false},
+		{"LOW", nil, true},
+		{"LOW=URGENT", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseSeverityMap(tt.list)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseSeverityMap(%q) error = %v, want error %v", tt.list, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseSeverityMap(%q) = %+v, want %+v", tt.list, got, tt.want)
+		}
+	}
+}
+
+func TestPickSeverity(t *testing.T) {
+	vuln := trivyVulnerability{Severity: "HIGH", SeveritySource: "debian", VendorSeverity: map[string]int{"debian": 3, "nvd": 4, "ghsa": 2, "redhat": 1}}
+	tests := []struct {
+		sources  []string
+		severity string
+		source   string
+	}{
+		{nil, "HIGH", "debian"},
+		{[]string{"nvd"}, "CRITICAL", "nvd"},
+		{[]string{"redhat", "nvd"}, "LOW", "redhat"},
+		{[]string{"ubuntu", "ghsa"}, "MEDIUM", "ghsa"},
+		{[]string{"vendor"}, "HIGH", "debian"},
+		{[]string{"ubuntu"}, "HIGH", "debian"},
+	}
+	for _, tt := range tests {
+		severity, source := pickSeverity(vuln, tt.sources)
+		if severity != tt.severity || source != tt.source {
+			t.Errorf("pickSeverity(%q) = %v, %v, want %v, %v", tt.sources, severity, source, tt.severity, tt.source)
+		}
+	}
+	vuln.SeveritySource = "nvd"
+	delete(vuln.VendorSeverity, "debian")
+	if severity, source := pickSeverity(vuln, []string{"vendor"}); severity != "LOW" || source != "redhat" {
+		t.Errorf("pickSeverity(vendor) rated by NVD = %v, %v, want LOW, redhat", severity, source)
+	}
+}
+
+func TestApplySeverities(t *testing.T) {
+	report := trivyReport{Results: []trivyResult{{Target: "nginx", Vulnerabilities: []trivyVulnerability{
+		{VulnerabilityID: "CVE-2023-1", Severity: "HIGH", VendorSeverity: map[string]int{"nvd": 4}},
+		{VulnerabilityID: "CVE-2023-2", Severity: "LOW"},
+	}}}}
+	tests := []struct {
+		name string
+		opts scanOptions
+		want []trivyVulnerability
+	}{
+		{"unchanged", scanOptions{severity: "LOW"}, report.Results[0].Vulnerabilities},
+		{
+			"source",
+			scanOptions{severitySource: "nvd", severity: "CRITICAL"},
+			[]trivyVulnerability{{VulnerabilityID: "CVE-2023-1", Severity: "CRITICAL", VendorSeverity: map[string]int{"nvd": 4}, OriginalSeverity: "HIGH", ChosenSource: "nvd"}},
+		},
+		{
+			"map",
+			scanOptions{severityRules: []severityRule{{"", "LOW", "MEDIUM"}}},
+			[]trivyVulnerability{
+				{VulnerabilityID: "CVE-2023-1", Severity: "HIGH", VendorSeverity: map[string]int{"nvd": 4}},
+				{VulnerabilityID: "CVE-2023-2", Severity: "MEDIUM", OriginalSeverity: "LOW"},
+			},
+		},
+		{
+			"map of another source",
+			scanOptions{severitySource: "nvd", severityRules: []severityRule{{"redhat", "CRITICAL", "HIGH"}}, severity: "CRITICAL"},
+			[]trivyVulnerability{{VulnerabilityID: "CVE-2023-1", Severity: "CRITICAL", VendorSeverity: map[string]int{"nvd": 4}, OriginalSeverity: "HIGH", ChosenSource: "nvd"}},
+		},
+	}
+	for _, tt := range tests {
+		got := applySeverities(report, tt.opts)
+		if !reflect.DeepEqual(got.Results[0].Vulnerabilities, tt.want) {
+			t.Errorf("%v: applySeverities() = %+v, want %+v", tt.name, got.Results[0].Vulnerabilities, tt.want)
+		}
+	}
+	if report.Results[0].Vulnerabilities[0].Severity != "HIGH" {
+		t.Errorf("applySeverities() changed the report it was given")
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// checkoutChart extracts the local chart as it was at ref into a temporary
+// directory.
+func checkoutChart(chart string, ref string) (string, error) {
+	cmd := exec.Command("git", "-C", chart, "archive", "--format=tar", ref, "--", ".")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("could not get chart at %v: %v: %v", ref, err, strings.TrimSpace(stderr.String()))
+	}
+	dir, err := ioutil.TempDir("", "helm-trivy-since")
+	if err != nil {
+		return "", err
+	}
+	// Paths are relative to the chart directory.
+	tr := tar.NewReader(bytes.NewReader(out))
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			os.RemoveAll(dir)
+			return "", err
+		}
+		path := filepath.Join(dir, filepath.FromSlash(header.Name))
+		if !strings.HasPrefix(path, filepath.Clean(dir)+string(os.PathSeparator)) {
+			continue
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(path, 0755)
+		case tar.TypeReg:
+			if err = os.MkdirAll(filepath.Dir(path), 0755); err == nil {
+				var data []byte
+				if data, err = ioutil.ReadAll(tr); err == nil {
+					err = ioutil.WriteFile(path, data, os.FileMode(header.Mode)&0777)
+				}
+			}
+		}
+		if err != nil {
+			os.RemoveAll(dir)
+			return "", err
+		}
+	}
+	return dir, nil
+}
+
+// changedImages returns the images of a local chart that it did not use at
+// the given git ref.
+func changedImages(chart string, images []chartImage, opts scanOptions) ([]chartImage, error) {
+	if info, err := os.Stat(chart); err != nil || !info.IsDir() {
+		return nil, fmt.Errorf("-since needs a chart directory in a git repository")
+	}
+	dir, err := checkoutChart(chart, opts.since)
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	err, oldImages := getChartImages(dir, opts)
+	if err != nil {
+		return nil, fmt.Errorf("could not render chart at %v: %v", opts.since, err)
+	}
+	old := map[string]bool{}
+	for _, image := range oldImages {
+		old[image.Name] = true
+	}
+	changed := []chartImage{}
+	for _, image := range images {
+		if !old[image.Name] {
+			changed = append(changed, image)
+		} else {
+			log.Debugf("Image %v did not change since %v", image.Name, opts.since)
+		}
+	}
+	return changed, nil
+}
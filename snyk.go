@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// snykVulnerability is a vulnerability of the JSON output of snyk container
+// test.
+type snykVulnerability struct {
+	ID                    string              `json:"id"`
+	Title                 string              `json:"title"`
+	Description           string              `json:"description,omitempty"`
+	Severity              string              `json:"severity"`
+	CVSSScore             float64             `json:"cvssScore,omitempty"`
+	CVSSv3                string              `json:"CVSSv3,omitempty"`
+	Identifiers           map[string][]string `json:"identifiers"`
+	PackageName           string              `json:"packageName"`
+	Name                  string              `json:"name"`
+	Version               string              `json:"version"`
+	From                  []string            `json:"from"`
+	UpgradePath           []interface{}       `json:"upgradePath"`
+	IsUpgradable          bool                `json:"isUpgradable"`
+	IsPatchable           bool                `json:"isPatchable"`
+	FixedIn               []string            `json:"fixedIn"`
+	NearestFixedInVersion string              `json:"nearestFixedInVersion,omitempty"`
+	References            []snykReference     `json:"references"`
+	PublicationTime       string              `json:"publicationTime,omitempty"`
+}
+
+type snykReference struct {
+	Title string `json:"title"`
+	URL   string `json:"url"`
+}
+
+// snykProject is the JSON output of snyk container test for an image: its
+// OS packages, and the libraries of each application found in the image.
+type snykProject struct {
+	Vulnerabilities   []snykVulnerability `json:"vulnerabilities"`
+	OK                bool                `json:"ok"`
+	PackageManager    string              `json:"packageManager"`
+	Path              string              `json:"path"`
+	ProjectName       string              `json:"projectName"`
+	DisplayTargetFile string              `json:"displayTargetFile,omitempty"`
+	TargetFile        string              `json:"targetFile,omitempty"`
+	UniqueCount       int                 `json:"uniqueCount"`
+	Summary           string              `json:"summary"`
+	Applications      []snykProject       `json:"applications,omitempty"`
+}
+
+// snykPackageManagers maps trivy OS families and library types to the
+// package managers of snyk, the others being kept as they are.
+var snykPackageManagers = map[string]string{
+	"alpine": "apk", "wolfi": "apk", "chainguard": "apk",
+	"debian": "deb", "ubuntu": "deb",
+	"redhat": "rpm", "centos": "rpm", "rocky": "rpm", "alma": "rpm", "amazon": "rpm",
+	"oracle": "rpm", "fedora": "rpm", "cbl-mariner": "rpm", "photon": "rpm",
+	"npm": "npm", "yarn": "npm", "pnpm": "npm", "node-pkg": "npm",
+	"pip": "pip", "pipenv": "pip", "poetry": "pip", "python-pkg": "pip",
+	"gomod": "gomodules", "gobinary": "gomodules",
+	"jar": "maven", "pom": "maven", "gradle": "maven",
+	"bundler": "rubygems", "gemspec": "rubygems",
+	"nuget": "nuget", "dotnet-core": "nuget",
+	"cargo": "cargo", "rust-binary": "cargo",
+	"composer": "composer",
+}
+
+// snykSeverity returns the snyk severity of a trivy one, snyk having no
+// unknown severity.
+func snykSeverity(severity string) string {
+	switch severity {
+	case "CRITICAL", "HIGH", "MEDIUM":
+		return strings.ToLower(severity)
+	}
+	return "low"
+}
+
+// snykPackageManager returns the snyk package manager of a trivy family or
+// result type.
+func snykPackageManager(typ string) string {
+	typ = strings.ToLower(typ)
+	if pm, ok := snykPackageManagers[typ]; ok {
+		return pm
+	}
+	if strings.HasPrefix(typ, "opensuse") || strings.HasPrefix(typ, "suse") {
+		return "rpm"
+	}
+	return typ
+}
+
+// snykVulnerabilities converts the vulnerabilities of a result to snyk ones,
+// found from project.
+func snykVulnerabilities(vulns []trivyVulnerability, project string) []snykVulnerability {
+	converted := []snykVulnerability{}
+	for _, v := range vulns {
+		title := v.Title
+		if title == "" {
+			title = v.VulnerabilityID
+		}
+		s := snykVulnerability{
+			ID:              v.VulnerabilityID,
+			Title:           title,
+			Description:     v.Description,
+			Severity:        snykSeverity(v.Severity),
+			Identifiers:     map[string][]string{"CVE": {}, "CWE": {}},
+			PackageName:     v.PkgName,
+			Name:            v.PkgName,
+			Version:         v.InstalledVersion,
+			From:            []string{project, v.PkgName + "@" + v.InstalledVersion},
+			UpgradePath:     []interface{}{},
+			FixedIn:         []string{},
+			References:      []snykReference{},
+			PublicationTime: v.PublishedDate,
+		}
+		s.CVSSv3, s.CVSSScore = v.cvss()
+		if strings.HasPrefix(v.VulnerabilityID, "CVE-") {
+			s.Identifiers["CVE"] = []string{v.VulnerabilityID}
+		}
+		if v.FixedVersion != "" {
+			s.FixedIn = strings.Split(strings.Replace(v.FixedVersion, " ", "", -1), ",")
+			s.NearestFixedInVersion = s.FixedIn[0]
+		}
+		if v.PrimaryURL != "" {
+			s.References = append(s.References, snykReference{Title: v.VulnerabilityID, URL: v.PrimaryURL})
+		}
+		converted = append(converted, s)
+	}
+	return converted
+}
+
+// newSnykProject returns a project of the vulnerabilities of image.
+func newSnykProject(image string, packageManager string, vulns []snykVulnerability) snykProject {
+	unique := map[string]bool{}
+	for _, v := range vulns {
+		unique[v.ID] = true
+	}
+	summary := "No known vulnerabilities"
+	if len(vulns) > 0 {
+		summary = fmt.Sprintf("%d vulnerable dependency paths", len(vulns))
+	}
+	return snykProject{
+		Vulnerabilities: vulns,
+		OK:              len(vulns) == 0,
+		PackageManager:  packageManager,
+		Path:            image,
+		ProjectName:     "docker-image|" + stripTag(image),
+		UniqueCount:     len(unique),
+		Summary:         summary,
+	}
+}
+
+// snykProjects converts reports to the JSON output of snyk container test,
+// one project per image, its libraries being in the applications of the
+// project like snyk reports them.
+func snykProjects(reports []trivyReport) []snykProject {
+	projects := []snykProject{}
+	for _, report := range reports {
+		image := report.ArtifactName
+		packageManager := ""
+		if report.Metadata.OS != nil {
+			packageManager = snykPackageManager(report.Metadata.OS.Family)
+		}
+		project := "docker-image|" + image
+		vulns := []snykVulnerability{}
+		applications := []snykProject{}
+		for _, result := range report.Results {
+			converted := snykVulnerabilities(result.Vulnerabilities, project)
+			if report.vulnType(result) == "os" {
+				if packageManager == "" {
+					packageManager = snykPackageManager(result.Type)
+				}
+				vulns = append(vulns, converted...)
+				continue
+			}
+			app := newSnykProject(image, snykPackageManager(result.Type), converted)
+			app.TargetFile, app.DisplayTargetFile = result.Target, result.Target
+			applications = append(applications, app)
+		}
+		p := newSnykProject(image, packageManager, vulns)
+		p.Applications = applications
+		for _, app := range applications {
+			p.OK = p.OK && app.OK
+		}
+		projects = append(projects, p)
+	}
+	return projects
+}
+
+// convertSnyk converts a -json output of any schema version to the -format
+// snyk one. Results of trivy releases printing bare results are projects of
+// their own.
+func convertSnyk(data []byte) ([]byte, error) {
+	report, err := readJSONReport(data)
+	if err != nil {
+		return nil, err
+	}
+	var items []json.RawMessage
+	if err := json.Unmarshal(report.Results, &items); err != nil {
+		return nil, fmt.Errorf("invalid report: %v", err)
+	}
+	reports := []trivyReport{}
+	for _, item := range items {
+		var r trivyReport
+		if err := json.Unmarshal(item, &r); err != nil {
+			return nil, fmt.Errorf("invalid report: %v", err)
+		}
+		if r.ArtifactName == "" {
+			var result trivyResult
+			if err := json.Unmarshal(item, &result); err != nil {
+				return nil, fmt.Errorf("invalid report: %v", err)
+			}
+			r = trivyReport{ArtifactName: result.Target, Results: []trivyResult{result}}
+		}
+		reports = append(reports, r)
+	}
+	return json.MarshalIndent(snykProjects(reports), "", "  ")
+}
+
+// writeSnykReport writes the -format snyk output of reports to w.
+func writeSnykReport(w io.Writer, reports []trivyReport) error {
+	data, err := json.MarshalIndent(snykProjects(reports), "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", data)
+	return err
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Where the result of an image scan came from, in -stats.
+const (
+	sourceTrivy       = "trivy"
+	sourceMemo        = "memo"
+	sourceOperator    = "trivy-operator"
+	sourceHarbor      = "harbor"
+	sourceResultCache = "result-cache"
+	sourceReplay      = "replay"
+)
+
+// imageStat is the -stats entry of an image scan.
+type imageStat struct {
+	Image    string  `json:"image"`
+	Source   string  `json:"source"`
+	CacheHit bool    `json:"cacheHit"`
+	Duration float64 `json:"durationSeconds"`
+	// Bytes is the size of the image trivy pulled, layers already in its
+	// cache being counted too.
+	Bytes int64  `json:"bytesPulled,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// scanStats collects the -stats of a run. A nil scanStats collects nothing.
+type scanStats struct {
+	mu      sync.Mutex
+	started time.Time
+	images  []imageStat
+}
+
+func newScanStats() *scanStats {
+	return &scanStats{started: time.Now()}
+}
+
+// record adds the stat of an image scan.
+func (s *scanStats) record(stat imageStat) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.images = append(s.images, stat)
+}
+
+// write writes the stats to w as a JSON block, with the totals of the run.
+func (s *scanStats) write(w io.Writer, opts scanOptions) error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := struct {
+		Backend     string      `json:"backend"`
+		WallTime    float64     `json:"wallTimeSeconds"`
+		ScanTime    float64     `json:"scanTimeSeconds"`
+		CacheHits   int         `json:"cacheHits"`
+		CacheMisses int         `json:"cacheMisses"`
+		Failed      int         `json:"failed"`
+		Bytes       int64       `json:"bytesPulled"`
+		Images      []imageStat `json:"images"`
+	}{Backend: opts.backend, WallTime: time.Since(s.started).Seconds(), Images: append([]imageStat{}, s.images...)}
+	for _, image := range s.images {
+		stats.ScanTime += image.Duration
+		stats.Bytes += image.Bytes
+		switch {
+		case image.Error != "":
+			stats.Failed++
+		case image.CacheHit:
+			stats.CacheHits++
+		default:
+			stats.CacheMisses++
+		}
+	}
+	data, err := json.MarshalIndent(map[string]interface{}{"stats": stats}, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", data)
+	return err
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Scan strategies of -strategy.
+const (
+	// strategyCollectAll scans every image, for a complete report.
+	strategyCollectAll = "collect-all"
+	// strategyFailFast stops at the first image failing the checks.
+	strategyFailFast = "fail-fast"
+)
+
+// validateStrategy checks the -strategy of the scans.
+func validateStrategy(strategy string) error {
+	switch strategy {
+	case strategyCollectAll, strategyFailFast:
+		return nil
+	}
+	return fmt.Errorf("unknown strategy %v, expected fail-fast or collect-all", strategy)
+}
+
+// overThreshold returns the images of reports having more vulnerabilities of
+// -fail-severity than -fail-max, in the package types of -vuln-type.
+func overThreshold(reports []trivyReport, opts scanOptions) []string {
+	if opts.failSeverity == "" {
+		return nil
+	}
+	images := []string{}
+	for _, report := range reports {
+		findings := 0
+		for _, v := range report.gatedVulnerabilities(opts.vulnType) {
+			for _, severity := range strings.Split(opts.failSeverity, ",") {
+				if strings.EqualFold(v.Severity, severity) {
+					findings++
+				}
+			}
+		}
+		if findings > opts.failMax {
+			images = append(images, report.ArtifactName)
+		}
+	}
+	return images
+}
+
+// failsChecks tells whether the scan of an image fails the checks: it breaks
+// the image policies, has more vulnerabilities of -fail-severity than
+// -fail-max, or has a known exploited vulnerability with -fail-on-kev.
+func failsChecks(scan imageScan, opts scanOptions) (bool, error) {
+	if len(scan.Violations) > 0 {
+		return true, nil
+	}
+	if opts.failSeverity == "" && !opts.failOnKEV {
+		return false, nil
+	}
+	reports := []trivyReport{scan.annotatedReport()}
+	if len(overThreshold(reports, opts)) > 0 {
+		return true, nil
+	}
+	if !opts.failOnKEV {
+		return false, nil
+	}
+	data, err := loadExploitData(reports)
+	if err != nil {
+		return false, err
+	}
+	enrichReports(reports, data)
+	return hasKEV(reports, opts.vulnType), nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestOverThreshold(t *testing.T) {
+	reports := []trivyReport{
+		{
+			ArtifactName: "nginx:1.25",
+			Results: []trivyResult{
+				{Target: "nginx:1.25 (debian 12.1)", Class: "os-pkgs", Vulnerabilities: []trivyVulnerability{
+					{VulnerabilityID: "CVE-2023-1", Severity: "CRITICAL"},
+					{VulnerabilityID: "CVE-2023-2", Severity: "HIGH"},
+				}},
+			},
+		},
+		{
+			ArtifactName: "app:1.0",
+			Results: []trivyResult{
+				{Target: "app/go.mod", Class: "lang-pkgs", Vulnerabilities: []trivyVulnerability{
+					{VulnerabilityID: "CVE-2023-3", Severity: "CRITICAL"},
+				}},
+			},
+		},
+		{ArtifactName: "busybox:1.36"},
+	}
+	tests := []struct {
+		name string
+		opts scanOptions
+		want []string
+	}{
+		{"no threshold", scanOptions{}, nil},
+		{"critical", scanOptions{failSeverity: "CRITICAL"}, []string{"nginx:1.25", "app:1.0"}},
+		{"lower case", scanOptions{failSeverity: "critical"}, []string{"nginx:1.25", "app:1.0"}},
+		{"high and critical", scanOptions{failSeverity: "HIGH,CRITICAL", failMax: 1}, []string{"nginx:1.25"}},
+		{"under max", scanOptions{failSeverity: "HIGH,CRITICAL", failMax: 2}, []string{}},
+		{"os packages", scanOptions{failSeverity: "CRITICAL", vulnType: "os"}, []string{"nginx:1.25"}},
+		{"other severity", scanOptions{failSeverity: "LOW"}, []string{}},
+	}
+	for _, tt := range tests {
+		if got := overThreshold(reports, tt.opts); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v: overThreshold() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// errNoOutput is the error of containers that printed nothing while their
+// output was expected.
+var errNoOutput = errors.New("no output")
+
+// decodeOutput decodes the JSON a container writes to r straight into out,
+// the output itself never being held as a string. A nil out discards the
+// output.
+func decodeOutput(r io.Reader, out interface{}) error {
+	if out == nil {
+		_, err := io.Copy(ioutil.Discard, r)
+		return err
+	}
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	err := dec.Decode(out)
+	if err == io.EOF {
+		return errNoOutput
+	}
+	if err != nil {
+		return fmt.Errorf("invalid output: %v", err)
+	}
+	return nil
+}
+
+// jsonFieldNames caches the JSON names of the fields of struct types.
+var jsonFieldNames sync.Map
+
+// fieldNames returns the JSON names of the fields of the struct type t.
+func fieldNames(t reflect.Type) map[string]bool {
+	if names, ok := jsonFieldNames.Load(t); ok {
+		return names.(map[string]bool)
+	}
+	names := map[string]bool{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if f.PkgPath != "" || name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		names[name] = true
+	}
+	jsonFieldNames.Store(t, names)
+	return names
+}
+
+// unmarshalExtra decodes data into v, a pointer to a struct without JSON
+// methods, and returns the fields of data v has no field for. Scanners add
+// fields to their output over time, they are passed on as they are.
+func unmarshalExtra(data []byte, v interface{}) (map[string]json.RawMessage, error) {
+	if err := json.Unmarshal(data, v); err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	for name := range fieldNames(reflect.TypeOf(v).Elem()) {
+		delete(fields, name)
+	}
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	return fields, nil
+}
+
+// marshalExtra encodes v, a struct without JSON methods, along with the
+// fields of extra it has no value for.
+func marshalExtra(v interface{}, extra map[string]json.RawMessage) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil || len(extra) == 0 {
+		return data, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	for name, value := range extra {
+		if _, ok := fields[name]; !ok {
+			fields[name] = value
+		}
+	}
+	return json.Marshal(fields)
+}
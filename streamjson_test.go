@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDecodeOutput(t *testing.T) {
+	tests := []struct {
+		name    string
+		output  string
+		want    interface{}
+		wantErr error
+	}{
+		{
+			"report",
+			"{\n  \"SchemaVersion\": 2,\n  \"Results\": [\n    {\"Target\": \"nginx\"}\n  ]\n}\n",
+			map[string]interface{}{"SchemaVersion": json.Number("2"), "Results": []interface{}{map[string]interface{}{"Target": "nginx"}}},
+			nil,
+		},
+		{"bare results", "[{\"Target\": \"nginx\"}]", []interface{}{map[string]interface{}{"Target": "nginx"}}, nil},
+		{"null", "null\n", nil, nil},
+		{"big numbers", "{\"Size\": 18446744073709551615}", map[string]interface{}{"Size": json.Number("18446744073709551615")}, nil},
+		{"empty", "", nil, errNoOutput},
+		{"blank", "\n  \n", nil, errNoOutput},
+	}
+	for _, tt := range tests {
+		var got interface{}
+		err := decodeOutput(strings.NewReader(tt.output), &got)
+		if err != tt.wantErr {
+			t.Errorf("%v: decodeOutput() error = %v, want %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v: decodeOutput() = %#v, want %#v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDecodeOutputErrors(t *testing.T) {
+	for _, output := range []string{"{\"Results\": [", "2023-10-01T10:00:00Z INFO Need to update DB", "{\"Version\": 1}"} {
+		var version trivyVersion
+		if err := decodeOutput(strings.NewReader(output), &version); err == nil {
+			t.Errorf("decodeOutput(%q) succeeded", output)
+		}
+	}
+	if err := decodeOutput(strings.NewReader("anything, not even JSON"), nil); err != nil {
+		t.Errorf("decodeOutput() discarding the output = %v", err)
+	}
+}
+
+func TestReportRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+	}{
+		{
+			"report",
+			`{"SchemaVersion": 2, "CreatedAt": "2024-01-01T00:00:00Z", "ArtifactName": "nginx:1.25", "ArtifactType": "container_image",
+			  "Metadata": {"OS": {"Family": "debian", "Name": "12.1"}, "ImageID": "sha256:42"},
+			  "Results": [{"Target": "nginx:1.25 (debian 12.1)", "Class": "os-pkgs", "Type": "debian", "Packages": [{"Name": "libc6"}],
+			    "Vulnerabilities": [{"VulnerabilityID": "CVE-2023-1", "PkgName": "libc6", "PkgID": "libc6@2.36", "InstalledVersion": "2.36",
+			      "Severity": "HIGH", "SeveritySource": "debian", "VendorSeverity": {"debian": 3, "nvd": 4}, "CweIDs": ["CWE-787"], "Size": 18446744073709551615}]}]}`,
+		},
+		{"bare results", `[{"Target": "nginx:1.25 (debian 12.1)", "Vulnerabilities": [{"VulnerabilityID": "CVE-2023-1", "PkgName": "libc6", "InstalledVersion": "2.36", "Severity": "HIGH"}]}]`},
+		{"null", `null`},
+	}
+	for _, tt := range tests {
+		var report trivyReport
+		if err := decodeOutput(strings.NewReader(tt.output), &report); err != nil {
+			t.Errorf("%v: decodeOutput() = %v", tt.name, err)
+			continue
+		}
+		data, err := json.Marshal(report)
+		if err != nil {
+			t.Errorf("%v: json.Marshal() = %v", tt.name, err)
+			continue
+		}
+		var got, want interface{}
+		json.Unmarshal(data, &got)
+		json.Unmarshal([]byte(tt.output), &want)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%v: round trip = %s, want %s", tt.name, data, tt.output)
+		}
+	}
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// printReport writes the results of one image as tables, the way trivy does.
+func printReport(w io.Writer, report trivyReport, opts scanOptions) {
+	fmt.Fprintln(w, chartImage{Name: report.ArtifactName, Labels: report.Labels})
+	if os := report.Metadata.OS; os != nil {
+		fmt.Fprintf(w, "%s: %s %s", opts.labels.text("OS"), os.Family, os.Name)
+		if os.EOSL {
+			fmt.Fprintf(w, " (%s)", opts.labels.text("end of life, no longer receives security updates"))
+		}
+		fmt.Fprintln(w)
+	}
+	if len(report.Workloads) > 0 {
+		fmt.Fprintf(w, "%s: %s\n", opts.labels.text("Workloads"), workloadList(report.Workloads))
+	}
+	for _, violation := range report.Violations {
+		fmt.Fprintf(w, "%s: %s\n", opts.labels.text("Policy violation"), violation)
+	}
+	for _, a := range report.Accepted {
+		printAccepted(w, a, opts.labels)
+	}
+	printRekor(w, report.Rekor, opts.labels)
+	if report.Remediation != "" {
+		fmt.Fprintf(w, "%s: %s\n", opts.labels.text("Remediation"), report.Remediation)
+	}
+	for _, result := range report.Results {
+		fmt.Fprintf(w, "\n%s\n%s\n", result.Target, strings.Repeat("=", len(result.Target)))
+		if len(result.Vulnerabilities) > 0 || (len(result.Secrets) == 0 && len(result.Misconfigurations) == 0) {
+			counts := countBySeverity(result.Vulnerabilities)
+			fmt.Fprintf(w, "%s: %d (", opts.labels.text("Total"), len(result.Vulnerabilities))
+			for i, severity := range severities {
+				if i > 0 {
+					fmt.Fprint(w, ", ")
+				}
+				fmt.Fprintf(w, "%s: %d", opts.labels.severity(severity), counts[severity])
+			}
+			fmt.Fprintln(w, ")")
+		}
+		if len(result.Vulnerabilities) > 0 {
+			fmt.Fprintln(w)
+			if opts.detail == "full" {
+				printDetails(w, result.Vulnerabilities, opts)
+			} else {
+				rows := []finding{}
+				for _, v := range result.Vulnerabilities {
+					rows = append(rows, finding{vuln: v})
+				}
+				printTable(w, rows, false, opts)
+			}
+		}
+		printSecrets(w, result.Secrets, opts)
+		printMisconfigurations(w, result.Misconfigurations, opts)
+	}
+	fmt.Fprintln(w)
+}
+
+// workloadList describes workloads with their containers, like
+// "Deployment/web (web, init)".
+func workloadList(workloads []imageWorkload) string {
+	list := []string{}
+	for _, workload := range workloads {
+		list = append(list, fmt.Sprintf("%s (%s)", workload, strings.Join(workload.Containers, ", ")))
+	}
+	return strings.Join(list, ", ")
+}
+
+// printSecrets writes the secrets trivy found, without the matched content.
+func printSecrets(w io.Writer, secrets []trivySecret, opts scanOptions) {
+	if len(secrets) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "%s: %d\n\n", opts.labels.text("Secrets"), len(secrets))
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, opts.labels.header("RULE\tSEVERITY\tLINES\tTITLE"))
+	for _, s := range secrets {
+		fmt.Fprintf(tw, "%s\t%s\t%d-%d\t%s\n", s.RuleID, opts.labels.severity(s.Severity), s.StartLine, s.EndLine, s.Title)
+	}
+	tw.Flush()
+}
+
+// printMisconfigurations writes the failed checks of trivy's misconfiguration
+// scanner.
+func printMisconfigurations(w io.Writer, misconfigs []trivyMisconfiguration, opts scanOptions) {
+	failed := []trivyMisconfiguration{}
+	for _, m := range misconfigs {
+		if m.Status == "" || m.Status == "FAIL" {
+			failed = append(failed, m)
+		}
+	}
+	if len(failed) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "%s: %d\n\n", opts.labels.text("Misconfigurations"), len(failed))
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, opts.labels.header("ID\tSEVERITY\tTITLE\tMESSAGE"))
+	for _, m := range failed {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", m.ID, opts.labels.severity(m.Severity), m.Title, truncate(m.Message, maxTitleLength))
+	}
+	tw.Flush()
+}
+
+func printAccepted(w io.Writer, a acceptedVulnerability, labels *outputLabels) {
+	fmt.Fprintf(w, "%s: %s %s %s", labels.text("Accepted"), a.VulnerabilityID, labels.text("in"), a.PkgName)
+	if a.Until != "" {
+		fmt.Fprintf(w, " %s %s", labels.text("until"), a.Until)
+	}
+	if a.Reason != "" {
+		fmt.Fprintf(w, " (%s)", a.Reason)
+	}
+	fmt.Fprintln(w)
+}
+
+// printRekor lists the Rekor entries of an image.
+func printRekor(w io.Writer, entries []rekorEntry, labels *outputLabels) {
+	if entries == nil {
+		return
+	}
+	fmt.Fprintf(w, "%s: %d\n", labels.text("Rekor entries"), len(entries))
+	for _, e := range entries {
+		fmt.Fprintf(w, "  %s, %s %d, %s %s", e.Kind, labels.text("log index"), e.LogIndex, labels.text("integrated"), e.IntegratedTime.Format("2006-01-02 15:04:05"))
+		if e.InclusionProof != nil {
+			fmt.Fprintf(w, ", %s %d", labels.text("included in tree of size"), e.InclusionProof.TreeSize)
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+// maxTitleLength is where titles are cut in compact tables.
+const maxTitleLength = 60
+
+func truncate(s string, max int) string {
+	if len([]rune(s)) <= max {
+		return s
+	}
+	return string([]rune(s)[:max-3]) + "..."
+}
+
+// severityRank orders severities from the most severe.
+func severityRank(severity string) int {
+	for i, s := range severities {
+		if s == severity {
+			return i
+		}
+	}
+	return len(severities)
+}
+
+// printTable writes vulnerabilities as a table, with an IMAGE column if
+// withImage is set. Past -max-table-rows, only the most severe rows are kept.
+func printTable(w io.Writer, rows []finding, withImage bool, opts scanOptions) {
+	hidden := 0
+	if opts.maxTableRows > 0 && len(rows) > opts.maxTableRows {
+		rows = append([]finding{}, rows...)
+		sort.SliceStable(rows, func(i, j int) bool { return severityRank(rows[i].vuln.Severity) < severityRank(rows[j].vuln.Severity) })
+		hidden = len(rows) - opts.maxTableRows
+		rows = rows[:opts.maxTableRows]
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	header := "LIBRARY\tVULNERABILITY ID\tSEVERITY\tINSTALLED VERSION\tFIXED VERSION\tTITLE"
+	if opts.exploits {
+		header = "LIBRARY\tVULNERABILITY ID\tSEVERITY\tEPSS\tKEV\tINSTALLED VERSION\tFIXED VERSION\tTITLE"
+	}
+	if withImage {
+		header = "IMAGE\t" + header
+	}
+	fmt.Fprintln(tw, opts.labels.header(header))
+	for _, row := range rows {
+		v := row.vuln
+		if withImage {
+			fmt.Fprintf(tw, "%s\t", row.image)
+		}
+		severity := opts.labels.severity(v.Severity)
+		if opts.exploits {
+			kev := ""
+			if v.KEV {
+				kev = "yes"
+			}
+			severity += fmt.Sprintf("\t%.3f\t%s", v.EPSS, kev)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", v.PkgName, v.VulnerabilityID, severity, v.InstalledVersion, v.FixedVersion, truncate(v.Title, maxTitleLength))
+	}
+	tw.Flush()
+	if hidden > 0 {
+		fmt.Fprintf(w, "... and %d more vulnerabilities, raise -max-table-rows or use -json to see them\n", hidden)
+	}
+}
+
+// printGrouped writes the results of all the images of a chart at once, a
+// summary line per image then a section per severity, per package or per
+// workload. The section of a workload lists its containers, and the findings
+// of the images they run.
+func printGrouped(w io.Writer, result chartResult, opts scanOptions) {
+	heading := opts.labels.text("Images")
+	fmt.Fprintf(w, "%s\n%s\n", heading, strings.Repeat("=", len([]rune(heading))))
+	for _, image := range result.Images {
+		report := image.Report
+		vulns := report.vulnerabilities()
+		counts := countBySeverity(vulns)
+		summary := []string{}
+		for _, severity := range severities {
+			summary = append(summary, fmt.Sprintf("%s: %d", opts.labels.severity(severity), counts[severity]))
+		}
+		fmt.Fprintf(w, "%s (%s)\n", chartImage{Name: report.ArtifactName, Labels: report.Labels}, strings.Join(summary, ", "))
+		if os := report.Metadata.OS; os != nil && os.EOSL {
+			fmt.Fprintf(w, "  %s: %s %s (%s)\n", opts.labels.text("OS"), os.Family, os.Name, opts.labels.text("end of life, no longer receives security updates"))
+		}
+		for _, violation := range report.Violations {
+			fmt.Fprintf(w, "  %s: %s\n", opts.labels.text("Policy violation"), violation)
+		}
+	}
+	groups := map[string][]finding{}
+	containers := map[string][]string{}
+	if opts.groupBy == "workload" {
+		groups, containers = workloadGroups(result)
+	} else {
+		for _, f := range result.findings() {
+			key := f.vuln.Severity
+			if opts.groupBy == "package" {
+				key = f.vuln.PkgName
+			}
+			groups[key] = append(groups[key], f)
+		}
+	}
+	keys := []string{}
+	if opts.groupBy == "severity" {
+		keys = append(keys, severities...)
+	} else {
+		for key := range groups {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+	}
+	for _, key := range keys {
+		rows := groups[key]
+		if len(rows) == 0 {
+			continue
+		}
+		title := fmt.Sprintf("%s (%d)", key, len(rows))
+		if opts.groupBy == "severity" {
+			title = fmt.Sprintf("%s (%d)", opts.labels.severity(key), len(rows))
+		}
+		fmt.Fprintf(w, "\n%s\n%s\n", title, strings.Repeat("=", len(title)))
+		if len(containers[key]) > 0 {
+			fmt.Fprintf(w, "%s: %s\n\n", opts.labels.text("Containers"), strings.Join(containers[key], ", "))
+		}
+		printTable(w, rows, true, opts)
+	}
+	fmt.Fprintln(w)
+}
+
+// noWorkload is the -group-by workload section of the images no workload
+// runs, found in other resources or by extraction rules.
+const noWorkload = "(no workload)"
+
+// workloadGroups returns the findings of each workload, the findings of an
+// image being repeated in every workload running it, and the containers of
+// each workload with their image.
+func workloadGroups(result chartResult) (map[string][]finding, map[string][]string) {
+	groups := map[string][]finding{}
+	containers := map[string][]string{}
+	for _, image := range result.Images {
+		if len(image.Report.Workloads) == 0 {
+			groups[noWorkload] = append(groups[noWorkload], image.findings()...)
+		}
+		for _, workload := range image.Report.Workloads {
+			key := workload.String()
+			for _, c := range workload.Containers {
+				containers[key] = append(containers[key], fmt.Sprintf("%s (%s)", c, image.Scan.Image))
+			}
+			groups[key] = append(groups[key], image.findings()...)
+		}
+	}
+	return groups, containers
+}
+
+// validateGroupBy checks the value of -group-by.
+func validateGroupBy(groupBy string) error {
+	switch groupBy {
+	case "image", "severity", "package", "workload":
+		return nil
+	}
+	return fmt.Errorf("unknown grouping %v, expected image, severity, package or workload", groupBy)
+}
+
+// printDetails writes everything known about each vulnerability, for audits.
+func printDetails(w io.Writer, vulns []trivyVulnerability, opts scanOptions) {
+	// field starts the line of a field, its value aligned with the others.
+	field := func(name string) string {
+		return fmt.Sprintf("  %-10s ", opts.labels.text(name)+":")
+	}
+	for _, v := range vulns {
+		fmt.Fprintf(w, "%s (%s)\n", v.VulnerabilityID, opts.labels.severity(v.Severity))
+		if v.OriginalSeverity != "" {
+			fmt.Fprintf(w, "%s%s, %s %s\n", field("Severity"), opts.labels.severity(v.Severity), opts.labels.severity(v.OriginalSeverity), opts.labels.text("according to trivy"))
+		}
+		fmt.Fprintf(w, "%s%s %s\n", field("Package"), v.PkgName, v.InstalledVersion)
+		if v.FixedVersion != "" {
+			fmt.Fprintf(w, "%s%s\n", field("Fixed in"), v.FixedVersion)
+		}
+		if v.Title != "" {
+			fmt.Fprintf(w, "%s%s\n", field("Title"), v.Title)
+		}
+		if v.PrimaryURL != "" {
+			fmt.Fprintf(w, "%s%s\n", field("URL"), v.PrimaryURL)
+		}
+		if vector, score := v.cvss(); vector != "" {
+			fmt.Fprintf(w, "%s%.1f %s\n", field("CVSS"), score, vector)
+		}
+		if v.PublishedDate != "" {
+			fmt.Fprintf(w, "%s%s\n", field("Published"), v.PublishedDate)
+		}
+		if opts.exploits {
+			fmt.Fprintf(w, "%s%.3f\n", field("EPSS"), v.EPSS)
+			fmt.Fprintf(w, "%s%v\n", field("Known exploited"), v.KEV)
+		}
+		if v.Description != "" {
+			fmt.Fprintf(w, "  %s\n", strings.Replace(strings.TrimSpace(v.Description), "\n", "\n  ", -1))
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+// eolImages returns the images whose OS no longer receives security updates.
+func eolImages(reports []trivyReport) []trivyReport {
+	eol := []trivyReport{}
+	for _, report := range reports {
+		if report.Metadata.OS != nil && report.Metadata.OS.EOSL {
+			eol = append(eol, report)
+		}
+	}
+	return eol
+}
+
+// eolSummary sums up the images of a chart running an end of life OS, their
+// vulnerabilities won't get fixed until the base image is changed.
+func eolSummary(reports []trivyReport) string {
+	eol := eolImages(reports)
+	if len(eol) == 0 {
+		return ""
+	}
+	images := []string{}
+	for _, report := range eol {
+		os := report.Metadata.OS
+		images = append(images, fmt.Sprintf("%s (%s %s)", report.ArtifactName, os.Family, os.Name))
+	}
+	return fmt.Sprintf("%d of %d images run an end of life OS: %s", len(eol), len(reports), strings.Join(images, ", "))
+}
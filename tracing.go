@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// traceparentPattern is the W3C traceparent of TRACEPARENT, set by CI
+// systems tracing their pipelines, which the traces of helm-trivy join.
+var traceparentPattern = regexp.MustCompile(`^[0-9a-f]{2}-([0-9a-f]{32})-([0-9a-f]{16})-[0-9a-f]{2}$`)
+
+// tracer exports the spans of the scan pipeline to an OpenTelemetry
+// collector, with OTLP over HTTP in its JSON encoding. It is configured with
+// the environment variables of the OpenTelemetry SDKs. A nil tracer traces
+// nothing.
+type tracer struct {
+	endpoint string
+	headers  map[string]string
+	resource []otlpAttribute
+	client   *http.Client
+	traceID  string
+	parentID string
+	mu       sync.Mutex
+	open     map[*traceSpan]bool
+	ended    []otlpSpan
+}
+
+// traceSpan is a span of a trace. A nil traceSpan records nothing.
+type traceSpan struct {
+	tracer     *tracer
+	traceID    string
+	spanID     string
+	parentID   string
+	root       bool
+	name       string
+	start      time.Time
+	attributes []otlpAttribute
+}
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+	BoolValue   *bool   `json:"boolValue,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+// otlpStatusError is the status code of the spans of failed steps.
+const otlpStatusError = 2
+
+// newAttribute returns an attribute of a string, int or bool value, others
+// being formatted as strings.
+func newAttribute(key string, value interface{}) otlpAttribute {
+	a := otlpAttribute{Key: key}
+	switch v := value.(type) {
+	case int:
+		s := strconv.Itoa(v)
+		a.Value.IntValue = &s
+	case bool:
+		a.Value.BoolValue = &v
+	default:
+		s := fmt.Sprint(v)
+		a.Value.StringValue = &s
+	}
+	return a
+}
+
+// otelList parses the comma separated key=value lists of OTEL_RESOURCE_ATTRIBUTES
+// and OTEL_EXPORTER_OTLP_HEADERS, whose values are URL encoded.
+func otelList(list string) (map[string]string, error) {
+	values := map[string]string{}
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("invalid item %q, expected key=value", item)
+		}
+		value, err := url.QueryUnescape(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid item %q: %v", item, err)
+		}
+		values[strings.TrimSpace(parts[0])] = value
+	}
+	return values, nil
+}
+
+// newTracer returns the tracer configured by the OTLP environment variables,
+// nil when no OTLP endpoint is set or tracing is disabled.
+func newTracer() (*tracer, error) {
+	if strings.EqualFold(os.Getenv("OTEL_SDK_DISABLED"), "true") {
+		return nil, nil
+	}
+	if exporter := os.Getenv("OTEL_TRACES_EXPORTER"); exporter != "" && exporter != "otlp" {
+		return nil, nil
+	}
+	endpoint := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if endpoint == "" {
+		if endpoint = os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); endpoint == "" {
+			return nil, nil
+		}
+		endpoint = strings.TrimSuffix(endpoint, "/") + "/v1/traces"
+	}
+	protocol := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_PROTOCOL")
+	if protocol == "" {
+		protocol = os.Getenv("OTEL_EXPORTER_OTLP_PROTOCOL")
+	}
+	if protocol == "grpc" {
+		return nil, fmt.Errorf("OTLP over gRPC is not supported, use the OTLP/HTTP endpoint of the collector")
+	}
+	t := &tracer{endpoint: endpoint, headers: map[string]string{}, client: &http.Client{Timeout: 10 * time.Second}, open: map[*traceSpan]bool{}}
+	for _, name := range []string{"OTEL_EXPORTER_OTLP_HEADERS", "OTEL_EXPORTER_OTLP_TRACES_HEADERS"} {
+		headers, err := otelList(os.Getenv(name))
+		if err != nil {
+			return nil, fmt.Errorf("invalid %v: %v", name, err)
+		}
+		for key, value := range headers {
+			t.headers[key] = value
+			addSecrets(value)
+		}
+	}
+	for _, name := range []string{"OTEL_EXPORTER_OTLP_TIMEOUT", "OTEL_EXPORTER_OTLP_TRACES_TIMEOUT"} {
+		if timeout := os.Getenv(name); timeout != "" {
+			ms, err := strconv.Atoi(timeout)
+			if err != nil || ms <= 0 {
+				return nil, fmt.Errorf("invalid %v %v, expected milliseconds", name, timeout)
+			}
+			t.client.Timeout = time.Duration(ms) * time.Millisecond
+		}
+	}
+	attributes, err := otelList(os.Getenv("OTEL_RESOURCE_ATTRIBUTES"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid OTEL_RESOURCE_ATTRIBUTES: %v", err)
+	}
+	if service := os.Getenv("OTEL_SERVICE_NAME"); service != "" {
+		attributes["service.name"] = service
+	} else if attributes["service.name"] == "" {
+		attributes["service.name"] = "helm-trivy"
+	}
+	keys := []string{}
+	for key := range attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		t.resource = append(t.resource, newAttribute(key, attributes[key]))
+	}
+	if m := traceparentPattern.FindStringSubmatch(os.Getenv("TRACEPARENT")); m != nil {
+		t.traceID, t.parentID = m[1], m[2]
+	}
+	log.Debugf("Exporting traces to %v", endpoint)
+	return t, nil
+}
+
+// randomID returns a random trace or span ID of n bytes.
+func randomID(n int) string {
+	id := make([]byte, n)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// start starts a span of parent, or the root span of a new trace when
+// parent is nil. Root spans join the trace of TRACEPARENT when it is set.
+func (t *tracer) start(parent *traceSpan, name string) *traceSpan {
+	if t == nil {
+		return nil
+	}
+	s := &traceSpan{tracer: t, spanID: randomID(8), name: name, start: time.Now()}
+	if parent != nil {
+		s.traceID, s.parentID = parent.traceID, parent.spanID
+	} else {
+		s.traceID, s.parentID, s.root = t.traceID, t.parentID, true
+		if s.traceID == "" {
+			s.traceID = randomID(16)
+		}
+	}
+	t.mu.Lock()
+	t.open[s] = true
+	t.mu.Unlock()
+	return s
+}
+
+// startSpan starts a span of the current span of opts.
+func startSpan(opts scanOptions, name string) *traceSpan {
+	return opts.tracer.start(opts.span, name)
+}
+
+// set sets an attribute of the span.
+func (s *traceSpan) set(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.tracer.mu.Lock()
+	defer s.tracer.mu.Unlock()
+	s.attributes = append(s.attributes, newAttribute(key, value))
+}
+
+// end ends the span, failed when err is not nil. Ending a root span
+// exports its trace.
+func (s *traceSpan) end(err error) {
+	if s == nil {
+		return
+	}
+	t := s.tracer
+	t.mu.Lock()
+	if !t.open[s] {
+		t.mu.Unlock()
+		return
+	}
+	delete(t.open, s)
+	span := otlpSpan{
+		TraceID:           s.traceID,
+		SpanID:            s.spanID,
+		ParentSpanID:      s.parentID,
+		Name:              s.name,
+		Kind:              1,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(time.Now().UnixNano(), 10),
+		Attributes:        s.attributes,
+	}
+	if err != nil {
+		span.Status = otlpStatus{Code: otlpStatusError, Message: redact(err.Error())}
+	}
+	t.ended = append(t.ended, span)
+	t.mu.Unlock()
+	if s.root {
+		t.flush()
+	}
+}
+
+// close ends the spans still open when helm-trivy exits with status, failed
+// unless it is 0, and exports them.
+func (t *tracer) close(status int) {
+	if t == nil {
+		return
+	}
+	var err error
+	if status != exitOK {
+		err = fmt.Errorf("exit status %d", status)
+	}
+	t.mu.Lock()
+	open := []*traceSpan{}
+	for s := range t.open {
+		open = append(open, s)
+	}
+	t.mu.Unlock()
+	// Children end before their parents.
+	for len(open) > 0 {
+		for i, s := range open {
+			if !hasChild(s, open) {
+				s.end(err)
+				open = append(open[:i], open[i+1:]...)
+				break
+			}
+		}
+	}
+	t.flush()
+}
+
+// hasChild tells whether one of spans is a child of s.
+func hasChild(s *traceSpan, spans []*traceSpan) bool {
+	for _, other := range spans {
+		if other.parentID == s.spanID && other.traceID == s.traceID {
+			return true
+		}
+	}
+	return false
+}
+
+// flush exports the ended spans. Export errors are logged, tracing should
+// never fail a scan.
+func (t *tracer) flush() {
+	t.mu.Lock()
+	spans := t.ended
+	t.ended = nil
+	t.mu.Unlock()
+	if len(spans) == 0 {
+		return
+	}
+	payload := map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{"attributes": t.resource},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "helm-trivy"},
+				"spans": spans,
+			}},
+		}},
+	}
+	if err := t.export(payload); err != nil {
+		log.Warnf("Could not export %d spans to %v: %v", len(spans), t.endpoint, err)
+	}
+}
+
+// export posts an OTLP payload to the collector.
+func (t *tracer) export(payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, t.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range t.headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%v: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+)
+
+// Trivy releases helm-trivy was tested with, older and newer ones get a
+// warning.
+const (
+	oldestTestedTrivy = "0.20"
+	newestTestedTrivy = "0.56"
+)
+
+// trivyRenamedFlags lists the trivy flags renamed along its releases: their
+// name since a release, and before.
+var trivyRenamedFlags = []struct {
+	since  string
+	flag   string
+	before string
+}{
+	{"0.37", "--scanners", "--security-checks"},
+	{"0.48", "--skip-db-update", "--skip-update"},
+	{"0.50", "--pkg-types", "--vuln-type"},
+}
+
+// trivyAddedFlags lists the boolean trivy flags that older releases don't
+// know, and can do without.
+var trivyAddedFlags = []struct {
+	since string
+	flag  string
+}{
+	{"0.23", "--offline-scan"},
+	{"0.37", "--skip-java-db-update"},
+}
+
+// trivyImageCommand is the release images are scanned with the image
+// subcommand since, instead of the root command.
+const trivyImageCommand = "0.20"
+
+// trivyBefore tells whether version is older than release, unknown versions
+// being taken for the latest one.
+func trivyBefore(version string, release string) bool {
+	v, _ := tagVersion(version)
+	r, _ := tagVersion(release)
+	return len(v) > 0 && compareVersions(v, r) < 0
+}
+
+// detectTrivyVersion returns the version of the trivy image, empty if it
+// can't be told, and warns when it wasn't tested.
+func detectTrivyVersion(ctx context.Context, backend scanBackend, opts scanOptions) string {
+	info, err := scannerInfo(ctx, backend, opts)
+	if err != nil || info.Trivy == "" {
+		log.Warnf("Could not get trivy version, using the flags of the latest release: %v", err)
+		return ""
+	}
+	log.Debugf("Using trivy %v", info.Trivy)
+	newest, _ := tagVersion(newestTestedTrivy)
+	version, _ := tagVersion(info.Trivy)
+	if trivyBefore(info.Trivy, oldestTestedTrivy) || (len(version) >= 2 && compareVersions(version[:2], newest) > 0) {
+		log.Warnf("Trivy %v was not tested with helm-trivy, which supports %v to %v", info.Trivy, oldestTestedTrivy, newestTestedTrivy)
+	}
+	return info.Trivy
+}
+
+// trivyCommand adapts the trivy arguments of a scan, written for the latest
+// release, to the one of version: renamed flags get their former name and
+// the flags it doesn't know are left out. Its JSON output needs no change,
+// parseTrivyOutput reads both of its schemas.
+func trivyCommand(args []string, version string) []string {
+	cmd := []string{}
+	if !trivyBefore(version, trivyImageCommand) {
+		cmd = append(cmd, "image")
+	}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		dropped := false
+		for _, added := range trivyAddedFlags {
+			dropped = dropped || (arg == added.flag && trivyBefore(version, added.since))
+		}
+		if dropped {
+			continue
+		}
+		for _, renamed := range trivyRenamedFlags {
+			if arg == renamed.flag && trivyBefore(version, renamed.since) {
+				arg = renamed.before
+			}
+		}
+		cmd = append(cmd, arg)
+		// The misconfiguration scanner was called config.
+		if arg == "--security-checks" && i+1 < len(args) {
+			i++
+			checks := strings.Split(args[i], ",")
+			for j, check := range checks {
+				if check == "misconfig" {
+					checks[j] = "config"
+				}
+			}
+			cmd = append(cmd, strings.Join(checks, ","))
+		}
+	}
+	return cmd
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// releaseData runs helm get on release, what being values or manifest.
+func releaseData(what string, release string, opts scanOptions) ([]byte, error) {
+	if opts.releaseStorage == "secret" || opts.releaseStorage == "configmap" {
+		return storedReleaseData(what, release, opts)
+	}
+	cmd := []string{"get", what, release}
+	if what == "values" {
+		cmd = append(cmd, "--output", "yaml")
+	}
+	if opts.namespace != "" {
+		cmd = append(cmd, "--namespace", opts.namespace)
+	}
+	cmd = helmClusterArgs(cmd...)
+	log.Debugf("Running helm cmd: helm %v", redactArgs(cmd))
+	out, err := exec.Command("helm", cmd...).Output()
+	if exitErr, ok := err.(*exec.ExitError); ok && len(exitErr.Stderr) > 0 {
+		err = fmt.Errorf("%v: %s", err, bytes.TrimSpace(exitErr.Stderr))
+	}
+	return out, err
+}
+
+// writeTempFile writes data to a new temporary file and returns its name.
+func writeTempFile(pattern string, data []byte) (string, error) {
+	f, err := ioutil.TempFile("", pattern)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// releaseValuesFile writes the user-supplied values of release to a
+// temporary file and returns its name.
+func releaseValuesFile(release string, opts scanOptions) (string, error) {
+	values, err := releaseData("values", release, opts)
+	if err != nil {
+		return "", fmt.Errorf("could not get values of release %v: %v", release, err)
+	}
+	file, err := writeTempFile("helm-trivy-values", values)
+	if err != nil {
+		return "", fmt.Errorf("could not write values of release %v: %v", release, err)
+	}
+	return file, nil
+}
+
+func upgradeCheckMain(args []string) {
+	var opts scanOptions
+
+	fs := flag.NewFlagSet("upgrade-check", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: helm trivy upgrade-check [options] <release> <helm chart>\n")
+		fmt.Fprintf(fs.Output(), "Example: helm trivy upgrade-check -namespace db -version 12.0.0 mariadb stable/mariadb\n\n")
+		fmt.Fprintf(fs.Output(), "Options:\n")
+		fs.PrintDefaults()
+	}
+	fs.BoolVar(&opts.json, "json", false, "Enable JSON output")
+	fs.StringVar(&opts.namespace, "namespace", os.Getenv("HELM_NAMESPACE"), "Namespace of the release, defaults to $HELM_NAMESPACE, the one of the current context if empty")
+	fs.StringVar(&opts.releaseStorage, "release-storage", "helm", "Where releases are read from: helm (helm list and helm get), or the release secret or configmap objects of helm, only needing read access to them")
+	addScannerFlags(fs, &opts)
+	addChartFlags(fs, &opts)
+	addPolicyFlags(fs, &opts)
+	fs.Parse(args)
+	opts.setFlags = setFlags(fs)
+
+	if fs.NArg() != 2 {
+		fmt.Fprintf(os.Stderr, "Error: A release and a chart are needed.\n")
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	if err := validateReleaseStorage(opts.releaseStorage); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v.\n", err)
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	release, chart := fs.Arg(0), fs.Arg(1)
+
+	ctx, backend, cleanup := setupScanner(&opts)
+	defer cleanup()
+	cleanupValues, err := fetchValues(&opts)
+	if err != nil {
+		fatal(exitRender, opts, "%v", err)
+	}
+	defer cleanupValues()
+
+	version, err := resolveChartVersion(chart, opts)
+	if err != nil {
+		fatal(exitRender, opts, "%v", err)
+	}
+	opts.chartVersion = version
+
+	valuesFile, err := releaseValuesFile(release, opts)
+	if err != nil {
+		fatal(exitRender, opts, "%v", err)
+	}
+	defer os.Remove(valuesFile)
+	manifest, err := releaseData("manifest", release, opts)
+	if err != nil {
+		fatal(exitRender, opts, "Could not get manifest of release %v: %v", release, err)
+	}
+	manifestFile, err := writeTempFile("helm-trivy-manifest", manifest)
+	if err != nil {
+		fatal(exitBackend, opts, "Could not write manifest of release %v: %v", release, err)
+	}
+	defer os.Remove(manifestFile)
+
+	deployedOpts := opts
+	deployedOpts.manifestFiles = stringList{manifestFile}
+	deployedScans, err := scanChart(release, ctx, backend, deployedOpts, nil)
+	if err != nil {
+		fatal(exitCode(err), opts, "Could not scan release %v: %v", release, err)
+	}
+
+	// The release values come first, like helm upgrade --reuse-values does
+	// with the values given along.
+	upgradeOpts := opts
+	upgradeOpts.templateValues = valuesFile
+	if opts.templateValues != "" {
+		upgradeOpts.templateValues += "," + opts.templateValues
+	}
+	upgradeScans, err := scanChart(chart, ctx, backend, upgradeOpts, nil)
+	if err != nil {
+		fatal(exitCode(err), opts, "Could not scan chart %v: %v", chart, err)
+	}
+
+	weights, _ := parseRiskWeights(opts.riskWeights)
+	deployed := summarizeScans("release "+release, deployedScans, weights)
+	target := "chart " + chart
+	if opts.chartVersion != "" {
+		target += " " + opts.chartVersion
+	}
+	upgrade := summarizeScans(target, upgradeScans, weights)
+	diffMatrixResults(&upgrade, deployed)
+	if err := printMatrix(os.Stdout, []matrixResult{deployed, upgrade}, opts); err != nil {
+		fatal(exitPartial, opts, "%v", err)
+	}
+	if len(upgrade.AddedVulnerabilities) > 0 || hasViolations(upgradeScans) {
+		exit(exitFindings, opts)
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// valuesImage is an image set through chart values, either as a single
+// string or as a map with registry, repository and tag keys.
+type valuesImage struct {
+	Path []string
+	Ref  imageRef
+	// Split is true when the tag has a value of its own.
+	Split bool
+}
+
+// chartValues returns the default values of chart, merged with the user
+// values file when there is a local one.
+func chartValues(chart string, opts scanOptions) (map[string]interface{}, error) {
+	cmd := []string{"show", "values"}
+	if len(opts.chartVersion) > 0 {
+		cmd = append(cmd, "--version", opts.chartVersion)
+	}
+	cmd = append(cmd, chartArgs(chart, opts)...)
+	out, err := runHelm(cmd, opts)
+	if err != nil {
+		return nil, err
+	}
+	values := map[string]interface{}{}
+	if err := yaml.Unmarshal(out, &values); err != nil {
+		return nil, fmt.Errorf("invalid chart values: %v", err)
+	}
+	for _, file := range valuesFiles(opts.templateValues) {
+		if strings.Contains(file, "://") {
+			continue
+		}
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		docs, err := valuesDocuments(data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid values file %v: %v", file, err)
+		}
+		for _, doc := range docs {
+			user := map[string]interface{}{}
+			if err := doc.Decode(&user); err != nil {
+				return nil, fmt.Errorf("invalid values file %v: %v", file, err)
+			}
+			mergeValues(values, user)
+		}
+	}
+	return values, nil
+}
+
+// valuesFiles splits the comma separated values files of -values.
+func valuesFiles(values string) []string {
+	files := []string{}
+	for _, file := range strings.Split(values, ",") {
+		if file = strings.TrimSpace(file); file != "" {
+			files = append(files, file)
+		}
+	}
+	return files
+}
+
+// valuesDocuments returns the non-empty documents of a values file.
+func valuesDocuments(data []byte) ([]*yaml.Node, error) {
+	docs := []*yaml.Node{}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	for {
+		var doc yaml.Node
+		err := decoder.Decode(&doc)
+		if err == io.EOF {
+			return docs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(doc.Content) > 0 && doc.Content[0].Tag != "!!null" {
+			docs = append(docs, &doc)
+		}
+	}
+}
+
+// splitHeader splits a -values-header into its name and value.
+func splitHeader(header string) (string, string, bool) {
+	parts := strings.SplitN(header, ":", 2)
+	if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+		return "", "", false
+	}
+	return strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]), true
+}
+
+// credentialHeader tells whether the value of a header is a credential to
+// mask.
+func credentialHeader(name string) bool {
+	name = strings.ToUpper(name)
+	return strings.Contains(name, "AUTH") || strings.Contains(name, "TOKEN") || strings.Contains(name, "KEY") || strings.Contains(name, "SECRET")
+}
+
+// validateValuesHeaders checks the format of the -values-header flags.
+func validateValuesHeaders(headers []string) error {
+	for _, header := range headers {
+		if _, _, ok := splitHeader(header); !ok {
+			return fmt.Errorf("invalid values header %v, expected 'Name: value'", header)
+		}
+	}
+	return nil
+}
+
+// downloadValues fetches a values URL with the -values-header headers and
+// the -values-token bearer token.
+func downloadValues(u string, opts scanOptions) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, header := range opts.valuesHeaders {
+		name, value, _ := splitHeader(header)
+		req.Header.Add(name, value)
+	}
+	if opts.valuesToken != "" {
+		req.Header.Set("Authorization", "Bearer "+opts.valuesToken)
+	}
+	// The query of presigned URLs is a credential.
+	name := strings.SplitN(u, "?", 2)[0]
+	log.Debugf("Fetching values %v", name)
+	resp, err := registryClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch values %v: %v", name, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("could not fetch values %v: %v", name, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// fetchValues downloads the http(s) values URLs of -values and splits the
+// multi-document values files, helm only reading their first document, into
+// temporary files replacing them in -values, in the same order. Other URLs
+// are left to helm. The returned function removes the temporary files.
+func fetchValues(opts *scanOptions) (func(), error) {
+	cleanup := func() {}
+	if opts.templateValues == "" {
+		return cleanup, nil
+	}
+	if err := validateValuesHeaders(opts.valuesHeaders); err != nil {
+		return cleanup, err
+	}
+	dir := ""
+	files := []string{}
+	for _, file := range valuesFiles(opts.templateValues) {
+		remote := strings.HasPrefix(file, "http://") || strings.HasPrefix(file, "https://")
+		if !remote && strings.Contains(file, "://") {
+			files = append(files, file)
+			continue
+		}
+		var data []byte
+		var err error
+		if remote {
+			data, err = downloadValues(file, *opts)
+		} else {
+			data, err = ioutil.ReadFile(file)
+		}
+		if err != nil {
+			return cleanup, err
+		}
+		docs, err := valuesDocuments(data)
+		if err != nil {
+			return cleanup, fmt.Errorf("invalid values file %v: %v", strings.SplitN(file, "?", 2)[0], err)
+		}
+		if !remote && len(docs) < 2 {
+			files = append(files, file)
+			continue
+		}
+		if dir == "" {
+			if dir, err = ioutil.TempDir("", "helm-trivy-values"); err != nil {
+				return cleanup, err
+			}
+			cleanup = atExit(func() { os.RemoveAll(dir) })
+		}
+		for _, doc := range docs {
+			out, err := yaml.Marshal(doc)
+			if err != nil {
+				return cleanup, err
+			}
+			path := filepath.Join(dir, fmt.Sprintf("values-%d.yaml", len(files)))
+			if err := ioutil.WriteFile(path, out, 0600); err != nil {
+				return cleanup, err
+			}
+			files = append(files, path)
+		}
+	}
+	opts.valuesSources = opts.templateValues
+	opts.templateValues = strings.Join(files, ",")
+	return cleanup, nil
+}
+
+// mergeValues merges src into dst the way helm merges values files.
+func mergeValues(dst map[string]interface{}, src map[string]interface{}) {
+	for key, value := range src {
+		srcMap, srcOk := value.(map[string]interface{})
+		dstMap, dstOk := dst[key].(map[string]interface{})
+		if srcOk && dstOk {
+			mergeValues(dstMap, srcMap)
+		} else {
+			dst[key] = value
+		}
+	}
+}
+
+// setValue sets the value at path, creating intermediate maps.
+func setValue(values map[string]interface{}, path []string, value interface{}) {
+	for _, key := range path[:len(path)-1] {
+		next, ok := values[key].(map[string]interface{})
+		if !ok {
+			next = map[string]interface{}{}
+			values[key] = next
+		}
+		values = next
+	}
+	values[path[len(path)-1]] = value
+}
+
+func copyPath(path []string, key string) []string {
+	return append(append([]string{}, path...), key)
+}
+
+// findValuesImages walks values looking for the usual ways charts let users
+// set images.
+func findValuesImages(values map[string]interface{}, path []string) []valuesImage {
+	images := []valuesImage{}
+	if repository, ok := values["repository"].(string); ok && repository != "" {
+		image := repository
+		if registry, ok := values["registry"].(string); ok && registry != "" {
+			image = registry + "/" + repository
+		}
+		if tag := fmt.Sprint(values["tag"]); values["tag"] != nil && tag != "" {
+			image += ":" + tag
+		}
+		images = append(images, valuesImage{Path: path, Ref: parseImageRef(image), Split: true})
+	}
+	for key, value := range values {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			images = append(images, findValuesImages(v, copyPath(path, key))...)
+		case string:
+			if key == "image" && imagePattern.MatchString(v) {
+				images = append(images, valuesImage{Path: copyPath(path, key), Ref: parseImageRef(v)})
+			}
+		}
+	}
+	return images
+}
+
+// imageValues returns where in values the given rendered image is set, the
+// repositories have to match.
+func imageValues(images []valuesImage, image string) (valuesImage, bool) {
+	name := parseImageRef(image).Name()
+	for _, v := range images {
+		if v.Ref.Name() == name {
+			return v, true
+		}
+	}
+	return valuesImage{}, false
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// chartVerification is the result of the -verify-chart check of a chart.
+type chartVerification struct {
+	Verified bool   `json:"verified"`
+	Method   string `json:"method"`
+	Signer   string `json:"signer,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+func (v chartVerification) String() string {
+	if !v.Verified {
+		return fmt.Sprintf("Chart %s verification failed: %s", v.Method, v.Error)
+	}
+	if v.Signer != "" {
+		return fmt.Sprintf("Chart %s verified, signed by %s", v.Method, v.Signer)
+	}
+	return fmt.Sprintf("Chart %s verified", v.Method)
+}
+
+// defaultKeyring is the keyring helm verifies provenance files with.
+func defaultKeyring() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".gnupg", "pubring.gpg")
+}
+
+// verifyChart checks the chart is signed before it is rendered: OCI charts
+// with their cosign signature, packaged and repository charts with their
+// provenance file.
+func verifyChart(chart string, opts scanOptions) chartVerification {
+	var cmd *exec.Cmd
+	v := chartVerification{Method: "provenance"}
+	if strings.HasPrefix(chart, "oci://") {
+		v.Method = "signature"
+		if opts.cosignKey == "" {
+			v.Error = "OCI charts need -cosign-key"
+			return v
+		}
+		ref := strings.TrimPrefix(chart, "oci://")
+		if opts.chartVersion != "" {
+			ref += ":" + opts.chartVersion
+		}
+		cmd = exec.Command("cosign", "verify", "--key", opts.cosignKey, ref)
+		v.Signer = opts.cosignKey
+	} else if info, err := os.Stat(chart); err == nil && info.IsDir() {
+		v.Error = "unpackaged charts have no provenance file"
+		return v
+	} else if err == nil {
+		cmd = exec.Command("helm", "verify", "--keyring", opts.keyring, "--", chart)
+	} else {
+		dir, err := ioutil.TempDir("", "helm-trivy-verify")
+		if err != nil {
+			v.Error = err.Error()
+			return v
+		}
+		defer os.RemoveAll(dir)
+		args := []string{"pull", "--verify", "--keyring", opts.keyring, "--destination", dir}
+		if opts.chartVersion != "" {
+			args = append(args, "--version", opts.chartVersion)
+		}
+		cmd = exec.Command("helm", append(args, chartArgs(chart, opts)...)...)
+	}
+	log.Debugf("Verifying chart: %v", redactArgs(cmd.Args))
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		v.Error = strings.TrimSpace(string(out))
+		if v.Error == "" {
+			v.Error = err.Error()
+		}
+		return v
+	}
+	v.Verified = true
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		if line := scanner.Text(); strings.HasPrefix(line, "Signed by: ") {
+			v.Signer = strings.TrimPrefix(line, "Signed by: ")
+		}
+	}
+	return v
+}
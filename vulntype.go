@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// vulnTypes are the package types of -vuln-type: OS packages and application
+// libraries.
+var vulnTypes = []string{"os", "library"}
+
+// osFamilies are the trivy result types of OS packages, for trivy releases
+// not setting the result class.
+var osFamilies = map[string]bool{
+	"alpine": true, "alma": true, "amazon": true, "cbl-mariner": true, "centos": true,
+	"chainguard": true, "debian": true, "fedora": true, "opensuse.leap": true,
+	"opensuse.tumbleweed": true, "oracle": true, "photon": true, "redhat": true,
+	"rocky": true, "suse linux enterprise server": true, "ubuntu": true, "wolfi": true,
+}
+
+// vulnType returns the package type of the vulnerabilities of a result of
+// the report.
+func (r trivyReport) vulnType(result trivyResult) string {
+	switch result.Class {
+	case "os-pkgs":
+		return "os"
+	case "lang-pkgs":
+		return "library"
+	}
+	if osFamilies[strings.ToLower(result.Type)] {
+		return "os"
+	}
+	if os := r.Metadata.OS; os != nil && strings.EqualFold(result.Type, os.Family) {
+		return "os"
+	}
+	return "library"
+}
+
+// gatedTypes returns the package types of the comma separated types, all of
+// them if empty.
+func gatedTypes(types string) map[string]bool {
+	if types == "" {
+		types = strings.Join(vulnTypes, ",")
+	}
+	gated := map[string]bool{}
+	for _, t := range strings.Split(types, ",") {
+		gated[strings.ToLower(strings.TrimSpace(t))] = true
+	}
+	return gated
+}
+
+// gatedVulnerabilities returns the vulnerabilities of the package types of
+// the comma separated types, the ones failing checks. The others are only
+// reported.
+func (r trivyReport) gatedVulnerabilities(types string) []trivyVulnerability {
+	gated := gatedTypes(types)
+	vulns := []trivyVulnerability{}
+	for _, result := range r.Results {
+		if gated[r.vulnType(result)] {
+			vulns = append(vulns, result.Vulnerabilities...)
+		}
+	}
+	return vulns
+}
+
+// validateVulnTypes checks the value of -vuln-type.
+func validateVulnTypes(types string) error {
+	if types == "" {
+		return nil
+	}
+	for _, t := range strings.Split(types, ",") {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t != "os" && t != "library" {
+			return fmt.Errorf("unknown vulnerability type %q, expected os or library", t)
+		}
+	}
+	return nil
+}
+
+// vulnTypeSummary sums up the vulnerabilities of a chart by package type,
+// telling which types are only reported.
+func vulnTypeSummary(reports []trivyReport, types string) string {
+	counts := map[string]map[string]int{}
+	for _, report := range reports {
+		for _, result := range report.Results {
+			t := report.vulnType(result)
+			if counts[t] == nil {
+				counts[t] = map[string]int{}
+			}
+			for _, v := range result.Vulnerabilities {
+				counts[t][v.Severity]++
+			}
+		}
+	}
+	gated := gatedTypes(types)
+	parts := []string{}
+	for _, t := range vulnTypes {
+		total := 0
+		bySeverity := []string{}
+		for _, severity := range severities {
+			total += counts[t][severity]
+			bySeverity = append(bySeverity, fmt.Sprintf("%s: %d", severity, counts[t][severity]))
+		}
+		part := fmt.Sprintf("%s %d (%s)", t, total, strings.Join(bySeverity, ", "))
+		if !gated[t] {
+			part += " reported only"
+		}
+		parts = append(parts, part)
+	}
+	return "Vulnerabilities by package type: " + strings.Join(parts, ", ")
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+)
+
+// The admission types below only carry the fields the webhook uses, they
+// follow admission.k8s.io/v1.
+type admissionReview struct {
+	APIVersion string             `json:"apiVersion"`
+	Kind       string             `json:"kind"`
+	Request    *admissionRequest  `json:"request,omitempty"`
+	Response   *admissionResponse `json:"response,omitempty"`
+}
+
+type admissionRequest struct {
+	UID       string          `json:"uid"`
+	Namespace string          `json:"namespace"`
+	Name      string          `json:"name"`
+	Object    json.RawMessage `json:"object"`
+}
+
+type admissionStatus struct {
+	Message string `json:"message"`
+}
+
+type admissionResponse struct {
+	UID      string           `json:"uid"`
+	Allowed  bool             `json:"allowed"`
+	Result   *admissionStatus `json:"status,omitempty"`
+	Warnings []string         `json:"warnings,omitempty"`
+}
+
+// webhookPolicy decides which scan results get a workload denied.
+// failurePolicy, Fail or Ignore like the one of the webhook configuration,
+// decides whether objects whose images can't be found are denied.
+type webhookPolicy struct {
+	severities     []string
+	maxFindings    int
+	denyUnscanned  bool
+	renderReleases bool
+	renderTimeout  time.Duration
+	failurePolicy  string
+	cacheTTL       time.Duration
+}
+
+// webhookResult is the severity counts of a scanned image.
+type webhookResult struct {
+	counts  map[string]int
+	scanned time.Time
+}
+
+// webhook validates workloads against the scan results of their images.
+// Images seen for the first time are scanned in the background, admission
+// requests never wait for trivy.
+type webhook struct {
+	ctx     context.Context
+	backend scanBackend
+	opts    scanOptions
+	policy  webhookPolicy
+
+	mu      sync.Mutex
+	results map[string]webhookResult
+	pending map[string]bool
+	queue   chan string
+}
+
+func newWebhook(ctx context.Context, backend scanBackend, opts scanOptions, policy webhookPolicy) *webhook {
+	return &webhook{
+		ctx:     ctx,
+		backend: backend,
+		opts:    opts,
+		policy:  policy,
+		results: map[string]webhookResult{},
+		pending: map[string]bool{},
+		queue:   make(chan string, 1000),
+	}
+}
+
+func (wh *webhook) work() {
+	for image := range wh.queue {
+		counts, err := wh.scan(image)
+		wh.mu.Lock()
+		delete(wh.pending, image)
+		if err != nil {
+			log.Errorf("Could not scan image %v: %v", image, err)
+		} else {
+			wh.results[image] = webhookResult{counts: counts, scanned: time.Now()}
+		}
+		wh.mu.Unlock()
+	}
+}
+
+func (wh *webhook) scan(image string) (map[string]int, error) {
+	report, err := scanImageCached(image, wh.ctx, wh.backend, wh.opts)
+	if err != nil {
+		return nil, err
+	}
+	return countBySeverity(report.gatedVulnerabilities(wh.opts.vulnType)), nil
+}
+
+// lookup returns the cached severity counts of image, queueing a scan when
+// there are none yet or they are older than the cache TTL. Expired counts are
+// still used until the image is scanned again.
+func (wh *webhook) lookup(image string) (map[string]int, bool) {
+	wh.mu.Lock()
+	defer wh.mu.Unlock()
+	result, ok := wh.results[image]
+	if ok && (wh.policy.cacheTTL <= 0 || time.Since(result.scanned) < wh.policy.cacheTTL) {
+		return result.counts, true
+	}
+	if !wh.pending[image] {
+		select {
+		case wh.queue <- image:
+			wh.pending[image] = true
+		default:
+			log.Warnf("Scan queue is full, not scanning %v", image)
+		}
+	}
+	return result.counts, ok
+}
+
+// review applies the policy to every image of the object under review: the
+// registry and tag policies, then the vulnerability counts of its scan.
+func (wh *webhook) review(req *admissionRequest) *admissionResponse {
+	resp := &admissionResponse{UID: req.UID, Allowed: true}
+	var obj map[string]interface{}
+	if err := json.Unmarshal(req.Object, &obj); err != nil {
+		resp.Allowed = false
+		resp.Result = &admissionStatus{Message: fmt.Sprintf("helm-trivy: could not decode object: %v", err)}
+		return resp
+	}
+	images, err := wh.objectImages(obj)
+	if err != nil && wh.policy.failurePolicy == "Ignore" {
+		log.Warnf("Admitting %v/%v: %v", req.Namespace, req.Name, err)
+		resp.Warnings = append(resp.Warnings, fmt.Sprintf("helm-trivy: %v", err))
+		return resp
+	}
+	if err != nil {
+		resp.Allowed = false
+		resp.Result = &admissionStatus{Message: fmt.Sprintf("helm-trivy: %v", err)}
+		return resp
+	}
+	denied := []string{}
+	for _, image := range images {
+		if violations := imageViolations(image, wh.opts); len(violations) > 0 {
+			denied = append(denied, fmt.Sprintf("%v: %v", image, strings.Join(violations, ", ")))
+			continue
+		}
+		counts, ok := wh.lookup(image)
+		if !ok {
+			if wh.policy.denyUnscanned {
+				denied = append(denied, fmt.Sprintf("%v has not been scanned yet", image))
+			} else {
+				resp.Warnings = append(resp.Warnings, fmt.Sprintf("helm-trivy: %v has not been scanned yet", image))
+			}
+			continue
+		}
+		findings := 0
+		for _, severity := range wh.policy.severities {
+			findings += counts[severity]
+		}
+		if findings > wh.policy.maxFindings {
+			denied = append(denied, fmt.Sprintf("%v has %d %v vulnerabilities", image, findings, strings.Join(wh.policy.severities, "/")))
+		}
+	}
+	if len(denied) > 0 {
+		resp.Allowed = false
+		resp.Result = &admissionStatus{Message: "helm-trivy: " + strings.Join(denied, ", ")}
+	}
+	log.Infof("Reviewed %v/%v: allowed=%v images=%v", req.Namespace, req.Name, resp.Allowed, images)
+	return resp
+}
+
+func (wh *webhook) objectImages(obj map[string]interface{}) ([]string, error) {
+	if obj["kind"] == "HelmRelease" {
+		if !wh.policy.renderReleases {
+			return nil, nil
+		}
+		return wh.renderRelease(obj)
+	}
+	return containerImages(obj), nil
+}
+
+// renderRelease returns the images of a HelmRelease, killing helm after the
+// render timeout.
+func (wh *webhook) renderRelease(obj map[string]interface{}) ([]string, error) {
+	opts := wh.opts
+	opts.helmContext = wh.ctx
+	if wh.policy.renderTimeout > 0 {
+		ctx, cancel := context.WithTimeout(wh.ctx, wh.policy.renderTimeout)
+		defer cancel()
+		opts.helmContext = ctx
+	}
+	images, err := helmReleaseImages(obj, opts)
+	if err != nil && opts.helmContext.Err() == context.DeadlineExceeded {
+		return nil, fmt.Errorf("rendering HelmRelease took longer than %v", wh.policy.renderTimeout)
+	}
+	return images, err
+}
+
+// containerImages collects the images of every container list found in obj,
+// whatever the workload kind.
+func containerImages(obj interface{}) []string {
+	images := []string{}
+	switch v := obj.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if key == "containers" || key == "initContainers" || key == "ephemeralContainers" {
+				if list, ok := value.([]interface{}); ok {
+					for _, c := range list {
+						if c, ok := c.(map[string]interface{}); ok {
+							if image, ok := c["image"].(string); ok && image != "" {
+								images = append(images, image)
+							}
+						}
+					}
+					continue
+				}
+			}
+			images = append(images, containerImages(value)...)
+		}
+	case []interface{}:
+		for _, value := range v {
+			images = append(images, containerImages(value)...)
+		}
+	}
+	return images
+}
+
+// helmReleaseNamePattern matches the chart and source names of the
+// HelmReleases the webhook renders: names of repository charts, not paths nor
+// URLs.
+var helmReleaseNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]*$`)
+
+// helmReleaseImages renders a flux HelmRelease with helm template. The chart
+// is looked up as <source name>/<chart>, so the repository has to be added
+// under the same name as its HelmRepository.
+func helmReleaseImages(obj map[string]interface{}, opts scanOptions) ([]string, error) {
+	spec, _ := obj["spec"].(map[string]interface{})
+	chartSpec, _ := spec["chart"].(map[string]interface{})
+	chartSpec, _ = chartSpec["spec"].(map[string]interface{})
+	chart, _ := chartSpec["chart"].(string)
+	version, _ := chartSpec["version"].(string)
+	sourceRef, _ := chartSpec["sourceRef"].(map[string]interface{})
+	source, _ := sourceRef["name"].(string)
+	if chart == "" {
+		return nil, fmt.Errorf("HelmRelease has no chart")
+	}
+	if !helmReleaseNamePattern.MatchString(chart) || (source != "" && !helmReleaseNamePattern.MatchString(source)) {
+		return nil, fmt.Errorf("HelmRelease has an invalid chart %q of %q", chart, source)
+	}
+	if err := validateChartRef(chart, version); err != nil {
+		return nil, fmt.Errorf("HelmRelease: %v", err)
+	}
+	if source != "" {
+		chart = source + "/" + chart
+	}
+	opts.templateSet, opts.templateValues, opts.chartVersion = "", "", version
+	if values, ok := spec["values"]; ok {
+		data, err := json.Marshal(values)
+		if err != nil {
+			return nil, err
+		}
+		f, err := ioutil.TempFile("", "helm-trivy-values")
+		if err != nil {
+			return nil, err
+		}
+		defer os.Remove(f.Name())
+		_, err = f.Write(data)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		opts.templateValues = f.Name()
+	}
+	err, chartImages := getChartImages(chart, opts)
+	if err != nil {
+		return nil, fmt.Errorf("could not render chart %v: %v", chart, err)
+	}
+	images := []string{}
+	for _, image := range chartImages {
+		images = append(images, image.Name)
+	}
+	return images, nil
+}
+
+func (wh *webhook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var review admissionReview
+	if err := json.NewDecoder(r.Body).Decode(&review); err != nil || review.Request == nil {
+		http.Error(w, "expected an AdmissionReview request", http.StatusBadRequest)
+		return
+	}
+	review.Response = wh.review(review.Request)
+	review.Request = nil
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(review); err != nil {
+		log.Errorf("Could not write admission response: %v", err)
+	}
+}
+
+func webhookMain(args []string) {
+	var opts scanOptions
+	var policy webhookPolicy
+	var port int
+	var severity, tlsCert, tlsKey string
+
+	fs := flag.NewFlagSet("webhook", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: helm trivy webhook [options]\n")
+		fmt.Fprintf(fs.Output(), "Example: helm trivy webhook -tls-cert tls.crt -tls-key tls.key -severity HIGH,CRITICAL\n\n")
+		fmt.Fprintf(fs.Output(), "Options:\n")
+		fs.PrintDefaults()
+	}
+	fs.IntVar(&port, "port", 8443, "Port to listen on")
+	fs.StringVar(&tlsCert, "tls-cert", "", "TLS certificate file, required by the Kubernetes API server")
+	fs.StringVar(&tlsKey, "tls-key", "", "TLS key file")
+	fs.StringVar(&severity, "severity", "CRITICAL", "Comma separated severities counted against -max")
+	fs.StringVar(&opts.vulnType, "vuln-type", "os,library", "Comma separated package types whose vulnerabilities are counted against -max: os or library")
+	fs.IntVar(&policy.maxFindings, "max", 0, "Deny workloads with an image having more vulnerabilities than this")
+	fs.BoolVar(&policy.denyUnscanned, "deny-unscanned", false, "Deny workloads using images that were not scanned yet instead of warning")
+	fs.BoolVar(&policy.renderReleases, "helmreleases", false, "Render HelmRelease objects to check the images of their chart")
+	fs.DurationVar(&policy.renderTimeout, "render-timeout", 10*time.Second, "Time rendering a HelmRelease is given, no limit if 0")
+	fs.StringVar(&policy.failurePolicy, "failure-policy", "Fail", "Admit (Ignore) or deny (Fail) objects whose images can't be found, like a HelmRelease failing to render")
+	fs.DurationVar(&policy.cacheTTL, "cache-ttl", 24*time.Hour, "Scan images again when their results are older than this, never if 0")
+	fs.StringVar(&opts.allowedRegistries, "allowed-registries", "", "Comma separated registries (or registry/namespace prefixes) images may come from, workloads using other images are denied")
+	fs.BoolVar(&opts.denyLatestTag, "deny-latest-tag", false, "Deny workloads with images using the latest tag, or no tag")
+	addScannerFlags(fs, &opts)
+	fs.Parse(args)
+	opts.setFlags = setFlags(fs)
+	opts.json = true
+	policy.severities = strings.Split(strings.ToUpper(severity), ",")
+
+	if tlsCert == "" || tlsKey == "" {
+		fmt.Fprintf(os.Stderr, "Error: -tls-cert and -tls-key are required.\n")
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	if policy.failurePolicy != "Fail" && policy.failurePolicy != "Ignore" {
+		fmt.Fprintf(os.Stderr, "Error: Unknown -failure-policy %v, expected Fail or Ignore.\n", policy.failurePolicy)
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	if err := validateSeverities(severity); err != nil || severity == "" {
+		fmt.Fprintf(os.Stderr, "Error: Invalid -severity %q, expected comma separated severities among %v.\n", severity, strings.Join(severities, ","))
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	if policy.maxFindings < 0 || policy.renderTimeout < 0 || policy.cacheTTL < 0 {
+		fmt.Fprintf(os.Stderr, "Error: -max, -render-timeout and -cache-ttl can't be negative.\n")
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+
+	ctx, backend, cleanup := setupScanner(&opts)
+	defer cleanup()
+
+	wh := newWebhook(ctx, backend, opts, policy)
+	go wh.work()
+	log.Infof("Listening on :%d", port)
+	if err := http.ListenAndServeTLS(fmt.Sprintf(":%d", port), tlsCert, tlsKey, wh); err != nil {
+		fatal(exitBackend, opts, "Webhook stopped: %v", err)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestWebhookReview(t *testing.T) {
+	deployment := func(images ...string) string {
+		containers := []map[string]string{}
+		for i, image := range images {
+			containers = append(containers, map[string]string{"name": fmt.Sprintf("c%d", i), "image": image})
+		}
+		obj := map[string]interface{}{
+			"kind": "Deployment",
+			"spec": map[string]interface{}{"template": map[string]interface{}{"spec": map[string]interface{}{"containers": containers}}},
+		}
+		data, _ := json.Marshal(obj)
+		return string(data)
+	}
+	tests := []struct {
+		name     string
+		object   string
+		policy   webhookPolicy
+		opts     scanOptions
+		allowed  bool
+		message  string
+		warnings int
+	}{
+		{"clean image", deployment("registry.corp.local/app:1.0"), webhookPolicy{}, scanOptions{}, true, "", 0},
+		{"vulnerable image", deployment("nginx:1.25"), webhookPolicy{}, scanOptions{}, false, "nginx:1.25 has 2 CRITICAL vulnerabilities", 0},
+		{"under max", deployment("nginx:1.25"), webhookPolicy{maxFindings: 2}, scanOptions{}, true, "", 0},
+		{"unscanned image", deployment("redis:7"), webhookPolicy{}, scanOptions{}, true, "", 1},
+		{"deny unscanned", deployment("redis:7"), webhookPolicy{denyUnscanned: true}, scanOptions{}, false, "redis:7 has not been scanned yet", 0},
+		{
+			"other registry",
+			deployment("registry.corp.local/app:1.0", "docker.io/library/busybox:1.36"),
+			webhookPolicy{}, scanOptions{allowedRegistries: "registry.corp.local"},
+			false, "docker.io/library/busybox:1.36: registry docker.io is not allowed", 0,
+		},
+		{"latest tag", deployment("registry.corp.local/app"), webhookPolicy{}, scanOptions{denyLatestTag: true}, false, "registry.corp.local/app: latest tag is not allowed", 0},
+		{"HelmRelease not rendered", `{"kind": "HelmRelease", "spec": {}}`, webhookPolicy{}, scanOptions{}, true, "", 0},
+		{"invalid object", `[`, webhookPolicy{}, scanOptions{}, false, "could not decode object", 0},
+	}
+	for _, tt := range tests {
+		tt.policy.severities = []string{"CRITICAL"}
+		wh := newWebhook(context.Background(), nil, tt.opts, tt.policy)
+		wh.results["registry.corp.local/app:1.0"] = webhookResult{counts: map[string]int{"HIGH": 3}, scanned: time.Now()}
+		wh.results["nginx:1.25"] = webhookResult{counts: map[string]int{"CRITICAL": 2}, scanned: time.Now()}
+		resp := wh.review(&admissionRequest{UID: "42", Object: json.RawMessage(tt.object)})
+		if resp.UID != "42" || resp.Allowed != tt.allowed {
+			t.Errorf("%v: allowed = %v, want %v", tt.name, resp.Allowed, tt.allowed)
+			continue
+		}
+		if tt.message != "" && (resp.Result == nil || !strings.Contains(resp.Result.Message, tt.message)) {
+			t.Errorf("%v: status %+v, want %q", tt.name, resp.Result, tt.message)
+		}
+		if len(resp.Warnings) != tt.warnings {
+			t.Errorf("%v: warnings %q, want %d", tt.name, resp.Warnings, tt.warnings)
+		}
+	}
+}
+
+func TestWebhookLookup(t *testing.T) {
+	wh := newWebhook(context.Background(), nil, scanOptions{}, webhookPolicy{cacheTTL: time.Hour})
+	if _, ok := wh.lookup("nginx:1.25"); ok || len(wh.queue) != 1 {
+		t.Fatalf("unscanned image: found %v, %d queued", ok, len(wh.queue))
+	}
+	if _, ok := wh.lookup("nginx:1.25"); ok || len(wh.queue) != 1 {
+		t.Fatalf("pending image: found %v, %d queued", ok, len(wh.queue))
+	}
+	<-wh.queue
+	delete(wh.pending, "nginx:1.25")
+	wh.results["nginx:1.25"] = webhookResult{counts: map[string]int{"CRITICAL": 1}, scanned: time.Now().Add(-2 * time.Hour)}
+	counts, ok := wh.lookup("nginx:1.25")
+	if !ok || counts["CRITICAL"] != 1 || len(wh.queue) != 1 {
+		t.Errorf("expired result: counts %v, found %v, %d queued", counts, ok, len(wh.queue))
+	}
+}
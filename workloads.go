@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// workloadContainer is a container of a rendered workload, with the chart
+// and subchart of its template.
+type workloadContainer struct {
+	Kind      string
+	Name      string
+	Namespace string
+	Container string
+	Image     string
+	Chart     string
+	Subchart  string
+}
+
+// imageWorkload is a workload running an image, with the names of the
+// containers running it.
+type imageWorkload struct {
+	Kind       string   `json:"Kind"`
+	Name       string   `json:"Name"`
+	Namespace  string   `json:"Namespace,omitempty"`
+	Containers []string `json:"Containers"`
+}
+
+func (w imageWorkload) String() string {
+	s := w.Kind + "/" + w.Name
+	if w.Namespace != "" {
+		s += " in " + w.Namespace
+	}
+	return s
+}
+
+// imageWorkloads returns the workloads of rendered manifests by image, in
+// order of appearance.
+func imageWorkloads(manifests string) map[string][]imageWorkload {
+	workloads := map[string][]imageWorkload{}
+	for _, c := range manifestWorkloads(manifests) {
+		list := workloads[c.Image]
+		if n := len(list); n > 0 && list[n-1].Kind == c.Kind && list[n-1].Name == c.Name && list[n-1].Namespace == c.Namespace {
+			list[n-1].Containers = append(list[n-1].Containers, c.Container)
+			continue
+		}
+		workloads[c.Image] = append(list, imageWorkload{Kind: c.Kind, Name: c.Name, Namespace: c.Namespace, Containers: []string{c.Container}})
+	}
+	return workloads
+}
+
+// templateCharts returns the chart a manifest rendered by helm template comes
+// from, and its subchart if it comes from one, read from its "# Source:"
+// comment.
+func templateCharts(doc string) (string, string) {
+	scanner := bufio.NewScanner(strings.NewReader(doc))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "# Source: ") {
+			chart := strings.Split(strings.TrimPrefix(line, "# Source: "), "/")[0]
+			if subchart := sourceChart(doc); subchart != chart {
+				return chart, subchart
+			}
+			return chart, ""
+		}
+	}
+	return "", ""
+}
+
+// manifestWorkloads returns the containers of the workloads of rendered
+// manifests, in order of appearance. Documents that aren't valid YAML are
+// skipped.
+func manifestWorkloads(manifests string) []workloadContainer {
+	containers := []workloadContainer{}
+	for _, doc := range strings.Split(manifests, "\n---") {
+		var node yaml.Node
+		if err := yaml.Unmarshal([]byte(doc), &node); err != nil || len(node.Content) == 0 || node.Content[0].Kind != yaml.MappingNode {
+			continue
+		}
+		w := workloadContainer{}
+		if kind := mappingValue(node.Content[0], "kind"); kind != nil {
+			w.Kind = kind.Value
+		}
+		if metadata := mappingValue(node.Content[0], "metadata"); metadata != nil {
+			if name := mappingValue(metadata, "name"); name != nil {
+				w.Name = name.Value
+			}
+			if namespace := mappingValue(metadata, "namespace"); namespace != nil {
+				w.Namespace = namespace.Value
+			}
+		}
+		w.Chart, w.Subchart = templateCharts(doc)
+		for _, c := range nodeContainers(&node) {
+			w.Container, w.Image = c[0], c[1]
+			containers = append(containers, w)
+		}
+	}
+	return containers
+}